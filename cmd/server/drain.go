@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"tunnel-api/internal/edge"
+	"tunnel-api/internal/tunnel"
+)
+
+// drainer drains the local tunnel server once, started by a shutdown signal
+// or the admin endpoint. Later calls wait for the first drain to finish.
+type drainer struct {
+	server  *tunnel.Server // nil in control mode
+	timeout time.Duration
+	log     *slog.Logger
+
+	once sync.Once
+	done chan struct{}
+}
+
+func newDrainer(server *tunnel.Server, timeout time.Duration, logger *slog.Logger) *drainer {
+	return &drainer{server: server, timeout: timeout, log: logger, done: make(chan struct{})}
+}
+
+// start begins draining in the background.
+func (d *drainer) start() {
+	d.once.Do(func() {
+		go func() {
+			defer close(d.done)
+			if d.server == nil {
+				return
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+			defer cancel()
+			if open := d.server.Drain(ctx); open > 0 {
+				d.log.Warn("Drain timed out", "open_connections", open)
+			} else {
+				d.log.Info("Drained")
+			}
+		}()
+	})
+}
+
+// handoff tells the tunnel server that a new process took over its
+// listeners. Call it before start.
+func (d *drainer) handoff() {
+	if d.server != nil {
+		d.server.Handoff()
+	}
+}
+
+// wait drains, if that has not started yet, and waits until it is done.
+func (d *drainer) wait() {
+	d.start()
+	<-d.done
+}
+
+// handler serves /admin/drain: GET reports the drain state, POST starts
+// draining. Both require "Authorization: Bearer <ADMIN_TOKEN>".
+func (d *drainer) handler(token string) http.Handler {
+	return adminOnly(token, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			if d.server == nil {
+				writeJSON(w, http.StatusNotImplemented, map[string]string{"error": "no tunnel server in this process"})
+				return
+			}
+			d.start()
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		status := map[string]any{"draining": false}
+		if d.server != nil {
+			status["draining"] = d.server.Draining()
+			status["open_connections"] = d.server.OpenConnections()
+			status["clients"] = len(d.server.Clients())
+		}
+		select {
+		case <-d.done:
+			status["drained"] = true
+		default:
+			status["drained"] = false
+		}
+		writeJSON(w, http.StatusOK, status)
+	}))
+}
+
+// adminOnly requires "Authorization: Bearer <ADMIN_TOKEN>" before calling h.
+func adminOnly(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !edge.Authorized(r, token) {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid token"})
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// shutdownHTTP stops an HTTP server, closing the connections still open
+// (event streams) after timeout.
+func shutdownHTTP(srv *http.Server, timeout time.Duration, logger *slog.Logger) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Warn("HTTP server did not shut down in time, closing connections", "error", err)
+		srv.Close()
+	}
+}
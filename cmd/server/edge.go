@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"tunnel-api/internal/config"
+	"tunnel-api/internal/database"
+	"tunnel-api/internal/edge"
+	"tunnel-api/internal/events"
+	"tunnel-api/internal/metrics"
+	"tunnel-api/internal/routes"
+	"tunnel-api/internal/tracing"
+	"tunnel-api/internal/upgrade"
+)
+
+// runEdge runs an edge node (MODE=edge): a tunnel server without database or
+// API that gets its tunnels from the control plane at CONTROL_URL.
+func runEdge(cfg *config.Config, upg *upgrade.Upgrader, tracer *tracing.Tracer, logger *slog.Logger) {
+	if cfg.ControlURL == "" || cfg.EdgeToken == "" || cfg.EdgeRPCURL == "" {
+		logger.Error("CONTROL_URL, EDGE_TOKEN and EDGE_RPC_URL are required in edge mode")
+		os.Exit(1)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Other nodes of the region share the routes through the database
+	var routeStore *routes.Postgres
+	if cfg.RouteStore != "" {
+		if err := database.Connect(cfg.DatabaseURL); err != nil {
+			logger.Error("Failed to connect to database", "error", err)
+			os.Exit(1)
+		}
+		defer database.Close()
+		routeStore = newRouteStore(cfg, logger)
+	}
+
+	// Events go to the control plane's streams through the agent
+	bus := events.NewBus()
+	tunnelServer := newTunnelServer(cfg, upg, bus, routeStore, logger)
+	if err := tunnelServer.Run(ctx); err != nil {
+		logger.Error("Failed to start tunnel server", "error", err)
+		os.Exit(1)
+	}
+	var node edge.Node
+	if routeStore != nil {
+		if err := routeStore.Run(ctx, tunnelServer); err != nil {
+			logger.Error("Failed to start route store", "error", err)
+			os.Exit(1)
+		}
+		node = routeStore
+	}
+
+	agent := edge.NewAgent(tunnelServer, edge.AgentConfig{
+		ControlURL: cfg.ControlURL,
+		Token:      cfg.EdgeToken,
+		Region:     cfg.Region,
+		Domain:     cfg.Domain,
+		RPCURL:     cfg.EdgeRPCURL,
+		Interval:   time.Duration(cfg.EdgeHeartbeatSeconds) * time.Second,
+		Node:       node,
+		Events:     bus,
+		Logger:     logger,
+	})
+	rpc := &http.Server{Addr: cfg.EdgeRPCAddr, Handler: agent.Handler()}
+	go func() {
+		logger.Info("Edge RPC listening", "addr", cfg.EdgeRPCAddr)
+		if err := serveHTTP(upg, rpc); !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("Edge RPC listener failed", "error", err)
+			os.Exit(1)
+		}
+	}()
+	agentCtx, stopAgent := context.WithCancel(ctx)
+	defer stopAgent()
+	go agent.Run(agentCtx)
+
+	// Authoritative DNS for the region's domain; challenges come from the control plane
+	if cfg.DNSAddr != "" {
+		startDNS(ctx, cfg, upg, agent, logger)
+	}
+
+	drain := newDrainer(tunnelServer, time.Duration(cfg.DrainTimeoutSeconds)*time.Second, logger)
+	if cfg.AdminAddr != "" && (cfg.MetricsEnabled || cfg.AdminToken != "") {
+		admin := http.NewServeMux()
+		if cfg.MetricsEnabled {
+			metrics.Register(tunnelServer)
+			admin.Handle("/metrics", metrics.Handler())
+		}
+		if cfg.AdminToken != "" {
+			admin.Handle("/admin/drain", drain.handler(cfg.AdminToken))
+		}
+		go func() {
+			logger.Info("Admin endpoints listening", "addr", cfg.AdminAddr)
+			if err := serveHTTP(upg, &http.Server{Addr: cfg.AdminAddr, Handler: admin}); err != nil {
+				logger.Error("Admin listener failed", "error", err)
+			}
+		}()
+	}
+
+	logger.Info("VoidLink edge node starting", "region", cfg.Region, "domain", cfg.Domain, "control_url", cfg.ControlURL,
+		"tunnel_port", cfg.TunnelPort, "mc_proxy_port", cfg.MCProxyPort, "http_proxy_port", cfg.HTTPProxyPort)
+
+	upg.Ready()
+	if waitForStop(upg, logger) {
+		// The new process heartbeats and answers the control plane now
+		drain.handoff()
+		drain.start()
+		stopAgent()
+		shutdownHTTP(rpc, 10*time.Second, logger)
+	}
+	drain.wait()
+
+	// Report the traffic counted since the last heartbeat
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelShutdown()
+	if err := agent.Heartbeat(shutdownCtx); err != nil {
+		logger.Error("Failed to send final heartbeat", "error", err)
+	}
+	cancel()
+	tunnelServer.Close()
+	if tracer != nil {
+		if err := tracer.Shutdown(shutdownCtx); err != nil {
+			logger.Error("Failed to flush traces", "error", err)
+		}
+	}
+}
@@ -2,60 +2,187 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
+	"net/http"
 	"os"
-	"os/signal"
-	"syscall"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
 	"tunnel-api/internal/config"
 	"tunnel-api/internal/database"
+	"tunnel-api/internal/dns"
+	"tunnel-api/internal/edge"
+	"tunnel-api/internal/events"
 	"tunnel-api/internal/handlers"
+	"tunnel-api/internal/logging"
+	"tunnel-api/internal/metrics"
 	"tunnel-api/internal/middleware"
+	"tunnel-api/internal/models"
+	"tunnel-api/internal/routes"
 	"tunnel-api/internal/services"
+	"tunnel-api/internal/tracing"
 	"tunnel-api/internal/tunnel"
+	"tunnel-api/internal/upgrade"
 	"tunnel-api/internal/utils"
 )
 
 func main() {
 	cfg := config.Load()
 
+	// Logging: slog.SetDefault also routes the standard log package through it
+	logLevel, err := logging.ParseLevel(cfg.LogLevel)
+	if err != nil {
+		log.Fatalf("Invalid LOG_LEVEL: %v", err)
+	}
+	logLevels, err := logging.ParseLevels(cfg.LogLevels)
+	if err != nil {
+		log.Fatalf("Invalid LOG_LEVELS: %v", err)
+	}
+	logger := logging.New(os.Stderr, logging.Config{
+		Format:      cfg.LogFormat,
+		Level:       logLevel,
+		Levels:      logLevels,
+		SampleBurst: cfg.LogSampleBurst,
+	})
+	slog.SetDefault(logger)
+
+	// Tracing: spans for API requests, database queries and proxied connections
+	var tracer *tracing.Tracer
+	switch cfg.TracingExporter {
+	case "", "none":
+	case "otlp":
+		headers, err := tracing.ParseHeaders(cfg.TracingHeaders)
+		if err != nil {
+			logger.Error("Invalid OTEL_EXPORTER_OTLP_HEADERS", "error", err)
+			os.Exit(1)
+		}
+		tracer = tracing.NewTracer(tracing.Config{
+			Exporter:    tracing.NewOTLPExporter(cfg.TracingEndpoint, cfg.TracingServiceName, headers),
+			SampleRatio: float64(cfg.TracingSamplePercent) / 100,
+			Logger:      logger.With(logging.Subsystem, "tracing"),
+		})
+		tracing.SetDefault(tracer)
+		logger.Info("Exporting traces", "endpoint", cfg.TracingEndpoint, "sample_percent", cfg.TracingSamplePercent)
+	default:
+		logger.Error("Invalid TRACING_EXPORTER, expected none or otlp", "value", cfg.TracingExporter)
+		os.Exit(1)
+	}
+
+	switch cfg.RouteStore {
+	case "":
+	case "postgres":
+		if cfg.NodeAddr == "" || cfg.PeerToken == "" {
+			logger.Error("NODE_ADDR and PEER_TOKEN are required with ROUTE_STORE")
+			os.Exit(1)
+		}
+	default:
+		logger.Error("Invalid ROUTE_STORE, expected postgres or empty", "value", cfg.RouteStore)
+		os.Exit(1)
+	}
+
+	// Every listener opens through the upgrader, which hands them to the next
+	// binary on SIGUSR2
+	upg := newUpgrader(cfg, logger)
+
+	switch cfg.Mode {
+	case "all", "control":
+	case "edge":
+		runEdge(cfg, upg, tracer, logger)
+		return
+	default:
+		logger.Error("Invalid MODE, expected all, control or edge", "value", cfg.Mode)
+		os.Exit(1)
+	}
+	edgeTokens, err := edge.ParseTokens(cfg.EdgeTokens)
+	if err != nil {
+		logger.Error("Invalid EDGE_TOKENS", "error", err)
+		os.Exit(1)
+	}
+	if cfg.Mode == "control" && len(edgeTokens) == 0 {
+		logger.Error("EDGE_TOKENS is required in control mode")
+		os.Exit(1)
+	}
+	if cfg.EdgeToken != "" && len(edgeTokens) == 0 {
+		logger.Error("EDGE_TOKEN is not accepted by the control plane, bind a token to each region with EDGE_TOKENS=<region>=<token>,...")
+		os.Exit(1)
+	}
+
 	// Connect to database
 	if err := database.Connect(cfg.DatabaseURL); err != nil {
-		log.Fatalf("Failed to connect to database: %v", err)
+		logger.Error("Failed to connect to database", "error", err)
+		os.Exit(1)
 	}
 	defer database.Close()
 
 	if err := database.RunMigrations(); err != nil {
-		log.Fatalf("Failed to run migrations: %v", err)
+		logger.Error("Failed to run migrations", "error", err)
+		os.Exit(1)
 	}
 
-	// Create and start the built-in tunnel server (replaces FRP)
-	tunnelServer := tunnel.NewServer(
-		[]byte(cfg.JWTSecret),
-		cfg.TunnelPort,
-		cfg.MCProxyPort,
-		cfg.HTTPProxyPort,
-		cfg.Domain,
-		cfg.MinPort,
-		cfg.MaxPort,
-	)
+	// Status events for the desktop app, published by the tunnel server and
+	// forwarded by edge nodes
+	eventBus := events.NewBus()
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	if err := tunnelServer.Run(ctx); err != nil {
-		log.Fatalf("Failed to start tunnel server: %v", err)
+	// Create and start the built-in tunnel server (replaces FRP), unless all
+	// tunnels run on remote edge nodes
+	var tunnelServer *tunnel.Server
+	var localNode edge.Node
+	if cfg.Mode == "all" {
+		routeStore := newRouteStore(cfg, logger)
+		tunnelServer = newTunnelServer(cfg, upg, eventBus, routeStore, logger)
+		if err := tunnelServer.Run(ctx); err != nil {
+			logger.Error("Failed to start tunnel server", "error", err)
+			os.Exit(1)
+		}
+		if routeStore != nil {
+			if err := routeStore.Run(ctx, tunnelServer); err != nil {
+				logger.Error("Failed to start route store", "error", err)
+				os.Exit(1)
+			}
+			localNode = routeStore
+		}
+	}
+
+	// Regions: the local tunnel server and the edge nodes known from earlier heartbeats
+	edgeService := services.NewEdgeService(tunnelServer, localNode, cfg.Region, cfg.Domain, edgeTokens,
+		time.Duration(cfg.EdgeHeartbeatSeconds)*time.Second, logger)
+	if err := edgeService.LoadNodes(ctx); err != nil {
+		logger.Error("Failed to load edge nodes", "error", err)
+		os.Exit(1)
 	}
 
 	// Initialize services
 	jwtManager := utils.NewJWTManager(cfg.JWTSecret, cfg.JWTAccessTokenTTL, cfg.JWTRefreshTokenTTL)
 	totpService := services.NewTOTPService("VoidLink Tunnels")
-	subdomainService, _ := services.NewSubdomainService("wordlist/words.txt")
-	tunnelService := services.NewTunnelService(tunnelServer, cfg.Domain)
+	subdomainService, err := services.NewSubdomainService("wordlist/words.txt", cfg.SubdomainBlocklist)
+	if err != nil {
+		logger.Error("Failed to load subdomain blocklist", "error", err)
+		os.Exit(1)
+	}
+	quotaService := services.NewQuotaService(edgeService, cfg.QuotaAction, cfg.QuotaThrottleKbps,
+		time.Duration(cfg.QuotaCheckSeconds)*time.Second, logger)
+	go quotaService.Run(ctx)
+	tunnelService := services.NewTunnelService(edgeService, quotaService, logger)
+	adminService := services.NewAdminService(tunnelService, quotaService, logger)
 	emailService := services.NewEmailService(cfg)
+	domainService := services.NewDomainService(edgeService, services.NewResolver(cfg.DomainResolver),
+		time.Duration(cfg.DomainRecheckMinutes)*time.Minute, cfg.DomainRecheckFailures, logger)
+	go domainService.Run(ctx)
+
+	// Authoritative DNS for the tunnel domain, answered from the live tunnel table
+	if cfg.DNSAddr != "" && tunnelServer != nil {
+		startDNS(ctx, cfg, upg, domainService, logger)
+	}
+	usageService := services.NewUsageService(tunnelServer, time.Duration(cfg.UsageFlushSeconds)*time.Second, logger)
+	go usageService.Run(ctx)
 
 	// Re-register tunnels that were active before server restart
 	tunnelService.RestoreActiveTunnels()
@@ -63,21 +190,29 @@ func main() {
 	// Initialize handlers
 	authHandler := handlers.NewAuthHandler(cfg, jwtManager, totpService, emailService)
 	twoFactorHandler := handlers.NewTwoFactorHandler(totpService)
-	tunnelHandler := handlers.NewTunnelHandler(cfg, subdomainService, tunnelService)
+	tunnelHandler := handlers.NewTunnelHandler(cfg, subdomainService, tunnelService, domainService, edgeService)
+	edgeHandler := handlers.NewEdgeHandler(edgeService, tunnelService, domainService, usageService, eventBus)
 	healthHandler := handlers.NewHealthHandler(tunnelService)
+	eventsHandler := handlers.NewEventsHandler(eventBus)
+	adminHandler := handlers.NewAdminHandler(adminService, tunnelService, edgeService)
 
 	// Setup Gin
 	if os.Getenv("GIN_MODE") == "" {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
-	r := gin.Default()
+	r := gin.New()
+	r.Use(gin.Recovery(), middleware.RequestLogger(logger))
+	if tracer != nil {
+		r.Use(middleware.Tracing())
+	}
 
 	// CORS middleware
 	r.Use(func(c *gin.Context) {
 		c.Header("Access-Control-Allow-Origin", "*")
 		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
-		c.Header("Access-Control-Allow-Headers", "Authorization, Content-Type")
+		c.Header("Access-Control-Allow-Headers", "Authorization, Content-Type, traceparent")
+		c.Header("Access-Control-Expose-Headers", "X-Trace-Id")
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
 			return
@@ -85,6 +220,42 @@ func main() {
 		c.Next()
 	})
 
+	// Prometheus metrics and the drain endpoint, on the admin listener if one is configured
+	drain := newDrainer(tunnelServer, time.Duration(cfg.DrainTimeoutSeconds)*time.Second, logger)
+	admin := http.NewServeMux()
+	if cfg.MetricsEnabled {
+		r.Use(middleware.Metrics())
+		if tunnelServer != nil {
+			metrics.Register(tunnelServer)
+		}
+		metrics.Register(metrics.CollectorFunc(database.CollectPoolStats))
+		// Per-tunnel series name tunnels and their traffic, so metrics on
+		// the public API port need the admin token.
+		switch {
+		case cfg.AdminAddr != "":
+			admin.Handle("/metrics", metrics.Handler())
+		case cfg.AdminToken != "":
+			r.GET("/metrics", gin.WrapH(adminOnly(cfg.AdminToken, metrics.Handler())))
+		default:
+			logger.Warn("Metrics are not served: set ADMIN_ADDR, or ADMIN_TOKEN to serve them on the API port")
+		}
+	}
+	if cfg.AdminToken != "" {
+		if cfg.AdminAddr != "" {
+			admin.Handle("/admin/drain", drain.handler(cfg.AdminToken))
+		} else {
+			r.Any("/admin/drain", gin.WrapH(drain.handler(cfg.AdminToken)))
+		}
+	}
+	if cfg.AdminAddr != "" && (cfg.MetricsEnabled || cfg.AdminToken != "") {
+		go func() {
+			logger.Info("Admin endpoints listening", "addr", cfg.AdminAddr)
+			if err := serveHTTP(upg, &http.Server{Addr: cfg.AdminAddr, Handler: admin}); err != nil {
+				logger.Error("Admin listener failed", "error", err)
+			}
+		}()
+	}
+
 	// Health endpoints (public)
 	r.GET("/health", healthHandler.Health)
 	r.GET("/ping", healthHandler.Ping)
@@ -102,14 +273,24 @@ func main() {
 			auth.POST("/reset-password", authHandler.ResetPassword)
 		}
 
+		// Edge nodes, authenticated with EDGE_TOKEN
+		api.POST("/edge/heartbeat", edgeHandler.Heartbeat)
+		api.POST("/edge/events", edgeHandler.Events)
+		api.GET("/edge/challenges", edgeHandler.Challenges)
+
+		// Event stream; EventSource cannot set headers, so ?access_token= is accepted too
+		api.GET("/events", middleware.QueryToken(), middleware.AuthMiddleware(jwtManager), middleware.RequireActive(), eventsHandler.Stream)
+
 		protected := api.Group("")
-		protected.Use(middleware.AuthMiddleware(jwtManager))
+		protected.Use(middleware.AuthMiddleware(jwtManager), middleware.RequireActive())
 		{
 			protected.GET("/auth/me", authHandler.Me)
 			protected.POST("/auth/2fa/setup", twoFactorHandler.Setup)
 			protected.POST("/auth/2fa/verify", twoFactorHandler.Verify)
 			protected.POST("/auth/2fa/disable", twoFactorHandler.Disable)
 
+			protected.GET("/regions", edgeHandler.Regions)
+			protected.GET("/subdomains/check", tunnelHandler.CheckSubdomain)
 			protected.GET("/tunnels", tunnelHandler.List)
 			protected.POST("/tunnels", tunnelHandler.Create)
 			protected.GET("/tunnels/:id", tunnelHandler.Get)
@@ -117,26 +298,173 @@ func main() {
 			protected.DELETE("/tunnels/:id", tunnelHandler.Delete)
 			protected.POST("/tunnels/:id/start", tunnelHandler.Start)
 			protected.POST("/tunnels/:id/stop", tunnelHandler.Stop)
+			protected.POST("/tunnels/:id/move", tunnelHandler.Move)
+			protected.GET("/tunnels/:id/stats", tunnelHandler.Stats)
+			protected.GET("/tunnels/:id/cache", tunnelHandler.CacheStats)
+			protected.DELETE("/tunnels/:id/cache", tunnelHandler.PurgeCache)
+			protected.GET("/tunnels/:id/logs/http", tunnelHandler.HTTPLogs)
+			protected.GET("/tunnels/:id/usage", tunnelHandler.Usage)
+			protected.GET("/tunnels/:id/limits", tunnelHandler.Limits)
+			protected.GET("/tunnels/:id/latency", tunnelHandler.Latency)
+			protected.GET("/tunnels/:id/connections", tunnelHandler.Connections)
+			protected.DELETE("/tunnels/:id/connections/:conn_id", tunnelHandler.CloseConnection)
+			protected.GET("/tunnels/:id/udp", tunnelHandler.ListUDPMappings)
+			protected.POST("/tunnels/:id/udp", tunnelHandler.CreateUDPMapping)
+			protected.PATCH("/tunnels/:id/udp/:mapping_id", tunnelHandler.UpdateUDPMapping)
+			protected.DELETE("/tunnels/:id/udp/:mapping_id", tunnelHandler.DeleteUDPMapping)
+			protected.GET("/tunnels/:id/domains", tunnelHandler.ListDomains)
+			protected.POST("/tunnels/:id/domains", tunnelHandler.AddDomain)
+			protected.GET("/tunnels/:id/domains/:domain_id", tunnelHandler.GetDomain)
+			protected.POST("/tunnels/:id/domains/:domain_id/verify", tunnelHandler.VerifyDomain)
+			protected.DELETE("/tunnels/:id/domains/:domain_id", tunnelHandler.DeleteDomain)
+
+			// Support staff and admins; every change is recorded in the audit log
+			support := protected.Group("/admin")
+			support.Use(middleware.RequireRole(models.RoleSupport, models.RoleAdmin))
+			{
+				support.GET("/users", adminHandler.ListUsers)
+				support.GET("/users/:id", adminHandler.GetUser)
+				support.POST("/users/:id/reset-2fa", adminHandler.ResetTOTP)
+				support.GET("/tunnels", adminHandler.ListTunnels)
+				support.GET("/tunnels/:id", adminHandler.GetTunnel)
+				support.POST("/tunnels/:id/stop", adminHandler.StopTunnel)
+				support.GET("/clients", adminHandler.Clients)
+			}
+			adminOnly := protected.Group("/admin")
+			adminOnly.Use(middleware.RequireRole(models.RoleAdmin))
+			{
+				adminOnly.POST("/users/:id/disable", adminHandler.DisableUser)
+				adminOnly.POST("/users/:id/enable", adminHandler.EnableUser)
+				adminOnly.PUT("/users/:id/limits", adminHandler.SetLimits)
+				adminOnly.PUT("/users/:id/role", adminHandler.SetRole)
+				adminOnly.POST("/tunnels/:id/suspend", adminHandler.SuspendTunnel)
+				adminOnly.POST("/tunnels/:id/unsuspend", adminHandler.UnsuspendTunnel)
+				adminOnly.GET("/audit", adminHandler.AuditLog)
+			}
 		}
 	}
 
-	// Graceful shutdown
+	addr := fmt.Sprintf("%s:%s", cfg.ServerHost, cfg.ServerPort)
+	srv := &http.Server{Addr: addr, Handler: r}
+
+	// Graceful shutdown: drain the tunnel server so players can finish, then
+	// stop the API, then the tunnel server. After an upgrade the new process
+	// answers API requests already, so the API stops first.
+	stopped := make(chan struct{})
 	go func() {
-		sigCh := make(chan os.Signal, 1)
-		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-		<-sigCh
-		log.Println("Shutting down...")
-		cancel()
-		database.Close()
-		os.Exit(0)
+		if waitForStop(upg, logger) {
+			drain.handoff()
+			drain.start()
+			shutdownHTTP(srv, 10*time.Second, logger)
+			drain.wait()
+		} else {
+			drain.wait()
+			shutdownHTTP(srv, 10*time.Second, logger)
+		}
+		close(stopped)
 	}()
 
-	addr := fmt.Sprintf("%s:%s", cfg.ServerHost, cfg.ServerPort)
-	log.Printf("VoidLink Tunnel API starting on %s", addr)
-	log.Printf("Domain: %s | Tunnel port: %d | MC proxy: %d | HTTP proxy: %d | UDP pool: %d-%d",
-		cfg.Domain, cfg.TunnelPort, cfg.MCProxyPort, cfg.HTTPProxyPort, cfg.MinPort, cfg.MaxPort)
+	logger.Info("VoidLink Tunnel API starting", "addr", addr, "mode", cfg.Mode, "region", cfg.Region, "domain", cfg.Domain,
+		"tunnel_port", cfg.TunnelPort, "mc_proxy_port", cfg.MCProxyPort, "http_proxy_port", cfg.HTTPProxyPort,
+		"udp_pool", fmt.Sprintf("%d-%d", cfg.MinPort, cfg.MaxPort))
+
+	l, err := upg.Listen("tcp", addr)
+	if err != nil {
+		logger.Error("Failed to start server", "error", err)
+		os.Exit(1)
+	}
+	upg.Ready()
+	if err := srv.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+		logger.Error("Failed to start server", "error", err)
+		os.Exit(1)
+	}
+	<-stopped
 
-	if err := r.Run(addr); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	cancel()
+	if tunnelServer != nil {
+		tunnelServer.Close()
+	}
+	if err := usageService.Flush(context.Background()); err != nil {
+		logger.Error("Failed to flush usage", "error", err)
+	}
+	if tracer != nil {
+		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := tracer.Shutdown(shutdownCtx); err != nil {
+			logger.Error("Failed to flush traces", "error", err)
+		}
+		cancelShutdown()
+	}
+	logger.Info("Stopped")
+}
+
+// newRouteStore returns the store shared with the region's other tunnel
+// servers, nil unless ROUTE_STORE is set. It needs a connected database.
+func newRouteStore(cfg *config.Config, logger *slog.Logger) *routes.Postgres {
+	if cfg.RouteStore == "" {
+		return nil
+	}
+	return routes.NewPostgres(database.Pool, cfg.Region, cfg.NodeAddr, logger)
+}
+
+// newTunnelServer creates the built-in tunnel server from the configuration.
+// store may be nil.
+func newTunnelServer(cfg *config.Config, upg *upgrade.Upgrader, bus *events.Bus, store *routes.Postgres, logger *slog.Logger) *tunnel.Server {
+	tc := tunnel.Config{
+		JWTSecret:         []byte(cfg.JWTSecret),
+		TunnelPort:        cfg.TunnelPort,
+		MCProxyPort:       cfg.MCProxyPort,
+		HTTPProxyPort:     cfg.HTTPProxyPort,
+		Domain:            cfg.Domain,
+		MinPort:           cfg.MinPort,
+		MaxPort:           cfg.MaxPort,
+		HTTPCacheMaxBytes: int64(cfg.HTTPCacheMaxMB) << 20,
+		AccessLogSize:     cfg.HTTPAccessLogSize,
+		AccessLogFile:     cfg.HTTPAccessLogFile,
+		UDPSessionIdle:    time.Duration(cfg.UDPSessionIdleSeconds) * time.Second,
+		MaxUDPSessions:    cfg.UDPMaxSessions,
+		MetricsPerTunnel:  cfg.MetricsPerTunnel,
+		PeerAddr:          cfg.PeerAddr,
+		NodeAddr:          cfg.NodeAddr,
+		PeerToken:         cfg.PeerToken,
+		Events:            bus,
+		Listen:            upg.Listen,
+		ListenPacket:      upg.ListenPacket,
+		Logger:            logger,
+	}
+	if store != nil {
+		tc.Routes = store
+	}
+	return tunnel.NewServer(tc)
+}
+
+// startDNS starts the authoritative DNS server for the tunnel domain.
+func startDNS(ctx context.Context, cfg *config.Config, upg *upgrade.Upgrader, zone dns.Zone, logger *slog.Logger) {
+	mcPort := cfg.DNSMCPort
+	if mcPort == 0 {
+		mcPort = cfg.MCProxyPort
+	}
+	var nameservers []string
+	if cfg.DNSNameservers != "" {
+		nameservers = strings.Split(cfg.DNSNameservers, ",")
+	}
+	dnsServer, err := dns.NewServer(dns.Config{
+		Addr:         cfg.DNSAddr,
+		Domain:       cfg.Domain,
+		IPv4:         cfg.DNSPublicIPv4,
+		IPv6:         cfg.DNSPublicIPv6,
+		Nameservers:  nameservers,
+		TTL:          uint32(cfg.DNSTTL),
+		MCPort:       mcPort,
+		Zone:         zone,
+		Logger:       logger,
+		Listen:       upg.Listen,
+		ListenPacket: upg.ListenPacket,
+	})
+	if err == nil {
+		err = dnsServer.Run(ctx)
+	}
+	if err != nil {
+		logger.Error("Failed to start DNS server", "error", err)
+		os.Exit(1)
 	}
 }
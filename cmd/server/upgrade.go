@@ -0,0 +1,69 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"tunnel-api/internal/config"
+	"tunnel-api/internal/upgrade"
+)
+
+// newUpgrader returns the upgrader every listener is opened through, holding
+// the sockets inherited from the previous process after a binary upgrade.
+func newUpgrader(cfg *config.Config, logger *slog.Logger) *upgrade.Upgrader {
+	upg, err := upgrade.New(cfg.UpgradePIDFile, logger)
+	if err != nil {
+		logger.Error("Failed to take over the previous process's sockets", "error", err)
+		os.Exit(1)
+	}
+	return upg
+}
+
+// serveHTTP serves srv on srv.Addr, on the inherited listener if there is one.
+func serveHTTP(upg *upgrade.Upgrader, srv *http.Server) error {
+	l, err := upg.Listen("tcp", srv.Addr)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(l)
+}
+
+// waitForStop blocks until SIGINT or SIGTERM, or until an upgrade (SIGUSR2)
+// started a new process that serves the listeners now. A failed upgrade
+// leaves this process running. Once it returns, another SIGINT or SIGTERM
+// exits immediately.
+func waitForStop(upg *upgrade.Upgrader, logger *slog.Logger) (upgraded bool) {
+	stopCh := make(chan os.Signal, 2)
+	signal.Notify(stopCh, syscall.SIGINT, syscall.SIGTERM)
+	upgradeCh := make(chan os.Signal, 1)
+	upgrade.Notify(upgradeCh)
+	defer signal.Stop(upgradeCh)
+
+	for !upgraded {
+		select {
+		case <-stopCh:
+			logger.Info("Shutting down...")
+			go exitOnSignal(stopCh, logger)
+			return false
+		case <-upgradeCh:
+			logger.Info("Upgrading...")
+			if err := upg.Upgrade(); err != nil {
+				logger.Error("Upgrade failed, still serving", "error", err)
+				continue
+			}
+			upgraded = true
+		}
+	}
+	logger.Info("Handed off to the new process, shutting down...")
+	go exitOnSignal(stopCh, logger)
+	return true
+}
+
+func exitOnSignal(sigCh <-chan os.Signal, logger *slog.Logger) {
+	<-sigCh
+	logger.Warn("Second signal, exiting")
+	os.Exit(1)
+}
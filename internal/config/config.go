@@ -23,12 +23,90 @@ type Config struct {
 	MCProxyPort   int // shared Minecraft TCP listener (default 25565)
 	HTTPProxyPort int // shared HTTP proxy listener (default 80)
 
+	// Web map edge cache
+	HTTPCacheMaxMB int // per-tunnel cache budget in MB (0 = caching disabled)
+
+	// HTTP access logs
+	HTTPAccessLogSize int    // records kept per tunnel for the owner API
+	HTTPAccessLogFile string // optional JSON lines export for operators
+
+	// UDP sessions
+	UDPSessionIdleSeconds int // idle time before a player's UDP session expires
+	UDPMaxSessions        int // concurrent UDP sessions per tunnel
+
+	// Usage accounting
+	UsageFlushSeconds int // how often traffic counters are written to tunnel_usage
+
+	// Plan quotas
+	QuotaAction       string // what happens when the monthly transfer cap is used up: throttle or suspend
+	QuotaThrottleKbps int    // bandwidth of throttled tunnels
+	QuotaCheckSeconds int    // how often limits of active tunnels are re-evaluated
+
+	// Logging
+	LogLevel       string // debug, info, warn or error
+	LogLevels      string // per-subsystem overrides, e.g. "udp=warn,mcproxy=debug"
+	LogFormat      string // text or json
+	LogSampleBurst int    // identical messages logged per second (0 = no sampling)
+
+	// Metrics
+	MetricsEnabled   bool   // serve Prometheus metrics at /metrics
+	MetricsPerTunnel bool   // add per-tunnel series (one set per active tunnel)
+	AdminAddr        string // separate listener for /metrics and /admin/drain (empty = served on the API port, behind AdminToken)
+
+	// Shutdown
+	AdminToken          string // bearer token of the admin endpoints such as /admin/drain (empty = disabled)
+	DrainTimeoutSeconds int    // how long open player connections may finish before shutdown
+	UpgradePIDFile      string // written with the PID once the process serves (follows binary upgrades)
+
+	// Tracing
+	TracingExporter      string // none or otlp
+	TracingEndpoint      string // OTLP/HTTP collector, e.g. http://localhost:4318
+	TracingHeaders       string // extra export headers, e.g. "authorization=Bearer xyz"
+	TracingServiceName   string
+	TracingSamplePercent int // share of new traces recorded (0-100)
+
 	// Tunnels
-	MinPort    int
-	MaxPort    int
-	MaxTunnels int
-	Domain     string
-	Region     string
+	MinPort        int // UDP pool
+	MaxPort        int
+	TCPMinPort     int // raw TCP pool
+	TCPMaxPort     int
+	MaxTunnels     int
+	MaxUDPMappings int // extra UDP mappings per tunnel (besides voice chat)
+	Domain         string
+	Region         string
+
+	SubdomainBlocklist string // words refused in custom subdomains, one per line
+
+	// Custom domains
+	MaxCustomDomains      int    // per tunnel
+	DomainResolver        string // DNS server for TXT challenges ("host:port", empty = system)
+	DomainRecheckMinutes  int
+	DomainRecheckFailures int // failed re-checks in a row before a domain is unrouted
+
+	// Built-in DNS server (disabled when DNSAddr is empty)
+	DNSAddr        string
+	DNSPublicIPv4  string
+	DNSPublicIPv6  string
+	DNSNameservers string // comma-separated, default ns1.<domain>
+	DNSTTL         int
+	DNSMCPort      int // port announced in SRV records (0 = MC_PROXY_PORT)
+
+	// Multi-region: "all" runs API and tunnel server in one process, "control"
+	// only the API, "edge" only a tunnel server managed by CONTROL_URL
+	Mode                 string
+	EdgeToken            string // edge: secret shared with the control plane
+	EdgeTokens           string // control plane: "region=token,..." binding each edge token to a region
+	ControlURL           string // edge: base URL of the control plane API
+	EdgeRPCAddr          string // edge: listener for the control plane's RPC
+	EdgeRPCURL           string // edge: URL the control plane reaches EdgeRPCAddr under
+	EdgeHeartbeatSeconds int
+
+	// Several tunnel servers per region behind one load balancer, sharing
+	// their routes (disabled when RouteStore is empty)
+	RouteStore string // "postgres" (uses DATABASE_URL)
+	PeerAddr   string // listener for players forwarded by other nodes
+	NodeAddr   string // address the other nodes reach PeerAddr under
+	PeerToken  string // shared secret of the peer link
 
 	// SMTP for password reset
 	SMTPHost     string
@@ -49,20 +127,96 @@ func Load() *Config {
 
 		// JWT
 		JWTSecret:          getEnv("JWT_SECRET", "change-this-in-production-very-secret-key-32chars"),
-		JWTAccessTokenTTL:  getEnvInt("JWT_ACCESS_TTL", 60),      // 1 hour
-		JWTRefreshTokenTTL: getEnvInt("JWT_REFRESH_TTL", 7),      // 7 days
+		JWTAccessTokenTTL:  getEnvInt("JWT_ACCESS_TTL", 60), // 1 hour
+		JWTRefreshTokenTTL: getEnvInt("JWT_REFRESH_TTL", 7), // 7 days
 
 		// Built-in tunnel server
 		TunnelPort:    getEnvInt("TUNNEL_PORT", 7001),
 		MCProxyPort:   getEnvInt("MC_PROXY_PORT", 25565),
 		HTTPProxyPort: getEnvInt("HTTP_PROXY_PORT", 8081),
 
+		// Web map edge cache
+		HTTPCacheMaxMB: getEnvInt("HTTP_CACHE_MAX_MB", 64),
+
+		// HTTP access logs
+		HTTPAccessLogSize: getEnvInt("HTTP_ACCESS_LOG_SIZE", 1000),
+		HTTPAccessLogFile: getEnv("HTTP_ACCESS_LOG_FILE", ""),
+
+		// UDP sessions
+		UDPSessionIdleSeconds: getEnvInt("UDP_SESSION_IDLE_SECONDS", 120),
+		UDPMaxSessions:        getEnvInt("UDP_MAX_SESSIONS", 256),
+
+		// Usage accounting
+		UsageFlushSeconds: getEnvInt("USAGE_FLUSH_SECONDS", 60),
+
+		// Plan quotas
+		QuotaAction:       getEnv("QUOTA_ACTION", "throttle"),
+		QuotaThrottleKbps: getEnvInt("QUOTA_THROTTLE_KBPS", 128),
+		QuotaCheckSeconds: getEnvInt("QUOTA_CHECK_SECONDS", 60),
+
+		// Logging
+		LogLevel:       getEnv("LOG_LEVEL", "info"),
+		LogLevels:      getEnv("LOG_LEVELS", ""),
+		LogFormat:      getEnv("LOG_FORMAT", "text"),
+		LogSampleBurst: getEnvInt("LOG_SAMPLE_BURST", 20),
+
+		// Metrics
+		MetricsEnabled:   getEnvBool("METRICS_ENABLED", true),
+		MetricsPerTunnel: getEnvBool("METRICS_PER_TUNNEL", false),
+		AdminAddr:        getEnv("ADMIN_ADDR", ""),
+
+		// Shutdown
+		AdminToken:          getEnv("ADMIN_TOKEN", ""),
+		DrainTimeoutSeconds: getEnvInt("DRAIN_TIMEOUT_SECONDS", 60),
+		UpgradePIDFile:      getEnv("UPGRADE_PID_FILE", ""),
+
+		// Tracing
+		TracingExporter:      getEnv("TRACING_EXPORTER", "none"),
+		TracingEndpoint:      getEnv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://localhost:4318"),
+		TracingHeaders:       getEnv("OTEL_EXPORTER_OTLP_HEADERS", ""),
+		TracingServiceName:   getEnv("OTEL_SERVICE_NAME", "voidlink-api"),
+		TracingSamplePercent: getEnvInt("TRACING_SAMPLE_PERCENT", 100),
+
 		// Tunnels
-		MinPort:    getEnvInt("MIN_PORT", 20000),
-		MaxPort:    getEnvInt("MAX_PORT", 30000),
-		MaxTunnels: getEnvInt("MAX_TUNNELS", 3),
-		Domain:     getEnv("DOMAIN", "eu.yourdomain.com"),
-		Region:     getEnv("REGION", "eu"),
+		MinPort:        getEnvInt("MIN_PORT", 20000),
+		MaxPort:        getEnvInt("MAX_PORT", 30000),
+		TCPMinPort:     getEnvInt("TCP_MIN_PORT", 31000),
+		TCPMaxPort:     getEnvInt("TCP_MAX_PORT", 32000),
+		MaxTunnels:     getEnvInt("MAX_TUNNELS", 3),
+		MaxUDPMappings: getEnvInt("MAX_UDP_MAPPINGS", 4),
+		Domain:         getEnv("DOMAIN", "eu.yourdomain.com"),
+		Region:         getEnv("REGION", "eu"),
+
+		SubdomainBlocklist: getEnv("SUBDOMAIN_BLOCKLIST", "wordlist/blocklist.txt"),
+
+		// Custom domains
+		MaxCustomDomains:      getEnvInt("MAX_CUSTOM_DOMAINS", 3),
+		DomainResolver:        getEnv("DOMAIN_RESOLVER", ""),
+		DomainRecheckMinutes:  getEnvInt("DOMAIN_RECHECK_MINUTES", 360),
+		DomainRecheckFailures: getEnvInt("DOMAIN_RECHECK_FAILURES", 3),
+
+		// Built-in DNS server
+		DNSAddr:        getEnv("DNS_ADDR", ""),
+		DNSPublicIPv4:  getEnv("DNS_PUBLIC_IPV4", ""),
+		DNSPublicIPv6:  getEnv("DNS_PUBLIC_IPV6", ""),
+		DNSNameservers: getEnv("DNS_NAMESERVERS", ""),
+		DNSTTL:         getEnvInt("DNS_TTL", 60),
+		DNSMCPort:      getEnvInt("DNS_MC_PORT", 0),
+
+		// Multi-region
+		Mode:                 getEnv("MODE", "all"),
+		EdgeToken:            getEnv("EDGE_TOKEN", ""),
+		EdgeTokens:           getEnv("EDGE_TOKENS", ""),
+		ControlURL:           getEnv("CONTROL_URL", ""),
+		EdgeRPCAddr:          getEnv("EDGE_RPC_ADDR", ":7002"),
+		EdgeRPCURL:           getEnv("EDGE_RPC_URL", ""),
+		EdgeHeartbeatSeconds: getEnvInt("EDGE_HEARTBEAT_SECONDS", 15),
+
+		// Horizontal scaling
+		RouteStore: getEnv("ROUTE_STORE", ""),
+		PeerAddr:   getEnv("PEER_ADDR", ":7003"),
+		NodeAddr:   getEnv("NODE_ADDR", ""),
+		PeerToken:  getEnv("PEER_TOKEN", ""),
 
 		// SMTP
 		SMTPHost:     getEnv("SMTP_HOST", ""),
@@ -88,3 +242,12 @@ func getEnvInt(key string, defaultValue int) int {
 	}
 	return defaultValue
 }
+
+func getEnvBool(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		if boolVal, err := strconv.ParseBool(value); err == nil {
+			return boolVal
+		}
+	}
+	return defaultValue
+}
@@ -0,0 +1,20 @@
+package database
+
+import "tunnel-api/internal/metrics"
+
+// CollectPoolStats exports the connection pool statistics.
+func CollectPoolStats(e *metrics.Emitter) {
+	if Pool == nil {
+		return
+	}
+	st := Pool.Stat()
+	e.Gauge("voidlink_db_pool_connections", "Database pool connections by state.", float64(st.AcquiredConns()), "state", "acquired")
+	e.Gauge("voidlink_db_pool_connections", "Database pool connections by state.", float64(st.IdleConns()), "state", "idle")
+	e.Gauge("voidlink_db_pool_connections", "Database pool connections by state.", float64(st.ConstructingConns()), "state", "constructing")
+	e.Gauge("voidlink_db_pool_max_connections", "Maximum size of the database pool.", float64(st.MaxConns()))
+	e.Counter("voidlink_db_pool_acquires_total", "Connections acquired from the pool.", float64(st.AcquireCount()))
+	e.Counter("voidlink_db_pool_empty_acquires_total", "Acquires that had to wait for a connection.", float64(st.EmptyAcquireCount()))
+	e.Counter("voidlink_db_pool_canceled_acquires_total", "Acquires canceled by their context.", float64(st.CanceledAcquireCount()))
+	e.Counter("voidlink_db_pool_acquire_seconds_total", "Total time spent acquiring connections.", st.AcquireDuration().Seconds())
+	e.Counter("voidlink_db_pool_new_connections_total", "Connections opened by the pool.", float64(st.NewConnsCount()))
+}
@@ -59,18 +59,115 @@ func RunMigrations() error {
 			created_at TIMESTAMP DEFAULT NOW()
 		)`,
 
+		// Additional UDP services per tunnel (Geyser, Valheim, ...). The voice chat
+		// mapping stays on the tunnels row; public ports share the UDP pool with it.
+		`CREATE TABLE IF NOT EXISTS tunnel_udp_mappings (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			tunnel_id UUID NOT NULL REFERENCES tunnels(id) ON DELETE CASCADE,
+			label VARCHAR(50) NOT NULL,
+			local_port INT NOT NULL,
+			public_port INT UNIQUE NOT NULL,
+			enabled BOOLEAN NOT NULL DEFAULT TRUE,
+			created_at TIMESTAMP DEFAULT NOW()
+		)`,
+
+		// Custom hostnames; several tunnels may claim one, but only one can verify it
+		`CREATE TABLE IF NOT EXISTS tunnel_domains (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			tunnel_id UUID NOT NULL REFERENCES tunnels(id) ON DELETE CASCADE,
+			hostname VARCHAR(253) NOT NULL,
+			token VARCHAR(64) NOT NULL,
+			verified BOOLEAN NOT NULL DEFAULT FALSE,
+			verified_at TIMESTAMP,
+			checked_at TIMESTAMP,
+			check_error TEXT,
+			failures INT NOT NULL DEFAULT 0,
+			created_at TIMESTAMP DEFAULT NOW(),
+			UNIQUE (tunnel_id, hostname)
+		)`,
+
+		// Traffic per tunnel, channel (mc/http/udp/tcp) and hour
+		`CREATE TABLE IF NOT EXISTS tunnel_usage (
+			tunnel_id UUID NOT NULL REFERENCES tunnels(id) ON DELETE CASCADE,
+			bucket TIMESTAMP NOT NULL,
+			channel VARCHAR(8) NOT NULL,
+			bytes_in BIGINT NOT NULL DEFAULT 0,
+			bytes_out BIGINT NOT NULL DEFAULT 0,
+			connections BIGINT NOT NULL DEFAULT 0,
+			bytes_saved BIGINT NOT NULL DEFAULT 0,
+			PRIMARY KEY (tunnel_id, bucket, channel)
+		)`,
+
+		// Plans: bandwidth limits in kbit/s and monthly transfer cap in GB (0 = unlimited)
+		`CREATE TABLE IF NOT EXISTS plans (
+			name VARCHAR(32) PRIMARY KEY,
+			upload_kbps INT NOT NULL DEFAULT 0,
+			download_kbps INT NOT NULL DEFAULT 0,
+			monthly_transfer_gb INT NOT NULL DEFAULT 0
+		)`,
+		`INSERT INTO plans (name) VALUES ('free') ON CONFLICT DO NOTHING`,
+
+		// Remote edge nodes, one per region, updated by their heartbeats
+		`CREATE TABLE IF NOT EXISTS edge_nodes (
+			region VARCHAR(10) PRIMARY KEY,
+			domain VARCHAR(253) NOT NULL,
+			rpc_url TEXT NOT NULL,
+			last_seen TIMESTAMP NOT NULL DEFAULT NOW(),
+			tunnels INT NOT NULL DEFAULT 0,
+			clients INT NOT NULL DEFAULT 0
+		)`,
+
+		// Admin actions (tunnel suspensions, account changes, ...), newest last
+		`CREATE TABLE IF NOT EXISTS audit_log (
+			id BIGSERIAL PRIMARY KEY,
+			actor_id UUID REFERENCES users(id) ON DELETE SET NULL,
+			actor_email VARCHAR(255) NOT NULL,
+			action VARCHAR(32) NOT NULL,
+			target_type VARCHAR(16) NOT NULL,
+			target_id UUID NOT NULL,
+			details JSONB,
+			created_at TIMESTAMP DEFAULT NOW()
+		)`,
+
 		// Indexes
 		`CREATE INDEX IF NOT EXISTS idx_tunnels_user_id ON tunnels(user_id)`,
 		`CREATE INDEX IF NOT EXISTS idx_tunnels_subdomain ON tunnels(subdomain)`,
+		`CREATE INDEX IF NOT EXISTS idx_tunnel_udp_mappings_tunnel_id ON tunnel_udp_mappings(tunnel_id)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_tunnel_domains_verified_hostname ON tunnel_domains(hostname) WHERE verified`,
 		`CREATE INDEX IF NOT EXISTS idx_refresh_tokens_user_id ON refresh_tokens(user_id)`,
 		`CREATE INDEX IF NOT EXISTS idx_refresh_tokens_token_hash ON refresh_tokens(token_hash)`,
 		`CREATE INDEX IF NOT EXISTS idx_password_reset_tokens_hash ON password_reset_tokens(token_hash)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_log_target ON audit_log(target_id, id)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_log_actor ON audit_log(actor_id, id)`,
 
 		// Migration: add new columns if upgrading from old schema
 		`ALTER TABLE tunnels ADD COLUMN IF NOT EXISTS mc_local_port INT NOT NULL DEFAULT 25565`,
 		`ALTER TABLE tunnels ADD COLUMN IF NOT EXISTS http_local_port INT DEFAULT NULL`,
 		`ALTER TABLE tunnels ADD COLUMN IF NOT EXISTS udp_local_port INT NOT NULL DEFAULT 24454`,
 		`ALTER TABLE tunnels ADD COLUMN IF NOT EXISTS udp_public_port INT UNIQUE DEFAULT NULL`,
+		`ALTER TABLE tunnels ADD COLUMN IF NOT EXISTS http_cache_enabled BOOLEAN NOT NULL DEFAULT FALSE`,
+		//   tcp_local_port : local port of the raw TCP channel (NULL = disabled)
+		//   tcp_public_port: allocated public TCP port (stable, unique)
+		`ALTER TABLE tunnels ADD COLUMN IF NOT EXISTS tcp_local_port INT DEFAULT NULL`,
+		`ALTER TABLE tunnels ADD COLUMN IF NOT EXISTS tcp_public_port INT UNIQUE DEFAULT NULL`,
+
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS plan VARCHAR(32) NOT NULL DEFAULT 'free'`,
+		//   role            : user, support or admin
+		//   disabled_at     : set while the account is disabled by an admin
+		//   upload_kbps, download_kbps, monthly_transfer_gb: per-user overrides of the plan (NULL = plan value)
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS role VARCHAR(16) NOT NULL DEFAULT 'user'`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS disabled_at TIMESTAMP DEFAULT NULL`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS disabled_reason TEXT DEFAULT NULL`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS upload_kbps INT DEFAULT NULL`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS download_kbps INT DEFAULT NULL`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS monthly_transfer_gb INT DEFAULT NULL`,
+		//   suspended_at: set while an admin keeps the tunnel from starting
+		`ALTER TABLE tunnels ADD COLUMN IF NOT EXISTS suspended_at TIMESTAMP DEFAULT NULL`,
+		`ALTER TABLE tunnels ADD COLUMN IF NOT EXISTS suspended_reason TEXT DEFAULT NULL`,
+		//   moved_from, moved_at: previous region of a moved tunnel, whose edge
+		//   nodes may still report its traffic while they redirect it
+		`ALTER TABLE tunnels ADD COLUMN IF NOT EXISTS moved_from VARCHAR(10) DEFAULT NULL`,
+		`ALTER TABLE tunnels ADD COLUMN IF NOT EXISTS moved_at TIMESTAMP DEFAULT NULL`,
 
 		// Migration: drop old columns/tables if upgrading
 		`DROP TABLE IF EXISTS tunnel_ports`,
@@ -0,0 +1,57 @@
+package database
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+
+	"tunnel-api/internal/tracing"
+)
+
+// maxStatementLen bounds the db.query.text attribute.
+const maxStatementLen = 1024
+
+// queryTracer records a client span for every query and batch.
+type queryTracer struct{}
+
+func statement(sql string) string {
+	if len(sql) > maxStatementLen {
+		return sql[:maxStatementLen] + "..."
+	}
+	return sql
+}
+
+func (queryTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	ctx, _ = tracing.Start(ctx, "db.query", tracing.KindClient,
+		tracing.String("db.system", "postgresql"),
+		tracing.String("db.query.text", statement(data.SQL)),
+	)
+	return ctx
+}
+
+func (queryTracer) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	span := tracing.SpanFromContext(ctx)
+	span.SetAttrs(tracing.Int64("db.rows_affected", data.CommandTag.RowsAffected()))
+	span.RecordError(data.Err)
+	span.End()
+}
+
+func (queryTracer) TraceBatchStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceBatchStartData) context.Context {
+	ctx, _ = tracing.Start(ctx, "db.batch", tracing.KindClient,
+		tracing.String("db.system", "postgresql"),
+		tracing.Int("db.batch.size", data.Batch.Len()),
+	)
+	return ctx
+}
+
+func (queryTracer) TraceBatchQuery(ctx context.Context, _ *pgx.Conn, data pgx.TraceBatchQueryData) {
+	span := tracing.SpanFromContext(ctx)
+	span.AddEvent("query", tracing.String("db.query.text", statement(data.SQL)))
+	span.RecordError(data.Err)
+}
+
+func (queryTracer) TraceBatchEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceBatchEndData) {
+	span := tracing.SpanFromContext(ctx)
+	span.RecordError(data.Err)
+	span.End()
+}
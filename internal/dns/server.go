@@ -0,0 +1,238 @@
+// Package dns is an optional authoritative DNS server for the tunnel domain.
+// It answers from the live tunnel table, so operators do not need wildcard
+// records at their DNS provider: they delegate the zone (NS records pointing
+// at this server) and every active tunnel resolves on its own.
+//
+// Served names, relative to the domain:
+//
+//	@, <nameserver>                  A/AAAA (public IPs), plus NS and SOA at the apex
+//	<sub>, map.<sub>                 A/AAAA of active tunnels
+//	_minecraft._tcp.<sub>            SRV pointing at the Minecraft proxy port
+//	_voidlink-challenge.<sub>        TXT challenges of the tunnel's custom domains
+//
+// Everything else under the domain is NXDOMAIN; names outside it are refused.
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"tunnel-api/internal/logging"
+)
+
+// Zone is the live data behind the records.
+type Zone interface {
+	// Tunnel returns the ID of the active tunnel with the given subdomain.
+	Tunnel(subdomain string) (tunnelID string, ok bool)
+	// Challenges returns the TXT challenge values of a tunnel's custom domains.
+	Challenges(ctx context.Context, tunnelID string) ([]string, error)
+}
+
+type Config struct {
+	Addr        string   // listen address for UDP and TCP, e.g. ":53"
+	Domain      string   // zone apex, e.g. "eu.yourdomain.com"
+	IPv4        string   // public address of the proxies (empty = no A records)
+	IPv6        string   // (empty = no AAAA records)
+	Nameservers []string // NS of the zone; defaults to ns1.<domain>
+	TTL         uint32   // also the negative caching TTL
+	MCPort      int      // public Minecraft proxy port announced in SRV records
+	Zone        Zone
+	Logger      *slog.Logger
+
+	// Listen and ListenPacket open the sockets (default net.Listen and net.ListenPacket)
+	Listen       func(network, addr string) (net.Listener, error)
+	ListenPacket func(network, addr string) (net.PacketConn, error)
+}
+
+// Server answers DNS queries over UDP and TCP.
+type Server struct {
+	addr   string
+	origin string // "<domain>." lower case
+	apex   dnsmessage.Name
+	ipv4   netip.Addr
+	ipv6   netip.Addr
+	ns     []dnsmessage.Name
+	ttl    uint32
+	mcPort uint16
+	serial uint32
+	zone   Zone
+	log    *slog.Logger
+
+	listen       func(network, addr string) (net.Listener, error)
+	listenPacket func(network, addr string) (net.PacketConn, error)
+}
+
+// Query timeouts.
+const (
+	tcpIdleTimeout = 10 * time.Second
+	lookupTimeout  = 2 * time.Second
+)
+
+// Response size limits: 512 bytes without EDNS, and at most 1232 bytes with
+// it (the usual choice to avoid IP fragmentation).
+const (
+	minUDPSize = 512
+	maxUDPSize = 1232
+)
+
+func NewServer(cfg Config) (*Server, error) {
+	var ipv4, ipv6 netip.Addr
+	if cfg.IPv4 != "" {
+		addr, err := netip.ParseAddr(cfg.IPv4)
+		if err != nil || !addr.Is4() {
+			return nil, fmt.Errorf("dns: invalid IPv4 address %q", cfg.IPv4)
+		}
+		ipv4 = addr
+	}
+	if cfg.IPv6 != "" {
+		addr, err := netip.ParseAddr(cfg.IPv6)
+		if err != nil || !addr.Is6() || addr.Is4In6() {
+			return nil, fmt.Errorf("dns: invalid IPv6 address %q", cfg.IPv6)
+		}
+		ipv6 = addr
+	}
+	if !ipv4.IsValid() && !ipv6.IsValid() {
+		return nil, errors.New("dns: a public IPv4 or IPv6 address is required")
+	}
+	if cfg.TTL == 0 {
+		cfg.TTL = 60
+	}
+	if cfg.MCPort <= 0 || cfg.MCPort > 65535 {
+		cfg.MCPort = 25565
+	}
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	if cfg.Listen == nil {
+		cfg.Listen = net.Listen
+	}
+	if cfg.ListenPacket == nil {
+		cfg.ListenPacket = net.ListenPacket
+	}
+
+	origin := strings.ToLower(strings.TrimSuffix(cfg.Domain, ".")) + "."
+	apex, err := dnsmessage.NewName(origin)
+	if err != nil {
+		return nil, fmt.Errorf("dns: invalid domain %q: %w", cfg.Domain, err)
+	}
+	if len(cfg.Nameservers) == 0 {
+		cfg.Nameservers = []string{"ns1." + origin}
+	}
+	s := &Server{
+		addr:   cfg.Addr,
+		origin: origin,
+		apex:   apex,
+		ipv4:   ipv4,
+		ipv6:   ipv6,
+		ttl:    cfg.TTL,
+		mcPort: uint16(cfg.MCPort),
+		serial: uint32(time.Now().Unix()),
+		zone:   cfg.Zone,
+		log:    logger.With(logging.Subsystem, "dns"),
+
+		listen:       cfg.Listen,
+		listenPacket: cfg.ListenPacket,
+	}
+	for _, ns := range cfg.Nameservers {
+		name, err := dnsmessage.NewName(strings.ToLower(strings.TrimSuffix(strings.TrimSpace(ns), ".")) + ".")
+		if err != nil {
+			return nil, fmt.Errorf("dns: invalid nameserver %q: %w", ns, err)
+		}
+		s.ns = append(s.ns, name)
+	}
+	return s, nil
+}
+
+// Run starts the UDP and TCP listeners. They are closed when ctx is cancelled.
+func (s *Server) Run(ctx context.Context) error {
+	pc, err := s.listenPacket("udp", s.addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on DNS address %s (udp): %w", s.addr, err)
+	}
+	l, err := s.listen("tcp", s.addr)
+	if err != nil {
+		pc.Close()
+		return fmt.Errorf("failed to listen on DNS address %s (tcp): %w", s.addr, err)
+	}
+	s.log.Info("DNS server running", "addr", s.addr, "zone", s.origin)
+
+	go func() {
+		<-ctx.Done()
+		pc.Close()
+		l.Close()
+	}()
+	go s.serveUDP(ctx, pc)
+	go s.serveTCP(ctx, l)
+	return nil
+}
+
+func (s *Server) serveUDP(ctx context.Context, pc net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			s.log.Warn("UDP read error", "error", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		req := append([]byte(nil), buf[:n]...)
+		go func() {
+			if resp := s.Answer(ctx, req, true); resp != nil {
+				pc.WriteTo(resp, addr)
+			}
+		}()
+	}
+}
+
+func (s *Server) serveTCP(ctx context.Context, l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			s.log.Warn("Accept error", "error", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go s.handleTCP(ctx, conn)
+	}
+}
+
+// handleTCP answers length-prefixed queries until the client goes quiet.
+func (s *Server) handleTCP(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	var lenBuf [2]byte
+	for {
+		conn.SetDeadline(time.Now().Add(tcpIdleTimeout))
+		if _, err := io.ReadFull(conn, lenBuf[:]); err != nil {
+			return
+		}
+		req := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+		if _, err := io.ReadFull(conn, req); err != nil {
+			return
+		}
+		resp := s.Answer(ctx, req, false)
+		if resp == nil {
+			return
+		}
+		out := binary.BigEndian.AppendUint16(nil, uint16(len(resp)))
+		if _, err := conn.Write(append(out, resp...)); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// testZone has one active tunnel, "play", with many custom domains.
+type testZone struct {
+	challenges []string
+}
+
+func (z testZone) Tunnel(subdomain string) (string, bool) {
+	return "t1", subdomain == "play"
+}
+
+func (z testZone) Challenges(_ context.Context, tunnelID string) ([]string, error) {
+	if tunnelID != "t1" {
+		return nil, errors.New("unknown tunnel")
+	}
+	return z.challenges, nil
+}
+
+// startServer runs a server for eu.example.test on a loopback port shared by
+// UDP and TCP, and returns its address.
+func startServer(t *testing.T, zone Zone) string {
+	t.Helper()
+	var pc net.PacketConn
+	var l net.Listener
+	for attempt := 0; l == nil; attempt++ {
+		var err error
+		if pc, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		if l, err = net.Listen("tcp", pc.LocalAddr().String()); err != nil {
+			pc.Close()
+			if attempt == 10 {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	s, err := NewServer(Config{
+		Domain:       "eu.example.test",
+		IPv4:         "203.0.113.7",
+		IPv6:         "2001:db8::7",
+		MCPort:       25570,
+		Zone:         zone,
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Listen:       func(string, string) (net.Listener, error) { return l, nil },
+		ListenPacket: func(string, string) (net.PacketConn, error) { return pc, nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if err := s.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return pc.LocalAddr().String()
+}
+
+// resolver sends every query to addr, falling back to TCP on truncation.
+func resolver(addr string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// query sends one query over UDP without EDNS and returns the parsed response.
+func query(t *testing.T, addr, name string, typ dnsmessage.Type) dnsmessage.Message {
+	t.Helper()
+	req := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 42, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: typ, Class: dnsmessage.ClassINET}},
+	}
+	buf, err := req.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	resp := make([]byte, 65535)
+	n, err := conn.Read(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.ID != 42 || !msg.Header.Response {
+		t.Fatalf("response header = %+v", msg.Header)
+	}
+	return msg
+}
+
+func TestServerAddresses(t *testing.T) {
+	r := resolver(startServer(t, testZone{}))
+	want := []netip.Addr{netip.MustParseAddr("203.0.113.7"), netip.MustParseAddr("2001:db8::7")}
+	for _, name := range []string{"eu.example.test.", "ns1.eu.example.test.", "play.eu.example.test.", "map.play.eu.example.test."} {
+		addrs, err := r.LookupNetIP(context.Background(), "ip", name)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		slices.SortFunc(addrs, netip.Addr.Compare)
+		if !slices.Equal(addrs, want) {
+			t.Errorf("%s: addresses %v, want %v", name, addrs, want)
+		}
+	}
+}
+
+func TestServerMinecraftSRV(t *testing.T) {
+	r := resolver(startServer(t, testZone{}))
+	_, srvs, err := r.LookupSRV(context.Background(), "minecraft", "tcp", "play.eu.example.test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(srvs) != 1 || srvs[0].Target != "play.eu.example.test." || srvs[0].Port != 25570 {
+		t.Fatalf("SRV records %+v, want play.eu.example.test.:25570", srvs)
+	}
+}
+
+func TestServerChallengeTXT(t *testing.T) {
+	r := resolver(startServer(t, testZone{challenges: []string{"voidlink-verify=a", "voidlink-verify=b"}}))
+	txts, err := r.LookupTXT(context.Background(), "_voidlink-challenge.play.eu.example.test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(txts)
+	if !slices.Equal(txts, []string{"voidlink-verify=a", "voidlink-verify=b"}) {
+		t.Fatalf("TXT records %v", txts)
+	}
+}
+
+func TestServerNXDOMAIN(t *testing.T) {
+	addr := startServer(t, testZone{})
+	for _, name := range []string{"other.eu.example.test.", "www.play.eu.example.test."} {
+		_, err := resolver(addr).LookupNetIP(context.Background(), "ip4", name)
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			t.Errorf("%s: error %v, want not found", name, err)
+		}
+
+		msg := query(t, addr, name, dnsmessage.TypeA)
+		if msg.Header.RCode != dnsmessage.RCodeNameError || !msg.Header.Authoritative || len(msg.Answers) != 0 {
+			t.Errorf("%s: header %+v with %d answers, want authoritative NXDOMAIN", name, msg.Header, len(msg.Answers))
+		}
+		if len(msg.Authorities) != 1 || msg.Authorities[0].Header.Type != dnsmessage.TypeSOA ||
+			msg.Authorities[0].Header.Name.String() != "eu.example.test." {
+			t.Errorf("%s: authority section %v, want the zone's SOA", name, msg.Authorities)
+		}
+	}
+}
+
+func TestServerRefusesOtherZones(t *testing.T) {
+	msg := query(t, startServer(t, testZone{}), "example.com.", dnsmessage.TypeA)
+	if msg.Header.RCode != dnsmessage.RCodeRefused || msg.Header.Authoritative || len(msg.Answers) != 0 {
+		t.Fatalf("header %+v with %d answers, want REFUSED", msg.Header, len(msg.Answers))
+	}
+}
+
+func TestServerTruncatesUDP(t *testing.T) {
+	var zone testZone
+	for i := range 40 {
+		zone.challenges = append(zone.challenges, fmt.Sprintf("voidlink-verify=%032d", i))
+	}
+	addr := startServer(t, zone)
+	name := "_voidlink-challenge.play.eu.example.test."
+
+	msg := query(t, addr, name, dnsmessage.TypeTXT)
+	if !msg.Header.Truncated || len(msg.Answers) != 0 {
+		t.Fatalf("header %+v with %d answers, want truncated and empty", msg.Header, len(msg.Answers))
+	}
+
+	// The resolver retries over TCP and gets every record
+	txts, err := resolver(addr).LookupTXT(context.Background(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txts) != len(zone.challenges) {
+		t.Fatalf("got %d TXT records over TCP, want %d", len(txts), len(zone.challenges))
+	}
+}
@@ -0,0 +1,196 @@
+package dns
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Answer builds the response to a raw DNS query. Over UDP the response is cut
+// down to the client's advertised size and flagged as truncated if needed.
+// It returns nil if the query is not worth answering (not a query, or not
+// even a parseable header).
+func (s *Server) Answer(ctx context.Context, req []byte, udp bool) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(req); err != nil {
+		var p dnsmessage.Parser
+		h, err := p.Start(req)
+		if err != nil || h.Response {
+			return nil
+		}
+		return s.pack(dnsmessage.Message{Header: replyHeader(h, dnsmessage.RCodeFormatError)}, udp, minUDPSize)
+	}
+	if msg.Header.Response {
+		return nil
+	}
+
+	resp := dnsmessage.Message{Header: replyHeader(msg.Header, dnsmessage.RCodeSuccess)}
+	size := minUDPSize
+	for _, rr := range msg.Additionals {
+		if rr.Header.Type == dnsmessage.TypeOPT {
+			// EDNS: the class carries the client's UDP payload size
+			size = min(max(int(rr.Header.Class), minUDPSize), maxUDPSize)
+			opt := dnsmessage.Resource{Body: &dnsmessage.OPTResource{}}
+			opt.Header.SetEDNS0(maxUDPSize, dnsmessage.RCodeSuccess, false)
+			resp.Additionals = append(resp.Additionals, opt)
+		}
+	}
+
+	switch {
+	case msg.Header.OpCode != 0:
+		resp.Header.RCode = dnsmessage.RCodeNotImplemented
+	case len(msg.Questions) != 1:
+		resp.Header.RCode = dnsmessage.RCodeFormatError
+	default:
+		resp.Questions = msg.Questions
+		s.resolve(ctx, msg.Questions[0], &resp)
+	}
+	return s.pack(resp, udp, size)
+}
+
+func replyHeader(h dnsmessage.Header, rcode dnsmessage.RCode) dnsmessage.Header {
+	return dnsmessage.Header{
+		ID:               h.ID,
+		Response:         true,
+		OpCode:           h.OpCode,
+		RecursionDesired: h.RecursionDesired,
+		RCode:            rcode,
+	}
+}
+
+func (s *Server) pack(resp dnsmessage.Message, udp bool, size int) []byte {
+	buf, err := resp.Pack()
+	if err == nil && udp && len(buf) > size {
+		resp.Header.Truncated = true
+		resp.Answers, resp.Authorities = nil, nil
+		buf, err = resp.Pack()
+	}
+	if err != nil {
+		s.log.Warn("Failed to pack response", "error", err)
+		return nil
+	}
+	return buf
+}
+
+// resolve fills in the answer to q.
+func (s *Server) resolve(ctx context.Context, q dnsmessage.Question, resp *dnsmessage.Message) {
+	name := strings.ToLower(q.Name.String())
+	if q.Class != dnsmessage.ClassINET && q.Class != dnsmessage.ClassANY {
+		resp.Header.RCode = dnsmessage.RCodeRefused
+		return
+	}
+	if name != s.origin && !strings.HasSuffix(name, "."+s.origin) {
+		// Authoritative only: no recursion for other zones
+		resp.Header.RCode = dnsmessage.RCodeRefused
+		return
+	}
+	resp.Header.Authoritative = true
+
+	ctx, cancel := context.WithTimeout(ctx, lookupTimeout)
+	defer cancel()
+	rrs, exists, err := s.records(ctx, q.Name, strings.TrimSuffix(strings.TrimSuffix(name, s.origin), "."))
+	if err != nil {
+		s.log.Warn("Zone lookup failed", "name", name, "error", err)
+		resp.Header.RCode = dnsmessage.RCodeServerFailure
+		return
+	}
+	if !exists {
+		resp.Header.RCode = dnsmessage.RCodeNameError
+	}
+	for _, rr := range rrs {
+		if q.Type == dnsmessage.TypeALL || rr.Header.Type == q.Type {
+			resp.Answers = append(resp.Answers, rr)
+		}
+	}
+	if len(resp.Answers) == 0 {
+		// NXDOMAIN or NODATA: the SOA tells resolvers how long to cache that
+		resp.Authorities = append(resp.Authorities, s.soa())
+	}
+}
+
+// records returns every record of a name, given relative to the zone apex
+// ("" for the apex itself), and whether the name exists at all.
+func (s *Server) records(ctx context.Context, owner dnsmessage.Name, rel string) ([]dnsmessage.Resource, bool, error) {
+	if rel == "" {
+		rrs := s.addrs(owner)
+		for _, ns := range s.ns {
+			rrs = append(rrs, s.rr(owner, dnsmessage.TypeNS, &dnsmessage.NSResource{NS: ns}))
+		}
+		return append(rrs, s.soa()), true, nil
+	}
+	for _, ns := range s.ns {
+		if strings.EqualFold(ns.String(), rel+"."+s.origin) {
+			return s.addrs(owner), true, nil
+		}
+	}
+
+	labels := strings.Split(rel, ".")
+	sub := labels[len(labels)-1]
+	tunnelID, ok := s.zone.Tunnel(sub)
+	if !ok {
+		return nil, false, nil
+	}
+
+	switch prefix := labels[:len(labels)-1]; {
+	case len(prefix) == 0, slices.Equal(prefix, []string{"map"}):
+		return s.addrs(owner), true, nil
+
+	case slices.Equal(prefix, []string{"_tcp"}):
+		// Empty non-terminal above the SRV record
+		return nil, true, nil
+
+	case slices.Equal(prefix, []string{"_minecraft", "_tcp"}):
+		target, err := dnsmessage.NewName(sub + "." + s.origin)
+		if err != nil {
+			return nil, false, err
+		}
+		srv := &dnsmessage.SRVResource{Priority: 0, Weight: 5, Port: s.mcPort, Target: target}
+		return []dnsmessage.Resource{s.rr(owner, dnsmessage.TypeSRV, srv)}, true, nil
+
+	case slices.Equal(prefix, []string{"_voidlink-challenge"}):
+		values, err := s.zone.Challenges(ctx, tunnelID)
+		if err != nil {
+			return nil, false, err
+		}
+		var rrs []dnsmessage.Resource
+		for _, v := range values {
+			rrs = append(rrs, s.rr(owner, dnsmessage.TypeTXT, &dnsmessage.TXTResource{TXT: []string{v}}))
+		}
+		return rrs, true, nil
+	}
+	return nil, false, nil
+}
+
+// addrs returns the A and AAAA records of the proxies.
+func (s *Server) addrs(owner dnsmessage.Name) []dnsmessage.Resource {
+	var rrs []dnsmessage.Resource
+	if s.ipv4.Is4() {
+		rrs = append(rrs, s.rr(owner, dnsmessage.TypeA, &dnsmessage.AResource{A: s.ipv4.As4()}))
+	}
+	if s.ipv6.Is6() {
+		rrs = append(rrs, s.rr(owner, dnsmessage.TypeAAAA, &dnsmessage.AAAAResource{AAAA: s.ipv6.As16()}))
+	}
+	return rrs
+}
+
+func (s *Server) soa() dnsmessage.Resource {
+	mbox, _ := dnsmessage.NewName("hostmaster." + s.origin)
+	return s.rr(s.apex, dnsmessage.TypeSOA, &dnsmessage.SOAResource{
+		NS:      s.ns[0],
+		MBox:    mbox,
+		Serial:  s.serial,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		MinTTL:  s.ttl,
+	})
+}
+
+func (s *Server) rr(owner dnsmessage.Name, typ dnsmessage.Type, body dnsmessage.ResourceBody) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: owner, Type: typ, Class: dnsmessage.ClassINET, TTL: s.ttl},
+		Body:   body,
+	}
+}
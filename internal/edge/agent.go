@@ -0,0 +1,327 @@
+package edge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"tunnel-api/internal/events"
+	"tunnel-api/internal/logging"
+	"tunnel-api/internal/tunnel"
+)
+
+type AgentConfig struct {
+	ControlURL string // base URL of the control plane API
+	Token      string
+	Region     string
+	Domain     string
+	RPCURL     string // URL under which the control plane reaches this node's RPC
+	Interval   time.Duration
+	Node       Node        // applies RPC calls, default Local (a route store shares them)
+	Events     *events.Bus // the tunnel server's events, forwarded if set
+	Logger     *slog.Logger
+}
+
+// Agent runs on an edge node: it serves the RPC for the control plane, sends
+// heartbeats with the node's status and traffic and forwards tunnel events.
+type Agent struct {
+	server *tunnel.Server
+	cfg    AgentConfig
+	http   *http.Client
+	log    *slog.Logger
+
+	mu      sync.Mutex
+	pending []tunnel.UsageRecord // drained, not yet accepted by the control plane
+}
+
+func NewAgent(srv *tunnel.Server, cfg AgentConfig) *Agent {
+	if cfg.Interval <= 0 {
+		cfg.Interval = 15 * time.Second
+	}
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	if cfg.Node == nil {
+		cfg.Node = Local{Server: srv}
+	}
+	cfg.ControlURL = strings.TrimSuffix(cfg.ControlURL, "/")
+	return &Agent{
+		server: srv,
+		cfg:    cfg,
+		http:   &http.Client{Timeout: 10 * time.Second},
+		log:    logger.With(logging.Subsystem, "edge"),
+	}
+}
+
+// Handler serves the RPC methods.
+func (a *Agent) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /rpc/{method}", a.serveRPC)
+	return mux
+}
+
+func (a *Agent) serveRPC(w http.ResponseWriter, r *http.Request) {
+	if !Authorized(r, a.cfg.Token) {
+		writeError(w, http.StatusUnauthorized, "invalid token")
+		return
+	}
+	body := http.MaxBytesReader(w, r.Body, 1<<20)
+	node := a.cfg.Node
+	ctx := r.Context()
+
+	var err error
+	switch method := r.PathValue("method"); method {
+	case MethodRegister:
+		var reg tunnel.TunnelRegistration
+		if err = json.NewDecoder(body).Decode(&reg); err == nil {
+			a.log.Info("Tunnel registered by control plane", "tunnel_id", reg.TunnelID, "subdomain", reg.Subdomain)
+			err = node.Register(ctx, reg)
+		}
+	case MethodUnregister, MethodRename, MethodHostnames, MethodLimits, MethodMove:
+		var p TunnelParams
+		if err = json.NewDecoder(body).Decode(&p); err != nil {
+			break
+		}
+		switch method {
+		case MethodUnregister:
+			a.log.Info("Tunnel unregistered by control plane", "tunnel_id", p.TunnelID)
+			err = node.Unregister(ctx, p.TunnelID)
+		case MethodRename:
+			err = node.Rename(ctx, p.TunnelID, p.Subdomain)
+		case MethodHostnames:
+			err = node.SetHostnames(ctx, p.TunnelID, p.Hostnames)
+		case MethodLimits:
+			if p.Limits == nil {
+				writeError(w, http.StatusBadRequest, "limits are required")
+				return
+			}
+			err = node.SetLimits(ctx, p.TunnelID, *p.Limits)
+		case MethodMove:
+			if p.Target == nil {
+				writeError(w, http.StatusBadRequest, "target is required")
+				return
+			}
+			a.log.Info("Tunnel moved by control plane", "tunnel_id", p.TunnelID, "region", p.Target.Region)
+			err = node.Move(ctx, p.TunnelID, *p.Target)
+		}
+	case MethodLatency, MethodCacheStats, MethodPurgeCache, MethodStats,
+		MethodConnections, MethodCloseConnection, MethodAccessLogs:
+		var p TunnelParams
+		if err = json.NewDecoder(body).Decode(&p); err != nil {
+			break
+		}
+		if method == MethodAccessLogs && p.Filter == nil {
+			writeError(w, http.StatusBadRequest, "filter is required")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(a.inspect(method, p))
+		return
+	default:
+		writeError(w, http.StatusNotFound, "unknown method "+method)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// inspect answers an inspection method from this node's tunnel server. With a
+// route store the control plane asks the instance the client is attached to.
+func (a *Agent) inspect(method string, p TunnelParams) Inspection {
+	var res Inspection
+	switch method {
+	case MethodLatency:
+		latency, found := a.server.ClientLatency(p.TunnelID)
+		res.Latency, res.Found = &latency, found
+	case MethodCacheStats:
+		stats, found := a.server.HTTPCacheStats(p.TunnelID)
+		res.CacheStats, res.Found = &stats, found
+	case MethodPurgeCache:
+		res.Purged = a.server.PurgeHTTPCache(p.TunnelID, p.Prefix)
+	case MethodStats:
+		stats := a.server.TunnelStats(p.TunnelID)
+		res.Stats = &stats
+	case MethodConnections:
+		res.Connections = a.server.Connections(p.TunnelID)
+	case MethodCloseConnection:
+		res.Found = a.server.CloseConnection(p.TunnelID, p.ConnID)
+	case MethodAccessLogs:
+		res.Logs = a.server.HTTPAccessLogs(p.TunnelID, *p.Filter)
+	}
+	return res
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+// Run sends a heartbeat right away and then every interval until ctx is
+// cancelled, and forwards events meanwhile.
+func (a *Agent) Run(ctx context.Context) {
+	if a.cfg.Events != nil {
+		go a.forwardEvents(ctx)
+	}
+	ticker := time.NewTicker(a.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		if err := a.Heartbeat(ctx); err != nil && ctx.Err() == nil {
+			a.log.Warn("Heartbeat failed", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Heartbeat reports the node's status and the traffic counted since the last
+// accepted heartbeat. Traffic of a failed heartbeat is sent again with the next.
+func (a *Agent) Heartbeat(ctx context.Context) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.pending = mergeUsage(a.pending, a.server.DrainUsage())
+	hb := Heartbeat{
+		Region:  a.cfg.Region,
+		Domain:  a.cfg.Domain,
+		RPCURL:  a.cfg.RPCURL,
+		MCPort:  a.server.MCProxyPort(),
+		Tunnels: a.server.TunnelIDs(),
+		Clients: a.server.Clients(),
+		Usage:   a.pending,
+	}
+	if err := a.post(ctx, "/api/edge/heartbeat", hb); err != nil {
+		return err
+	}
+	a.pending = nil
+	return nil
+}
+
+// mergeUsage adds records to pending, summing those of the same tunnel and channel.
+func mergeUsage(pending, records []tunnel.UsageRecord) []tunnel.UsageRecord {
+next:
+	for _, r := range records {
+		for i := range pending {
+			if p := &pending[i]; p.TunnelID == r.TunnelID && p.Channel == r.Channel {
+				p.BytesIn += r.BytesIn
+				p.BytesOut += r.BytesOut
+				p.Connections += r.Connections
+				p.BytesSaved += r.BytesSaved
+				continue next
+			}
+		}
+		pending = append(pending, r)
+	}
+	return pending
+}
+
+// Tunnel returns the active tunnel with the given subdomain (for dns.Zone).
+func (a *Agent) Tunnel(subdomain string) (string, bool) {
+	return a.server.LookupSubdomain(subdomain)
+}
+
+// Challenges asks the control plane for a tunnel's custom domain challenges
+// (for dns.Zone).
+func (a *Agent) Challenges(ctx context.Context, tunnelID string) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		a.cfg.ControlURL+"/api/edge/challenges?tunnel_id="+url.QueryEscape(tunnelID), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+a.cfg.Token)
+	resp, err := a.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("control plane: %s", resp.Status)
+	}
+	var out struct {
+		Challenges []string `json:"challenges"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	return out.Challenges, nil
+}
+
+const (
+	eventBuffer     = 1024                   // events held while a batch is being sent
+	eventBatchDelay = 250 * time.Millisecond // collects events into one request
+	eventBatchMax   = 256
+)
+
+// forwardEvents sends the tunnel server's events to the control plane in
+// batches. They are live updates: a batch the control plane does not accept
+// is dropped rather than sent again, and apps re-sync when they reconnect.
+func (a *Agent) forwardEvents(ctx context.Context) {
+	sub := a.cfg.Events.Subscribe(nil, eventBuffer)
+	defer sub.Close()
+	for {
+		var batch []events.Event
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-sub.C():
+			batch = append(batch, e)
+		}
+		timer := time.NewTimer(eventBatchDelay)
+	collect:
+		for len(batch) < eventBatchMax {
+			select {
+			case e := <-sub.C():
+				batch = append(batch, e)
+			case <-timer.C:
+				break collect
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			}
+		}
+		timer.Stop()
+
+		err := a.post(ctx, "/api/edge/events", EventBatch{Region: a.cfg.Region, Events: batch})
+		if err != nil && ctx.Err() == nil {
+			a.log.Warn("Failed to forward events", "events", len(batch), "error", err)
+		}
+	}
+}
+
+func (a *Agent) post(ctx context.Context, path string, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.cfg.ControlURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+a.cfg.Token)
+	resp, err := a.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("control plane: %s", resp.Status)
+	}
+	return nil
+}
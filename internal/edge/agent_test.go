@@ -0,0 +1,79 @@
+package edge
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"tunnel-api/internal/events"
+	"tunnel-api/internal/tunnel"
+)
+
+// Events published on the node's bus reach the control plane in batches,
+// authenticated with the region's token.
+func TestAgentForwardsEvents(t *testing.T) {
+	batches := make(chan EventBatch, 4)
+	control := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/edge/events" || r.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("%s %s with %q", r.Method, r.URL.Path, r.Header.Get("Authorization"))
+		}
+		var b EventBatch
+		if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+			t.Error(err)
+		}
+		batches <- b
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer control.Close()
+
+	bus := events.NewBus()
+	a := NewAgent(tunnel.NewServer(tunnel.Config{}), AgentConfig{
+		ControlURL: control.URL,
+		Token:      "secret",
+		Region:     "eu",
+		Events:     bus,
+		Logger:     slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		a.forwardEvents(ctx)
+	}()
+
+	// The subscription starts with the goroutine; publish until it is seen
+	var b EventBatch
+	deadline := time.After(5 * time.Second)
+wait:
+	for {
+		bus.Publish(events.Event{Type: events.ClientConnected, TunnelID: "t1", UserID: "u1"})
+		select {
+		case b = <-batches:
+			break wait
+		case <-time.After(50 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("no events forwarded")
+		}
+	}
+
+	if b.Region != "eu" || len(b.Events) == 0 {
+		t.Fatalf("batch %+v, want events of eu", b)
+	}
+	for _, e := range b.Events {
+		if e.Type != events.ClientConnected || e.TunnelID != "t1" || e.Time.IsZero() {
+			t.Errorf("event %+v, want client.connected of t1", e)
+		}
+		if e.UserID != "" {
+			t.Errorf("owner %q sent to the control plane", e.UserID)
+		}
+	}
+
+	cancel()
+	<-done
+}
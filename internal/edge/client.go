@@ -0,0 +1,152 @@
+package edge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"tunnel-api/internal/tunnel"
+)
+
+// Client is the control plane's Node for a remote edge node.
+type Client struct {
+	url   string
+	token string
+	http  *http.Client
+}
+
+func NewClient(rpcURL, token string) *Client {
+	return &Client{
+		url:   strings.TrimSuffix(rpcURL, "/"),
+		token: token,
+		http:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (c *Client) Register(ctx context.Context, reg tunnel.TunnelRegistration) error {
+	return c.call(ctx, MethodRegister, reg)
+}
+
+func (c *Client) Unregister(ctx context.Context, tunnelID string) error {
+	return c.call(ctx, MethodUnregister, TunnelParams{TunnelID: tunnelID})
+}
+
+func (c *Client) Rename(ctx context.Context, tunnelID, subdomain string) error {
+	return c.call(ctx, MethodRename, TunnelParams{TunnelID: tunnelID, Subdomain: subdomain})
+}
+
+func (c *Client) SetHostnames(ctx context.Context, tunnelID string, hostnames []string) error {
+	return c.call(ctx, MethodHostnames, TunnelParams{TunnelID: tunnelID, Hostnames: hostnames})
+}
+
+func (c *Client) SetLimits(ctx context.Context, tunnelID string, limits tunnel.TunnelLimits) error {
+	return c.call(ctx, MethodLimits, TunnelParams{TunnelID: tunnelID, Limits: &limits})
+}
+
+func (c *Client) Move(ctx context.Context, tunnelID string, target tunnel.MoveTarget) error {
+	return c.call(ctx, MethodMove, TunnelParams{TunnelID: tunnelID, Target: &target})
+}
+
+func (c *Client) ClientLatency(ctx context.Context, tunnelID string) (tunnel.ClientLatency, bool, error) {
+	res, err := c.inspect(ctx, MethodLatency, TunnelParams{TunnelID: tunnelID})
+	if err != nil || res.Latency == nil {
+		return tunnel.ClientLatency{Samples: []tunnel.RTTSample{}}, false, err
+	}
+	return *res.Latency, res.Found, nil
+}
+
+func (c *Client) HTTPCacheStats(ctx context.Context, tunnelID string) (tunnel.HTTPCacheStats, bool, error) {
+	res, err := c.inspect(ctx, MethodCacheStats, TunnelParams{TunnelID: tunnelID})
+	if err != nil || res.CacheStats == nil {
+		return tunnel.HTTPCacheStats{}, false, err
+	}
+	return *res.CacheStats, res.Found, nil
+}
+
+func (c *Client) PurgeHTTPCache(ctx context.Context, tunnelID, prefix string) (int, error) {
+	res, err := c.inspect(ctx, MethodPurgeCache, TunnelParams{TunnelID: tunnelID, Prefix: prefix})
+	return res.Purged, err
+}
+
+func (c *Client) TunnelStats(ctx context.Context, tunnelID string) (tunnel.TunnelStats, error) {
+	res, err := c.inspect(ctx, MethodStats, TunnelParams{TunnelID: tunnelID})
+	if err != nil || res.Stats == nil {
+		return tunnel.TunnelStats{}, err
+	}
+	return *res.Stats, nil
+}
+
+func (c *Client) Connections(ctx context.Context, tunnelID string) ([]tunnel.Connection, error) {
+	res, err := c.inspect(ctx, MethodConnections, TunnelParams{TunnelID: tunnelID})
+	if res.Connections == nil {
+		res.Connections = []tunnel.Connection{}
+	}
+	return res.Connections, err
+}
+
+func (c *Client) CloseConnection(ctx context.Context, tunnelID, connID string) (bool, error) {
+	res, err := c.inspect(ctx, MethodCloseConnection, TunnelParams{TunnelID: tunnelID, ConnID: connID})
+	return res.Found, err
+}
+
+func (c *Client) HTTPAccessLogs(ctx context.Context, tunnelID string, filter tunnel.AccessLogFilter) ([]tunnel.HTTPAccessLog, error) {
+	res, err := c.inspect(ctx, MethodAccessLogs, TunnelParams{TunnelID: tunnelID, Filter: &filter})
+	if res.Logs == nil {
+		res.Logs = []tunnel.HTTPAccessLog{}
+	}
+	return res.Logs, err
+}
+
+func (c *Client) inspect(ctx context.Context, method string, params TunnelParams) (res Inspection, err error) {
+	err = c.do(ctx, method, params, &res)
+	return res, err
+}
+
+// call posts params to an RPC method that returns no result.
+func (c *Client) call(ctx context.Context, method string, params any) error {
+	return c.do(ctx, method, params, nil)
+}
+
+// do posts params to an RPC method and decodes its result into out, if
+// not nil. Errors returned by the node come back as {"error": "..."} with a
+// non-2xx status.
+func (c *Client) do(ctx context.Context, method string, params any, out any) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url+"/rpc/"+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.token)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("edge %s: %w", method, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		if out != nil {
+			if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+				return fmt.Errorf("edge %s: %w", method, err)
+			}
+		}
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	var e struct {
+		Error string `json:"error"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&e)
+	if e.Error == "" {
+		e.Error = resp.Status
+	}
+	return fmt.Errorf("edge %s: %s", method, e.Error)
+}
@@ -0,0 +1,208 @@
+// Package edge connects tunnel servers in several regions to one central API,
+// the control plane.
+//
+// The control plane owns the database and decides which tunnels run where.
+// It pushes registrations to the edge node of a tunnel's region over a small
+// JSON RPC (POST <rpc_url>/rpc/<method>), which also serves live inspection
+// of tunnels. Edge nodes report their active tunnels, attached clients and
+// traffic back with a periodic heartbeat (POST <control_url>/api/edge/heartbeat)
+// and forward their tunnels' status events as they happen
+// (POST <control_url>/api/edge/events). Both directions authenticate with the
+// region's EDGE_TOKEN as a bearer token; the control plane only accepts
+// reports for the region a token is bound to.
+package edge
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"tunnel-api/internal/events"
+	"tunnel-api/internal/tunnel"
+)
+
+// RPC methods served by edge nodes.
+const (
+	MethodRegister   = "register"
+	MethodUnregister = "unregister"
+	MethodRename     = "rename"
+	MethodHostnames  = "hostnames"
+	MethodLimits     = "limits"
+	MethodMove       = "move"
+
+	// Live inspection of a tunnel, answered with an Inspection
+	MethodLatency         = "latency"
+	MethodCacheStats      = "cache_stats"
+	MethodPurgeCache      = "purge_cache"
+	MethodStats           = "stats"
+	MethodConnections     = "connections"
+	MethodCloseConnection = "close_connection"
+	MethodAccessLogs      = "access_logs"
+)
+
+// Node runs the tunnels of one region: the local tunnel server, or a remote
+// edge node reached over RPC.
+type Node interface {
+	Register(ctx context.Context, reg tunnel.TunnelRegistration) error
+	Unregister(ctx context.Context, tunnelID string) error
+	Rename(ctx context.Context, tunnelID, subdomain string) error
+	SetHostnames(ctx context.Context, tunnelID string, hostnames []string) error
+	SetLimits(ctx context.Context, tunnelID string, limits tunnel.TunnelLimits) error
+	Move(ctx context.Context, tunnelID string, target tunnel.MoveTarget) error
+}
+
+// Inspector reads the live state of a tunnel from the server its client is
+// attached to: the local tunnel server, or a remote edge node over RPC.
+type Inspector interface {
+	ClientLatency(ctx context.Context, tunnelID string) (tunnel.ClientLatency, bool, error)
+	HTTPCacheStats(ctx context.Context, tunnelID string) (tunnel.HTTPCacheStats, bool, error)
+	PurgeHTTPCache(ctx context.Context, tunnelID, prefix string) (int, error)
+	TunnelStats(ctx context.Context, tunnelID string) (tunnel.TunnelStats, error)
+	Connections(ctx context.Context, tunnelID string) ([]tunnel.Connection, error)
+	CloseConnection(ctx context.Context, tunnelID, connID string) (bool, error)
+	HTTPAccessLogs(ctx context.Context, tunnelID string, filter tunnel.AccessLogFilter) ([]tunnel.HTTPAccessLog, error)
+}
+
+// Params of the RPC methods other than register, which takes a
+// tunnel.TunnelRegistration.
+type TunnelParams struct {
+	TunnelID  string               `json:"tunnel_id"`
+	Subdomain string               `json:"subdomain,omitempty"` // rename
+	Hostnames []string             `json:"hostnames,omitempty"` // hostnames
+	Limits    *tunnel.TunnelLimits `json:"limits,omitempty"`    // limits
+	Target    *tunnel.MoveTarget   `json:"target,omitempty"`    // move
+
+	ConnID string                  `json:"conn_id,omitempty"` // close_connection
+	Prefix string                  `json:"prefix,omitempty"`  // purge_cache
+	Filter *tunnel.AccessLogFilter `json:"filter,omitempty"`  // access_logs
+}
+
+// Inspection is the result of an inspection method; only the field of the
+// method is set.
+type Inspection struct {
+	Found       bool                   `json:"found"` // latency, cache_stats, close_connection
+	Latency     *tunnel.ClientLatency  `json:"latency,omitempty"`
+	CacheStats  *tunnel.HTTPCacheStats `json:"cache_stats,omitempty"`
+	Purged      int                    `json:"purged,omitempty"`
+	Stats       *tunnel.TunnelStats    `json:"stats,omitempty"`
+	Connections []tunnel.Connection    `json:"connections,omitempty"`
+	Logs        []tunnel.HTTPAccessLog `json:"logs,omitempty"`
+}
+
+// Heartbeat is an edge node's periodic status report.
+type Heartbeat struct {
+	Region  string                       `json:"region"`
+	Domain  string                       `json:"domain"`
+	RPCURL  string                       `json:"rpc_url"`
+	MCPort  int                          `json:"mc_port"` // public Minecraft port, for redirects of moved tunnels
+	Tunnels []string                     `json:"tunnels"` // registered tunnel IDs
+	Clients map[string]tunnel.ClientInfo `json:"clients"` // tunnel ID → attached desktop app
+	Usage   []tunnel.UsageRecord         `json:"usage"`   // traffic since the last accepted heartbeat
+}
+
+// EventBatch carries status events of an edge node's tunnels to the control
+// plane, which publishes them to its own event streams. Owners are not sent:
+// the control plane looks them up.
+type EventBatch struct {
+	Region string         `json:"region"`
+	Events []events.Event `json:"events"`
+}
+
+// ParseTokens parses the control plane's EDGE_TOKENS, a "region=token,..."
+// list. Each token is bound to its region, so tokens must be distinct.
+func ParseTokens(s string) (map[string]string, error) {
+	tokens := make(map[string]string)
+	regions := make(map[string]string) // token → region
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		region, token, ok := strings.Cut(part, "=")
+		region, token = strings.TrimSpace(region), strings.TrimSpace(token)
+		if !ok || region == "" || token == "" {
+			return nil, fmt.Errorf("invalid edge token %q, expected region=token", part)
+		}
+		if _, dup := tokens[region]; dup {
+			return nil, fmt.Errorf("region %s has more than one token", region)
+		}
+		if other, dup := regions[token]; dup {
+			return nil, fmt.Errorf("regions %s and %s share a token", other, region)
+		}
+		tokens[region], regions[token] = token, region
+	}
+	return tokens, nil
+}
+
+// Authorized reports whether r carries "Authorization: Bearer <token>".
+func Authorized(r *http.Request, token string) bool {
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && token != "" && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// Local is the Node of the tunnel server running in this process.
+type Local struct {
+	Server *tunnel.Server
+}
+
+func (l Local) Register(_ context.Context, reg tunnel.TunnelRegistration) error {
+	l.Server.RegisterTunnel(reg)
+	return nil
+}
+
+func (l Local) Unregister(_ context.Context, tunnelID string) error {
+	l.Server.UnregisterTunnel(tunnelID)
+	return nil
+}
+
+func (l Local) Rename(_ context.Context, tunnelID, subdomain string) error {
+	l.Server.RenameTunnel(tunnelID, subdomain)
+	return nil
+}
+
+func (l Local) SetHostnames(_ context.Context, tunnelID string, hostnames []string) error {
+	l.Server.SetTunnelHostnames(tunnelID, hostnames)
+	return nil
+}
+
+func (l Local) SetLimits(_ context.Context, tunnelID string, limits tunnel.TunnelLimits) error {
+	l.Server.SetTunnelLimits(tunnelID, limits)
+	return nil
+}
+
+func (l Local) Move(_ context.Context, tunnelID string, target tunnel.MoveTarget) error {
+	l.Server.MoveTunnel(tunnelID, target)
+	return nil
+}
+
+func (l Local) ClientLatency(_ context.Context, tunnelID string) (tunnel.ClientLatency, bool, error) {
+	latency, ok := l.Server.ClientLatency(tunnelID)
+	return latency, ok, nil
+}
+
+func (l Local) HTTPCacheStats(_ context.Context, tunnelID string) (tunnel.HTTPCacheStats, bool, error) {
+	stats, ok := l.Server.HTTPCacheStats(tunnelID)
+	return stats, ok, nil
+}
+
+func (l Local) PurgeHTTPCache(_ context.Context, tunnelID, prefix string) (int, error) {
+	return l.Server.PurgeHTTPCache(tunnelID, prefix), nil
+}
+
+func (l Local) TunnelStats(_ context.Context, tunnelID string) (tunnel.TunnelStats, error) {
+	return l.Server.TunnelStats(tunnelID), nil
+}
+
+func (l Local) Connections(_ context.Context, tunnelID string) ([]tunnel.Connection, error) {
+	return l.Server.Connections(tunnelID), nil
+}
+
+func (l Local) CloseConnection(_ context.Context, tunnelID, connID string) (bool, error) {
+	return l.Server.CloseConnection(tunnelID, connID), nil
+}
+
+func (l Local) HTTPAccessLogs(_ context.Context, tunnelID string, filter tunnel.AccessLogFilter) ([]tunnel.HTTPAccessLog, error) {
+	return l.Server.HTTPAccessLogs(tunnelID, filter), nil
+}
@@ -0,0 +1,116 @@
+// Package events is an in-process publish/subscribe bus for tunnel status
+// changes. The tunnel server publishes, and API streams subscribe with a
+// filter (usually "events of this user's tunnels").
+//
+// Publishing never blocks: a subscriber that does not keep up loses events,
+// and the loss is counted so the stream can tell its client to re-sync.
+package events
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Event types.
+const (
+	ClientConnected    = "client.connected"
+	ClientDisconnected = "client.disconnected"
+	TunnelStarted      = "tunnel.started"
+	TunnelStopped      = "tunnel.stopped"
+	TunnelRenamed      = "tunnel.renamed"
+	TunnelMoved        = "tunnel.moved"
+	ConnectionOpened   = "connection.opened"
+	ConnectionClosed   = "connection.closed"
+	Usage              = "usage"
+)
+
+// Event is a status change of a tunnel. UserID is the tunnel's owner and is
+// used to scope streams; it is not sent to clients.
+type Event struct {
+	ID       uint64         `json:"id"`
+	Type     string         `json:"type"`
+	TunnelID string         `json:"tunnel_id"`
+	UserID   string         `json:"-"`
+	Time     time.Time      `json:"time"`
+	Data     map[string]any `json:"data,omitempty"`
+}
+
+// Bus fans events out to subscribers. A nil *Bus discards everything.
+type Bus struct {
+	seq  atomic.Uint64
+	mu   sync.RWMutex
+	subs map[*Subscription]struct{}
+}
+
+func NewBus() *Bus {
+	return &Bus{subs: make(map[*Subscription]struct{})}
+}
+
+// Publish stamps e with a sequence number and time and delivers it to every
+// matching subscriber.
+func (b *Bus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+	e.ID = b.seq.Add(1)
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for sub := range b.subs {
+		if sub.filter != nil && !sub.filter(e) {
+			continue
+		}
+		select {
+		case sub.ch <- e:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
+
+// Subscribe returns a subscription receiving the events accepted by filter
+// (all events if filter is nil). buffer is the number of events held for a
+// slow reader before new ones are dropped.
+func (b *Bus) Subscribe(filter func(Event) bool, buffer int) *Subscription {
+	if buffer <= 0 {
+		buffer = 64
+	}
+	sub := &Subscription{bus: b, filter: filter, ch: make(chan Event, buffer)}
+	b.mu.Lock()
+	b.subs[sub] = struct{}{}
+	b.mu.Unlock()
+	return sub
+}
+
+// Subscription is a filtered view of the bus.
+type Subscription struct {
+	bus     *Bus
+	filter  func(Event) bool
+	ch      chan Event
+	dropped atomic.Int64
+	once    sync.Once
+}
+
+// C delivers the events. It is closed by Close.
+func (s *Subscription) C() <-chan Event {
+	return s.ch
+}
+
+// Dropped returns the number of events lost because the buffer was full.
+func (s *Subscription) Dropped() int64 {
+	return s.dropped.Load()
+}
+
+// Close unsubscribes. It is safe to call more than once.
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		s.bus.mu.Lock()
+		delete(s.bus.subs, s)
+		s.bus.mu.Unlock()
+		close(s.ch)
+	})
+}
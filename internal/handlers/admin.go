@@ -0,0 +1,462 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"tunnel-api/internal/middleware"
+	"tunnel-api/internal/models"
+	"tunnel-api/internal/services"
+)
+
+const (
+	defaultAdminLimit = 50
+	maxAdminLimit     = 500
+)
+
+// AdminHandler serves /api/admin for support staff and admins. Access is
+// checked by middleware.RequireRole on the routes.
+type AdminHandler struct {
+	adminService  *services.AdminService
+	tunnelService *services.TunnelService
+	edgeService   *services.EdgeService
+}
+
+func NewAdminHandler(adminSvc *services.AdminService, tunnelSvc *services.TunnelService, edgeSvc *services.EdgeService) *AdminHandler {
+	return &AdminHandler{
+		adminService:  adminSvc,
+		tunnelService: tunnelSvc,
+		edgeService:   edgeSvc,
+	}
+}
+
+// GET /api/admin/users?q=&role=&disabled=&limit=&offset=
+func (h *AdminHandler) ListUsers(c *gin.Context) {
+	filter := services.UserFilter{Query: c.Query("q"), Role: c.Query("role")}
+	var ok bool
+	if filter.Limit, filter.Offset, ok = pageParams(c); !ok {
+		return
+	}
+	if filter.Disabled, ok = boolParam(c, "disabled"); !ok {
+		return
+	}
+
+	users, err := h.adminService.ListUsers(c.Request.Context(), filter)
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch users"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"users": users,
+		"count": len(users),
+	})
+}
+
+// GET /api/admin/users/:id
+func (h *AdminHandler) GetUser(c *gin.Context) {
+	userID, ok := idParam(c, "Invalid user ID")
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+
+	user, err := h.adminService.GetUser(ctx, userID)
+	if err != nil {
+		adminError(c, err, "Failed to fetch user")
+		return
+	}
+	tunnels, err := h.adminService.ListTunnels(ctx, services.TunnelFilter{UserID: &userID, Limit: maxAdminLimit})
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch tunnels"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"user":    user,
+		"tunnels": h.tunnelResponses(tunnels),
+	})
+}
+
+// GET /api/admin/tunnels?q=&user_id=&region=&active=&limit=&offset=
+//
+// q matches the name, subdomain or owner email.
+func (h *AdminHandler) ListTunnels(c *gin.Context) {
+	filter := services.TunnelFilter{Query: c.Query("q"), Region: c.Query("region")}
+	var ok bool
+	if filter.Limit, filter.Offset, ok = pageParams(c); !ok {
+		return
+	}
+	if filter.Active, ok = boolParam(c, "active"); !ok {
+		return
+	}
+	if v := c.Query("user_id"); v != "" {
+		userID, err := uuid.Parse(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user_id"})
+			return
+		}
+		filter.UserID = &userID
+	}
+
+	tunnels, err := h.adminService.ListTunnels(c.Request.Context(), filter)
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch tunnels"})
+		return
+	}
+	resp := h.tunnelResponses(tunnels)
+	c.JSON(http.StatusOK, gin.H{
+		"tunnels": resp,
+		"count":   len(resp),
+	})
+}
+
+// GET /api/admin/tunnels/:id
+//
+// Includes the owner's limits and, for active tunnels whose edge node can be
+// reached, the open player connections.
+func (h *AdminHandler) GetTunnel(c *gin.Context) {
+	tunnelID, ok := idParam(c, "Invalid tunnel ID")
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+
+	t, err := h.adminService.GetTunnel(ctx, tunnelID)
+	if err != nil {
+		adminError(c, err, "Failed to fetch tunnel")
+		return
+	}
+	limits, err := h.tunnelService.Limits(ctx, t.Tunnel)
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute limits"})
+		return
+	}
+
+	resp := gin.H{
+		"tunnel": h.tunnelResponse(t),
+		"limits": limits,
+	}
+	if t.IsActive {
+		// Best effort: the tunnel's edge node may be offline
+		if conns, err := h.tunnelService.Connections(ctx, t.Tunnel); err == nil {
+			resp["connections"] = conns
+		} else if !errors.Is(err, services.ErrRegionUnavailable) {
+			c.Error(err)
+		}
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// GET /api/admin/clients
+//
+// Lists the desktop apps attached in every region. For remote regions this is
+// the state of the edge nodes' last heartbeats.
+func (h *AdminHandler) Clients(c *gin.Context) {
+	clients := []models.AdminClient{}
+	for region, byTunnel := range h.edgeService.Clients() {
+		for tunnelID, info := range byTunnel {
+			clients = append(clients, models.AdminClient{
+				Region:         region,
+				TunnelID:       tunnelID,
+				ConnectedSince: info.ConnectedSince,
+				RemoteAddr:     info.RemoteAddr,
+				Version:        info.Version,
+				RTTMs:          info.RTTMs,
+			})
+		}
+	}
+	slices.SortFunc(clients, func(a, b models.AdminClient) int {
+		if r := strings.Compare(a.Region, b.Region); r != 0 {
+			return r
+		}
+		return strings.Compare(a.TunnelID, b.TunnelID)
+	})
+	c.JSON(http.StatusOK, gin.H{
+		"clients": clients,
+		"count":   len(clients),
+	})
+}
+
+// POST /api/admin/tunnels/:id/stop
+func (h *AdminHandler) StopTunnel(c *gin.Context) {
+	tunnelID, ok := idParam(c, "Invalid tunnel ID")
+	if !ok {
+		return
+	}
+	var req models.AdminReasonRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.adminService.StopTunnel(c.Request.Context(), actor(c), tunnelID, req.Reason); err != nil {
+		adminError(c, err, "Failed to stop tunnel")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Tunnel stopped"})
+}
+
+// POST /api/admin/tunnels/:id/suspend
+func (h *AdminHandler) SuspendTunnel(c *gin.Context) {
+	tunnelID, ok := idParam(c, "Invalid tunnel ID")
+	if !ok {
+		return
+	}
+	var req models.AdminReasonRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.adminService.SuspendTunnel(c.Request.Context(), actor(c), tunnelID, req.Reason); err != nil {
+		adminError(c, err, "Failed to suspend tunnel")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Tunnel suspended"})
+}
+
+// POST /api/admin/tunnels/:id/unsuspend
+func (h *AdminHandler) UnsuspendTunnel(c *gin.Context) {
+	tunnelID, ok := idParam(c, "Invalid tunnel ID")
+	if !ok {
+		return
+	}
+
+	if err := h.adminService.UnsuspendTunnel(c.Request.Context(), actor(c), tunnelID); err != nil {
+		adminError(c, err, "Failed to unsuspend tunnel")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Tunnel unsuspended"})
+}
+
+// POST /api/admin/users/:id/disable
+func (h *AdminHandler) DisableUser(c *gin.Context) {
+	userID, ok := idParam(c, "Invalid user ID")
+	if !ok {
+		return
+	}
+	var req models.AdminReasonRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.adminService.DisableUser(c.Request.Context(), actor(c), userID, req.Reason); err != nil {
+		adminError(c, err, "Failed to disable user")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "User disabled"})
+}
+
+// POST /api/admin/users/:id/enable
+func (h *AdminHandler) EnableUser(c *gin.Context) {
+	userID, ok := idParam(c, "Invalid user ID")
+	if !ok {
+		return
+	}
+
+	if err := h.adminService.EnableUser(c.Request.Context(), actor(c), userID); err != nil {
+		adminError(c, err, "Failed to enable user")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "User enabled"})
+}
+
+// POST /api/admin/users/:id/reset-2fa
+func (h *AdminHandler) ResetTOTP(c *gin.Context) {
+	userID, ok := idParam(c, "Invalid user ID")
+	if !ok {
+		return
+	}
+
+	if err := h.adminService.ResetTOTP(c.Request.Context(), actor(c), userID); err != nil {
+		adminError(c, err, "Failed to reset 2FA")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "2FA disabled"})
+}
+
+// PUT /api/admin/users/:id/limits
+func (h *AdminHandler) SetLimits(c *gin.Context) {
+	userID, ok := idParam(c, "Invalid user ID")
+	if !ok {
+		return
+	}
+	var req models.SetUserLimitsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ctx := c.Request.Context()
+
+	if err := h.adminService.SetLimits(ctx, actor(c), userID, req); err != nil {
+		adminError(c, err, "Failed to update limits")
+		return
+	}
+	user, err := h.adminService.GetUser(ctx, userID)
+	if err != nil {
+		adminError(c, err, "Failed to fetch user")
+		return
+	}
+	c.JSON(http.StatusOK, user)
+}
+
+// PUT /api/admin/users/:id/role
+func (h *AdminHandler) SetRole(c *gin.Context) {
+	userID, ok := idParam(c, "Invalid user ID")
+	if !ok {
+		return
+	}
+	var req models.SetUserRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.adminService.SetRole(c.Request.Context(), actor(c), userID, req.Role); err != nil {
+		adminError(c, err, "Failed to update role")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Role updated"})
+}
+
+// GET /api/admin/audit?target_id=&actor_id=&action=&before=&limit=
+//
+// Newest first; pass the lowest ID seen as before to page back.
+func (h *AdminHandler) AuditLog(c *gin.Context) {
+	filter := services.AuditFilter{Action: c.Query("action")}
+	var ok bool
+	if filter.Limit, _, ok = pageParams(c); !ok {
+		return
+	}
+	for param, dst := range map[string]**uuid.UUID{"target_id": &filter.TargetID, "actor_id": &filter.ActorID} {
+		if v := c.Query(param); v != "" {
+			id, err := uuid.Parse(v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + param})
+				return
+			}
+			*dst = &id
+		}
+	}
+	if v := c.Query("before"); v != "" {
+		before, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || before < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid before"})
+			return
+		}
+		filter.Before = before
+	}
+
+	entries, err := h.adminService.AuditLog(c.Request.Context(), filter)
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch audit log"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"entries": entries,
+		"count":   len(entries),
+	})
+}
+
+// ---- Helpers ----
+
+func (h *AdminHandler) tunnelResponse(t *services.OwnedTunnel) models.AdminTunnel {
+	return models.AdminTunnel{
+		TunnelResponse: tunnelResponse(h.edgeService, h.tunnelService, &t.Tunnel),
+		UserID:         t.UserID,
+		OwnerEmail:     t.OwnerEmail,
+		SuspendedAt:    t.SuspendedAt,
+	}
+}
+
+func (h *AdminHandler) tunnelResponses(tunnels []*services.OwnedTunnel) []models.AdminTunnel {
+	resp := []models.AdminTunnel{}
+	for _, t := range tunnels {
+		resp = append(resp, h.tunnelResponse(t))
+	}
+	return resp
+}
+
+// actor returns the support or admin user making the request.
+func actor(c *gin.Context) services.Actor {
+	userID, _ := middleware.GetUserID(c)
+	email, _ := middleware.GetUserEmail(c)
+	role, _ := middleware.GetUserRole(c)
+	return services.Actor{ID: userID, Email: email, Role: role}
+}
+
+// idParam parses the :id path parameter. On failure it writes msg as a 400 and returns ok=false.
+func idParam(c *gin.Context, msg string) (uuid.UUID, bool) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return id, false
+	}
+	return id, true
+}
+
+// pageParams parses ?limit= and ?offset=.
+func pageParams(c *gin.Context) (limit, offset int, ok bool) {
+	limit = defaultAdminLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return 0, 0, false
+		}
+		limit = min(n, maxAdminLimit)
+	}
+	if v := c.Query("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid offset"})
+			return 0, 0, false
+		}
+		offset = n
+	}
+	return limit, offset, true
+}
+
+// boolParam parses an optional true/false query parameter.
+func boolParam(c *gin.Context, name string) (*bool, bool) {
+	v := c.Query(name)
+	if v == "" {
+		return nil, true
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + name + " (expected true or false)"})
+		return nil, false
+	}
+	return &b, true
+}
+
+// adminError writes the response for an error of an AdminService call.
+func adminError(c *gin.Context, err error, msg string) {
+	switch {
+	case errors.Is(err, services.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+	case errors.Is(err, services.ErrSelfAction):
+		c.JSON(http.StatusForbidden, gin.H{"error": "You cannot disable or demote your own account"})
+	case errors.Is(err, services.ErrStaffTarget):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only admins can do this to support and admin accounts"})
+	case errors.Is(err, services.ErrTunnelNotActive):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Tunnel is not active"})
+	case errors.Is(err, services.ErrUnknownPlan):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown plan"})
+	default:
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
+	}
+}
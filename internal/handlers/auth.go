@@ -1,7 +1,6 @@
 package handlers
 
 import (
-	"context"
 	"net/http"
 	"strings"
 	"time"
@@ -48,12 +47,13 @@ func (h *AuthHandler) Register(c *gin.Context) {
 	// Hash password
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
 	if err != nil {
+		c.Error(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process password"})
 		return
 	}
 
 	// Insert user
-	ctx := context.Background()
+	ctx := c.Request.Context()
 	var userID uuid.UUID
 	err = database.Pool.QueryRow(ctx,
 		`INSERT INTO users (email, password_hash) VALUES ($1, $2) RETURNING id`,
@@ -65,6 +65,7 @@ func (h *AuthHandler) Register(c *gin.Context) {
 			c.JSON(http.StatusConflict, gin.H{"error": "Email already registered"})
 			return
 		}
+		c.Error(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
 		return
 	}
@@ -86,13 +87,13 @@ func (h *AuthHandler) Login(c *gin.Context) {
 	req.Email = strings.ToLower(strings.TrimSpace(req.Email))
 
 	// Get user from DB
-	ctx := context.Background()
+	ctx := c.Request.Context()
 	var user models.User
 	err := database.Pool.QueryRow(ctx,
-		`SELECT id, email, password_hash, totp_secret, totp_enabled, created_at, updated_at 
+		`SELECT id, email, password_hash, totp_secret, totp_enabled, role, disabled_at, created_at, updated_at 
 		 FROM users WHERE email = $1`,
 		req.Email,
-	).Scan(&user.ID, &user.Email, &user.PasswordHash, &user.TOTPSecret, &user.TOTPEnabled, &user.CreatedAt, &user.UpdatedAt)
+	).Scan(&user.ID, &user.Email, &user.PasswordHash, &user.TOTPSecret, &user.TOTPEnabled, &user.Role, &user.DisabledAt, &user.CreatedAt, &user.UpdatedAt)
 
 	if err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid email or password"})
@@ -105,6 +106,11 @@ func (h *AuthHandler) Login(c *gin.Context) {
 		return
 	}
 
+	if user.DisabledAt != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account disabled"})
+		return
+	}
+
 	// Check 2FA if enabled
 	if user.TOTPEnabled {
 		if req.TOTPCode == "" {
@@ -123,12 +129,14 @@ func (h *AuthHandler) Login(c *gin.Context) {
 	// Generate tokens
 	accessToken, err := h.jwtManager.GenerateAccessToken(user.ID, user.Email)
 	if err != nil {
+		c.Error(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
 	}
 
 	refreshToken, refreshHash, expiresAt, err := h.jwtManager.GenerateRefreshToken()
 	if err != nil {
+		c.Error(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate refresh token"})
 		return
 	}
@@ -139,6 +147,7 @@ func (h *AuthHandler) Login(c *gin.Context) {
 		user.ID, refreshHash, expiresAt,
 	)
 	if err != nil {
+		c.Error(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save session"})
 		return
 	}
@@ -160,7 +169,7 @@ func (h *AuthHandler) Refresh(c *gin.Context) {
 	}
 
 	tokenHash := h.jwtManager.HashToken(req.RefreshToken)
-	ctx := context.Background()
+	ctx := c.Request.Context()
 
 	// Find and validate refresh token
 	var userID uuid.UUID
@@ -186,24 +195,31 @@ func (h *AuthHandler) Refresh(c *gin.Context) {
 	// Get user
 	var user models.User
 	err = database.Pool.QueryRow(ctx,
-		`SELECT id, email, totp_enabled, created_at FROM users WHERE id = $1`,
+		`SELECT id, email, totp_enabled, role, disabled_at, created_at FROM users WHERE id = $1`,
 		userID,
-	).Scan(&user.ID, &user.Email, &user.TOTPEnabled, &user.CreatedAt)
+	).Scan(&user.ID, &user.Email, &user.TOTPEnabled, &user.Role, &user.DisabledAt, &user.CreatedAt)
 
 	if err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
 		return
 	}
 
+	if user.DisabledAt != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account disabled"})
+		return
+	}
+
 	// Generate new tokens
 	accessToken, err := h.jwtManager.GenerateAccessToken(user.ID, user.Email)
 	if err != nil {
+		c.Error(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
 	}
 
 	newRefreshToken, newRefreshHash, newExpiresAt, err := h.jwtManager.GenerateRefreshToken()
 	if err != nil {
+		c.Error(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate refresh token"})
 		return
 	}
@@ -226,13 +242,13 @@ func (h *AuthHandler) Refresh(c *gin.Context) {
 // GET /api/auth/me
 func (h *AuthHandler) Me(c *gin.Context) {
 	userID, _ := middleware.GetUserID(c)
-	ctx := context.Background()
+	ctx := c.Request.Context()
 
 	var user models.User
 	err := database.Pool.QueryRow(ctx,
-		`SELECT id, email, totp_enabled, created_at, updated_at FROM users WHERE id = $1`,
+		`SELECT id, email, totp_enabled, role, created_at, updated_at FROM users WHERE id = $1`,
 		userID,
-	).Scan(&user.ID, &user.Email, &user.TOTPEnabled, &user.CreatedAt, &user.UpdatedAt)
+	).Scan(&user.ID, &user.Email, &user.TOTPEnabled, &user.Role, &user.CreatedAt, &user.UpdatedAt)
 
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
@@ -251,7 +267,7 @@ func (h *AuthHandler) Logout(c *gin.Context) {
 	}
 
 	tokenHash := h.jwtManager.HashToken(req.RefreshToken)
-	ctx := context.Background()
+	ctx := c.Request.Context()
 
 	database.Pool.Exec(ctx, `DELETE FROM refresh_tokens WHERE token_hash = $1`, tokenHash)
 
@@ -269,7 +285,7 @@ func (h *AuthHandler) ForgotPassword(c *gin.Context) {
 	}
 
 	req.Email = strings.ToLower(strings.TrimSpace(req.Email))
-	ctx := context.Background()
+	ctx := c.Request.Context()
 
 	// Check if user exists
 	var userID uuid.UUID
@@ -287,6 +303,7 @@ func (h *AuthHandler) ForgotPassword(c *gin.Context) {
 	// Generate reset token
 	resetToken, tokenHash, expiresAt, err := h.jwtManager.GenerateRefreshToken()
 	if err != nil {
+		c.Error(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate reset token"})
 		return
 	}
@@ -301,6 +318,7 @@ func (h *AuthHandler) ForgotPassword(c *gin.Context) {
 		userID, tokenHash, expiresAt,
 	)
 	if err != nil {
+		c.Error(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save reset token"})
 		return
 	}
@@ -328,7 +346,7 @@ func (h *AuthHandler) ResetPassword(c *gin.Context) {
 	}
 
 	tokenHash := h.jwtManager.HashToken(req.Token)
-	ctx := context.Background()
+	ctx := c.Request.Context()
 
 	// Find and validate reset token
 	var tokenID uuid.UUID
@@ -359,6 +377,7 @@ func (h *AuthHandler) ResetPassword(c *gin.Context) {
 	// Hash new password
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
 	if err != nil {
+		c.Error(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process password"})
 		return
 	}
@@ -369,6 +388,7 @@ func (h *AuthHandler) ResetPassword(c *gin.Context) {
 		string(hashedPassword), userID,
 	)
 	if err != nil {
+		c.Error(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update password"})
 		return
 	}
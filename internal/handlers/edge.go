@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"tunnel-api/internal/edge"
+	"tunnel-api/internal/events"
+	"tunnel-api/internal/services"
+)
+
+// EdgeHandler serves the control plane side of the edge node protocol and
+// the list of regions users can create tunnels in.
+type EdgeHandler struct {
+	edgeService   *services.EdgeService
+	tunnelService *services.TunnelService
+	domainService *services.DomainService
+	usageService  *services.UsageService
+	bus           *events.Bus
+}
+
+func NewEdgeHandler(edgeSvc *services.EdgeService, tunnelSvc *services.TunnelService, domainSvc *services.DomainService, usageSvc *services.UsageService, bus *events.Bus) *EdgeHandler {
+	return &EdgeHandler{
+		edgeService:   edgeSvc,
+		tunnelService: tunnelSvc,
+		domainService: domainSvc,
+		usageService:  usageSvc,
+		bus:           bus,
+	}
+}
+
+// GET /api/regions
+func (h *EdgeHandler) Regions(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"regions": h.edgeService.Regions()})
+}
+
+// authorized checks the edge node's bearer token and returns the region it
+// is bound to. On failure it writes the error response and returns false.
+func (h *EdgeHandler) authorized(c *gin.Context) (region string, ok bool) {
+	region, ok = h.edgeService.AuthorizedRegion(c.Request)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid edge token"})
+	}
+	return region, ok
+}
+
+// POST /api/edge/heartbeat
+// Records an edge node's status and traffic, then reconciles its tunnels
+// with the database in the background.
+func (h *EdgeHandler) Heartbeat(c *gin.Context) {
+	region, ok := h.authorized(c)
+	if !ok {
+		return
+	}
+
+	var hb edge.Heartbeat
+	if err := c.ShouldBindJSON(&hb); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	if hb.Region != region {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Edge token is not valid for region " + hb.Region})
+		return
+	}
+	// Usage first: on failure the node sends it again with the next heartbeat
+	if _, err := h.usageService.AddFromRegion(c.Request.Context(), region, hb.Usage); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record usage"})
+		return
+	}
+	if err := h.edgeService.Heartbeat(c.Request.Context(), hb); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	go h.tunnelService.SyncEdge(context.Background(), hb.Region, hb.Tunnels)
+
+	c.Status(http.StatusNoContent)
+}
+
+// POST /api/edge/events
+// Publishes an edge node's tunnel events to the API's event streams. Events
+// of tunnels outside the node's region are dropped; owners come from the
+// database, not from the node.
+func (h *EdgeHandler) Events(c *gin.Context) {
+	region, ok := h.authorized(c)
+	if !ok {
+		return
+	}
+
+	var batch edge.EventBatch
+	if err := c.ShouldBindJSON(&batch); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	if batch.Region != region {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Edge token is not valid for region " + batch.Region})
+		return
+	}
+
+	var ids []uuid.UUID
+	for _, e := range batch.Events {
+		if id, err := uuid.Parse(e.TunnelID); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	owners, err := services.RegionTunnelOwners(c.Request.Context(), region, ids)
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up tunnels"})
+		return
+	}
+	for _, e := range batch.Events {
+		owner, ok := owners[e.TunnelID]
+		if !ok {
+			continue
+		}
+		e.ID, e.UserID = 0, owner
+		h.bus.Publish(e)
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// GET /api/edge/challenges?tunnel_id=
+// Custom domain challenges of a tunnel, for the edge node's DNS server.
+func (h *EdgeHandler) Challenges(c *gin.Context) {
+	if _, ok := h.authorized(c); !ok {
+		return
+	}
+
+	tunnelID, err := uuid.Parse(c.Query("tunnel_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tunnel ID"})
+		return
+	}
+	challenges, err := h.domainService.Challenges(c.Request.Context(), tunnelID.String())
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch challenges"})
+		return
+	}
+	if challenges == nil {
+		challenges = []string{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"challenges": challenges})
+}
@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"tunnel-api/internal/events"
+	"tunnel-api/internal/middleware"
+)
+
+const (
+	eventsHeartbeat = 15 * time.Second
+	eventsBuffer    = 256
+)
+
+type EventsHandler struct {
+	bus *events.Bus
+}
+
+func NewEventsHandler(bus *events.Bus) *EventsHandler {
+	return &EventsHandler{bus: bus}
+}
+
+// GET /api/events
+// Streams status events of the current user's tunnels as server-sent events.
+// ?tunnel_id= narrows the stream to one tunnel.
+func (h *EventsHandler) Stream(c *gin.Context) {
+	userID, _ := middleware.GetUserID(c)
+	owner := userID.String()
+
+	tunnelID := c.Query("tunnel_id")
+	if tunnelID != "" {
+		if _, err := uuid.Parse(tunnelID); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tunnel ID"})
+			return
+		}
+	}
+
+	sub := h.bus.Subscribe(func(e events.Event) bool {
+		return e.UserID == owner && (tunnelID == "" || e.TunnelID == tunnelID)
+	}, eventsBuffer)
+	defer sub.Close()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no") // no proxy buffering (nginx)
+	c.Status(http.StatusOK)
+	fmt.Fprint(c.Writer, "retry: 3000\n\n")
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+
+	var reported int64
+	for {
+		var err error
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(c.Writer, ": ping\n\n")
+		case e := <-sub.C():
+			// Tell the app it missed events so it can re-sync with GET /api/tunnels
+			if dropped := sub.Dropped(); dropped > reported {
+				err = writeSSE(c.Writer, "", "dropped", gin.H{"count": dropped - reported})
+				reported = dropped
+			}
+			if err == nil {
+				err = writeSSE(c.Writer, strconv.FormatUint(e.ID, 10), e.Type, e)
+			}
+		}
+		if err != nil {
+			return
+		}
+		c.Writer.Flush()
+	}
+}
+
+// writeSSE writes one server-sent event with a JSON payload.
+func writeSSE(w io.Writer, id, event string, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if id != "" {
+		if _, err := fmt.Fprintf(w, "id: %s\n", id); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+	return err
+}
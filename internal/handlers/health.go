@@ -28,6 +28,10 @@ func (h *HealthHandler) Health(c *gin.Context) {
 	if !dbOK {
 		status = "unhealthy"
 		httpStatus = http.StatusServiceUnavailable
+	} else if h.tunnelService.Draining() {
+		// Take the node out of the load balancer while it drains
+		status = "draining"
+		httpStatus = http.StatusServiceUnavailable
 	}
 
 	c.JSON(httpStatus, gin.H{
@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"tunnel-api/internal/services"
+)
+
+// GET /api/subdomains/check?name=
+func (h *TunnelHandler) CheckSubdomain(c *gin.Context) {
+	subdomain := services.Normalize(c.Query("name"))
+
+	err := h.subdomainService.Check(c.Request.Context(), subdomain)
+	var subErr *services.SubdomainError
+	switch {
+	case err == nil:
+		c.JSON(http.StatusOK, gin.H{"subdomain": subdomain, "available": true})
+	case errors.As(err, &subErr):
+		c.JSON(http.StatusOK, gin.H{
+			"subdomain": subdomain,
+			"available": false,
+			"reason":    subErr.Reason,
+			"message":   subErr.Message,
+		})
+	default:
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check subdomain"})
+	}
+}
+
+// subdomainErrorResponse writes a 400 for a subdomain rejected by Validate.
+func subdomainErrorResponse(c *gin.Context, err error) {
+	var subErr *services.SubdomainError
+	if errors.As(err, &subErr) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": subErr.Message, "reason": subErr.Reason})
+		return
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+}
@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GET /api/tunnels/:id/cache
+func (h *TunnelHandler) CacheStats(c *gin.Context) {
+	t, ok := h.findUserTunnel(c)
+	if !ok {
+		return
+	}
+
+	stats, enabled, err := h.tunnelService.HTTPCacheStats(c.Request.Context(), t)
+	if err != nil {
+		inspectFailed(c, t, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"enabled": enabled,
+		"stats":   stats,
+	})
+}
+
+// DELETE /api/tunnels/:id/cache?prefix=/tiles/
+func (h *TunnelHandler) PurgeCache(c *gin.Context) {
+	t, ok := h.findUserTunnel(c)
+	if !ok {
+		return
+	}
+
+	ctx := c.Request.Context()
+	_, enabled, err := h.tunnelService.HTTPCacheStats(ctx, t)
+	if err != nil {
+		inspectFailed(c, t, err)
+		return
+	}
+	if !enabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "HTTP cache is not active for this tunnel"})
+		return
+	}
+
+	removed, err := h.tunnelService.PurgeHTTPCache(ctx, t, c.Query("prefix"))
+	if err != nil {
+		inspectFailed(c, t, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Cache invalidated",
+		"removed": removed,
+	})
+}
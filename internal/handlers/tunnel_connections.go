@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GET /api/tunnels/:id/connections
+func (h *TunnelHandler) Connections(c *gin.Context) {
+	t, ok := h.findUserTunnel(c)
+	if !ok {
+		return
+	}
+
+	conns, err := h.tunnelService.Connections(c.Request.Context(), t)
+	if err != nil {
+		inspectFailed(c, t, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"connections": conns,
+		"count":       len(conns),
+	})
+}
+
+// DELETE /api/tunnels/:id/connections/:conn_id
+func (h *TunnelHandler) CloseConnection(c *gin.Context) {
+	t, ok := h.findUserTunnel(c)
+	if !ok {
+		return
+	}
+
+	closed, err := h.tunnelService.CloseConnection(c.Request.Context(), t, c.Param("conn_id"))
+	if err != nil {
+		inspectFailed(c, t, err)
+		return
+	}
+	if !closed {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Connection not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Connection closed"})
+}
@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"tunnel-api/internal/database"
+	"tunnel-api/internal/models"
+	"tunnel-api/internal/services"
+)
+
+// GET /api/tunnels/:id/domains
+func (h *TunnelHandler) ListDomains(c *gin.Context) {
+	t, ok := h.findUserTunnel(c)
+	if !ok {
+		return
+	}
+
+	rows, err := database.Pool.Query(c.Request.Context(),
+		`SELECT `+models.CustomDomainColumns+` FROM tunnel_domains WHERE tunnel_id = $1 ORDER BY created_at`, t.ID)
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch custom domains"})
+		return
+	}
+	defer rows.Close()
+
+	domains := []models.CustomDomainResponse{}
+	for rows.Next() {
+		var cd models.CustomDomain
+		if err := rows.Scan(cd.ScanFields()...); err != nil {
+			c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch custom domains"})
+			return
+		}
+		domains = append(domains, h.domainService.Response(&cd, t))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"domains": domains,
+		"count":   len(domains),
+		"limit":   h.config.MaxCustomDomains,
+	})
+}
+
+// POST /api/tunnels/:id/domains
+func (h *TunnelHandler) AddDomain(c *gin.Context) {
+	var req models.AddCustomDomainRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+
+	hostname := services.NormalizeHostname(req.Hostname)
+	if err := h.domainService.ValidateHostname(hostname); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	t, ok := h.findUserTunnel(c)
+	if !ok {
+		return
+	}
+
+	ctx := c.Request.Context()
+
+	var count int
+	if err := database.Pool.QueryRow(ctx,
+		`SELECT COUNT(*) FROM tunnel_domains WHERE tunnel_id = $1`, t.ID,
+	).Scan(&count); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check custom domain limit"})
+		return
+	}
+	if count >= h.config.MaxCustomDomains {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": fmt.Sprintf("Custom domain limit reached (%d/%d)", count, h.config.MaxCustomDomains),
+		})
+		return
+	}
+
+	token, err := services.NewToken()
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add custom domain"})
+		return
+	}
+
+	cd := models.CustomDomain{TunnelID: t.ID, Hostname: hostname, Token: token}
+	err = database.Pool.QueryRow(ctx,
+		`INSERT INTO tunnel_domains (tunnel_id, hostname, token)
+		 VALUES ($1, $2, $3)
+		 RETURNING id, created_at`,
+		cd.TunnelID, cd.Hostname, cd.Token,
+	).Scan(&cd.ID, &cd.CreatedAt)
+	if err != nil {
+		if database.IsUniqueViolation(err, "tunnel_domains_tunnel_id_hostname_key") {
+			c.JSON(http.StatusConflict, gin.H{"error": "This hostname is already added to the tunnel"})
+			return
+		}
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add custom domain"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, h.domainService.Response(&cd, t))
+}
+
+// GET /api/tunnels/:id/domains/:domain_id
+func (h *TunnelHandler) GetDomain(c *gin.Context) {
+	t, cd, ok := h.findDomain(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, h.domainService.Response(&cd, t))
+}
+
+// POST /api/tunnels/:id/domains/:domain_id/verify
+func (h *TunnelHandler) VerifyDomain(c *gin.Context) {
+	t, cd, ok := h.findDomain(c)
+	if !ok {
+		return
+	}
+
+	if err := h.domainService.Verify(c.Request.Context(), &cd); err != nil {
+		if errors.Is(err, services.ErrDomainClaimed) {
+			c.JSON(http.StatusConflict, gin.H{"error": "This hostname is already verified by another tunnel"})
+			return
+		}
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify custom domain"})
+		return
+	}
+
+	c.JSON(http.StatusOK, h.domainService.Response(&cd, t))
+}
+
+// DELETE /api/tunnels/:id/domains/:domain_id
+func (h *TunnelHandler) DeleteDomain(c *gin.Context) {
+	t, cd, ok := h.findDomain(c)
+	if !ok {
+		return
+	}
+
+	ctx := c.Request.Context()
+	if _, err := database.Pool.Exec(ctx, `DELETE FROM tunnel_domains WHERE id = $1`, cd.ID); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete custom domain"})
+		return
+	}
+	if cd.Verified {
+		if err := h.domainService.SyncRouting(ctx, t.ID); err != nil {
+			c.Error(err)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Custom domain deleted"})
+}
+
+// findDomain loads the :domain_id custom domain of the current user's :id tunnel.
+// On failure it writes the error response and returns ok=false.
+func (h *TunnelHandler) findDomain(c *gin.Context) (t models.Tunnel, cd models.CustomDomain, ok bool) {
+	domainID, err := uuid.Parse(c.Param("domain_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid custom domain ID"})
+		return t, cd, false
+	}
+
+	t, ok = h.findUserTunnel(c)
+	if !ok {
+		return t, cd, false
+	}
+
+	err = database.Pool.QueryRow(c.Request.Context(),
+		`SELECT `+models.CustomDomainColumns+` FROM tunnel_domains WHERE id = $1 AND tunnel_id = $2`,
+		domainID, t.ID,
+	).Scan(cd.ScanFields()...)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Custom domain not found"})
+		return t, cd, false
+	}
+	return t, cd, true
+}
@@ -0,0 +1,28 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GET /api/tunnels/:id/latency
+func (h *TunnelHandler) Latency(c *gin.Context) {
+	t, ok := h.findUserTunnel(c)
+	if !ok {
+		return
+	}
+
+	latency, connected, err := h.tunnelService.ClientLatency(c.Request.Context(), t)
+	if err != nil {
+		inspectFailed(c, t, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"client_connected": connected,
+		"samples":          latency.Samples,
+		"min_ms":           latency.MinMs,
+		"avg_ms":           latency.AvgMs,
+		"max_ms":           latency.MaxMs,
+	})
+}
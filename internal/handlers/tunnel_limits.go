@@ -0,0 +1,27 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GET /api/tunnels/:id/limits
+//
+// Bandwidth limits of the tunnel and the owner's monthly transfer against the
+// plan's cap. state is ok, throttled or suspended.
+func (h *TunnelHandler) Limits(c *gin.Context) {
+	t, ok := h.findUserTunnel(c)
+	if !ok {
+		return
+	}
+
+	limits, err := h.tunnelService.Limits(c.Request.Context(), t)
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch limits"})
+		return
+	}
+
+	c.JSON(http.StatusOK, limits)
+}
@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"tunnel-api/internal/tunnel"
+)
+
+const (
+	defaultLogLimit = 100
+	maxLogLimit     = 1000
+)
+
+// GET /api/tunnels/:id/logs/http?since=&until=&method=&path=&ip=&status=&limit=
+//
+// status accepts an exact code ("404") or a class ("5xx").
+// since/until are RFC 3339 timestamps.
+func (h *TunnelHandler) HTTPLogs(c *gin.Context) {
+	t, ok := h.findUserTunnel(c)
+	if !ok {
+		return
+	}
+
+	filter := tunnel.AccessLogFilter{
+		Method:     c.Query("method"),
+		PathPrefix: c.Query("path"),
+		ClientIP:   c.Query("ip"),
+		Limit:      defaultLogLimit,
+	}
+
+	for param, dst := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if v := c.Query(param); v != "" {
+			ts, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + param + " (expected RFC 3339 timestamp)"})
+				return
+			}
+			*dst = ts
+		}
+	}
+
+	if v := c.Query("status"); v != "" {
+		if len(v) == 3 && strings.HasSuffix(strings.ToLower(v), "xx") && v[0] >= '1' && v[0] <= '5' {
+			class := int(v[0]-'0') * 100
+			filter.StatusMin, filter.StatusMax = class, class+99
+		} else if code, err := strconv.Atoi(v); err == nil {
+			filter.StatusMin, filter.StatusMax = code, code
+		} else {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status filter"})
+			return
+		}
+	}
+
+	if v := c.Query("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return
+		}
+		if limit > maxLogLimit {
+			limit = maxLogLimit
+		}
+		filter.Limit = limit
+	}
+
+	logs, err := h.tunnelService.HTTPAccessLogs(c.Request.Context(), t, filter)
+	if err != nil {
+		inspectFailed(c, t, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"logs":  logs,
+		"count": len(logs),
+	})
+}
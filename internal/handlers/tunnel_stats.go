@@ -0,0 +1,22 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GET /api/tunnels/:id/stats
+func (h *TunnelHandler) Stats(c *gin.Context) {
+	t, ok := h.findUserTunnel(c)
+	if !ok {
+		return
+	}
+
+	stats, err := h.tunnelService.TunnelStats(c.Request.Context(), t)
+	if err != nil {
+		inspectFailed(c, t, err)
+		return
+	}
+	c.JSON(http.StatusOK, stats)
+}
@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"tunnel-api/internal/database"
+	"tunnel-api/internal/models"
+)
+
+// GET /api/tunnels/:id/udp
+func (h *TunnelHandler) ListUDPMappings(c *gin.Context) {
+	t, ok := h.findUserTunnel(c)
+	if !ok {
+		return
+	}
+
+	if err := h.tunnelService.LoadUDPMappings(c.Request.Context(), &t); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch UDP mappings"})
+		return
+	}
+
+	resp := t.ToResponse(h.edgeService.Domain(t.Region))
+	c.JSON(http.StatusOK, gin.H{
+		"udp_mappings": resp.UDPMappings,
+		"count":        len(resp.UDPMappings),
+		"limit":        h.config.MaxUDPMappings,
+	})
+}
+
+// POST /api/tunnels/:id/udp
+func (h *TunnelHandler) CreateUDPMapping(c *gin.Context) {
+	var req models.CreateUDPMappingRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+
+	t, ok := h.findUserTunnel(c)
+	if !ok {
+		return
+	}
+	if t.IsActive {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Stop the tunnel before editing it"})
+		return
+	}
+
+	ctx := c.Request.Context()
+
+	var count int
+	if err := database.Pool.QueryRow(ctx,
+		`SELECT COUNT(*) FROM tunnel_udp_mappings WHERE tunnel_id = $1`, t.ID,
+	).Scan(&count); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check UDP mapping limit"})
+		return
+	}
+	if count >= h.config.MaxUDPMappings {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": fmt.Sprintf("UDP mapping limit reached (%d/%d)", count, h.config.MaxUDPMappings),
+		})
+		return
+	}
+
+	port, err := h.allocateUDPPort(ctx)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "No available UDP ports"})
+		return
+	}
+
+	m := models.UDPMapping{
+		TunnelID:   t.ID,
+		Label:      req.Label,
+		LocalPort:  req.LocalPort,
+		PublicPort: port,
+		Enabled:    req.Enabled == nil || *req.Enabled,
+	}
+	err = database.Pool.QueryRow(ctx,
+		`INSERT INTO tunnel_udp_mappings (tunnel_id, label, local_port, public_port, enabled)
+		 VALUES ($1, $2, $3, $4, $5)
+		 RETURNING id, created_at`,
+		m.TunnelID, m.Label, m.LocalPort, m.PublicPort, m.Enabled,
+	).Scan(&m.ID, &m.CreatedAt)
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create UDP mapping"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, m.ToResponse(t.Subdomain+"."+h.edgeService.Domain(t.Region)))
+}
+
+// PATCH /api/tunnels/:id/udp/:mapping_id
+func (h *TunnelHandler) UpdateUDPMapping(c *gin.Context) {
+	var req models.UpdateUDPMappingRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+
+	t, m, ok := h.findUDPMapping(c)
+	if !ok {
+		return
+	}
+	if t.IsActive {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Stop the tunnel before editing it"})
+		return
+	}
+
+	// Apply only provided fields
+	if req.Label != nil {
+		if len(*req.Label) < 1 || len(*req.Label) > 50 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Label must be 1-50 characters"})
+			return
+		}
+		m.Label = *req.Label
+	}
+	if req.LocalPort != nil {
+		if *req.LocalPort < 1 || *req.LocalPort > 65535 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Local port must be 1-65535"})
+			return
+		}
+		m.LocalPort = *req.LocalPort
+	}
+	if req.Enabled != nil {
+		m.Enabled = *req.Enabled
+	}
+
+	_, err := database.Pool.Exec(c.Request.Context(),
+		`UPDATE tunnel_udp_mappings SET label=$1, local_port=$2, enabled=$3 WHERE id = $4`,
+		m.Label, m.LocalPort, m.Enabled, m.ID,
+	)
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update UDP mapping"})
+		return
+	}
+
+	c.JSON(http.StatusOK, m.ToResponse(t.Subdomain+"."+h.edgeService.Domain(t.Region)))
+}
+
+// DELETE /api/tunnels/:id/udp/:mapping_id
+func (h *TunnelHandler) DeleteUDPMapping(c *gin.Context) {
+	t, m, ok := h.findUDPMapping(c)
+	if !ok {
+		return
+	}
+	if t.IsActive {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Stop the tunnel before editing it"})
+		return
+	}
+
+	_, err := database.Pool.Exec(c.Request.Context(),
+		`DELETE FROM tunnel_udp_mappings WHERE id = $1`, m.ID,
+	)
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete UDP mapping"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "UDP mapping deleted"})
+}
+
+// findUDPMapping loads the :mapping_id UDP mapping of the current user's :id tunnel.
+// On failure it writes the error response and returns ok=false.
+func (h *TunnelHandler) findUDPMapping(c *gin.Context) (t models.Tunnel, m models.UDPMapping, ok bool) {
+	mappingID, err := uuid.Parse(c.Param("mapping_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid UDP mapping ID"})
+		return t, m, false
+	}
+
+	t, ok = h.findUserTunnel(c)
+	if !ok {
+		return t, m, false
+	}
+
+	err = database.Pool.QueryRow(c.Request.Context(),
+		`SELECT `+models.UDPMappingColumns+` FROM tunnel_udp_mappings WHERE id = $1 AND tunnel_id = $2`,
+		mappingID, t.ID,
+	).Scan(m.ScanFields()...)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "UDP mapping not found"})
+		return t, m, false
+	}
+	return t, m, true
+}
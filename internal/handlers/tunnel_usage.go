@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"tunnel-api/internal/database"
+	"tunnel-api/internal/models"
+)
+
+// usageRanges maps each granularity to the default range queried when from is omitted.
+var usageRanges = map[string]time.Duration{
+	"hour":  24 * time.Hour,
+	"day":   30 * 24 * time.Hour,
+	"month": 365 * 24 * time.Hour,
+}
+
+// GET /api/tunnels/:id/usage?from=&to=&granularity=hour|day|month
+//
+// from/to are RFC 3339 timestamps; to defaults to now and from to a range
+// matching the granularity (24h, 30d or 365d).
+func (h *TunnelHandler) Usage(c *gin.Context) {
+	t, ok := h.findUserTunnel(c)
+	if !ok {
+		return
+	}
+
+	granularity := c.DefaultQuery("granularity", "hour")
+	window, ok := usageRanges[granularity]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid granularity (expected hour, day or month)"})
+		return
+	}
+
+	to := time.Now().UTC()
+	from := time.Time{}
+	for param, dst := range map[string]*time.Time{"from": &from, "to": &to} {
+		if v := c.Query(param); v != "" {
+			ts, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + param + " (expected RFC 3339 timestamp)"})
+				return
+			}
+			*dst = ts.UTC()
+		}
+	}
+	if from.IsZero() {
+		from = to.Add(-window)
+	}
+	if !from.Before(to) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must be before to"})
+		return
+	}
+
+	rows, err := database.Pool.Query(c.Request.Context(),
+		`SELECT date_trunc($1, bucket) AS t, channel,
+		        SUM(bytes_in)::BIGINT, SUM(bytes_out)::BIGINT, SUM(connections)::BIGINT,
+		        SUM(bytes_saved)::BIGINT
+		 FROM tunnel_usage
+		 WHERE tunnel_id = $2 AND bucket >= date_trunc('hour', $3::TIMESTAMP) AND bucket < $4
+		 GROUP BY t, channel ORDER BY t`,
+		granularity, t.ID, from, to,
+	)
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch usage"})
+		return
+	}
+	defer rows.Close()
+
+	resp := models.UsageResponse{
+		From:        from,
+		To:          to,
+		Granularity: granularity,
+		Buckets:     []models.UsageBucket{},
+		Channels:    map[string]models.UsageCounters{},
+	}
+	for rows.Next() {
+		var ts time.Time
+		var channel string
+		var u models.UsageCounters
+		if err := rows.Scan(&ts, &channel, &u.BytesIn, &u.BytesOut, &u.Connections, &u.BytesSaved); err != nil {
+			c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch usage"})
+			return
+		}
+
+		if n := len(resp.Buckets); n == 0 || !resp.Buckets[n-1].Time.Equal(ts) {
+			resp.Buckets = append(resp.Buckets, models.UsageBucket{Time: ts, Channels: map[string]models.UsageCounters{}})
+		}
+		b := &resp.Buckets[len(resp.Buckets)-1]
+		b.Channels[channel] = u
+		b.Total.Add(u)
+
+		total := resp.Channels[channel]
+		total.Add(u)
+		resp.Channels[channel] = total
+		resp.Total.Add(u)
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
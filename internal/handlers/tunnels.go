@@ -2,11 +2,14 @@ package handlers
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"slices"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 
 	"tunnel-api/internal/config"
 	"tunnel-api/internal/database"
@@ -19,45 +22,56 @@ type TunnelHandler struct {
 	config           *config.Config
 	subdomainService *services.SubdomainService
 	tunnelService    *services.TunnelService
+	domainService    *services.DomainService
+	edgeService      *services.EdgeService
 }
 
-func NewTunnelHandler(cfg *config.Config, subdomainSvc *services.SubdomainService, tunnelSvc *services.TunnelService) *TunnelHandler {
+func NewTunnelHandler(cfg *config.Config, subdomainSvc *services.SubdomainService, tunnelSvc *services.TunnelService, domainSvc *services.DomainService, edgeSvc *services.EdgeService) *TunnelHandler {
 	return &TunnelHandler{
 		config:           cfg,
 		subdomainService: subdomainSvc,
 		tunnelService:    tunnelSvc,
+		domainService:    domainSvc,
+		edgeService:      edgeSvc,
 	}
 }
 
 // GET /api/tunnels
 func (h *TunnelHandler) List(c *gin.Context) {
 	userID, _ := middleware.GetUserID(c)
-	ctx := context.Background()
+	ctx := c.Request.Context()
 
 	rows, err := database.Pool.Query(ctx,
-		`SELECT id, user_id, name, subdomain, region, is_active,
-		        mc_local_port, http_local_port, udp_local_port, udp_public_port,
-		        created_at, updated_at
+		`SELECT `+models.TunnelColumns+`
 		 FROM tunnels WHERE user_id = $1 ORDER BY created_at DESC`,
 		userID,
 	)
 	if err != nil {
+		c.Error(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch tunnels"})
 		return
 	}
 	defer rows.Close()
 
-	tunnels := []models.TunnelResponse{}
+	var list []*models.Tunnel
 	for rows.Next() {
 		var t models.Tunnel
-		if err := rows.Scan(
-			&t.ID, &t.UserID, &t.Name, &t.Subdomain, &t.Region, &t.IsActive,
-			&t.MCLocalPort, &t.HTTPLocalPort, &t.UDPLocalPort, &t.UDPPublicPort,
-			&t.CreatedAt, &t.UpdatedAt,
-		); err != nil {
+		if err := rows.Scan(t.ScanFields()...); err != nil {
 			continue
 		}
-		tunnels = append(tunnels, t.ToResponse(h.config.Domain))
+		list = append(list, &t)
+	}
+	rows.Close()
+
+	if err := h.tunnelService.LoadUDPMappings(ctx, list...); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch UDP mappings"})
+		return
+	}
+
+	tunnels := []models.TunnelResponse{}
+	for _, t := range list {
+		tunnels = append(tunnels, h.tunnelResponse(t))
 	}
 
 	c.JSON(http.StatusOK, models.TunnelListResponse{
@@ -75,7 +89,21 @@ func (h *TunnelHandler) Create(c *gin.Context) {
 		return
 	}
 
+	if len(req.UDPMappings) > h.config.MaxUDPMappings {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("At most %d extra UDP mappings are allowed", h.config.MaxUDPMappings),
+		})
+		return
+	}
+
 	// Apply defaults
+	if req.Region == "" {
+		req.Region = h.config.Region
+	}
+	if _, err := h.edgeService.Node(req.Region); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Region " + req.Region + " is not available"})
+		return
+	}
 	if req.MCLocalPort == 0 {
 		req.MCLocalPort = 25565
 	}
@@ -84,13 +112,14 @@ func (h *TunnelHandler) Create(c *gin.Context) {
 	}
 
 	userID, _ := middleware.GetUserID(c)
-	ctx := context.Background()
+	ctx := c.Request.Context()
 
 	// Check tunnel limit
 	var count int
 	if err := database.Pool.QueryRow(ctx,
 		`SELECT COUNT(*) FROM tunnels WHERE user_id = $1`, userID,
 	).Scan(&count); err != nil {
+		c.Error(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check tunnel limit"})
 		return
 	}
@@ -101,10 +130,16 @@ func (h *TunnelHandler) Create(c *gin.Context) {
 		return
 	}
 
-	// Generate unique subdomain
-	var subdomain string
+	// Use the requested subdomain or generate a unique one
+	subdomain := services.Normalize(req.Subdomain)
 	var err error
-	for attempts := 0; attempts < 10; attempts++ {
+	if subdomain != "" {
+		if err := h.subdomainService.Validate(subdomain); err != nil {
+			subdomainErrorResponse(c, err)
+			return
+		}
+	}
+	for attempts := 0; subdomain == "" && attempts < 10; attempts++ {
 		subdomain, err = h.subdomainService.Generate()
 		if err != nil {
 			continue
@@ -113,10 +148,9 @@ func (h *TunnelHandler) Create(c *gin.Context) {
 		database.Pool.QueryRow(ctx,
 			`SELECT EXISTS(SELECT 1 FROM tunnels WHERE subdomain = $1)`, subdomain,
 		).Scan(&exists)
-		if !exists {
-			break
+		if exists {
+			subdomain = ""
 		}
-		subdomain = ""
 	}
 	if subdomain == "" {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate unique subdomain"})
@@ -130,33 +164,125 @@ func (h *TunnelHandler) Create(c *gin.Context) {
 		return
 	}
 
-	// Create tunnel record
+	// Allocate a dedicated public TCP port if the raw TCP channel is requested
+	var tcpLocalPort, tcpPublicPort *int
+	if req.TCPLocalPort != nil && *req.TCPLocalPort > 0 {
+		port, err := h.allocateTCPPort(ctx)
+		if err != nil {
+			tcpPortErrorResponse(c, err)
+			return
+		}
+		tcpLocalPort, tcpPublicPort = req.TCPLocalPort, &port
+	}
+
+	// Allocate public ports for the extra UDP mappings
+	mappings := make([]models.UDPMapping, 0, len(req.UDPMappings))
+	taken := []int{udpPublicPort}
+	for _, m := range req.UDPMappings {
+		port, err := h.allocateUDPPort(ctx, taken...)
+		if err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "No available UDP ports"})
+			return
+		}
+		taken = append(taken, port)
+		mappings = append(mappings, models.UDPMapping{
+			Label:      m.Label,
+			LocalPort:  m.LocalPort,
+			PublicPort: port,
+			Enabled:    m.Enabled == nil || *m.Enabled,
+		})
+	}
+
+	tx, err := database.Pool.Begin(ctx)
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create tunnel"})
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	// Create tunnel record. A concurrent request may take the same TCP port
+	// first; the unique constraint decides, and the loser picks another port.
 	var tunnelID uuid.UUID
-	err = database.Pool.QueryRow(ctx,
-		`INSERT INTO tunnels (user_id, name, subdomain, region, mc_local_port, http_local_port, udp_local_port, udp_public_port)
-		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
-		 RETURNING id`,
-		userID, req.Name, subdomain, h.config.Region,
-		req.MCLocalPort, req.HTTPLocalPort, req.UDPLocalPort, udpPublicPort,
-	).Scan(&tunnelID)
+	for attempt := 1; ; attempt++ {
+		var sp pgx.Tx
+		sp, err = tx.Begin(ctx)
+		if err != nil {
+			break
+		}
+		err = sp.QueryRow(ctx,
+			`INSERT INTO tunnels (user_id, name, subdomain, region, mc_local_port, http_local_port, udp_local_port, udp_public_port,
+			                      http_cache_enabled, tcp_local_port, tcp_public_port)
+			 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+			 RETURNING id`,
+			userID, req.Name, subdomain, req.Region,
+			req.MCLocalPort, req.HTTPLocalPort, req.UDPLocalPort, udpPublicPort,
+			req.HTTPCacheEnabled, tcpLocalPort, tcpPublicPort,
+		).Scan(&tunnelID)
+		if err == nil {
+			err = sp.Commit(ctx)
+			break
+		}
+		sp.Rollback(ctx)
+		if !database.IsUniqueViolation(err, tcpPublicPortConstraint) || attempt == maxPortAttempts {
+			break
+		}
+		port, err := h.allocateTCPPort(ctx)
+		if err != nil {
+			tcpPortErrorResponse(c, err)
+			return
+		}
+		tcpPublicPort = &port
+	}
+	if services.IsSubdomainTaken(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "This subdomain is already taken", "reason": services.SubdomainTaken})
+		return
+	}
 	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create tunnel"})
+		return
+	}
+
+	for i := range mappings {
+		m := &mappings[i]
+		m.TunnelID = tunnelID
+		err = tx.QueryRow(ctx,
+			`INSERT INTO tunnel_udp_mappings (tunnel_id, label, local_port, public_port, enabled)
+			 VALUES ($1, $2, $3, $4, $5)
+			 RETURNING id, created_at`,
+			tunnelID, m.Label, m.LocalPort, m.PublicPort, m.Enabled,
+		).Scan(&m.ID, &m.CreatedAt)
+		if err != nil {
+			c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create UDP mapping"})
+			return
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.Error(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create tunnel"})
 		return
 	}
 
 	t := models.Tunnel{
-		ID:            tunnelID,
-		UserID:        userID,
-		Name:          req.Name,
-		Subdomain:     subdomain,
-		Region:        h.config.Region,
-		IsActive:      false,
-		MCLocalPort:   req.MCLocalPort,
-		HTTPLocalPort: req.HTTPLocalPort,
-		UDPLocalPort:  req.UDPLocalPort,
-		UDPPublicPort: &udpPublicPort,
-	}
-	c.JSON(http.StatusCreated, t.ToResponse(h.config.Domain))
+		ID:               tunnelID,
+		UserID:           userID,
+		Name:             req.Name,
+		Subdomain:        subdomain,
+		Region:           req.Region,
+		IsActive:         false,
+		MCLocalPort:      req.MCLocalPort,
+		HTTPLocalPort:    req.HTTPLocalPort,
+		UDPLocalPort:     req.UDPLocalPort,
+		UDPPublicPort:    &udpPublicPort,
+		HTTPCacheEnabled: req.HTTPCacheEnabled,
+		TCPLocalPort:     tcpLocalPort,
+		TCPPublicPort:    tcpPublicPort,
+		UDPMappings:      mappings,
+	}
+	c.JSON(http.StatusCreated, h.tunnelResponse(&t))
 }
 
 // GET /api/tunnels/:id
@@ -168,26 +294,25 @@ func (h *TunnelHandler) Get(c *gin.Context) {
 	}
 
 	userID, _ := middleware.GetUserID(c)
-	ctx := context.Background()
+	ctx := c.Request.Context()
 
 	var t models.Tunnel
 	err = database.Pool.QueryRow(ctx,
-		`SELECT id, user_id, name, subdomain, region, is_active,
-		        mc_local_port, http_local_port, udp_local_port, udp_public_port,
-		        created_at, updated_at
-		 FROM tunnels WHERE id = $1 AND user_id = $2`,
+		`SELECT `+models.TunnelColumns+` FROM tunnels WHERE id = $1 AND user_id = $2`,
 		tunnelID, userID,
-	).Scan(
-		&t.ID, &t.UserID, &t.Name, &t.Subdomain, &t.Region, &t.IsActive,
-		&t.MCLocalPort, &t.HTTPLocalPort, &t.UDPLocalPort, &t.UDPPublicPort,
-		&t.CreatedAt, &t.UpdatedAt,
-	)
+	).Scan(t.ScanFields()...)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Tunnel not found"})
 		return
 	}
 
-	c.JSON(http.StatusOK, t.ToResponse(h.config.Domain))
+	if err := h.tunnelService.LoadUDPMappings(ctx, &t); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch UDP mappings"})
+		return
+	}
+
+	c.JSON(http.StatusOK, h.tunnelResponse(&t))
 }
 
 // PATCH /api/tunnels/:id
@@ -205,20 +330,22 @@ func (h *TunnelHandler) Update(c *gin.Context) {
 	}
 
 	userID, _ := middleware.GetUserID(c)
-	ctx := context.Background()
+	ctx := c.Request.Context()
 
 	var t models.Tunnel
 	err = database.Pool.QueryRow(ctx,
-		`SELECT id, subdomain, is_active, name, mc_local_port, http_local_port, udp_local_port, udp_public_port
-		 FROM tunnels WHERE id = $1 AND user_id = $2`,
+		`SELECT `+models.TunnelColumns+` FROM tunnels WHERE id = $1 AND user_id = $2`,
 		tunnelID, userID,
-	).Scan(&t.ID, &t.Subdomain, &t.IsActive, &t.Name, &t.MCLocalPort, &t.HTTPLocalPort, &t.UDPLocalPort, &t.UDPPublicPort)
+	).Scan(t.ScanFields()...)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Tunnel not found"})
 		return
 	}
 
-	if t.IsActive {
+	// Name and subdomain can change while the tunnel runs; ports cannot
+	portsChanged := req.MCLocalPort != nil || req.HTTPLocalPort != nil || req.HTTPCacheEnabled != nil ||
+		req.UDPLocalPort != nil || req.TCPLocalPort != nil
+	if t.IsActive && portsChanged {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Stop the tunnel before editing it"})
 		return
 	}
@@ -231,6 +358,17 @@ func (h *TunnelHandler) Update(c *gin.Context) {
 		}
 		t.Name = *req.Name
 	}
+	renamed, allocatedTCP := false, false
+	if req.Subdomain != nil {
+		subdomain := services.Normalize(*req.Subdomain)
+		if subdomain != t.Subdomain {
+			if err := h.subdomainService.Validate(subdomain); err != nil {
+				subdomainErrorResponse(c, err)
+				return
+			}
+			t.Subdomain, renamed = subdomain, true
+		}
+	}
 	if req.MCLocalPort != nil {
 		t.MCLocalPort = *req.MCLocalPort
 	}
@@ -241,22 +379,69 @@ func (h *TunnelHandler) Update(c *gin.Context) {
 			t.HTTPLocalPort = req.HTTPLocalPort
 		}
 	}
+	if req.HTTPCacheEnabled != nil {
+		t.HTTPCacheEnabled = *req.HTTPCacheEnabled
+	}
 	if req.UDPLocalPort != nil {
 		t.UDPLocalPort = *req.UDPLocalPort
 	}
+	if req.TCPLocalPort != nil {
+		if *req.TCPLocalPort == 0 {
+			// Disabling raw TCP releases the public port back to the pool
+			t.TCPLocalPort, t.TCPPublicPort = nil, nil
+		} else {
+			if t.TCPPublicPort == nil {
+				port, err := h.allocateTCPPort(ctx)
+				if err != nil {
+					tcpPortErrorResponse(c, err)
+					return
+				}
+				t.TCPPublicPort, allocatedTCP = &port, true
+			}
+			t.TCPLocalPort = req.TCPLocalPort
+		}
+	}
 
-	_, err = database.Pool.Exec(ctx,
-		`UPDATE tunnels SET name=$1, mc_local_port=$2, http_local_port=$3, udp_local_port=$4, updated_at=NOW()
-		 WHERE id = $5`,
-		t.Name, t.MCLocalPort, t.HTTPLocalPort, t.UDPLocalPort, tunnelID,
-	)
+	// The unique constraints decide races between two renames, and between two
+	// requests allocating the same TCP port (the loser picks another one).
+	for attempt := 1; ; attempt++ {
+		_, err = database.Pool.Exec(ctx,
+			`UPDATE tunnels SET name=$1, subdomain=$2, mc_local_port=$3, http_local_port=$4, udp_local_port=$5,
+			                    http_cache_enabled=$6, tcp_local_port=$7, tcp_public_port=$8, updated_at=NOW()
+			 WHERE id = $9`,
+			t.Name, t.Subdomain, t.MCLocalPort, t.HTTPLocalPort, t.UDPLocalPort,
+			t.HTTPCacheEnabled, t.TCPLocalPort, t.TCPPublicPort, tunnelID,
+		)
+		if !allocatedTCP || !database.IsUniqueViolation(err, tcpPublicPortConstraint) || attempt == maxPortAttempts {
+			break
+		}
+		port, err := h.allocateTCPPort(ctx)
+		if err != nil {
+			tcpPortErrorResponse(c, err)
+			return
+		}
+		t.TCPPublicPort = &port
+	}
+	if services.IsSubdomainTaken(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "This subdomain is already taken", "reason": services.SubdomainTaken})
+		return
+	}
 	if err != nil {
+		c.Error(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update tunnel"})
 		return
 	}
+	if renamed {
+		h.tunnelService.RenameTunnel(t)
+	}
 
-	t.Region = h.config.Region
-	c.JSON(http.StatusOK, t.ToResponse(h.config.Domain))
+	if err := h.tunnelService.LoadUDPMappings(ctx, &t); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch UDP mappings"})
+		return
+	}
+
+	c.JSON(http.StatusOK, h.tunnelResponse(&t))
 }
 
 // DELETE /api/tunnels/:id
@@ -268,14 +453,13 @@ func (h *TunnelHandler) Delete(c *gin.Context) {
 	}
 
 	userID, _ := middleware.GetUserID(c)
-	ctx := context.Background()
+	ctx := c.Request.Context()
 
 	var t models.Tunnel
 	err = database.Pool.QueryRow(ctx,
-		`SELECT id, subdomain, is_active, mc_local_port, http_local_port, udp_local_port, udp_public_port
-		 FROM tunnels WHERE id = $1 AND user_id = $2`,
+		`SELECT `+models.TunnelColumns+` FROM tunnels WHERE id = $1 AND user_id = $2`,
 		tunnelID, userID,
-	).Scan(&t.ID, &t.Subdomain, &t.IsActive, &t.MCLocalPort, &t.HTTPLocalPort, &t.UDPLocalPort, &t.UDPPublicPort)
+	).Scan(t.ScanFields()...)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Tunnel not found"})
 		return
@@ -287,6 +471,7 @@ func (h *TunnelHandler) Delete(c *gin.Context) {
 
 	_, err = database.Pool.Exec(ctx, `DELETE FROM tunnels WHERE id = $1`, tunnelID)
 	if err != nil {
+		c.Error(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete tunnel"})
 		return
 	}
@@ -303,14 +488,13 @@ func (h *TunnelHandler) Start(c *gin.Context) {
 	}
 
 	userID, _ := middleware.GetUserID(c)
-	ctx := context.Background()
+	ctx := c.Request.Context()
 
 	var t models.Tunnel
 	err = database.Pool.QueryRow(ctx,
-		`SELECT id, subdomain, is_active, mc_local_port, http_local_port, udp_local_port, udp_public_port
-		 FROM tunnels WHERE id = $1 AND user_id = $2`,
+		`SELECT `+models.TunnelColumns+` FROM tunnels WHERE id = $1 AND user_id = $2`,
 		tunnelID, userID,
-	).Scan(&t.ID, &t.Subdomain, &t.IsActive, &t.MCLocalPort, &t.HTTPLocalPort, &t.UDPLocalPort, &t.UDPPublicPort)
+	).Scan(t.ScanFields()...)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Tunnel not found"})
 		return
@@ -319,20 +503,42 @@ func (h *TunnelHandler) Start(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Tunnel is already active"})
 		return
 	}
+	if t.SuspendedAt != nil {
+		msg := "Tunnel is suspended"
+		if t.SuspendedReason != nil {
+			msg += ": " + *t.SuspendedReason
+		}
+		c.JSON(http.StatusForbidden, gin.H{"error": msg})
+		return
+	}
 
-	if err := h.tunnelService.StartTunnel(t); err != nil {
+	if err := h.tunnelService.LoadUDPMappings(ctx, &t); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch UDP mappings"})
+		return
+	}
+
+	if err := h.tunnelService.StartTunnel(ctx, t); err != nil {
+		c.Error(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start tunnel: " + err.Error()})
 		return
 	}
 
-	_, err = database.Pool.Exec(ctx,
-		`UPDATE tunnels SET is_active = TRUE, updated_at = NOW() WHERE id = $1`, tunnelID,
+	// A suspension that lands while the tunnel starts wins
+	tag, err := database.Pool.Exec(ctx,
+		`UPDATE tunnels SET is_active = TRUE, updated_at = NOW() WHERE id = $1 AND suspended_at IS NULL`, tunnelID,
 	)
 	if err != nil {
+		c.Error(err)
 		h.tunnelService.StopTunnel(t)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update tunnel status"})
 		return
 	}
+	if tag.RowsAffected() == 0 {
+		h.tunnelService.StopTunnel(t)
+		c.JSON(http.StatusForbidden, gin.H{"error": "Tunnel is suspended"})
+		return
+	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "Tunnel started"})
 }
@@ -346,14 +552,13 @@ func (h *TunnelHandler) Stop(c *gin.Context) {
 	}
 
 	userID, _ := middleware.GetUserID(c)
-	ctx := context.Background()
+	ctx := c.Request.Context()
 
 	var t models.Tunnel
 	err = database.Pool.QueryRow(ctx,
-		`SELECT id, subdomain, is_active, mc_local_port, http_local_port, udp_local_port, udp_public_port
-		 FROM tunnels WHERE id = $1 AND user_id = $2`,
+		`SELECT `+models.TunnelColumns+` FROM tunnels WHERE id = $1 AND user_id = $2`,
 		tunnelID, userID,
-	).Scan(&t.ID, &t.Subdomain, &t.IsActive, &t.MCLocalPort, &t.HTTPLocalPort, &t.UDPLocalPort, &t.UDPPublicPort)
+	).Scan(t.ScanFields()...)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Tunnel not found"})
 		return
@@ -369,6 +574,7 @@ func (h *TunnelHandler) Stop(c *gin.Context) {
 		`UPDATE tunnels SET is_active = FALSE, updated_at = NOW() WHERE id = $1`, tunnelID,
 	)
 	if err != nil {
+		c.Error(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update tunnel status"})
 		return
 	}
@@ -376,14 +582,72 @@ func (h *TunnelHandler) Stop(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "Tunnel stopped"})
 }
 
+// POST /api/tunnels/:id/move
+func (h *TunnelHandler) Move(c *gin.Context) {
+	t, ok := h.findUserTunnel(c)
+	if !ok {
+		return
+	}
+
+	var req models.MoveTunnelRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Region == t.Region {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Tunnel is already in region " + t.Region})
+		return
+	}
+	if _, err := h.edgeService.Node(req.Region); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Region " + req.Region + " is not available"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	if err := h.tunnelService.LoadUDPMappings(ctx, &t); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch UDP mappings"})
+		return
+	}
+
+	// The region changes first, so a heartbeat sync of the new region during
+	// the move keeps the tunnel rather than removing it
+	from := t.Region
+	t.Region = req.Region
+	_, err := database.Pool.Exec(ctx,
+		`UPDATE tunnels SET region = $1, moved_from = $3, moved_at = NOW(), updated_at = NOW() WHERE id = $2`,
+		t.Region, t.ID, from,
+	)
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update tunnel"})
+		return
+	}
+
+	if err := h.tunnelService.MoveTunnel(ctx, t, from); err != nil {
+		c.Error(err)
+		database.Pool.Exec(ctx,
+			`UPDATE tunnels SET region = $1, moved_from = NULL, moved_at = NULL, updated_at = NOW() WHERE id = $2`, from, t.ID)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to move tunnel: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, h.tunnelResponse(&t))
+}
+
 // ---- Helpers ----
 
-// allocateUDPPort finds a public port from the pool that is not already assigned in the DB.
-func (h *TunnelHandler) allocateUDPPort(ctx context.Context) (int, error) {
+// allocateUDPPort finds a public port from the pool that is not already assigned in the DB
+// (voice chat or extra mapping) and is not one of skip.
+func (h *TunnelHandler) allocateUDPPort(ctx context.Context, skip ...int) (int, error) {
 	for port := h.config.MinPort; port <= h.config.MaxPort; port++ {
+		if slices.Contains(skip, port) {
+			continue
+		}
 		var exists bool
 		database.Pool.QueryRow(ctx,
-			`SELECT EXISTS(SELECT 1 FROM tunnels WHERE udp_public_port = $1)`, port,
+			`SELECT EXISTS(SELECT 1 FROM tunnels WHERE udp_public_port = $1)
+			     OR EXISTS(SELECT 1 FROM tunnel_udp_mappings WHERE public_port = $1)`, port,
 		).Scan(&exists)
 		if !exists {
 			return port, nil
@@ -391,3 +655,96 @@ func (h *TunnelHandler) allocateUDPPort(ctx context.Context) (int, error) {
 	}
 	return 0, fmt.Errorf("no available UDP ports in range %d-%d", h.config.MinPort, h.config.MaxPort)
 }
+
+const (
+	// tcpPublicPortConstraint is the unique constraint on tunnels.tcp_public_port.
+	tcpPublicPortConstraint = "tunnels_tcp_public_port_key"
+	// maxPortAttempts bounds the retries when concurrent requests allocate the same port.
+	maxPortAttempts = 5
+)
+
+var errNoTCPPorts = errors.New("no available TCP ports")
+
+// allocateTCPPort finds a public port from the raw TCP pool that is not already assigned in the DB.
+func (h *TunnelHandler) allocateTCPPort(ctx context.Context) (int, error) {
+	for port := h.config.TCPMinPort; port <= h.config.TCPMaxPort; port++ {
+		var exists bool
+		if err := database.Pool.QueryRow(ctx,
+			`SELECT EXISTS(SELECT 1 FROM tunnels WHERE tcp_public_port = $1)`, port,
+		).Scan(&exists); err != nil {
+			return 0, err
+		}
+		if !exists {
+			return port, nil
+		}
+	}
+	return 0, fmt.Errorf("%w in range %d-%d", errNoTCPPorts, h.config.TCPMinPort, h.config.TCPMaxPort)
+}
+
+// tcpPortErrorResponse writes the response for a failed TCP port allocation.
+func tcpPortErrorResponse(c *gin.Context, err error) {
+	if errors.Is(err, errNoTCPPorts) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "No available TCP ports"})
+		return
+	}
+	c.Error(err)
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to allocate TCP port"})
+}
+
+// findUserTunnel loads the tunnel from the :id path parameter if it belongs to the
+// current user. On failure it writes the error response and returns ok=false.
+func (h *TunnelHandler) findUserTunnel(c *gin.Context) (t models.Tunnel, ok bool) {
+	tunnelID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tunnel ID"})
+		return t, false
+	}
+
+	userID, _ := middleware.GetUserID(c)
+	ctx := c.Request.Context()
+
+	err = database.Pool.QueryRow(ctx,
+		`SELECT `+models.TunnelColumns+` FROM tunnels WHERE id = $1 AND user_id = $2`,
+		tunnelID, userID,
+	).Scan(t.ScanFields()...)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tunnel not found"})
+		return t, false
+	}
+	return t, true
+}
+
+// inspectFailed answers a live inspection request whose tunnel server could
+// not be asked: 501 if no node of the tunnel's region is connected.
+func inspectFailed(c *gin.Context, t models.Tunnel, err error) {
+	if errors.Is(err, services.ErrRegionUnavailable) {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "No edge node of region " + t.Region + " is connected"})
+		return
+	}
+	c.Error(err)
+	c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to reach the edge node of region " + t.Region})
+}
+
+// tunnelResponse renders a tunnel with its live client state.
+func (h *TunnelHandler) tunnelResponse(t *models.Tunnel) models.TunnelResponse {
+	return tunnelResponse(h.edgeService, h.tunnelService, t)
+}
+
+func tunnelResponse(edges *services.EdgeService, tunnels *services.TunnelService, t *models.Tunnel) models.TunnelResponse {
+	resp := t.ToResponse(edges.Domain(t.Region))
+	if !t.IsActive {
+		return resp
+	}
+	info, ok := tunnels.ClientInfo(*t)
+	if !ok {
+		return resp
+	}
+	resp.ClientConnected = true
+	resp.ClientConnectedSince = &info.ConnectedSince
+	resp.ClientRemoteAddr = &info.RemoteAddr
+	if info.Version != "" {
+		resp.ClientVersion = &info.Version
+	}
+	resp.ClientRTTMs = info.RTTMs
+	return resp
+}
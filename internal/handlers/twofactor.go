@@ -2,7 +2,6 @@ package handlers
 
 import (
 	"bytes"
-	"context"
 	"encoding/base64"
 	"image/png"
 	"net/http"
@@ -30,7 +29,7 @@ func NewTwoFactorHandler(totpService *services.TOTPService) *TwoFactorHandler {
 func (h *TwoFactorHandler) Setup(c *gin.Context) {
 	userID, _ := middleware.GetUserID(c)
 	email, _ := middleware.GetUserEmail(c)
-	ctx := context.Background()
+	ctx := c.Request.Context()
 
 	// Check if 2FA already enabled
 	var totpEnabled bool
@@ -52,6 +51,7 @@ func (h *TwoFactorHandler) Setup(c *gin.Context) {
 	// Generate new TOTP secret
 	secret, err := h.totpService.GenerateSecret()
 	if err != nil {
+		c.Error(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate 2FA secret"})
 		return
 	}
@@ -59,18 +59,21 @@ func (h *TwoFactorHandler) Setup(c *gin.Context) {
 	// Generate QR code
 	key, err := h.totpService.GenerateKey(email, secret)
 	if err != nil {
+		c.Error(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate 2FA key"})
 		return
 	}
 
 	img, err := key.Image(200, 200)
 	if err != nil {
+		c.Error(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate QR code"})
 		return
 	}
 
 	var buf bytes.Buffer
 	if err := png.Encode(&buf, img); err != nil {
+		c.Error(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode QR code"})
 		return
 	}
@@ -84,6 +87,7 @@ func (h *TwoFactorHandler) Setup(c *gin.Context) {
 	)
 
 	if err != nil {
+		c.Error(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save 2FA secret"})
 		return
 	}
@@ -104,7 +108,7 @@ func (h *TwoFactorHandler) Verify(c *gin.Context) {
 	}
 
 	userID, _ := middleware.GetUserID(c)
-	ctx := context.Background()
+	ctx := c.Request.Context()
 
 	// Get stored secret
 	var secret *string
@@ -137,6 +141,7 @@ func (h *TwoFactorHandler) Verify(c *gin.Context) {
 	)
 
 	if err != nil {
+		c.Error(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enable 2FA"})
 		return
 	}
@@ -153,7 +158,7 @@ func (h *TwoFactorHandler) Disable(c *gin.Context) {
 	}
 
 	userID, _ := middleware.GetUserID(c)
-	ctx := context.Background()
+	ctx := c.Request.Context()
 
 	// Get user data
 	var passwordHash string
@@ -193,6 +198,7 @@ func (h *TwoFactorHandler) Disable(c *gin.Context) {
 	)
 
 	if err != nil {
+		c.Error(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disable 2FA"})
 		return
 	}
@@ -0,0 +1,177 @@
+// Package logging builds the application's slog logger: text or JSON output,
+// a level per subsystem and sampling of repetitive messages.
+//
+// Components receive a *slog.Logger and derive their subsystem logger with
+// logger.With(logging.Subsystem, "udp"); the handler picks that subsystem's
+// level from the configuration. Common fields are tunnel_id, user_id and conn_id.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Subsystem is the attribute key that selects a per-subsystem level.
+const Subsystem = "subsystem"
+
+// Config describes the logger.
+type Config struct {
+	Format string     // "text" (default) or "json"
+	Level  slog.Level // default level
+	// Levels overrides the level of individual subsystems.
+	Levels map[string]slog.Level
+	// SampleBurst is the number of records with the same message and level
+	// logged per second; further records in that second are dropped and
+	// reported on the next logged one. 0 disables sampling.
+	SampleBurst int
+}
+
+// New creates a logger writing to w.
+func New(w io.Writer, cfg Config) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug} // filtering happens in handler
+	var next slog.Handler
+	if strings.EqualFold(cfg.Format, "json") {
+		next = slog.NewJSONHandler(w, opts)
+	} else {
+		next = slog.NewTextHandler(w, opts)
+	}
+	h := &handler{next: next, cfg: &cfg, level: cfg.Level}
+	if cfg.SampleBurst > 0 {
+		h.sampler = &sampler{burst: cfg.SampleBurst, counts: map[sampleKey]*sampleCount{}}
+	}
+	return slog.New(h)
+}
+
+// ParseLevel parses debug, info, warn or error.
+func ParseLevel(s string) (slog.Level, error) {
+	var l slog.Level
+	err := l.UnmarshalText([]byte(strings.TrimSpace(s)))
+	return l, err
+}
+
+// ParseLevels parses per-subsystem levels such as "udp=warn,mcproxy=debug".
+func ParseLevels(s string) (map[string]slog.Level, error) {
+	levels := map[string]slog.Level{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid log level %q (expected subsystem=level)", part)
+		}
+		l, err := ParseLevel(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid log level for %s: %w", name, err)
+		}
+		levels[strings.ToLower(strings.TrimSpace(name))] = l
+	}
+	return levels, nil
+}
+
+type handler struct {
+	next    slog.Handler
+	cfg     *Config
+	level   slog.Level
+	sampler *sampler
+}
+
+func (h *handler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= h.level
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	if h.sampler != nil {
+		allow, dropped := h.sampler.allow(r)
+		if !allow {
+			return nil
+		}
+		if dropped > 0 {
+			r.AddAttrs(slog.Int("sampled_out", dropped))
+		}
+	}
+	return h.next.Handle(ctx, r)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	for _, a := range attrs {
+		if a.Key == Subsystem {
+			if l, ok := h.cfg.Levels[strings.ToLower(a.Value.String())]; ok {
+				h2.level = l
+			}
+		}
+	}
+	h2.next = h.next.WithAttrs(attrs)
+	return &h2
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	h2 := *h
+	h2.next = h.next.WithGroup(name)
+	return &h2
+}
+
+// sampler limits records per message and level to burst per second.
+type sampler struct {
+	burst int
+
+	mu     sync.Mutex
+	counts map[sampleKey]*sampleCount
+	swept  time.Time
+}
+
+type sampleKey struct {
+	msg   string
+	level slog.Level
+}
+
+type sampleCount struct {
+	second  int64
+	n       int
+	dropped int
+}
+
+func (s *sampler) allow(r slog.Record) (bool, int) {
+	now := r.Time
+	if now.IsZero() {
+		now = time.Now()
+	}
+	sec := now.Unix()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.swept) > time.Minute {
+		// Forget messages that have gone quiet
+		for k, c := range s.counts {
+			if c.second < sec-60 && c.dropped == 0 {
+				delete(s.counts, k)
+			}
+		}
+		s.swept = now
+	}
+
+	k := sampleKey{msg: r.Message, level: r.Level}
+	c := s.counts[k]
+	if c == nil {
+		c = &sampleCount{second: sec}
+		s.counts[k] = c
+	}
+	if c.second != sec {
+		c.second, c.n = sec, 0
+	}
+	if c.n >= s.burst {
+		c.dropped++
+		return false, 0
+	}
+	c.n++
+	dropped := c.dropped
+	c.dropped = 0
+	return true, dropped
+}
@@ -0,0 +1,276 @@
+// Package metrics is a small Prometheus instrumentation library: histograms
+// with labels, collectors for values read at scrape time, and an http.Handler
+// serving the text exposition format (version 0.0.4).
+package metrics
+
+import (
+	"bufio"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Collector emits samples when the registry is scraped.
+type Collector interface {
+	Collect(e *Emitter)
+}
+
+// CollectorFunc adapts a function to Collector.
+type CollectorFunc func(e *Emitter)
+
+func (f CollectorFunc) Collect(e *Emitter) { f(e) }
+
+// Registry is a set of collectors served together.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []Collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Default is the registry served by the /metrics endpoint.
+var Default = NewRegistry()
+
+// Register adds a collector to the registry.
+func (r *Registry) Register(c Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// Register adds a collector to the default registry.
+func Register(c Collector) {
+	Default.Register(c)
+}
+
+// Handler serves the registry in the Prometheus text format.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		r.mu.Lock()
+		collectors := append([]Collector(nil), r.collectors...)
+		r.mu.Unlock()
+
+		e := &Emitter{byName: map[string]*family{}}
+		for _, c := range collectors {
+			c.Collect(e)
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		e.write(bw)
+		bw.Flush()
+	})
+}
+
+// Handler serves the default registry.
+func Handler() http.Handler {
+	return Default.Handler()
+}
+
+// ---- Emitter ----
+
+// Emitter collects the samples of one scrape. Samples of the same metric name
+// are grouped under a single HELP/TYPE header, in the order names first appear.
+// Labels are given as alternating name, value pairs.
+type Emitter struct {
+	families []*family
+	byName   map[string]*family
+}
+
+type family struct {
+	name, help, typ string
+	samples         []string
+}
+
+func (e *Emitter) family(name, help, typ string) *family {
+	f := e.byName[name]
+	if f == nil {
+		f = &family{name: name, help: help, typ: typ}
+		e.byName[name] = f
+		e.families = append(e.families, f)
+	}
+	return f
+}
+
+func (f *family) add(suffix string, labels []string, v float64) {
+	f.samples = append(f.samples, f.name+suffix+formatLabels(labels)+" "+formatValue(v))
+}
+
+// Counter emits a sample of a monotonically increasing value.
+func (e *Emitter) Counter(name, help string, v float64, labels ...string) {
+	e.family(name, help, "counter").add("", labels, v)
+}
+
+// Gauge emits a sample of a value that can go up and down.
+func (e *Emitter) Gauge(name, help string, v float64, labels ...string) {
+	e.family(name, help, "gauge").add("", labels, v)
+}
+
+// Histogram emits the buckets, sum and count of h.
+func (e *Emitter) Histogram(name, help string, h *Histogram, labels ...string) {
+	f := e.family(name, help, "histogram")
+	var cumulative uint64
+	for i, upper := range h.upper {
+		cumulative += h.counts[i].Load()
+		f.add("_bucket", append(labels[:len(labels):len(labels)], "le", formatValue(upper)), float64(cumulative))
+	}
+	count := h.count.Load()
+	f.add("_bucket", append(labels[:len(labels):len(labels)], "le", "+Inf"), float64(count))
+	f.add("_sum", labels, math.Float64frombits(h.sum.Load()))
+	f.add("_count", labels, float64(count))
+}
+
+func (e *Emitter) write(w *bufio.Writer) {
+	for _, f := range e.families {
+		w.WriteString("# HELP " + f.name + " " + escape(f.help, false) + "\n")
+		w.WriteString("# TYPE " + f.name + " " + f.typ + "\n")
+		for _, s := range f.samples {
+			w.WriteString(s)
+			w.WriteByte('\n')
+		}
+	}
+}
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i])
+		b.WriteString(`="`)
+		b.WriteString(escape(labels[i+1], true))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func escape(s string, quote bool) string {
+	if quote {
+		return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(s)
+	}
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+// ---- Histogram ----
+
+// DefBuckets suit latencies in seconds from a few milliseconds to 10s.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Histogram counts observations in cumulative buckets.
+type Histogram struct {
+	upper  []float64
+	counts []atomic.Uint64
+	count  atomic.Uint64
+	sum    atomic.Uint64 // float64 bits
+}
+
+func NewHistogram(buckets []float64) *Histogram {
+	return &Histogram{upper: buckets, counts: make([]atomic.Uint64, len(buckets))}
+}
+
+func (h *Histogram) Observe(v float64) {
+	if i := sort.SearchFloat64s(h.upper, v); i < len(h.upper) {
+		h.counts[i].Add(1)
+	}
+	h.count.Add(1)
+	for {
+		old := h.sum.Load()
+		if h.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+// HistogramVec is a set of histograms partitioned by label values.
+type HistogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu       sync.RWMutex
+	children map[string]*histogramChild
+}
+
+type histogramChild struct {
+	values []string
+	h      *Histogram
+}
+
+// NewHistogramVec creates a histogram vector and registers it.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	v := &HistogramVec{
+		name:     name,
+		help:     help,
+		labels:   labels,
+		buckets:  buckets,
+		children: map[string]*histogramChild{},
+	}
+	r.Register(v)
+	return v
+}
+
+// NewHistogramVec creates a histogram vector in the default registry.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return Default.NewHistogramVec(name, help, buckets, labels...)
+}
+
+// With returns the histogram for the given label values, in label order.
+func (v *HistogramVec) With(values ...string) *Histogram {
+	key := strings.Join(values, "\xff")
+	v.mu.RLock()
+	c := v.children[key]
+	v.mu.RUnlock()
+	if c != nil {
+		return c.h
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if c = v.children[key]; c == nil {
+		c = &histogramChild{values: values, h: NewHistogram(v.buckets)}
+		v.children[key] = c
+	}
+	return c.h
+}
+
+func (v *HistogramVec) Collect(e *Emitter) {
+	v.mu.RLock()
+	keys := make([]string, 0, len(v.children))
+	for k := range v.children {
+		keys = append(keys, k)
+	}
+	v.mu.RUnlock()
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		v.mu.RLock()
+		c := v.children[k]
+		v.mu.RUnlock()
+		labels := make([]string, 0, 2*len(v.labels))
+		for i, name := range v.labels {
+			labels = append(labels, name, c.values[i])
+		}
+		e.Histogram(v.name, v.help, c.h, labels...)
+	}
+}
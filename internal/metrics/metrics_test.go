@@ -0,0 +1,93 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func scrape(t *testing.T, r *Registry) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	return rec.Body.String()
+}
+
+func TestLabelAndHelpEscaping(t *testing.T) {
+	r := NewRegistry()
+	r.Register(CollectorFunc(func(e *Emitter) {
+		e.Gauge("voidlink_test", "Help with a \\ backslash\nand a \"quote\"", 1,
+			"path", `C:\maps\"world"`+"\nnext", "plain", "ok")
+	}))
+
+	want := `# HELP voidlink_test Help with a \\ backslash\nand a "quote"
+# TYPE voidlink_test gauge
+voidlink_test{path="C:\\maps\\\"world\"\nnext",plain="ok"} 1
+`
+	if got := scrape(t, r); got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestFamiliesGroupedInFirstSeenOrder(t *testing.T) {
+	r := NewRegistry()
+	r.Register(CollectorFunc(func(e *Emitter) {
+		e.Counter("b_total", "B.", 1, "tunnel", "t1")
+		e.Gauge("a", "A.", 2.5)
+		e.Counter("b_total", "B.", 3, "tunnel", "t2")
+	}))
+
+	want := `# HELP b_total B.
+# TYPE b_total counter
+b_total{tunnel="t1"} 1
+b_total{tunnel="t2"} 3
+# HELP a A.
+# TYPE a gauge
+a 2.5
+`
+	if got := scrape(t, r); got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestHistogramExposition(t *testing.T) {
+	r := NewRegistry()
+	v := r.NewHistogramVec("voidlink_latency_seconds", "Latency.", []float64{0.1, 1}, "route", "code")
+	v.With("/b", "200").Observe(5)
+	v.With("/a", "200").Observe(0.05)
+	v.With("/a", "200").Observe(0.1) // on the boundary: counted in le="0.1"
+	v.With("/a", "200").Observe(0.5)
+
+	want := `# HELP voidlink_latency_seconds Latency.
+# TYPE voidlink_latency_seconds histogram
+voidlink_latency_seconds_bucket{route="/a",code="200",le="0.1"} 2
+voidlink_latency_seconds_bucket{route="/a",code="200",le="1"} 3
+voidlink_latency_seconds_bucket{route="/a",code="200",le="+Inf"} 3
+voidlink_latency_seconds_sum{route="/a",code="200"} 0.65
+voidlink_latency_seconds_count{route="/a",code="200"} 3
+voidlink_latency_seconds_bucket{route="/b",code="200",le="0.1"} 0
+voidlink_latency_seconds_bucket{route="/b",code="200",le="1"} 0
+voidlink_latency_seconds_bucket{route="/b",code="200",le="+Inf"} 1
+voidlink_latency_seconds_sum{route="/b",code="200"} 5
+voidlink_latency_seconds_count{route="/b",code="200"} 1
+`
+	if got := scrape(t, r); got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+// Emitting a histogram must not write "le" into the caller's label slice.
+func TestHistogramKeepsCallerLabels(t *testing.T) {
+	h := NewHistogram([]float64{1})
+	labels := make([]string, 2, 8)
+	labels[0], labels[1] = "route", "/a"
+	e := &Emitter{byName: map[string]*family{}}
+	e.Histogram("h", "H.", h, labels...)
+	e.Gauge("g", "G.", 1, labels...)
+	if got := e.byName["g"].samples[0]; got != `g{route="/a"} 1` {
+		t.Fatalf("gauge sample = %s", got)
+	}
+}
@@ -45,6 +45,27 @@ func AuthMiddleware(jwtManager *utils.JWTManager) gin.HandlerFunc {
 	}
 }
 
+// QueryToken lets clients that cannot set headers (a browser EventSource)
+// authenticate with ?access_token=. The token is moved to the Authorization
+// header and stripped from the URL so it does not end up in logs or traces.
+// It must run before AuthMiddleware.
+func QueryToken() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		q := c.Request.URL.Query()
+		token := q.Get("access_token")
+		if token == "" {
+			c.Next()
+			return
+		}
+		if c.GetHeader("Authorization") == "" {
+			c.Request.Header.Set("Authorization", "Bearer "+token)
+		}
+		q.Del("access_token")
+		c.Request.URL.RawQuery = q.Encode()
+		c.Next()
+	}
+}
+
 // Helper to get user ID from context
 func GetUserID(c *gin.Context) (uuid.UUID, bool) {
 	userID, exists := c.Get(AuthUserIDKey)
@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"tunnel-api/internal/logging"
+)
+
+// RequestLogger logs every API request with its route, status and latency,
+// plus user_id and tunnel_id when known. Errors attached by handlers with
+// c.Error are logged at error level; other requests at debug (info for 4xx).
+func RequestLogger(logger *slog.Logger) gin.HandlerFunc {
+	logger = logger.With(logging.Subsystem, "api")
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		status := c.Writer.Status()
+		level := slog.LevelDebug
+		switch {
+		case len(c.Errors) > 0 || status >= 500:
+			level = slog.LevelError
+		case status >= 400:
+			level = slog.LevelInfo
+		}
+		if !logger.Enabled(c.Request.Context(), level) {
+			return
+		}
+
+		attrs := []slog.Attr{
+			slog.String("method", c.Request.Method),
+			slog.String("route", c.FullPath()),
+			slog.Int("status", status),
+			slog.Duration("latency", time.Since(start)),
+			slog.String("client_ip", c.ClientIP()),
+		}
+		if userID, ok := GetUserID(c); ok {
+			attrs = append(attrs, slog.String("user_id", userID.String()))
+		}
+		if id := c.Param("id"); id != "" {
+			attrs = append(attrs, slog.String("tunnel_id", id))
+		}
+		if len(c.Errors) > 0 {
+			attrs = append(attrs, slog.String("error", strings.Join(c.Errors.Errors(), "; ")))
+		}
+		logger.LogAttrs(c.Request.Context(), level, "Request", attrs...)
+	}
+}
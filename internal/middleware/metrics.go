@@ -0,0 +1,33 @@
+package middleware
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"tunnel-api/internal/metrics"
+)
+
+var requestDuration = metrics.NewHistogramVec(
+	"voidlink_http_request_duration_seconds",
+	"API request latency by route.",
+	metrics.DefBuckets,
+	"method", "route", "status",
+)
+
+// Metrics records the latency of every API request, labelled with the route
+// template (e.g. /api/tunnels/:id) so IDs do not create new series.
+func Metrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		requestDuration.With(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).
+			Observe(time.Since(start).Seconds())
+	}
+}
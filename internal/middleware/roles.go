@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"tunnel-api/internal/database"
+)
+
+const AuthUserRoleKey = "user_role"
+
+// RequireActive rejects users whose account was disabled since their access
+// token was issued, and stores their current role for RequireRole. It must
+// run after AuthMiddleware.
+func RequireActive() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, _ := GetUserID(c)
+
+		var role string
+		var disabledAt *time.Time
+		err := database.Pool.QueryRow(c.Request.Context(),
+			`SELECT role, disabled_at FROM users WHERE id = $1`, userID,
+		).Scan(&role, &disabledAt)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+			c.Abort()
+			return
+		}
+		if disabledAt != nil {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Account disabled"})
+			c.Abort()
+			return
+		}
+
+		c.Set(AuthUserRoleKey, role)
+		c.Next()
+	}
+}
+
+// RequireRole only lets users with one of the given roles through. It must
+// run after RequireActive.
+func RequireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		role, _ := GetUserRole(c)
+		if !slices.Contains(roles, role) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// Helper to get user role from context
+func GetUserRole(c *gin.Context) (string, bool) {
+	role, exists := c.Get(AuthUserRoleKey)
+	if !exists {
+		return "", false
+	}
+	return role.(string), true
+}
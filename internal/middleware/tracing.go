@@ -0,0 +1,55 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"tunnel-api/internal/tracing"
+)
+
+// Tracing starts a server span for every API request, continuing the caller's
+// trace when a traceparent header is present. Handlers must use
+// c.Request.Context() for their database calls to appear as child spans.
+// The trace ID is returned in X-Trace-Id so users can quote it in reports.
+func Tracing() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		if traceID, spanID, sampled, ok := tracing.ParseTraceparent(c.GetHeader("traceparent")); ok {
+			ctx = tracing.ContextWithRemoteParent(ctx, traceID, spanID, sampled)
+		}
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		ctx, span := tracing.Start(ctx, c.Request.Method+" "+route, tracing.KindServer,
+			tracing.String("http.request.method", c.Request.Method),
+			tracing.String("http.route", route),
+			tracing.String("client.address", c.ClientIP()),
+		)
+		defer span.End()
+		if span != nil {
+			c.Header("X-Trace-Id", span.TraceID().String())
+		}
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttrs(tracing.Int("http.response.status_code", status))
+		if userID, ok := GetUserID(c); ok {
+			span.SetAttrs(tracing.String("user_id", userID.String()))
+		}
+		if id := c.Param("id"); id != "" {
+			span.SetAttrs(tracing.String("tunnel_id", id))
+		}
+		if len(c.Errors) > 0 {
+			for _, err := range c.Errors {
+				span.RecordError(err.Err)
+			}
+		} else if status >= 500 {
+			span.SetStatus(tracing.StatusError, http.StatusText(status))
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"tunnel-api/internal/tracing"
+)
+
+func TestTracingContinuesRemoteTrace(t *testing.T) {
+	exp := tracing.NewInMemoryExporter()
+	tracer := tracing.NewTracer(tracing.Config{Exporter: exp, SampleRatio: 1})
+	tracing.SetDefault(tracer)
+	t.Cleanup(func() {
+		tracing.SetDefault(nil)
+		tracer.Shutdown(context.Background())
+	})
+
+	gin.SetMode(gin.TestMode)
+	userID := uuid.New()
+	r := gin.New()
+	r.Use(Tracing())
+	r.GET("/api/tunnels/:id", func(c *gin.Context) {
+		c.Set(AuthUserIDKey, userID)
+		_, span := tracing.Start(c.Request.Context(), "db.query", tracing.KindClient)
+		span.End()
+		c.Status(http.StatusOK)
+	})
+
+	const (
+		remoteTrace = "4bf92f3577b34da6a3ce929d0e0e4736"
+		remoteSpan  = "00f067aa0ba902b7"
+	)
+	req := httptest.NewRequest(http.MethodGet, "/api/tunnels/t1", nil)
+	req.Header.Set("traceparent", "00-"+remoteTrace+"-"+remoteSpan+"-01")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+
+	if got := rec.Header().Get("X-Trace-Id"); got != remoteTrace {
+		t.Fatalf("X-Trace-Id = %q, want %q", got, remoteTrace)
+	}
+
+	tracer.ForceFlush(context.Background())
+	spans := exp.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	query, server := spans[0], spans[1]
+	if server.Name != "GET /api/tunnels/:id" || server.Kind != tracing.KindServer {
+		t.Fatalf("server span = %q kind %d", server.Name, server.Kind)
+	}
+	if server.TraceID.String() != remoteTrace || server.ParentID.String() != remoteSpan {
+		t.Errorf("server span trace %s parent %s, want %s %s", server.TraceID, server.ParentID, remoteTrace, remoteSpan)
+	}
+	if query.Name != "db.query" || query.TraceID != server.TraceID || query.ParentID != server.SpanID {
+		t.Errorf("query span %q trace %s parent %s, want child of %s", query.Name, query.TraceID, query.ParentID, server.SpanID)
+	}
+
+	for key, want := range map[string]any{
+		"http.request.method":       "GET",
+		"http.route":                "/api/tunnels/:id",
+		"client.address":            "192.0.2.1",
+		"http.response.status_code": int64(http.StatusOK),
+		"user_id":                   userID.String(),
+		"tunnel_id":                 "t1",
+	} {
+		if got := server.Attr(key); got != want {
+			t.Errorf("%s = %v, want %v", key, got, want)
+		}
+	}
+	if server.Status != tracing.StatusUnset {
+		t.Errorf("status = %d, want unset", server.Status)
+	}
+}
+
+func TestTracingMarksServerErrors(t *testing.T) {
+	exp := tracing.NewInMemoryExporter()
+	tracer := tracing.NewTracer(tracing.Config{Exporter: exp, SampleRatio: 1})
+	tracing.SetDefault(tracer)
+	t.Cleanup(func() {
+		tracing.SetDefault(nil)
+		tracer.Shutdown(context.Background())
+	})
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(Tracing())
+	r.GET("/fail", func(c *gin.Context) { c.Status(http.StatusServiceUnavailable) })
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/fail", nil))
+	traceID := rec.Header().Get("X-Trace-Id")
+	if len(traceID) != 32 {
+		t.Fatalf("X-Trace-Id = %q, want a new trace ID", traceID)
+	}
+
+	tracer.ForceFlush(context.Background())
+	spans := exp.Spans()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(spans))
+	}
+	if s := spans[0]; s.TraceID.String() != traceID || s.ParentID.IsValid() || s.Status != tracing.StatusError {
+		t.Errorf("span trace %s parent %s status %d, want root span of %s with error status", s.TraceID, s.ParentID, s.Status, traceID)
+	}
+}
@@ -0,0 +1,137 @@
+package models
+
+import (
+	"encoding/json"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// User roles, from least to most privileged.
+const (
+	RoleUser    = "user"
+	RoleSupport = "support" // read access to all users and tunnels, force-stop, 2FA resets
+	RoleAdmin   = "admin"   // also suspensions, account status, limits, roles and the audit log
+)
+
+// Roles lists the valid roles.
+var Roles = []string{RoleUser, RoleSupport, RoleAdmin}
+
+// ValidRole reports whether role is one of Roles.
+func ValidRole(role string) bool {
+	return slices.Contains(Roles, role)
+}
+
+// Audit log actions
+const (
+	AuditTunnelStop      = "tunnel.stop"
+	AuditTunnelSuspend   = "tunnel.suspend"
+	AuditTunnelUnsuspend = "tunnel.unsuspend"
+	AuditUserDisable     = "user.disable"
+	AuditUserEnable      = "user.enable"
+	AuditUserReset2FA    = "user.reset_2fa"
+	AuditUserLimits      = "user.limits"
+	AuditUserRole        = "user.role"
+)
+
+// Audit log target types
+const (
+	AuditTargetUser   = "user"
+	AuditTargetTunnel = "tunnel"
+)
+
+// UserLimits overrides the plan limits of one user; nil fields use the plan's value.
+type UserLimits struct {
+	UploadKbps        *int `json:"upload_kbps"`
+	DownloadKbps      *int `json:"download_kbps"`
+	MonthlyTransferGB *int `json:"monthly_transfer_gb"`
+}
+
+// AdminUser is a user as seen by support and admins.
+type AdminUser struct {
+	ID             uuid.UUID  `json:"id"`
+	Email          string     `json:"email"`
+	Role           string     `json:"role"`
+	Plan           string     `json:"plan"`
+	LimitOverrides UserLimits `json:"limit_overrides"`
+	TOTPEnabled    bool       `json:"totp_enabled"`
+	DisabledAt     *time.Time `json:"disabled_at"`
+	DisabledReason *string    `json:"disabled_reason"`
+	Tunnels        int        `json:"tunnels"`
+	ActiveTunnels  int        `json:"active_tunnels"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+// AdminUserColumns is the column list matching AdminUser.ScanFields, for a
+// query on users aliased as u.
+const AdminUserColumns = `u.id, u.email, u.role, u.plan, u.upload_kbps, u.download_kbps, u.monthly_transfer_gb,
+	COALESCE(u.totp_enabled, FALSE), u.disabled_at, u.disabled_reason,
+	(SELECT COUNT(*) FROM tunnels t WHERE t.user_id = u.id),
+	(SELECT COUNT(*) FROM tunnels t WHERE t.user_id = u.id AND t.is_active),
+	u.created_at`
+
+// ScanFields returns scan destinations for a row selected with AdminUserColumns.
+func (u *AdminUser) ScanFields() []any {
+	return []any{&u.ID, &u.Email, &u.Role, &u.Plan,
+		&u.LimitOverrides.UploadKbps, &u.LimitOverrides.DownloadKbps, &u.LimitOverrides.MonthlyTransferGB,
+		&u.TOTPEnabled, &u.DisabledAt, &u.DisabledReason, &u.Tunnels, &u.ActiveTunnels, &u.CreatedAt}
+}
+
+// AdminTunnel is a tunnel as seen by support and admins: the owner's view
+// with live client state, plus the owner.
+type AdminTunnel struct {
+	TunnelResponse
+	UserID      uuid.UUID  `json:"user_id"`
+	OwnerEmail  string     `json:"owner_email"`
+	SuspendedAt *time.Time `json:"suspended_at"`
+}
+
+// AdminClient is a desktop app attached to a tunnel server.
+type AdminClient struct {
+	Region         string    `json:"region"`
+	TunnelID       string    `json:"tunnel_id"`
+	ConnectedSince time.Time `json:"connected_since"`
+	RemoteAddr     string    `json:"remote_addr"`
+	Version        string    `json:"version"`
+	RTTMs          *float64  `json:"rtt_ms"`
+}
+
+// AuditEntry is one recorded admin action.
+type AuditEntry struct {
+	ID         int64           `json:"id"`
+	ActorID    *uuid.UUID      `json:"actor_id"` // nil once the actor's account is deleted
+	ActorEmail string          `json:"actor_email"`
+	Action     string          `json:"action"`
+	TargetType string          `json:"target_type"` // user or tunnel
+	TargetID   uuid.UUID       `json:"target_id"`
+	Details    json.RawMessage `json:"details"`
+	CreatedAt  time.Time       `json:"created_at"`
+}
+
+// AuditEntryColumns is the column list matching AuditEntry.ScanFields.
+const AuditEntryColumns = `id, actor_id, actor_email, action, target_type, target_id, details, created_at`
+
+// ScanFields returns scan destinations for a row selected with AuditEntryColumns.
+func (e *AuditEntry) ScanFields() []any {
+	return []any{&e.ID, &e.ActorID, &e.ActorEmail, &e.Action, &e.TargetType, &e.TargetID, &e.Details, &e.CreatedAt}
+}
+
+// Request DTOs
+
+type AdminReasonRequest struct {
+	Reason string `json:"reason" binding:"required,max=500"`
+}
+
+type SetUserRoleRequest struct {
+	Role string `json:"role" binding:"required,oneof=user support admin"`
+}
+
+// SetUserLimitsRequest replaces a user's limit overrides; nil clears one.
+// An empty plan keeps the current plan.
+type SetUserLimitsRequest struct {
+	Plan              string `json:"plan"`
+	UploadKbps        *int   `json:"upload_kbps" binding:"omitempty,min=0"`
+	DownloadKbps      *int   `json:"download_kbps" binding:"omitempty,min=0"`
+	MonthlyTransferGB *int   `json:"monthly_transfer_gb" binding:"omitempty,min=0"`
+}
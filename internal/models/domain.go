@@ -0,0 +1,93 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Custom domain verification states.
+const (
+	DomainPending  = "pending"  // TXT record not found yet
+	DomainVerified = "verified" // routed to the tunnel
+	DomainFailing  = "failing"  // verified, but recent re-checks failed (still routed)
+)
+
+// CustomDomain is a hostname attached to a tunnel. It is routed once the
+// owner proves control of it with a TXT record containing Token.
+type CustomDomain struct {
+	ID         uuid.UUID  `json:"id"`
+	TunnelID   uuid.UUID  `json:"tunnel_id"`
+	Hostname   string     `json:"hostname"`
+	Token      string     `json:"-"`
+	Verified   bool       `json:"verified"`
+	VerifiedAt *time.Time `json:"verified_at"`
+	CheckedAt  *time.Time `json:"checked_at"`
+	CheckError *string    `json:"check_error"`
+	Failures   int        `json:"-"` // consecutive failed re-checks
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// CustomDomainColumns is the column list matching CustomDomain.ScanFields.
+const CustomDomainColumns = `id, tunnel_id, hostname, token, verified, verified_at, checked_at, check_error, failures, created_at`
+
+// ScanFields returns scan destinations for a row selected with CustomDomainColumns.
+func (d *CustomDomain) ScanFields() []any {
+	return []any{&d.ID, &d.TunnelID, &d.Hostname, &d.Token, &d.Verified, &d.VerifiedAt,
+		&d.CheckedAt, &d.CheckError, &d.Failures, &d.CreatedAt}
+}
+
+// Status returns DomainPending, DomainVerified or DomainFailing.
+func (d *CustomDomain) Status() string {
+	switch {
+	case !d.Verified:
+		return DomainPending
+	case d.Failures > 0:
+		return DomainFailing
+	default:
+		return DomainVerified
+	}
+}
+
+type AddCustomDomainRequest struct {
+	Hostname string `json:"hostname" binding:"required,max=253"`
+}
+
+// DNSRecord is a record the owner has to create at their DNS provider.
+type DNSRecord struct {
+	Type  string `json:"type"`
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type CustomDomainResponse struct {
+	ID         uuid.UUID  `json:"id"`
+	Hostname   string     `json:"hostname"`
+	Status     string     `json:"status"`
+	VerifiedAt *time.Time `json:"verified_at"`
+	CheckedAt  *time.Time `json:"checked_at"`
+	CheckError *string    `json:"check_error"`
+	CreatedAt  time.Time  `json:"created_at"`
+
+	// Records to create: the TXT challenge proving ownership, and a CNAME
+	// pointing the hostname at the tunnel
+	Records []DNSRecord `json:"records"`
+}
+
+// ToResponse builds the response; challengeName and challengeValue are the
+// TXT record, target the tunnel's own hostname.
+func (d *CustomDomain) ToResponse(challengeName, challengeValue, target string) CustomDomainResponse {
+	return CustomDomainResponse{
+		ID:         d.ID,
+		Hostname:   d.Hostname,
+		Status:     d.Status(),
+		VerifiedAt: d.VerifiedAt,
+		CheckedAt:  d.CheckedAt,
+		CheckError: d.CheckError,
+		CreatedAt:  d.CreatedAt,
+		Records: []DNSRecord{
+			{Type: "TXT", Name: challengeName, Value: challengeValue},
+			{Type: "CNAME", Name: d.Hostname, Value: target},
+		},
+	}
+}
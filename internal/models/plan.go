@@ -0,0 +1,31 @@
+package models
+
+import "time"
+
+// Plan limits. Bandwidth is in kbit/s; zero values are unlimited.
+type Plan struct {
+	Name              string `json:"name"`
+	UploadKbps        int    `json:"upload_kbps"`
+	DownloadKbps      int    `json:"download_kbps"`
+	MonthlyTransferGB int    `json:"monthly_transfer_gb"`
+}
+
+// Quota states
+const (
+	QuotaOK        = "ok"
+	QuotaThrottled = "throttled"
+	QuotaSuspended = "suspended"
+)
+
+// TunnelLimitsResponse describes the limits applied to a tunnel. Transfer is
+// counted per user over all tunnels, in both directions, for the calendar month (UTC).
+type TunnelLimitsResponse struct {
+	Plan                Plan      `json:"plan"`
+	State               string    `json:"state"` // ok, throttled, suspended
+	UploadBytesPerSec   int64     `json:"upload_bytes_per_sec"`
+	DownloadBytesPerSec int64     `json:"download_bytes_per_sec"`
+	MonthlyTransfer     int64     `json:"monthly_transfer_bytes"` // 0 = unlimited
+	UsedTransfer        int64     `json:"used_transfer_bytes"`
+	ResetsAt            time.Time `json:"resets_at"`
+	Reason              string    `json:"reason,omitempty"`
+}
@@ -0,0 +1,11 @@
+package models
+
+import "time"
+
+// Region is a location tunnels can be created in, served by an edge node.
+type Region struct {
+	Name     string     `json:"name"`
+	Domain   string     `json:"domain"` // base domain of the region's tunnel addresses
+	Online   bool       `json:"online"`
+	LastSeen *time.Time `json:"last_seen,omitempty"` // last heartbeat of a remote edge node
+}
@@ -20,6 +20,72 @@ type Tunnel struct {
 	UDPPublicPort *int      `json:"udp_public_port"` // allocated public UDP port (stable)
 	CreatedAt     time.Time `json:"created_at"`
 	UpdatedAt     time.Time `json:"updated_at"`
+
+	HTTPCacheEnabled bool `json:"http_cache_enabled"` // cache web map responses at the edge
+	TCPLocalPort     *int `json:"tcp_local_port"`     // local port of the raw TCP channel (nil = disabled)
+	TCPPublicPort    *int `json:"tcp_public_port"`    // allocated public TCP port (stable)
+
+	// Set while an admin keeps the tunnel from starting
+	SuspendedAt     *time.Time `json:"suspended_at"`
+	SuspendedReason *string    `json:"suspended_reason"`
+
+	UDPMappings []UDPMapping `json:"udp_mappings"` // loaded from tunnel_udp_mappings
+}
+
+// TunnelColumns is the column list matching Tunnel.ScanFields.
+const TunnelColumns = `id, user_id, name, subdomain, region, is_active,
+	mc_local_port, http_local_port, udp_local_port, udp_public_port,
+	http_cache_enabled, tcp_local_port, tcp_public_port, created_at, updated_at,
+	suspended_at, suspended_reason`
+
+// ScanFields returns scan destinations for a row selected with TunnelColumns.
+func (t *Tunnel) ScanFields() []any {
+	return []any{
+		&t.ID, &t.UserID, &t.Name, &t.Subdomain, &t.Region, &t.IsActive,
+		&t.MCLocalPort, &t.HTTPLocalPort, &t.UDPLocalPort, &t.UDPPublicPort,
+		&t.HTTPCacheEnabled, &t.TCPLocalPort, &t.TCPPublicPort, &t.CreatedAt, &t.UpdatedAt,
+		&t.SuspendedAt, &t.SuspendedReason,
+	}
+}
+
+// UDPMapping is an additional UDP service exposed by a tunnel
+// (e.g. a Geyser/Bedrock listener or a non-Minecraft game server).
+type UDPMapping struct {
+	ID         uuid.UUID `json:"id"`
+	TunnelID   uuid.UUID `json:"tunnel_id"`
+	Label      string    `json:"label"`
+	LocalPort  int       `json:"local_port"`
+	PublicPort int       `json:"public_port"` // allocated from the UDP pool (stable)
+	Enabled    bool      `json:"enabled"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// UDPMappingColumns is the column list matching UDPMapping.ScanFields.
+const UDPMappingColumns = `id, tunnel_id, label, local_port, public_port, enabled, created_at`
+
+// ScanFields returns scan destinations for a row selected with UDPMappingColumns.
+func (m *UDPMapping) ScanFields() []any {
+	return []any{&m.ID, &m.TunnelID, &m.Label, &m.LocalPort, &m.PublicPort, &m.Enabled, &m.CreatedAt}
+}
+
+type UDPMappingResponse struct {
+	ID         uuid.UUID `json:"id"`
+	Label      string    `json:"label"`
+	Address    string    `json:"address"`
+	PublicPort int       `json:"public_port"`
+	LocalPort  int       `json:"local_port"`
+	Enabled    bool      `json:"enabled"`
+}
+
+func (m *UDPMapping) ToResponse(fullAddr string) UDPMappingResponse {
+	return UDPMappingResponse{
+		ID:         m.ID,
+		Label:      m.Label,
+		Address:    fmt.Sprintf("%s:%d", fullAddr, m.PublicPort),
+		PublicPort: m.PublicPort,
+		LocalPort:  m.LocalPort,
+		Enabled:    m.Enabled,
+	}
 }
 
 type TunnelResponse struct {
@@ -29,19 +95,40 @@ type TunnelResponse struct {
 	Region    string    `json:"region"`
 	IsActive  bool      `json:"is_active"`
 
+	// Suspended tunnels cannot be started; the reason is shown to the owner
+	Suspended       bool    `json:"suspended"`
+	SuspendedReason *string `json:"suspended_reason"`
+
+	// Desktop app attached to the tunnel server, filled in by the handler
+	// from the live connection (nil while no client is connected)
+	ClientConnected      bool       `json:"client_connected"`
+	ClientConnectedSince *time.Time `json:"client_connected_since"`
+	ClientRemoteAddr     *string    `json:"client_remote_addr"`
+	ClientVersion        *string    `json:"client_version"`
+	ClientRTTMs          *float64   `json:"client_rtt_ms"`
+
 	// Minecraft TCP — players connect without specifying port (standard 25565)
 	MCAddress   string `json:"mc_address"`
 	MCLocalPort int    `json:"mc_local_port"`
 
 	// HTTP (optional) — web map like Dynmap/BlueMap
-	HTTPAddress   *string `json:"http_address"`
-	HTTPLocalPort *int    `json:"http_local_port"`
+	HTTPAddress      *string `json:"http_address"`
+	HTTPLocalPort    *int    `json:"http_local_port"`
+	HTTPCacheEnabled bool    `json:"http_cache_enabled"`
 
 	// UDP Voice Chat — one dedicated port per tunnel
 	UDPAddress    string `json:"udp_address"`
 	UDPPublicPort int    `json:"udp_public_port"`
 	UDPLocalPort  int    `json:"udp_local_port"`
 
+	// Raw TCP (optional) — RCON, SFTP, other games; one dedicated port per tunnel
+	TCPAddress    *string `json:"tcp_address"`
+	TCPPublicPort *int    `json:"tcp_public_port"`
+	TCPLocalPort  *int    `json:"tcp_local_port"`
+
+	// Additional UDP services — each with its own dedicated port
+	UDPMappings []UDPMappingResponse `json:"udp_mappings"`
+
 	CreatedAt time.Time `json:"created_at"`
 }
 
@@ -56,13 +143,18 @@ func (t *Tunnel) ToResponse(domain string) TunnelResponse {
 		MCAddress:    fullAddr,
 		MCLocalPort:  t.MCLocalPort,
 		UDPLocalPort: t.UDPLocalPort,
+		UDPMappings:  []UDPMappingResponse{},
 		CreatedAt:    t.CreatedAt,
+
+		Suspended:       t.SuspendedAt != nil,
+		SuspendedReason: t.SuspendedReason,
 	}
 
 	if t.HTTPLocalPort != nil {
 		httpAddr := "map." + fullAddr
 		resp.HTTPAddress = &httpAddr
 		resp.HTTPLocalPort = t.HTTPLocalPort
+		resp.HTTPCacheEnabled = t.HTTPCacheEnabled
 	}
 
 	if t.UDPPublicPort != nil {
@@ -70,23 +162,59 @@ func (t *Tunnel) ToResponse(domain string) TunnelResponse {
 		resp.UDPAddress = fmt.Sprintf("%s:%d", fullAddr, *t.UDPPublicPort)
 	}
 
+	if t.TCPLocalPort != nil && t.TCPPublicPort != nil {
+		tcpAddr := fmt.Sprintf("%s:%d", fullAddr, *t.TCPPublicPort)
+		resp.TCPAddress = &tcpAddr
+		resp.TCPPublicPort = t.TCPPublicPort
+		resp.TCPLocalPort = t.TCPLocalPort
+	}
+
+	for _, m := range t.UDPMappings {
+		resp.UDPMappings = append(resp.UDPMappings, m.ToResponse(fullAddr))
+	}
+
 	return resp
 }
 
 // Request DTOs
 
 type CreateTunnelRequest struct {
-	Name          string `json:"name" binding:"required,min=1,max=100"`
-	MCLocalPort   int    `json:"mc_local_port"`   // defaults to 25565
-	HTTPLocalPort *int   `json:"http_local_port"` // nil = disabled
-	UDPLocalPort  int    `json:"udp_local_port"`  // defaults to 24454
+	Name             string `json:"name" binding:"required,min=1,max=100"`
+	Subdomain        string `json:"subdomain"`          // empty = generate one
+	Region           string `json:"region"`             // empty = the control plane's REGION
+	MCLocalPort      int    `json:"mc_local_port"`      // defaults to 25565
+	HTTPLocalPort    *int   `json:"http_local_port"`    // nil = disabled
+	HTTPCacheEnabled bool   `json:"http_cache_enabled"` // cache web map tiles at the edge
+	UDPLocalPort     int    `json:"udp_local_port"`     // defaults to 24454
+	TCPLocalPort     *int   `json:"tcp_local_port"`     // raw TCP channel, nil = disabled
+
+	UDPMappings []CreateUDPMappingRequest `json:"udp_mappings" binding:"omitempty,dive"` // extra UDP services
 }
 
 type UpdateTunnelRequest struct {
-	Name          *string `json:"name"`
-	MCLocalPort   *int    `json:"mc_local_port"`
-	HTTPLocalPort *int    `json:"http_local_port"` // set to 0 to disable HTTP
-	UDPLocalPort  *int    `json:"udp_local_port"`
+	Name             *string `json:"name"`
+	Subdomain        *string `json:"subdomain"` // renames the tunnel, also while active
+	MCLocalPort      *int    `json:"mc_local_port"`
+	HTTPLocalPort    *int    `json:"http_local_port"` // set to 0 to disable HTTP
+	HTTPCacheEnabled *bool   `json:"http_cache_enabled"`
+	UDPLocalPort     *int    `json:"udp_local_port"`
+	TCPLocalPort     *int    `json:"tcp_local_port"` // set to 0 to disable raw TCP
+}
+
+type MoveTunnelRequest struct {
+	Region string `json:"region" binding:"required"`
+}
+
+type CreateUDPMappingRequest struct {
+	Label     string `json:"label" binding:"required,min=1,max=50"`
+	LocalPort int    `json:"local_port" binding:"required,min=1,max=65535"`
+	Enabled   *bool  `json:"enabled"` // defaults to true
+}
+
+type UpdateUDPMappingRequest struct {
+	Label     *string `json:"label"`
+	LocalPort *int    `json:"local_port"`
+	Enabled   *bool   `json:"enabled"`
 }
 
 type TunnelListResponse struct {
@@ -0,0 +1,34 @@
+package models
+
+import "time"
+
+// UsageCounters is traffic of one channel (or a sum of channels).
+// Ingress is player → owner's server, egress is owner's server → player.
+type UsageCounters struct {
+	BytesIn     int64 `json:"bytes_in"`
+	BytesOut    int64 `json:"bytes_out"`
+	Connections int64 `json:"connections"`
+	BytesSaved  int64 `json:"bytes_saved"` // by compression of web map traffic
+}
+
+func (u *UsageCounters) Add(o UsageCounters) {
+	u.BytesIn += o.BytesIn
+	u.BytesOut += o.BytesOut
+	u.Connections += o.Connections
+	u.BytesSaved += o.BytesSaved
+}
+
+type UsageBucket struct {
+	Time     time.Time                `json:"time"`
+	Channels map[string]UsageCounters `json:"channels"` // mc, http, udp, tcp
+	Total    UsageCounters            `json:"total"`
+}
+
+type UsageResponse struct {
+	From        time.Time                `json:"from"`
+	To          time.Time                `json:"to"`
+	Granularity string                   `json:"granularity"`
+	Buckets     []UsageBucket            `json:"buckets"`
+	Channels    map[string]UsageCounters `json:"channels"` // per-channel totals over the range
+	Total       UsageCounters            `json:"total"`
+}
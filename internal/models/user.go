@@ -12,6 +12,8 @@ type User struct {
 	PasswordHash string     `json:"-"` // Never expose in JSON
 	TOTPSecret   *string    `json:"-"` // Never expose
 	TOTPEnabled  bool       `json:"totp_enabled"`
+	Role         string     `json:"role"`
+	DisabledAt   *time.Time `json:"disabled_at"`
 	CreatedAt    time.Time  `json:"created_at"`
 	UpdatedAt    time.Time  `json:"updated_at"`
 }
@@ -20,6 +22,7 @@ type UserResponse struct {
 	ID          uuid.UUID `json:"id"`
 	Email       string    `json:"email"`
 	TOTPEnabled bool      `json:"totp_enabled"`
+	Role        string    `json:"role"`
 	CreatedAt   time.Time `json:"created_at"`
 }
 
@@ -28,6 +31,7 @@ func (u *User) ToResponse() UserResponse {
 		ID:          u.ID,
 		Email:       u.Email,
 		TOTPEnabled: u.TOTPEnabled,
+		Role:        u.Role,
 		CreatedAt:   u.CreatedAt,
 	}
 }
@@ -0,0 +1,517 @@
+// Package routes shares the routing state of a region's tunnel servers so
+// several instances can run behind one load balancer (ROUTE_STORE).
+//
+// The Postgres store keeps one row per registered tunnel with its
+// registration and the node its client is attached to. Changes are announced
+// with NOTIFY; the other nodes re-read the row and apply it to their own
+// tunnel.Server, so every node can accept the tunnel's client and knows where
+// to forward players to.
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"reflect"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"tunnel-api/internal/logging"
+	"tunnel-api/internal/tunnel"
+)
+
+const channel = "tunnel_routes"
+
+const (
+	claimQueueSize = 1024
+	// resyncInterval is how often the write loop checks whether dropped
+	// claim writes must be made up for.
+	resyncInterval = 5 * time.Second
+)
+
+// The table is created here rather than in the API migrations because edge
+// nodes may share a database of their own. Rows are per region: a moved
+// tunnel keeps a row in its old region (moved) while its redirect lasts.
+const schema = `CREATE TABLE IF NOT EXISTS tunnel_routes (
+	region VARCHAR(10) NOT NULL,
+	tunnel_id VARCHAR(64) NOT NULL,
+	registration JSONB NOT NULL,
+	owner TEXT,
+	client JSONB,
+	moved JSONB,
+	updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+	PRIMARY KEY (region, tunnel_id)
+)`
+
+type notification struct {
+	Region   string `json:"region"`
+	Node     string `json:"node"`
+	TunnelID string `json:"tunnel_id"`
+}
+
+type owner struct {
+	node string
+	info tunnel.ClientInfo
+}
+
+// route is a row of the region.
+type route struct {
+	reg   tunnel.TunnelRegistration
+	owner owner
+	moved *tunnel.MoveTarget
+}
+
+// Postgres is a tunnel.RouteStore backed by a table and LISTEN/NOTIFY. It is
+// also the edge.Node of the local server: changes made through it are
+// replicated to the other nodes of the region.
+type Postgres struct {
+	pool   *pgxpool.Pool
+	region string
+	node   string // this node's peer address
+	log    *slog.Logger
+	server *tunnel.Server
+
+	mu     sync.RWMutex
+	owners map[string]owner // tunnel ID → node holding the client
+
+	claims chan func(context.Context) error // ordered claim/release writes
+	resync atomic.Bool                      // writes were dropped; rewrite this node's claims
+}
+
+func NewPostgres(pool *pgxpool.Pool, region, node string, logger *slog.Logger) *Postgres {
+	return &Postgres{
+		pool:   pool,
+		region: region,
+		node:   node,
+		log:    logger.With(logging.Subsystem, "routes"),
+		owners: make(map[string]owner),
+		claims: make(chan func(context.Context) error, claimQueueSize),
+	}
+}
+
+// Run creates the table, drops claims left over from a previous run of this
+// node and expired redirects, and starts following the other nodes' changes.
+// srv must be the server the store was configured on.
+func (p *Postgres) Run(ctx context.Context, srv *tunnel.Server) error {
+	p.server = srv
+	if _, err := p.pool.Exec(ctx, schema); err != nil {
+		return err
+	}
+	if _, err := p.pool.Exec(ctx,
+		`UPDATE tunnel_routes SET owner = NULL, client = NULL WHERE region = $1 AND owner = $2`, p.region, p.node); err != nil {
+		return err
+	}
+	if _, err := p.pool.Exec(ctx,
+		`DELETE FROM tunnel_routes WHERE region = $1 AND moved IS NOT NULL AND updated_at < $2`,
+		p.region, time.Now().Add(-tunnel.MoveRedirectTTL)); err != nil {
+		return err
+	}
+	go p.writeLoop(ctx)
+	go p.listenLoop(ctx)
+	return nil
+}
+
+// ---- tunnel.RouteStore ----
+
+func (p *Postgres) Claim(tunnelID string, info tunnel.ClientInfo) {
+	p.mu.Lock()
+	p.owners[tunnelID] = owner{node: p.node, info: info}
+	p.mu.Unlock()
+
+	client, _ := json.Marshal(info)
+	p.queue(func(ctx context.Context) error {
+		_, err := p.pool.Exec(ctx,
+			`UPDATE tunnel_routes SET owner = $3, client = $4, updated_at = NOW()
+			 WHERE region = $1 AND tunnel_id = $2 AND moved IS NULL`,
+			p.region, tunnelID, p.node, client)
+		if err != nil {
+			return err
+		}
+		return p.notify(ctx, tunnelID)
+	})
+}
+
+func (p *Postgres) Release(tunnelID string) {
+	p.mu.Lock()
+	if o, ok := p.owners[tunnelID]; ok && o.node == p.node {
+		delete(p.owners, tunnelID)
+	}
+	p.mu.Unlock()
+
+	p.queue(func(ctx context.Context) error {
+		tag, err := p.pool.Exec(ctx,
+			`UPDATE tunnel_routes SET owner = NULL, client = NULL, updated_at = NOW()
+			 WHERE region = $1 AND tunnel_id = $2 AND owner = $3`,
+			p.region, tunnelID, p.node)
+		if err != nil || tag.RowsAffected() == 0 {
+			return err
+		}
+		return p.notify(ctx, tunnelID)
+	})
+}
+
+func (p *Postgres) Owner(tunnelID string) (string, tunnel.ClientInfo, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	o, ok := p.owners[tunnelID]
+	return o.node, o.info, ok
+}
+
+// ---- edge.Node ----
+
+func (p *Postgres) Register(ctx context.Context, reg tunnel.TunnelRegistration) error {
+	p.server.RegisterTunnel(reg)
+	return p.save(ctx, reg.TunnelID)
+}
+
+func (p *Postgres) Unregister(ctx context.Context, tunnelID string) error {
+	p.server.UnregisterTunnel(tunnelID)
+	p.mu.Lock()
+	delete(p.owners, tunnelID)
+	p.mu.Unlock()
+	if _, err := p.pool.Exec(ctx,
+		`DELETE FROM tunnel_routes WHERE region = $1 AND tunnel_id = $2`, p.region, tunnelID); err != nil {
+		return err
+	}
+	return p.notify(ctx, tunnelID)
+}
+
+func (p *Postgres) Rename(ctx context.Context, tunnelID, subdomain string) error {
+	p.server.RenameTunnel(tunnelID, subdomain)
+	return p.save(ctx, tunnelID)
+}
+
+func (p *Postgres) SetHostnames(ctx context.Context, tunnelID string, hostnames []string) error {
+	p.server.SetTunnelHostnames(tunnelID, hostnames)
+	return p.save(ctx, tunnelID)
+}
+
+func (p *Postgres) SetLimits(ctx context.Context, tunnelID string, limits tunnel.TunnelLimits) error {
+	p.server.SetTunnelLimits(tunnelID, limits)
+	return p.save(ctx, tunnelID)
+}
+
+// Move replaces the region's row with a redirect; the other nodes drop the
+// tunnel and redirect its players too.
+func (p *Postgres) Move(ctx context.Context, tunnelID string, target tunnel.MoveTarget) error {
+	p.server.MoveTunnel(tunnelID, target)
+	p.mu.Lock()
+	delete(p.owners, tunnelID)
+	p.mu.Unlock()
+	data, err := json.Marshal(target)
+	if err != nil {
+		return err
+	}
+	if _, err := p.pool.Exec(ctx,
+		`UPDATE tunnel_routes SET moved = $3, owner = NULL, client = NULL, updated_at = NOW()
+		 WHERE region = $1 AND tunnel_id = $2`,
+		p.region, tunnelID, data); err != nil {
+		return err
+	}
+	return p.notify(ctx, tunnelID)
+}
+
+// save stores the local registration of a tunnel and announces it.
+func (p *Postgres) save(ctx context.Context, tunnelID string) error {
+	reg, ok := p.server.Registration(tunnelID)
+	if !ok {
+		return nil
+	}
+	data, err := json.Marshal(reg)
+	if err != nil {
+		return err
+	}
+	_, err = p.pool.Exec(ctx,
+		`INSERT INTO tunnel_routes (region, tunnel_id, registration) VALUES ($1, $2, $3)
+		 ON CONFLICT (region, tunnel_id) DO UPDATE SET registration = $3, moved = NULL, updated_at = NOW()`,
+		p.region, tunnelID, data)
+	if err != nil {
+		return err
+	}
+	return p.notify(ctx, tunnelID)
+}
+
+func (p *Postgres) notify(ctx context.Context, tunnelID string) error {
+	payload, _ := json.Marshal(notification{Region: p.region, Node: p.node, TunnelID: tunnelID})
+	_, err := p.pool.Exec(ctx, `SELECT pg_notify($1, $2)`, channel, string(payload))
+	return err
+}
+
+// ---- Writes and notifications ----
+
+// queue schedules a claim write. Claims and releases also come from
+// notification handling, so a full queue drops the write rather than stall
+// it; the write loop then rewrites all of this node's claims once it has
+// caught up.
+func (p *Postgres) queue(write func(context.Context) error) {
+	select {
+	case p.claims <- write:
+	default:
+		if !p.resync.Swap(true) {
+			p.log.Warn("Client route queue full, resyncing claims once drained")
+		}
+	}
+}
+
+func (p *Postgres) writeLoop(ctx context.Context) {
+	ticker := time.NewTicker(resyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case write := <-p.claims:
+			wctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			if err := write(wctx); err != nil {
+				p.log.Warn("Failed to update client route", "error", err)
+			}
+			cancel()
+		case <-ticker.C:
+			if len(p.claims) > 0 || !p.resync.Swap(false) {
+				continue
+			}
+			wctx, cancel := context.WithTimeout(ctx, time.Minute)
+			if err := p.resyncClaims(wctx); err != nil {
+				p.log.Warn("Failed to resync client routes", "error", err)
+				p.resync.Store(true)
+			}
+			cancel()
+		}
+	}
+}
+
+// resyncClaims makes the table's claims of this node match the tunnels whose
+// clients are attached here, announcing every row it changes.
+func (p *Postgres) resyncClaims(ctx context.Context) error {
+	p.mu.RLock()
+	claimed := make(map[string]tunnel.ClientInfo)
+	for tunnelID, o := range p.owners {
+		if o.node == p.node {
+			claimed[tunnelID] = o.info
+		}
+	}
+	p.mu.RUnlock()
+
+	// Not nil: ANY(NULL) would release nothing
+	ids := make([]string, 0, len(claimed))
+	var changed []string
+	for tunnelID, info := range claimed {
+		ids = append(ids, tunnelID)
+		client, _ := json.Marshal(info)
+		tag, err := p.pool.Exec(ctx,
+			`UPDATE tunnel_routes SET owner = $3, client = $4, updated_at = NOW()
+			 WHERE region = $1 AND tunnel_id = $2 AND moved IS NULL
+			   AND (owner IS DISTINCT FROM $3 OR client IS DISTINCT FROM $4::jsonb)`,
+			p.region, tunnelID, p.node, client)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() > 0 {
+			changed = append(changed, tunnelID)
+		}
+	}
+
+	rows, err := p.pool.Query(ctx,
+		`UPDATE tunnel_routes SET owner = NULL, client = NULL, updated_at = NOW()
+		 WHERE region = $1 AND owner = $2 AND NOT (tunnel_id = ANY($3))
+		 RETURNING tunnel_id`,
+		p.region, p.node, ids)
+	if err != nil {
+		return err
+	}
+	released, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return err
+	}
+	changed = append(changed, released...)
+
+	for _, tunnelID := range changed {
+		if err := p.notify(ctx, tunnelID); err != nil {
+			return err
+		}
+	}
+	if len(changed) > 0 {
+		p.log.Info("Resynced client routes", "changed", len(changed))
+	}
+	return nil
+}
+
+// listenLoop follows notifications, reconnecting after errors. Every
+// (re)connect starts with a full load so missed notifications do not matter.
+func (p *Postgres) listenLoop(ctx context.Context) {
+	for {
+		err := p.listen(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		p.log.Warn("Route notifications interrupted, reconnecting", "error", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func (p *Postgres) listen(ctx context.Context) error {
+	conn, err := p.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	if _, err := conn.Exec(ctx, "LISTEN "+channel); err != nil {
+		return err
+	}
+	defer conn.Exec(context.Background(), "UNLISTEN "+channel)
+	if err := p.load(ctx); err != nil {
+		return err
+	}
+
+	for {
+		n, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		var msg notification
+		if err := json.Unmarshal([]byte(n.Payload), &msg); err != nil {
+			continue
+		}
+		if msg.Region != p.region || msg.Node == p.node {
+			continue
+		}
+		if err := p.sync(ctx, msg.TunnelID); err != nil {
+			p.log.Warn("Failed to apply route", "tunnel_id", msg.TunnelID, "error", err)
+		}
+	}
+}
+
+// load applies all routes of the region and drops local tunnels without one.
+func (p *Postgres) load(ctx context.Context) error {
+	rows, err := p.pool.Query(ctx,
+		`SELECT registration, COALESCE(owner, ''), client, moved FROM tunnel_routes WHERE region = $1`, p.region)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	seen := make(map[string]bool)
+	for rows.Next() {
+		r, err := scanRoute(rows)
+		if err != nil {
+			return err
+		}
+		if r.moved == nil {
+			seen[r.reg.TunnelID] = true
+		}
+		p.apply(r)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, id := range p.server.TunnelIDs() {
+		if !seen[id] {
+			p.drop(id)
+		}
+	}
+	p.log.Info("Routes loaded", "tunnels", len(seen))
+	return nil
+}
+
+// sync re-reads one tunnel's route after a notification.
+func (p *Postgres) sync(ctx context.Context, tunnelID string) error {
+	row := p.pool.QueryRow(ctx,
+		`SELECT registration, COALESCE(owner, ''), client, moved FROM tunnel_routes WHERE region = $1 AND tunnel_id = $2`,
+		p.region, tunnelID)
+	r, err := scanRoute(row)
+	if errors.Is(err, pgx.ErrNoRows) {
+		p.drop(tunnelID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	p.apply(r)
+	return nil
+}
+
+func scanRoute(row pgx.Row) (r route, err error) {
+	var data, client, moved []byte
+	if err = row.Scan(&data, &r.owner.node, &client, &moved); err != nil {
+		return r, err
+	}
+	if err = json.Unmarshal(data, &r.reg); err != nil {
+		return r, err
+	}
+	if client != nil {
+		json.Unmarshal(client, &r.owner.info)
+	}
+	if moved != nil {
+		r.moved = new(tunnel.MoveTarget)
+		if err = json.Unmarshal(moved, r.moved); err != nil {
+			return r, err
+		}
+	}
+	return r, nil
+}
+
+// apply brings the local server in line with a route stored by another node.
+// Renames, hostnames and limits are applied in place so clients stay
+// attached; other changes re-register the tunnel.
+func (p *Postgres) apply(r route) {
+	reg, o := r.reg, r.owner
+	if r.moved != nil {
+		p.mu.Lock()
+		delete(p.owners, reg.TunnelID)
+		p.mu.Unlock()
+		if _, ok := p.server.Registration(reg.TunnelID); ok {
+			p.server.MoveTunnel(reg.TunnelID, *r.moved)
+		} else {
+			p.server.RedirectTunnel(reg, *r.moved)
+		}
+		return
+	}
+
+	p.mu.Lock()
+	if o.node == "" {
+		delete(p.owners, reg.TunnelID)
+	} else {
+		p.owners[reg.TunnelID] = o
+	}
+	p.mu.Unlock()
+
+	cur, ok := p.server.Registration(reg.TunnelID)
+	if !ok {
+		p.server.RegisterTunnel(reg)
+		return
+	}
+	if cur.Subdomain != reg.Subdomain {
+		p.server.RenameTunnel(reg.TunnelID, reg.Subdomain)
+	}
+	if !slices.Equal(cur.Hostnames, reg.Hostnames) {
+		p.server.SetTunnelHostnames(reg.TunnelID, reg.Hostnames)
+	}
+	if cur.Limits != reg.Limits {
+		p.server.SetTunnelLimits(reg.TunnelID, reg.Limits)
+	}
+	cur.Subdomain, cur.Hostnames, cur.Limits = reg.Subdomain, reg.Hostnames, reg.Limits
+	if len(cur.UDPMappings) == 0 && len(reg.UDPMappings) == 0 {
+		cur.UDPMappings = reg.UDPMappings
+	}
+	if !reflect.DeepEqual(cur, reg) {
+		p.server.RegisterTunnel(reg)
+	}
+}
+
+// drop removes a tunnel another node unregistered.
+func (p *Postgres) drop(tunnelID string) {
+	p.mu.Lock()
+	delete(p.owners, tunnelID)
+	p.mu.Unlock()
+	p.server.UnregisterTunnel(tunnelID)
+}
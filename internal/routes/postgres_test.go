@@ -0,0 +1,41 @@
+package routes
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"tunnel-api/internal/tunnel"
+)
+
+// Claims and releases made while the write queue is full return at once and
+// leave a resync for the write loop.
+func TestQueueFullSchedulesResync(t *testing.T) {
+	p := NewPostgres(nil, "eu", "10.0.0.1:7000", slog.New(slog.NewTextHandler(io.Discard, nil)))
+	for range claimQueueSize {
+		p.queue(func(context.Context) error { return nil })
+	}
+	if p.resync.Load() {
+		t.Fatal("resync scheduled before the queue was full")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Claim("t1", tunnel.ClientInfo{})
+		p.Release("t2")
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Claim blocked on a full queue")
+	}
+	if !p.resync.Load() {
+		t.Error("no resync scheduled for the dropped writes")
+	}
+	if node, _, ok := p.Owner("t1"); !ok || node != "10.0.0.1:7000" {
+		t.Errorf("Owner = %q, %v; want the claim kept in memory", node, ok)
+	}
+}
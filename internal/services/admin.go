@@ -0,0 +1,560 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"tunnel-api/internal/database"
+	"tunnel-api/internal/logging"
+	"tunnel-api/internal/models"
+)
+
+var (
+	// ErrNotFound is returned when the user or tunnel of an admin action does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrSelfAction is returned when admins try to disable or demote themselves.
+	ErrSelfAction = errors.New("you cannot disable or demote your own account")
+	// ErrTunnelNotActive is returned when stopping a tunnel that is not running.
+	ErrTunnelNotActive = errors.New("tunnel is not active")
+	// ErrUnknownPlan is returned when assigning a plan that does not exist.
+	ErrUnknownPlan = errors.New("unknown plan")
+	// ErrStaffTarget is returned when support staff act on a support or admin account.
+	ErrStaffTarget = errors.New("only admins can do this to support and admin accounts")
+)
+
+// Actor is the support or admin user performing an action.
+type Actor struct {
+	ID    uuid.UUID
+	Email string
+	Role  string
+}
+
+// mayManage reports whether actor may act on an account with the given
+// role: support staff only manage regular users.
+func (actor Actor) mayManage(targetRole string) bool {
+	return actor.Role == models.RoleAdmin || targetRole == models.RoleUser
+}
+
+// UserFilter selects users in ListUsers. Zero values match everything.
+type UserFilter struct {
+	Query    string // substring of the email
+	Role     string
+	Disabled *bool
+	Limit    int
+	Offset   int
+}
+
+// TunnelFilter selects tunnels in ListTunnels. Zero values match everything.
+type TunnelFilter struct {
+	Query  string // substring of the name, subdomain or owner email
+	UserID *uuid.UUID
+	Region string
+	Active *bool
+	Limit  int
+	Offset int
+}
+
+// AuditFilter selects audit log entries. Zero values match everything.
+type AuditFilter struct {
+	TargetID *uuid.UUID
+	ActorID  *uuid.UUID
+	Action   string
+	Before   int64 // only entries with a lower ID, for paging
+	Limit    int
+}
+
+// OwnedTunnel is a tunnel with its owner's email.
+type OwnedTunnel struct {
+	models.Tunnel
+	OwnerEmail string
+}
+
+// AdminService implements the support and admin actions on users and
+// tunnels. Every change is recorded in the audit log in the same
+// transaction; tunnel servers are only told after it committed.
+type AdminService struct {
+	tunnels *TunnelService
+	quota   *QuotaService
+	log     *slog.Logger
+}
+
+func NewAdminService(tunnels *TunnelService, quota *QuotaService, logger *slog.Logger) *AdminService {
+	return &AdminService{
+		tunnels: tunnels,
+		quota:   quota,
+		log:     logger.With(logging.Subsystem, "admin"),
+	}
+}
+
+// ---- Queries ----
+
+// ListUsers returns the users matching f, newest first.
+func (a *AdminService) ListUsers(ctx context.Context, f UserFilter) ([]models.AdminUser, error) {
+	var where []string
+	var args []any
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	if f.Query != "" {
+		where = append(where, "u.email ILIKE "+arg("%"+escapeLike(f.Query)+"%"))
+	}
+	if f.Role != "" {
+		where = append(where, "u.role = "+arg(f.Role))
+	}
+	if f.Disabled != nil {
+		if *f.Disabled {
+			where = append(where, "u.disabled_at IS NOT NULL")
+		} else {
+			where = append(where, "u.disabled_at IS NULL")
+		}
+	}
+
+	query := `SELECT ` + models.AdminUserColumns + ` FROM users u`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	query += ` ORDER BY u.created_at DESC LIMIT ` + arg(f.Limit) + ` OFFSET ` + arg(f.Offset)
+
+	rows, err := database.Pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []models.AdminUser{}
+	for rows.Next() {
+		var u models.AdminUser
+		if err := rows.Scan(u.ScanFields()...); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// GetUser returns one user.
+func (a *AdminService) GetUser(ctx context.Context, userID uuid.UUID) (models.AdminUser, error) {
+	var u models.AdminUser
+	err := database.Pool.QueryRow(ctx,
+		`SELECT `+models.AdminUserColumns+` FROM users u WHERE u.id = $1`, userID,
+	).Scan(u.ScanFields()...)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return u, ErrNotFound
+	}
+	return u, err
+}
+
+// ownedTunnelColumns selects models.TunnelColumns and the owner's email.
+const ownedTunnelColumns = models.TunnelColumns + `, (SELECT email FROM users WHERE users.id = tunnels.user_id)`
+
+func (t *OwnedTunnel) scanFields() []any {
+	return append(t.ScanFields(), &t.OwnerEmail)
+}
+
+// ListTunnels returns the tunnels matching f, newest first, with their UDP mappings.
+func (a *AdminService) ListTunnels(ctx context.Context, f TunnelFilter) ([]*OwnedTunnel, error) {
+	var where []string
+	var args []any
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	if f.Query != "" {
+		q := arg("%" + escapeLike(f.Query) + "%")
+		where = append(where, "(name ILIKE "+q+" OR subdomain ILIKE "+q+
+			" OR user_id IN (SELECT id FROM users WHERE email ILIKE "+q+"))")
+	}
+	if f.UserID != nil {
+		where = append(where, "user_id = "+arg(*f.UserID))
+	}
+	if f.Region != "" {
+		where = append(where, "region = "+arg(f.Region))
+	}
+	if f.Active != nil {
+		where = append(where, "is_active = "+arg(*f.Active))
+	}
+
+	query := `SELECT ` + ownedTunnelColumns + ` FROM tunnels`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	query += ` ORDER BY created_at DESC LIMIT ` + arg(f.Limit) + ` OFFSET ` + arg(f.Offset)
+
+	rows, err := database.Pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	var list []*OwnedTunnel
+	var tunnels []*models.Tunnel
+	for rows.Next() {
+		var t OwnedTunnel
+		if err := rows.Scan(t.scanFields()...); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		list = append(list, &t)
+		tunnels = append(tunnels, &t.Tunnel)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return list, a.tunnels.LoadUDPMappings(ctx, tunnels...)
+}
+
+// GetTunnel returns one tunnel with its UDP mappings.
+func (a *AdminService) GetTunnel(ctx context.Context, tunnelID uuid.UUID) (*OwnedTunnel, error) {
+	var t OwnedTunnel
+	err := database.Pool.QueryRow(ctx,
+		`SELECT `+ownedTunnelColumns+` FROM tunnels WHERE id = $1`, tunnelID,
+	).Scan(t.scanFields()...)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, a.tunnels.LoadUDPMappings(ctx, &t.Tunnel)
+}
+
+// AuditLog returns the audit log entries matching f, newest first.
+func (a *AdminService) AuditLog(ctx context.Context, f AuditFilter) ([]models.AuditEntry, error) {
+	var where []string
+	var args []any
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	if f.TargetID != nil {
+		where = append(where, "target_id = "+arg(*f.TargetID))
+	}
+	if f.ActorID != nil {
+		where = append(where, "actor_id = "+arg(*f.ActorID))
+	}
+	if f.Action != "" {
+		where = append(where, "action = "+arg(f.Action))
+	}
+	if f.Before > 0 {
+		where = append(where, "id < "+arg(f.Before))
+	}
+
+	query := `SELECT ` + models.AuditEntryColumns + ` FROM audit_log`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	query += ` ORDER BY id DESC LIMIT ` + arg(f.Limit)
+
+	rows, err := database.Pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []models.AuditEntry{}
+	for rows.Next() {
+		var e models.AuditEntry
+		if err := rows.Scan(e.ScanFields()...); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// ---- Tunnel actions ----
+
+// StopTunnel force-stops an active tunnel. The owner can start it again.
+func (a *AdminService) StopTunnel(ctx context.Context, actor Actor, tunnelID uuid.UUID, reason string) error {
+	tx, err := database.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	t, err := lockTunnel(ctx, tx, tunnelID)
+	if err != nil {
+		return err
+	}
+	if !t.IsActive {
+		return ErrTunnelNotActive
+	}
+	if _, err := tx.Exec(ctx, `UPDATE tunnels SET is_active = FALSE, updated_at = NOW() WHERE id = $1`, tunnelID); err != nil {
+		return err
+	}
+	if err := a.audit(ctx, tx, actor, models.AuditTunnelStop, models.AuditTargetTunnel, tunnelID,
+		map[string]any{"reason": reason}); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	a.tunnels.StopTunnel(t)
+	return nil
+}
+
+// SuspendTunnel stops a tunnel and keeps its owner from starting it until
+// it is unsuspended. The reason is shown to the owner.
+func (a *AdminService) SuspendTunnel(ctx context.Context, actor Actor, tunnelID uuid.UUID, reason string) error {
+	tx, err := database.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	t, err := lockTunnel(ctx, tx, tunnelID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx,
+		`UPDATE tunnels SET suspended_at = NOW(), suspended_reason = $2, is_active = FALSE, updated_at = NOW()
+		 WHERE id = $1`,
+		tunnelID, reason,
+	)
+	if err != nil {
+		return err
+	}
+	if err := a.audit(ctx, tx, actor, models.AuditTunnelSuspend, models.AuditTargetTunnel, tunnelID,
+		map[string]any{"reason": reason, "was_active": t.IsActive}); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	if t.IsActive {
+		a.tunnels.StopTunnel(t)
+	}
+	return nil
+}
+
+// UnsuspendTunnel lets the owner start a suspended tunnel again.
+func (a *AdminService) UnsuspendTunnel(ctx context.Context, actor Actor, tunnelID uuid.UUID) error {
+	tx, err := database.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx,
+		`UPDATE tunnels SET suspended_at = NULL, suspended_reason = NULL, updated_at = NOW() WHERE id = $1`, tunnelID,
+	)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	if err := a.audit(ctx, tx, actor, models.AuditTunnelUnsuspend, models.AuditTargetTunnel, tunnelID, nil); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// lockTunnel loads a tunnel, locking its row until tx ends.
+func lockTunnel(ctx context.Context, tx pgx.Tx, tunnelID uuid.UUID) (models.Tunnel, error) {
+	var t models.Tunnel
+	err := tx.QueryRow(ctx,
+		`SELECT `+models.TunnelColumns+` FROM tunnels WHERE id = $1 FOR UPDATE`, tunnelID,
+	).Scan(t.ScanFields()...)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return t, ErrNotFound
+	}
+	return t, err
+}
+
+// ---- User actions ----
+
+// DisableUser locks a user out: their sessions end, their active tunnels
+// stop and they cannot log in or use the API until enabled again.
+func (a *AdminService) DisableUser(ctx context.Context, actor Actor, userID uuid.UUID, reason string) error {
+	if userID == actor.ID {
+		return ErrSelfAction
+	}
+	tx, err := database.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx,
+		`UPDATE users SET disabled_at = NOW(), disabled_reason = $2, updated_at = NOW() WHERE id = $1`,
+		userID, reason,
+	)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM refresh_tokens WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(ctx,
+		`UPDATE tunnels SET is_active = FALSE, updated_at = NOW() WHERE user_id = $1 AND is_active = TRUE
+		 RETURNING `+models.TunnelColumns,
+		userID,
+	)
+	if err != nil {
+		return err
+	}
+	var stopped []models.Tunnel
+	for rows.Next() {
+		var t models.Tunnel
+		if err := rows.Scan(t.ScanFields()...); err != nil {
+			rows.Close()
+			return err
+		}
+		stopped = append(stopped, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if err := a.audit(ctx, tx, actor, models.AuditUserDisable, models.AuditTargetUser, userID,
+		map[string]any{"reason": reason, "stopped_tunnels": len(stopped)}); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	for _, t := range stopped {
+		a.tunnels.StopTunnel(t)
+	}
+	return nil
+}
+
+// EnableUser lifts DisableUser. Stopped tunnels stay stopped.
+func (a *AdminService) EnableUser(ctx context.Context, actor Actor, userID uuid.UUID) error {
+	return a.updateUser(ctx, actor, userID, models.AuditUserEnable, nil,
+		`UPDATE users SET disabled_at = NULL, disabled_reason = NULL, updated_at = NOW() WHERE id = $1`)
+}
+
+// ResetTOTP turns off two-factor authentication for a user who lost their
+// authenticator. Support staff may only reset regular users, or they could
+// take over each other's and the admins' accounts.
+func (a *AdminService) ResetTOTP(ctx context.Context, actor Actor, userID uuid.UUID) error {
+	tx, err := database.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var role string
+	err = tx.QueryRow(ctx, `SELECT role FROM users WHERE id = $1 FOR UPDATE`, userID).Scan(&role)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if !actor.mayManage(role) {
+		a.log.Warn("Rejected admin action", "action", models.AuditUserReset2FA, "actor", actor.Email,
+			"actor_role", actor.Role, "target_id", userID, "target_role", role)
+		return ErrStaffTarget
+	}
+
+	if _, err := tx.Exec(ctx,
+		`UPDATE users SET totp_enabled = FALSE, totp_secret = NULL, updated_at = NOW() WHERE id = $1`, userID); err != nil {
+		return err
+	}
+	if err := a.audit(ctx, tx, actor, models.AuditUserReset2FA, models.AuditTargetUser, userID, nil); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// SetRole changes a user's role. Admins cannot demote themselves, so there
+// is always an admin left to undo a mistake.
+func (a *AdminService) SetRole(ctx context.Context, actor Actor, userID uuid.UUID, role string) error {
+	if !models.ValidRole(role) {
+		return fmt.Errorf("invalid role %q", role)
+	}
+	if userID == actor.ID && role != models.RoleAdmin {
+		return ErrSelfAction
+	}
+	return a.updateUser(ctx, actor, userID, models.AuditUserRole, map[string]any{"role": role},
+		`UPDATE users SET role = $2, updated_at = NOW() WHERE id = $1`, role)
+}
+
+// SetLimits changes a user's plan and per-user limit overrides, and applies
+// the new limits to their active tunnels.
+func (a *AdminService) SetLimits(ctx context.Context, actor Actor, userID uuid.UUID, req models.SetUserLimitsRequest) error {
+	if req.Plan != "" {
+		var exists bool
+		err := database.Pool.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM plans WHERE name = $1)`, req.Plan).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrUnknownPlan
+		}
+	}
+	err := a.updateUser(ctx, actor, userID, models.AuditUserLimits, req,
+		`UPDATE users SET plan = COALESCE(NULLIF($2, ''), plan), upload_kbps = $3, download_kbps = $4,
+		                  monthly_transfer_gb = $5, updated_at = NOW()
+		 WHERE id = $1`,
+		req.Plan, req.UploadKbps, req.DownloadKbps, req.MonthlyTransferGB)
+	if err != nil {
+		return err
+	}
+	if err := a.quota.ApplyUser(ctx, userID); err != nil {
+		a.log.Warn("Failed to apply limits", "user_id", userID, "error", err)
+	}
+	return nil
+}
+
+// updateUser runs a single UPDATE of the user ($1) and records it.
+func (a *AdminService) updateUser(ctx context.Context, actor Actor, userID uuid.UUID, action string, details any, query string, args ...any) error {
+	tx, err := database.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, query, append([]any{userID}, args...)...)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	if err := a.audit(ctx, tx, actor, action, models.AuditTargetUser, userID, details); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// audit records an action in the audit log as part of tx.
+func (a *AdminService) audit(ctx context.Context, tx pgx.Tx, actor Actor, action, targetType string, targetID uuid.UUID, details any) error {
+	var raw []byte
+	if details != nil {
+		var err error
+		if raw, err = json.Marshal(details); err != nil {
+			return err
+		}
+	}
+	_, err := tx.Exec(ctx,
+		`INSERT INTO audit_log (actor_id, actor_email, action, target_type, target_id, details)
+		 VALUES ($1, $2, $3, $4, $5, $6)`,
+		actor.ID, actor.Email, action, targetType, targetID, raw,
+	)
+	if err != nil {
+		return err
+	}
+	a.log.Info("Admin action", "action", action, "actor", actor.Email, "target_type", targetType, "target_id", targetID)
+	return nil
+}
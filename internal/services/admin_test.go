@@ -0,0 +1,27 @@
+package services
+
+import (
+	"testing"
+
+	"tunnel-api/internal/models"
+)
+
+// Support staff manage regular users only; admins manage every account.
+func TestActorMayManage(t *testing.T) {
+	for _, tt := range []struct {
+		actor, target string
+		want          bool
+	}{
+		{models.RoleSupport, models.RoleUser, true},
+		{models.RoleSupport, models.RoleSupport, false},
+		{models.RoleSupport, models.RoleAdmin, false},
+		{models.RoleAdmin, models.RoleUser, true},
+		{models.RoleAdmin, models.RoleSupport, true},
+		{models.RoleAdmin, models.RoleAdmin, true},
+		{"", models.RoleAdmin, false},
+	} {
+		if got := (Actor{Role: tt.actor}).mayManage(tt.target); got != tt.want {
+			t.Errorf("%q acting on %q: mayManage = %v, want %v", tt.actor, tt.target, got, tt.want)
+		}
+	}
+}
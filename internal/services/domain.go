@@ -0,0 +1,392 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"tunnel-api/internal/database"
+	"tunnel-api/internal/logging"
+	"tunnel-api/internal/models"
+)
+
+// ChallengePrefix is the label under which the ownership TXT record lives.
+const ChallengePrefix = "_voidlink-challenge."
+
+// ErrDomainClaimed is returned when another tunnel has already verified the hostname.
+var ErrDomainClaimed = errors.New("hostname is verified by another tunnel")
+
+// Resolver looks up TXT records. *net.Resolver implements it.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// NewResolver returns a resolver querying the given DNS server ("host:port"),
+// or the system resolver if server is empty. Asking a public resolver
+// directly avoids waiting for a local cache to expire after the owner adds
+// the record.
+func NewResolver(server string) *net.Resolver {
+	if server == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// DomainService verifies ownership of custom hostnames and keeps the hostname
+// routing of the tunnel servers in sync with the verified ones.
+//
+// Verified hostnames are re-checked every interval. A hostname stays routed
+// while its TXT record is missing for fewer than graceChecks checks in a row,
+// so a DNS hiccup does not take a server offline.
+type DomainService struct {
+	edges       *EdgeService
+	resolver    Resolver
+	interval    time.Duration
+	graceChecks int
+	store       domainStore
+	log         *slog.Logger
+}
+
+func NewDomainService(edges *EdgeService, resolver Resolver, interval time.Duration, graceChecks int, logger *slog.Logger) *DomainService {
+	if interval <= 0 {
+		interval = 6 * time.Hour
+	}
+	if graceChecks < 1 {
+		graceChecks = 1
+	}
+	return &DomainService{
+		edges:       edges,
+		resolver:    resolver,
+		interval:    interval,
+		graceChecks: graceChecks,
+		store:       pgDomainStore{},
+		log:         logger.With(logging.Subsystem, "domains"),
+	}
+}
+
+// NormalizeHostname lower-cases a hostname and strips surrounding spaces and a trailing dot.
+func NormalizeHostname(hostname string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(hostname)), ".")
+}
+
+// ValidateHostname checks that a normalized hostname is a fully qualified DNS
+// name that is not part of the service's own domains.
+func (d *DomainService) ValidateHostname(hostname string) error {
+	if len(hostname) > 253 {
+		return errors.New("Hostname must be at most 253 characters")
+	}
+	labels := strings.Split(hostname, ".")
+	if len(labels) < 2 {
+		return errors.New("Hostname must be a fully qualified domain name")
+	}
+	for _, label := range labels {
+		if len(label) < 1 || len(label) > 63 {
+			return errors.New("Each hostname label must be 1-63 characters")
+		}
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+				return errors.New("Hostname may only contain letters, digits, hyphens and dots")
+			}
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return errors.New("Hostname labels cannot start or end with a hyphen")
+		}
+	}
+	if strings.Trim(labels[len(labels)-1], "0123456789") == "" {
+		return errors.New("Hostname cannot be an IP address")
+	}
+	for _, r := range d.edges.Regions() {
+		domain := strings.ToLower(r.Domain)
+		if hostname == domain || strings.HasSuffix(hostname, "."+domain) {
+			return fmt.Errorf("Hostnames under %s cannot be added as custom domains", domain)
+		}
+	}
+	return nil
+}
+
+// NewToken returns a random verification token.
+func NewToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// ChallengeName returns the name of the TXT record proving ownership of hostname.
+func ChallengeName(hostname string) string {
+	return ChallengePrefix + hostname
+}
+
+// ChallengeValue returns the expected content of the TXT record.
+func ChallengeValue(token string) string {
+	return "voidlink-verify=" + token
+}
+
+// Response builds the API response for a domain of the given tunnel.
+func (d *DomainService) Response(cd *models.CustomDomain, tun models.Tunnel) models.CustomDomainResponse {
+	return cd.ToResponse(ChallengeName(cd.Hostname), ChallengeValue(cd.Token), tun.Subdomain+"."+d.edges.Domain(tun.Region))
+}
+
+// Verify looks up the TXT challenge of cd, records the outcome and updates
+// routing. cd is updated in place. A missing record is not an error: it is
+// reported through cd.CheckError. ErrDomainClaimed is returned if the record
+// is present but another tunnel verified the hostname first.
+func (d *DomainService) Verify(ctx context.Context, cd *models.CustomDomain) error {
+	checkErr := d.lookup(ctx, cd)
+	now := time.Now()
+	cd.CheckedAt = &now
+
+	if checkErr == nil {
+		verifiedAt, err := d.store.markVerified(ctx, cd.ID)
+		if errors.Is(err, ErrDomainClaimed) {
+			msg := ErrDomainClaimed.Error()
+			cd.CheckError = &msg
+			d.store.recordCheck(ctx, cd)
+			return ErrDomainClaimed
+		}
+		if err != nil {
+			return err
+		}
+		if !cd.Verified {
+			d.log.Info("Custom domain verified", "tunnel_id", cd.TunnelID, "hostname", cd.Hostname)
+		}
+		cd.Verified, cd.VerifiedAt, cd.Failures, cd.CheckError = true, verifiedAt, 0, nil
+		return d.SyncRouting(ctx, cd.TunnelID)
+	}
+
+	msg := checkErr.Error()
+	cd.CheckError = &msg
+	if cd.Verified {
+		cd.Failures++
+		if cd.Failures >= d.graceChecks {
+			cd.Verified = false
+			d.log.Warn("Custom domain lost verification", "tunnel_id", cd.TunnelID, "hostname", cd.Hostname, "error", msg)
+		} else {
+			d.log.Warn("Custom domain re-check failed", "tunnel_id", cd.TunnelID, "hostname", cd.Hostname,
+				"failures", cd.Failures, "error", msg)
+		}
+	}
+	if err := d.store.recordCheck(ctx, cd); err != nil {
+		return err
+	}
+	if !cd.Verified {
+		return d.SyncRouting(ctx, cd.TunnelID)
+	}
+	return nil
+}
+
+// lookup returns nil if the TXT challenge of cd is in place.
+func (d *DomainService) lookup(ctx context.Context, cd *models.CustomDomain) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	name := ChallengeName(cd.Hostname)
+	records, err := d.resolver.LookupTXT(ctx, name)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return fmt.Errorf("no TXT record found at %s", name)
+	}
+	if err != nil {
+		return fmt.Errorf("DNS lookup of %s failed: %w", name, err)
+	}
+	want := ChallengeValue(cd.Token)
+	for _, r := range records {
+		if strings.TrimSpace(r) == want {
+			return nil
+		}
+	}
+	return fmt.Errorf("TXT record at %s does not contain %s", name, want)
+}
+
+// SyncRouting routes the tunnel's verified hostnames if it is active.
+func (d *DomainService) SyncRouting(ctx context.Context, tunnelID uuid.UUID) error {
+	region, active, err := d.store.tunnelRegion(ctx, tunnelID)
+	if err != nil || !active {
+		return err
+	}
+	hostnames, err := d.store.verifiedHostnames(ctx, tunnelID)
+	if err != nil {
+		return err
+	}
+	node, err := d.edges.Node(region)
+	if err != nil {
+		return err
+	}
+	return node.SetHostnames(ctx, tunnelID.String(), hostnames)
+}
+
+// VerifiedHostnames returns the hostnames a tunnel has verified.
+func VerifiedHostnames(ctx context.Context, tunnelID uuid.UUID) ([]string, error) {
+	rows, err := database.Pool.Query(ctx,
+		`SELECT hostname FROM tunnel_domains WHERE tunnel_id = $1 AND verified ORDER BY hostname`, tunnelID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hostnames []string
+	for rows.Next() {
+		var h string
+		if err := rows.Scan(&h); err != nil {
+			return nil, err
+		}
+		hostnames = append(hostnames, h)
+	}
+	return hostnames, rows.Err()
+}
+
+// domainStore persists the outcome of verifications. pgDomainStore is the
+// implementation; tests replace it.
+type domainStore interface {
+	// markVerified marks a domain verified and returns since when it is.
+	// It returns ErrDomainClaimed if another tunnel verified the hostname.
+	markVerified(ctx context.Context, id uuid.UUID) (*time.Time, error)
+	// recordCheck stores the state of a domain after a check.
+	recordCheck(ctx context.Context, cd *models.CustomDomain) error
+	tunnelRegion(ctx context.Context, tunnelID uuid.UUID) (region string, active bool, err error)
+	verifiedHostnames(ctx context.Context, tunnelID uuid.UUID) ([]string, error)
+}
+
+// verifiedHostnameIndex is the unique index allowing one verified domain per hostname.
+const verifiedHostnameIndex = "idx_tunnel_domains_verified_hostname"
+
+type pgDomainStore struct{}
+
+func (pgDomainStore) markVerified(ctx context.Context, id uuid.UUID) (*time.Time, error) {
+	var verifiedAt *time.Time
+	err := database.Pool.QueryRow(ctx,
+		`UPDATE tunnel_domains
+		 SET verified = TRUE, verified_at = COALESCE(verified_at, NOW()), checked_at = NOW(),
+		     check_error = NULL, failures = 0
+		 WHERE id = $1
+		 RETURNING verified_at`, id,
+	).Scan(&verifiedAt)
+	if database.IsUniqueViolation(err, verifiedHostnameIndex) {
+		return nil, ErrDomainClaimed
+	}
+	return verifiedAt, err
+}
+
+func (pgDomainStore) recordCheck(ctx context.Context, cd *models.CustomDomain) error {
+	_, err := database.Pool.Exec(ctx,
+		`UPDATE tunnel_domains SET verified = $1, checked_at = NOW(), check_error = $2, failures = $3 WHERE id = $4`,
+		cd.Verified, cd.CheckError, cd.Failures, cd.ID,
+	)
+	return err
+}
+
+func (pgDomainStore) tunnelRegion(ctx context.Context, tunnelID uuid.UUID) (region string, active bool, err error) {
+	err = database.Pool.QueryRow(ctx,
+		`SELECT region, is_active FROM tunnels WHERE id = $1`, tunnelID,
+	).Scan(&region, &active)
+	return region, active, err
+}
+
+func (pgDomainStore) verifiedHostnames(ctx context.Context, tunnelID uuid.UUID) ([]string, error) {
+	return VerifiedHostnames(ctx, tunnelID)
+}
+
+// Run re-checks custom domains every interval until ctx is cancelled.
+func (d *DomainService) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := d.RecheckAll(context.Background()); err != nil {
+				d.log.Warn("Failed to re-check custom domains", "error", err)
+			}
+		}
+	}
+}
+
+// RecheckAll re-verifies verified domains, and pending ones added in the last
+// week so they go live on their own once the record has propagated.
+func (d *DomainService) RecheckAll(ctx context.Context) error {
+	rows, err := database.Pool.Query(ctx,
+		`SELECT `+models.CustomDomainColumns+` FROM tunnel_domains
+		 WHERE verified OR created_at > NOW() - INTERVAL '7 days'`)
+	if err != nil {
+		return err
+	}
+	var domains []models.CustomDomain
+	for rows.Next() {
+		var cd models.CustomDomain
+		if err := rows.Scan(cd.ScanFields()...); err != nil {
+			rows.Close()
+			return err
+		}
+		domains = append(domains, cd)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// Verify pending domains last so a hostname losing verification frees it first
+	slices.SortStableFunc(domains, func(a, b models.CustomDomain) int {
+		switch {
+		case a.Verified == b.Verified:
+			return 0
+		case a.Verified:
+			return -1
+		default:
+			return 1
+		}
+	})
+	for i := range domains {
+		if err := d.Verify(ctx, &domains[i]); err != nil && !errors.Is(err, ErrDomainClaimed) {
+			d.log.Warn("Failed to re-check custom domain", "hostname", domains[i].Hostname, "error", err)
+		}
+	}
+	return nil
+}
+
+// Tunnel returns the active tunnel with the given subdomain (for dns.Zone).
+func (d *DomainService) Tunnel(subdomain string) (string, bool) {
+	srv := d.edges.Local()
+	if srv == nil {
+		return "", false
+	}
+	return srv.LookupSubdomain(subdomain)
+}
+
+// Challenges returns the TXT challenge values of all custom domains of a
+// tunnel (for dns.Zone). Serving them lets owners delegate the challenge with
+// a CNAME from _voidlink-challenge.<hostname> to _voidlink-challenge.<subdomain>.<domain>.
+func (d *DomainService) Challenges(ctx context.Context, tunnelID string) ([]string, error) {
+	rows, err := database.Pool.Query(ctx,
+		`SELECT token FROM tunnel_domains WHERE tunnel_id = $1 ORDER BY created_at`, tunnelID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var values []string
+	for rows.Next() {
+		var token string
+		if err := rows.Scan(&token); err != nil {
+			return nil, err
+		}
+		values = append(values, ChallengeValue(token))
+	}
+	return values, rows.Err()
+}
@@ -0,0 +1,230 @@
+package services
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"tunnel-api/internal/edge"
+	"tunnel-api/internal/models"
+	"tunnel-api/internal/tunnel"
+)
+
+// stubResolver serves TXT records from a map; missing names are NXDOMAIN.
+type stubResolver map[string][]string
+
+func (r stubResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	records, ok := r[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return records, nil
+}
+
+// memDomainStore keeps domains in memory, enforcing one verified domain per
+// hostname like the database does.
+type memDomainStore struct {
+	domains map[uuid.UUID]*models.CustomDomain
+	region  string
+}
+
+func (m *memDomainStore) markVerified(_ context.Context, id uuid.UUID) (*time.Time, error) {
+	cd := m.domains[id]
+	for _, other := range m.domains {
+		if other.ID != id && other.Verified && other.Hostname == cd.Hostname {
+			return nil, ErrDomainClaimed
+		}
+	}
+	if cd.VerifiedAt == nil {
+		now := time.Now()
+		cd.VerifiedAt = &now
+	}
+	cd.Verified, cd.Failures, cd.CheckError = true, 0, nil
+	return cd.VerifiedAt, nil
+}
+
+func (m *memDomainStore) recordCheck(_ context.Context, cd *models.CustomDomain) error {
+	stored := m.domains[cd.ID]
+	stored.Verified, stored.CheckError, stored.Failures = cd.Verified, cd.CheckError, cd.Failures
+	return nil
+}
+
+func (m *memDomainStore) tunnelRegion(context.Context, uuid.UUID) (string, bool, error) {
+	return m.region, true, nil
+}
+
+func (m *memDomainStore) verifiedHostnames(_ context.Context, tunnelID uuid.UUID) ([]string, error) {
+	var hostnames []string
+	for _, cd := range m.domains {
+		if cd.TunnelID == tunnelID && cd.Verified {
+			hostnames = append(hostnames, cd.Hostname)
+		}
+	}
+	slices.Sort(hostnames)
+	return hostnames, nil
+}
+
+// hostnameNode records the hostnames routed per tunnel.
+type hostnameNode struct {
+	edge.Node
+	routed map[string][]string
+}
+
+func (n *hostnameNode) SetHostnames(_ context.Context, tunnelID string, hostnames []string) error {
+	n.routed[tunnelID] = hostnames
+	return nil
+}
+
+type domainTest struct {
+	svc      *DomainService
+	store    *memDomainStore
+	node     *hostnameNode
+	resolver stubResolver
+}
+
+func newDomainTest(graceChecks int) *domainTest {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	node := &hostnameNode{routed: make(map[string][]string)}
+	edges := NewEdgeService(tunnel.NewServer(tunnel.Config{}), node, "eu", "example.com", nil, 0, logger)
+	resolver := stubResolver{}
+	svc := NewDomainService(edges, resolver, time.Hour, graceChecks, logger)
+	store := &memDomainStore{domains: make(map[uuid.UUID]*models.CustomDomain), region: "eu"}
+	svc.store = store
+	return &domainTest{svc: svc, store: store, node: node, resolver: resolver}
+}
+
+// add stores a pending domain and returns the caller's copy of it.
+func (dt *domainTest) add(tunnelID uuid.UUID, hostname string) *models.CustomDomain {
+	cd := models.CustomDomain{ID: uuid.New(), TunnelID: tunnelID, Hostname: hostname, Token: uuid.NewString()}
+	stored := cd
+	dt.store.domains[cd.ID] = &stored
+	return &cd
+}
+
+func (dt *domainTest) publish(cd *models.CustomDomain) {
+	dt.resolver[ChallengeName(cd.Hostname)] = []string{"v=spf1 -all", ChallengeValue(cd.Token)}
+}
+
+func TestVerifyRecordPresent(t *testing.T) {
+	dt := newDomainTest(1)
+	tunnelID := uuid.New()
+	cd := dt.add(tunnelID, "play.example.org")
+	dt.publish(cd)
+
+	if err := dt.svc.Verify(context.Background(), cd); err != nil {
+		t.Fatal(err)
+	}
+	if !cd.Verified || cd.VerifiedAt == nil || cd.CheckedAt == nil || cd.CheckError != nil {
+		t.Fatalf("domain = %+v, want verified", cd)
+	}
+	if !dt.store.domains[cd.ID].Verified {
+		t.Error("verification not stored")
+	}
+	if got := dt.node.routed[tunnelID.String()]; !slices.Equal(got, []string{"play.example.org"}) {
+		t.Errorf("routed hostnames = %v", got)
+	}
+}
+
+func TestVerifyRecordMissingOrWrong(t *testing.T) {
+	for name, records := range map[string][]string{
+		"missing": nil,
+		"wrong":   {"voidlink-verify=someone-else"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dt := newDomainTest(1)
+			cd := dt.add(uuid.New(), "play.example.org")
+			if records != nil {
+				dt.resolver[ChallengeName(cd.Hostname)] = records
+			}
+
+			if err := dt.svc.Verify(context.Background(), cd); err != nil {
+				t.Fatal(err)
+			}
+			if cd.Verified || cd.CheckError == nil {
+				t.Fatalf("domain = %+v, want unverified with a check error", cd)
+			}
+			if !strings.Contains(*cd.CheckError, ChallengeName(cd.Hostname)) {
+				t.Errorf("check error %q does not name the record", *cd.CheckError)
+			}
+			stored := dt.store.domains[cd.ID]
+			if stored.Verified || stored.CheckError == nil || *stored.CheckError != *cd.CheckError {
+				t.Errorf("stored domain = %+v, want the check error recorded", stored)
+			}
+		})
+	}
+}
+
+func TestVerifyHostnameClaimed(t *testing.T) {
+	dt := newDomainTest(1)
+	owner := dt.add(uuid.New(), "play.example.org")
+	dt.publish(owner)
+	if err := dt.svc.Verify(context.Background(), owner); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another tunnel publishes its own token for the same hostname
+	other := uuid.New()
+	cd := dt.add(other, "play.example.org")
+	dt.publish(cd)
+	if err := dt.svc.Verify(context.Background(), cd); err != ErrDomainClaimed {
+		t.Fatalf("Verify = %v, want ErrDomainClaimed", err)
+	}
+	if cd.Verified || cd.CheckError == nil || *cd.CheckError != ErrDomainClaimed.Error() {
+		t.Errorf("domain = %+v, want unverified with the claim reported", cd)
+	}
+	if stored := dt.store.domains[cd.ID]; stored.Verified || stored.CheckError == nil {
+		t.Errorf("stored domain = %+v, want the claim recorded", stored)
+	}
+	if _, routed := dt.node.routed[other.String()]; routed {
+		t.Error("claimed hostname routed to the second tunnel")
+	}
+}
+
+func TestVerifyGraceChecks(t *testing.T) {
+	dt := newDomainTest(3)
+	tunnelID := uuid.New()
+	cd := dt.add(tunnelID, "play.example.org")
+	dt.publish(cd)
+	if err := dt.svc.Verify(context.Background(), cd); err != nil {
+		t.Fatal(err)
+	}
+
+	delete(dt.resolver, ChallengeName(cd.Hostname))
+	for i := 1; i < 3; i++ {
+		if err := dt.svc.Verify(context.Background(), cd); err != nil {
+			t.Fatal(err)
+		}
+		if !cd.Verified || cd.Failures != i {
+			t.Fatalf("after %d failed checks: verified %v, failures %d; want verified", i, cd.Verified, cd.Failures)
+		}
+		if got := dt.node.routed[tunnelID.String()]; len(got) != 1 {
+			t.Fatalf("after %d failed checks: routed %v, want still routed", i, got)
+		}
+	}
+
+	if err := dt.svc.Verify(context.Background(), cd); err != nil {
+		t.Fatal(err)
+	}
+	if cd.Verified {
+		t.Fatal("still verified after graceChecks failed checks")
+	}
+	if got := dt.node.routed[tunnelID.String()]; len(got) != 0 {
+		t.Errorf("routed %v, want the hostname removed", got)
+	}
+
+	// The record coming back verifies it again from zero failures
+	dt.publish(cd)
+	if err := dt.svc.Verify(context.Background(), cd); err != nil {
+		t.Fatal(err)
+	}
+	if !cd.Verified || cd.Failures != 0 {
+		t.Errorf("verified %v, failures %d; want verified again", cd.Verified, cd.Failures)
+	}
+}
@@ -0,0 +1,357 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"tunnel-api/internal/database"
+	"tunnel-api/internal/edge"
+	"tunnel-api/internal/logging"
+	"tunnel-api/internal/models"
+	"tunnel-api/internal/tunnel"
+)
+
+// ErrRegionUnavailable is returned when a region has no online edge node.
+var ErrRegionUnavailable = errors.New("region is not available")
+
+// EdgeService knows the regions tunnels can run in: the local tunnel server
+// (MODE=all) and the remote edge nodes that sent a heartbeat (MODE=control).
+// A region may be served by several edge node instances sharing their routes
+// (ROUTE_STORE); each sends its own heartbeat. An instance is offline once it
+// misses three heartbeats, a region once all of its instances are.
+type EdgeService struct {
+	local        *tunnel.Server // nil in control mode
+	localNode    edge.Node
+	localRegion  string
+	localDomain  string
+	tokens       map[string]string // region → token of its edge nodes
+	offlineAfter time.Duration
+	log          *slog.Logger
+
+	mu    sync.RWMutex
+	nodes map[string]*edgeNode // region → remote node
+}
+
+type edgeNode struct {
+	domain    string
+	mcPort    int
+	instances map[string]*edgeInstance // RPC URL → instance
+}
+
+type edgeInstance struct {
+	client   *edge.Client
+	lastSeen time.Time
+	clients  map[string]tunnel.ClientInfo
+}
+
+// NewEdgeService creates the service. localNode is how changes reach the local
+// server; nil means directly (edge.Local). tokens binds each remote region to
+// the token its edge nodes authenticate with.
+func NewEdgeService(local *tunnel.Server, localNode edge.Node, region, domain string, tokens map[string]string, heartbeat time.Duration, logger *slog.Logger) *EdgeService {
+	if heartbeat <= 0 {
+		heartbeat = 15 * time.Second
+	}
+	if localNode == nil && local != nil {
+		localNode = edge.Local{Server: local}
+	}
+	return &EdgeService{
+		local:        local,
+		localNode:    localNode,
+		localRegion:  region,
+		localDomain:  domain,
+		tokens:       tokens,
+		offlineAfter: 3 * heartbeat,
+		log:          logger.With(logging.Subsystem, "edges"),
+		nodes:        make(map[string]*edgeNode),
+	}
+}
+
+// AuthorizedRegion returns the region whose edge token r carries.
+func (e *EdgeService) AuthorizedRegion(r *http.Request) (string, bool) {
+	for region, token := range e.tokens {
+		if edge.Authorized(r, token) {
+			return region, true
+		}
+	}
+	return "", false
+}
+
+// Local returns the tunnel server of this process, nil in control mode.
+func (e *EdgeService) Local() *tunnel.Server {
+	return e.local
+}
+
+// IsLocal reports whether tunnels of the region run in this process.
+func (e *EdgeService) IsLocal(region string) bool {
+	return e.local != nil && region == e.localRegion
+}
+
+// LoadNodes reads the known edge nodes so their regions and domains are
+// available before their first heartbeat. They stay offline until then.
+func (e *EdgeService) LoadNodes(ctx context.Context) error {
+	rows, err := database.Pool.Query(ctx, `SELECT region, domain FROM edge_nodes`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for rows.Next() {
+		var region, domain string
+		if err := rows.Scan(&region, &domain); err != nil {
+			return err
+		}
+		if _, ok := e.nodes[region]; !ok && !e.IsLocal(region) {
+			e.nodes[region] = &edgeNode{domain: domain, instances: make(map[string]*edgeInstance)}
+		}
+	}
+	return rows.Err()
+}
+
+// Node returns where the tunnels of a region run: for remote regions the
+// instance that sent the latest heartbeat.
+func (e *EdgeService) Node(region string) (edge.Node, error) {
+	if e.IsLocal(region) {
+		return e.localNode, nil
+	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	inst := e.latest(region)
+	if inst == nil {
+		return nil, ErrRegionUnavailable
+	}
+	return inst.client, nil
+}
+
+// Inspector returns where the live state of a tunnel can be read: for remote
+// regions the instance its client is attached to, or the one that sent the
+// latest heartbeat if none reports the client.
+func (e *EdgeService) Inspector(region, tunnelID string) (edge.Inspector, error) {
+	if e.IsLocal(region) {
+		return edge.Local{Server: e.local}, nil
+	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if n, ok := e.nodes[region]; ok {
+		for _, inst := range n.instances {
+			if _, attached := inst.clients[tunnelID]; attached && e.online(inst) {
+				return inst.client, nil
+			}
+		}
+	}
+	inst := e.latest(region)
+	if inst == nil {
+		return nil, ErrRegionUnavailable
+	}
+	return inst.client, nil
+}
+
+// latest returns the online instance of a remote region that sent the latest
+// heartbeat, nil if there is none. e.mu must be held.
+func (e *EdgeService) latest(region string) *edgeInstance {
+	n, ok := e.nodes[region]
+	if !ok {
+		return nil
+	}
+	var latest *edgeInstance
+	for _, inst := range n.instances {
+		if e.online(inst) && (latest == nil || inst.lastSeen.After(latest.lastSeen)) {
+			latest = inst
+		}
+	}
+	return latest
+}
+
+func (e *EdgeService) online(inst *edgeInstance) bool {
+	return time.Since(inst.lastSeen) < e.offlineAfter
+}
+
+// lastSeen returns the latest heartbeat of any instance of a node.
+func (n *edgeNode) lastSeen() time.Time {
+	var t time.Time
+	for _, inst := range n.instances {
+		if inst.lastSeen.After(t) {
+			t = inst.lastSeen
+		}
+	}
+	return t
+}
+
+// Target returns where players of a tunnel moved to the region are sent.
+func (e *EdgeService) Target(region string) (tunnel.MoveTarget, error) {
+	if e.IsLocal(region) {
+		return tunnel.MoveTarget{Region: region, Domain: e.localDomain, MCPort: e.local.MCProxyPort()}, nil
+	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	n, ok := e.nodes[region]
+	if !ok {
+		return tunnel.MoveTarget{}, ErrRegionUnavailable
+	}
+	return tunnel.MoveTarget{Region: region, Domain: n.domain, MCPort: n.mcPort}, nil
+}
+
+// Domain returns the base domain of a region ("" if the region is unknown).
+func (e *EdgeService) Domain(region string) string {
+	if e.IsLocal(region) {
+		return e.localDomain
+	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if n, ok := e.nodes[region]; ok {
+		return n.domain
+	}
+	return ""
+}
+
+// Regions lists the known regions, the local one first.
+func (e *EdgeService) Regions() []models.Region {
+	var regions []models.Region
+	if e.local != nil {
+		regions = append(regions, models.Region{Name: e.localRegion, Domain: e.localDomain, Online: true})
+	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	start := len(regions)
+	for name, n := range e.nodes {
+		r := models.Region{Name: name, Domain: n.domain}
+		if lastSeen := n.lastSeen(); !lastSeen.IsZero() {
+			r.Online = time.Since(lastSeen) < e.offlineAfter
+			r.LastSeen = &lastSeen
+		}
+		regions = append(regions, r)
+	}
+	slices.SortFunc(regions[start:], func(a, b models.Region) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return regions
+}
+
+// ClientInfo returns the desktop app attached to a tunnel in the given region.
+// For remote regions this is the state of the node's last heartbeat.
+func (e *EdgeService) ClientInfo(region, tunnelID string) (tunnel.ClientInfo, bool) {
+	if e.IsLocal(region) {
+		return e.local.ClientInfo(tunnelID)
+	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	n, ok := e.nodes[region]
+	if !ok {
+		return tunnel.ClientInfo{}, false
+	}
+	for _, inst := range n.instances {
+		if info, ok := inst.clients[tunnelID]; ok && e.online(inst) {
+			return info, true
+		}
+	}
+	return tunnel.ClientInfo{}, false
+}
+
+// Clients returns the desktop apps attached in every region, by region and
+// tunnel ID. For remote regions this is the state of the online instances'
+// last heartbeats.
+func (e *EdgeService) Clients() map[string]map[string]tunnel.ClientInfo {
+	clients := make(map[string]map[string]tunnel.ClientInfo)
+	if e.local != nil {
+		clients[e.localRegion] = e.local.Clients()
+	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	for region, n := range e.nodes {
+		byTunnel := make(map[string]tunnel.ClientInfo)
+		for _, inst := range n.instances {
+			if !e.online(inst) {
+				continue
+			}
+			for id, info := range inst.clients {
+				byTunnel[id] = info
+			}
+		}
+		clients[region] = byTunnel
+	}
+	return clients
+}
+
+// Heartbeat records the status of a remote edge node.
+func (e *EdgeService) Heartbeat(ctx context.Context, hb edge.Heartbeat) error {
+	if hb.Region == "" || hb.Domain == "" || hb.RPCURL == "" {
+		return errors.New("region, domain and rpc_url are required")
+	}
+	if len(hb.Region) > 10 {
+		return errors.New("region must be at most 10 characters")
+	}
+	if e.IsLocal(hb.Region) {
+		return errors.New("region " + hb.Region + " is served by the control plane itself")
+	}
+
+	_, err := database.Pool.Exec(ctx,
+		`INSERT INTO edge_nodes (region, domain, rpc_url, last_seen, tunnels, clients)
+		 VALUES ($1, $2, $3, NOW(), $4, $5)
+		 ON CONFLICT (region) DO UPDATE SET domain = $2, rpc_url = $3, last_seen = NOW(), tunnels = $4, clients = $5`,
+		hb.Region, hb.Domain, hb.RPCURL, len(hb.Tunnels), len(hb.Clients),
+	)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	n, ok := e.nodes[hb.Region]
+	if !ok {
+		n = &edgeNode{instances: make(map[string]*edgeInstance)}
+		e.nodes[hb.Region] = n
+	}
+	inst, ok := n.instances[hb.RPCURL]
+	if !ok {
+		inst = &edgeInstance{client: edge.NewClient(hb.RPCURL, e.tokens[hb.Region])}
+		n.instances[hb.RPCURL] = inst
+	}
+	if !e.online(inst) {
+		e.log.Info("Edge node online", "region", hb.Region, "domain", hb.Domain, "rpc_url", hb.RPCURL)
+	}
+	n.domain, n.mcPort = hb.Domain, hb.MCPort
+	inst.lastSeen = time.Now()
+	inst.clients = hb.Clients
+
+	// Forget instances that went away (replaced containers get new addresses)
+	for url, other := range n.instances {
+		if time.Since(other.lastSeen) > 10*e.offlineAfter {
+			delete(n.instances, url)
+		}
+	}
+	return nil
+}
+
+// RegionTunnelOwners returns the owners of the tunnels among ids that edge
+// nodes of region may report on: tunnels of the region, and tunnels moved
+// away from it within tunnel.MoveRedirectTTL, which its nodes still redirect.
+// Reports are keyed by tunnel ID, owners are user IDs.
+func RegionTunnelOwners(ctx context.Context, region string, ids []uuid.UUID) (map[string]string, error) {
+	rows, err := database.Pool.Query(ctx,
+		`SELECT id, user_id FROM tunnels
+		 WHERE id = ANY($1) AND (region = $2 OR (moved_from = $2 AND moved_at > $3))`,
+		ids, region, time.Now().Add(-tunnel.MoveRedirectTTL))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	owners := make(map[string]string)
+	for rows.Next() {
+		var id, userID uuid.UUID
+		if err := rows.Scan(&id, &userID); err != nil {
+			return nil, err
+		}
+		owners[id.String()] = userID.String()
+	}
+	return owners, rows.Err()
+}
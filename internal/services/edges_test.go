@@ -0,0 +1,93 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"tunnel-api/internal/edge"
+	"tunnel-api/internal/tunnel"
+)
+
+func TestEdgeServiceAuthorizedRegion(t *testing.T) {
+	tokens, err := edge.ParseTokens("eu=tok-eu, us=tok-us")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewEdgeService(nil, nil, "", "", tokens, 0, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	for token, want := range map[string]string{"tok-eu": "eu", "tok-us": "us", "other": ""} {
+		r := httptest.NewRequest(http.MethodPost, "/api/edge/heartbeat", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		if region, ok := e.AuthorizedRegion(r); region != want || ok != (want != "") {
+			t.Errorf("token %s: region %q, %v; want %q", token, region, ok, want)
+		}
+	}
+
+	for _, s := range []string{"eu", "eu=", "eu=a,eu=b", "eu=a,us=a"} {
+		if _, err := edge.ParseTokens(s); err == nil {
+			t.Errorf("ParseTokens(%q) accepted", s)
+		}
+	}
+}
+
+// Live inspection of a remote tunnel is read from the instance its client is
+// attached to, over the edge RPC.
+func TestEdgeServiceInspectorRemote(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	e := NewEdgeService(nil, nil, "", "", map[string]string{"us": "tok"}, time.Minute, logger)
+
+	if _, err := e.Inspector("us", "t1"); !errors.Is(err, ErrRegionUnavailable) {
+		t.Fatalf("Inspector without nodes: %v, want ErrRegionUnavailable", err)
+	}
+
+	owner := tunnel.NewServer(tunnel.Config{})
+	owner.RegisterTunnel(tunnel.TunnelRegistration{TunnelID: "t1", Subdomain: "play"})
+	ownerRPC := httptest.NewServer(edge.NewAgent(owner, edge.AgentConfig{Token: "tok", Logger: logger}).Handler())
+	defer ownerRPC.Close()
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("inspection sent to the instance without the client: %s", r.URL.Path)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer other.Close()
+
+	now := time.Now()
+	e.nodes["us"] = &edgeNode{domain: "us.example.com", instances: map[string]*edgeInstance{
+		ownerRPC.URL: {client: edge.NewClient(ownerRPC.URL, "tok"), lastSeen: now.Add(-time.Second),
+			clients: map[string]tunnel.ClientInfo{"t1": {}}},
+		other.URL: {client: edge.NewClient(other.URL, "tok"), lastSeen: now},
+	}}
+
+	node, err := e.Inspector("us", "t1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, connected, err := node.ClientLatency(ctx, "t1"); err != nil || connected {
+		t.Errorf("ClientLatency: connected %v, %v; want not connected", connected, err)
+	}
+	if conns, err := node.Connections(ctx, "t1"); err != nil || conns == nil || len(conns) != 0 {
+		t.Errorf("Connections = %v, %v; want none", conns, err)
+	}
+	if closed, err := node.CloseConnection(ctx, "t1", "nope"); err != nil || closed {
+		t.Errorf("CloseConnection = %v, %v; want not found", closed, err)
+	}
+	if logs, err := node.HTTPAccessLogs(ctx, "t1", tunnel.AccessLogFilter{Limit: 10}); err != nil || len(logs) != 0 {
+		t.Errorf("HTTPAccessLogs = %v, %v; want none", logs, err)
+	}
+	if _, err := node.TunnelStats(ctx, "t1"); err != nil {
+		t.Errorf("TunnelStats: %v", err)
+	}
+
+	// Without an instance reporting the client, the latest one answers
+	delete(e.nodes["us"].instances[ownerRPC.URL].clients, "t1")
+	e.nodes["us"].instances[ownerRPC.URL].lastSeen = now.Add(time.Second)
+	if node, err := e.Inspector("us", "t1"); err != nil || node.(*edge.Client) != e.nodes["us"].instances[ownerRPC.URL].client {
+		t.Errorf("Inspector = %v, %v; want the latest instance", node, err)
+	}
+}
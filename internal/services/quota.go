@@ -0,0 +1,198 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"tunnel-api/internal/database"
+	"tunnel-api/internal/logging"
+	"tunnel-api/internal/models"
+	"tunnel-api/internal/tunnel"
+)
+
+// Actions taken when a user's monthly transfer cap is used up.
+const (
+	QuotaActionThrottle = "throttle"
+	QuotaActionSuspend  = "suspend"
+)
+
+// QuotaService derives tunnel bandwidth limits from the owner's plan and
+// monthly transfer, and periodically re-applies them to active tunnels so
+// plan changes and exhausted caps take effect without a restart.
+type QuotaService struct {
+	edges        *EdgeService
+	action       string
+	throttleKbps int
+	interval     time.Duration
+	log          *slog.Logger
+
+	applied sync.Map // tunnel ID → tunnel.TunnelLimits last pushed to its node
+}
+
+func NewQuotaService(edges *EdgeService, action string, throttleKbps int, interval time.Duration, logger *slog.Logger) *QuotaService {
+	if action != QuotaActionSuspend {
+		action = QuotaActionThrottle
+	}
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	return &QuotaService{
+		edges:        edges,
+		action:       action,
+		throttleKbps: throttleKbps,
+		interval:     interval,
+		log:          logger.With(logging.Subsystem, "quota"),
+	}
+}
+
+// kbpsToBytes converts a kbit/s rate to bytes per second.
+func kbpsToBytes(kbps int) int64 {
+	return int64(kbps) * 1000 / 8
+}
+
+// Limits computes the limits of a user's tunnels: the plan's, unless an admin
+// set per-user overrides.
+func (q *QuotaService) Limits(ctx context.Context, userID uuid.UUID) (models.TunnelLimitsResponse, error) {
+	now := time.Now().UTC()
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	var resp models.TunnelLimitsResponse
+	err := database.Pool.QueryRow(ctx,
+		`SELECT p.name, COALESCE(users.upload_kbps, p.upload_kbps), COALESCE(users.download_kbps, p.download_kbps),
+		        COALESCE(users.monthly_transfer_gb, p.monthly_transfer_gb),
+		        COALESCE((SELECT SUM(u.bytes_in + u.bytes_out) FROM tunnel_usage u
+		                  JOIN tunnels t ON t.id = u.tunnel_id
+		                  WHERE t.user_id = $1 AND u.bucket >= $2), 0)::BIGINT
+		 FROM users JOIN plans p ON p.name = users.plan
+		 WHERE users.id = $1`,
+		userID, month,
+	).Scan(&resp.Plan.Name, &resp.Plan.UploadKbps, &resp.Plan.DownloadKbps, &resp.Plan.MonthlyTransferGB, &resp.UsedTransfer)
+	if err != nil {
+		return resp, err
+	}
+
+	resp.State = models.QuotaOK
+	resp.UploadBytesPerSec = kbpsToBytes(resp.Plan.UploadKbps)
+	resp.DownloadBytesPerSec = kbpsToBytes(resp.Plan.DownloadKbps)
+	resp.MonthlyTransfer = int64(resp.Plan.MonthlyTransferGB) << 30
+	resp.ResetsAt = month.AddDate(0, 1, 0)
+
+	if resp.MonthlyTransfer > 0 && resp.UsedTransfer >= resp.MonthlyTransfer {
+		if q.action == QuotaActionSuspend {
+			resp.State = models.QuotaSuspended
+			resp.Reason = fmt.Sprintf("This server's monthly transfer quota is used up. It resets on %s.",
+				resp.ResetsAt.Format("January 2"))
+		} else {
+			resp.State = models.QuotaThrottled
+			throttle := kbpsToBytes(q.throttleKbps)
+			resp.UploadBytesPerSec = minRate(resp.UploadBytesPerSec, throttle)
+			resp.DownloadBytesPerSec = minRate(resp.DownloadBytesPerSec, throttle)
+		}
+	}
+	return resp, nil
+}
+
+// minRate returns the stricter of two rates, where 0 is unlimited.
+func minRate(a, b int64) int64 {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+func tunnelLimits(l models.TunnelLimitsResponse) tunnel.TunnelLimits {
+	return tunnel.TunnelLimits{
+		UploadBytesPerSec:   l.UploadBytesPerSec,
+		DownloadBytesPerSec: l.DownloadBytesPerSec,
+		Suspended:           l.State == models.QuotaSuspended,
+		Reason:              l.Reason,
+	}
+}
+
+// Run re-applies limits to active tunnels every interval until ctx is cancelled.
+func (q *QuotaService) Run(ctx context.Context) {
+	ticker := time.NewTicker(q.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := q.Apply(context.Background()); err != nil {
+				q.log.Warn("Failed to apply limits", "error", err)
+			}
+		}
+	}
+}
+
+// AppliedLimits returns the limits last applied to an active tunnel.
+func (q *QuotaService) AppliedLimits(tunnelID string) tunnel.TunnelLimits {
+	v, _ := q.applied.Load(tunnelID)
+	limits, _ := v.(tunnel.TunnelLimits)
+	return limits
+}
+
+// Apply updates the limits of all active tunnels. Remote edge nodes are only
+// called for tunnels whose limits changed.
+func (q *QuotaService) Apply(ctx context.Context) error {
+	return q.apply(ctx, `SELECT id, user_id, region FROM tunnels WHERE is_active = TRUE`)
+}
+
+// ApplyUser updates the limits of one user's active tunnels, after a change
+// of their plan or overrides.
+func (q *QuotaService) ApplyUser(ctx context.Context, userID uuid.UUID) error {
+	return q.apply(ctx, `SELECT id, user_id, region FROM tunnels WHERE is_active = TRUE AND user_id = $1`, userID)
+}
+
+// apply updates the limits of the active tunnels selected by query.
+func (q *QuotaService) apply(ctx context.Context, query string, args ...any) error {
+	rows, err := database.Pool.Query(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	type activeTunnel struct{ id, region string }
+	byUser := make(map[uuid.UUID][]activeTunnel)
+	for rows.Next() {
+		var id, userID uuid.UUID
+		var region string
+		if err := rows.Scan(&id, &userID, &region); err != nil {
+			rows.Close()
+			return err
+		}
+		byUser[userID] = append(byUser[userID], activeTunnel{id.String(), region})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for userID, tunnels := range byUser {
+		l, err := q.Limits(ctx, userID)
+		if err != nil {
+			q.log.Warn("Failed to compute limits", "user_id", userID, "error", err)
+			continue
+		}
+		limits := tunnelLimits(l)
+		for _, t := range tunnels {
+			if q.AppliedLimits(t.id) == limits {
+				continue
+			}
+			node, err := q.edges.Node(t.region)
+			if err != nil {
+				continue
+			}
+			if err := node.SetLimits(ctx, t.id, limits); err != nil {
+				q.log.Warn("Failed to apply limits", "tunnel_id", t.id, "region", t.region, "error", err)
+				continue
+			}
+			q.log.Info("Tunnel limits changed", "tunnel_id", t.id, "user_id", userID, "state", l.State)
+			q.applied.Store(t.id, limits)
+		}
+	}
+	return nil
+}
@@ -2,29 +2,160 @@ package services
 
 import (
 	"bufio"
+	"context"
 	"crypto/rand"
+	"fmt"
 	"math/big"
 	"os"
 	"strings"
 	"sync"
+
+	"tunnel-api/internal/database"
+)
+
+// Subdomain length limits (the column is VARCHAR(50); DNS allows 63).
+const (
+	MinSubdomainLen = 3
+	MaxSubdomainLen = 50
 )
 
+// Reasons a requested subdomain is refused.
+const (
+	SubdomainInvalid  = "invalid"
+	SubdomainReserved = "reserved"
+	SubdomainBlocked  = "blocked"
+	SubdomainTaken    = "taken"
+)
+
+// SubdomainError explains why a subdomain cannot be used.
+type SubdomainError struct {
+	Reason  string // SubdomainInvalid, SubdomainReserved, SubdomainBlocked or SubdomainTaken
+	Message string
+}
+
+func (e *SubdomainError) Error() string { return e.Message }
+
+// reservedSubdomains are labels used by the service itself or likely to be
+// mistaken for it. "map" is the web map prefix (map.<subdomain>.<domain>).
+var reservedSubdomains = map[string]bool{
+	"map": true, "www": true, "api": true, "admin": true, "app": true, "dashboard": true,
+	"mail": true, "smtp": true, "imap": true, "pop": true, "ftp": true, "ns": true, "ns1": true, "ns2": true,
+	"dns": true, "mx": true, "cdn": true, "static": true, "assets": true, "status": true, "metrics": true,
+	"help": true, "support": true, "docs": true, "blog": true, "billing": true, "account": true,
+	"login": true, "auth": true, "root": true, "localhost": true, "edge": true, "tunnel": true,
+	"tunnels": true, "voidlink": true, "play": true, "mc": true, "minecraft": true, "test": true,
+}
+
 type SubdomainService struct {
-	words []string
-	mu    sync.RWMutex
+	words   []string
+	blocked map[string]bool
+	mu      sync.RWMutex
 }
 
-func NewSubdomainService(wordlistPath string) (*SubdomainService, error) {
-	s := &SubdomainService{}
+// NewSubdomainService loads the generator word list and the optional
+// blocklist (one word per line, # for comments); both files may be missing.
+func NewSubdomainService(wordlistPath, blocklistPath string) (*SubdomainService, error) {
+	s := &SubdomainService{blocked: make(map[string]bool)}
 	
 	if err := s.loadWords(wordlistPath); err != nil {
 		// Use default words if file not found
 		s.words = defaultWords
 	}
+	if blocklistPath != "" {
+		if err := s.loadBlocklist(blocklistPath); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("load subdomain blocklist: %w", err)
+		}
+	}
 	
 	return s, nil
 }
 
+func (s *SubdomainService) loadBlocklist(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		word := strings.TrimSpace(strings.ToLower(scanner.Text()))
+		if word != "" && !strings.HasPrefix(word, "#") {
+			s.blocked[word] = true
+		}
+	}
+	return scanner.Err()
+}
+
+// Normalize lower-cases and trims a requested subdomain.
+func Normalize(subdomain string) string {
+	return strings.ToLower(strings.TrimSpace(subdomain))
+}
+
+// Validate checks a normalized subdomain against DNS label rules, the
+// reserved names and the blocklist. Blocklist entries match whole words
+// (the parts between hyphens) and the subdomain with its hyphens removed.
+func (s *SubdomainService) Validate(subdomain string) error {
+	if len(subdomain) < MinSubdomainLen || len(subdomain) > MaxSubdomainLen {
+		return &SubdomainError{SubdomainInvalid,
+			fmt.Sprintf("Subdomain must be %d-%d characters", MinSubdomainLen, MaxSubdomainLen)}
+	}
+	for _, c := range subdomain {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return &SubdomainError{SubdomainInvalid, "Subdomain may only contain letters, digits and hyphens"}
+		}
+	}
+	if subdomain[0] == '-' || subdomain[len(subdomain)-1] == '-' {
+		return &SubdomainError{SubdomainInvalid, "Subdomain cannot start or end with a hyphen"}
+	}
+	if strings.Contains(subdomain, "--") {
+		// also rules out IDN A-labels (xn--)
+		return &SubdomainError{SubdomainInvalid, "Subdomain cannot contain consecutive hyphens"}
+	}
+	if reservedSubdomains[subdomain] {
+		return &SubdomainError{SubdomainReserved, "This subdomain is reserved"}
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.blocked[strings.ReplaceAll(subdomain, "-", "")] {
+		return &SubdomainError{SubdomainBlocked, "This subdomain is not allowed"}
+	}
+	for _, part := range strings.Split(subdomain, "-") {
+		if s.blocked[part] {
+			return &SubdomainError{SubdomainBlocked, "This subdomain is not allowed"}
+		}
+	}
+	return nil
+}
+
+// Check validates a normalized subdomain and reports whether another tunnel
+// already uses it. The unique constraint on tunnels.subdomain remains the
+// authority when the subdomain is actually taken.
+func (s *SubdomainService) Check(ctx context.Context, subdomain string) error {
+	if err := s.Validate(subdomain); err != nil {
+		return err
+	}
+	var exists bool
+	if err := database.Pool.QueryRow(ctx,
+		`SELECT EXISTS(SELECT 1 FROM tunnels WHERE subdomain = $1)`, subdomain,
+	).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return &SubdomainError{SubdomainTaken, "This subdomain is already taken"}
+	}
+	return nil
+}
+
+// subdomainConstraint is the unique constraint on tunnels.subdomain.
+const subdomainConstraint = "tunnels_subdomain_key"
+
+// IsSubdomainTaken reports whether err is a unique violation on tunnels.subdomain.
+func IsSubdomainTaken(err error) bool {
+	return database.IsUniqueViolation(err, subdomainConstraint)
+}
+
 func (s *SubdomainService) loadWords(path string) error {
 	file, err := os.Open(path)
 	if err != nil {
@@ -52,8 +183,18 @@ func isAlpha(s string) bool {
 	return true
 }
 
-// Generate creates a unique subdomain with 1-3 random words
+// Generate creates a random subdomain of 2 or 3 words that passes Validate.
 func (s *SubdomainService) Generate() (string, error) {
+	for attempts := 0; attempts < 20; attempts++ {
+		sub, err := s.generate()
+		if err != nil || s.Validate(sub) == nil {
+			return sub, err
+		}
+	}
+	return "", fmt.Errorf("no allowed subdomain generated")
+}
+
+func (s *SubdomainService) generate() (string, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
@@ -0,0 +1,29 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestIsSubdomainTaken(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"subdomain", &pgconn.PgError{Code: "23505", ConstraintName: "tunnels_subdomain_key"}, true},
+		{"wrapped", fmt.Errorf("rename: %w", &pgconn.PgError{Code: "23505", ConstraintName: "tunnels_subdomain_key"}), true},
+		{"other constraint", &pgconn.PgError{Code: "23505", ConstraintName: "tunnels_tcp_public_port_key"}, false},
+		{"other code", &pgconn.PgError{Code: "23503", ConstraintName: "tunnels_subdomain_key"}, false},
+		{"message only", errors.New(`duplicate key value violates unique constraint "tunnels_subdomain_key"`), false},
+	}
+	for _, tt := range tests {
+		if got := IsSubdomainTaken(tt.err); got != tt.want {
+			t.Errorf("%s: IsSubdomainTaken = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
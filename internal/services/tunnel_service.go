@@ -2,81 +2,359 @@ package services
 
 import (
 	"context"
-	"log"
+	"log/slog"
+	"slices"
+	"sync"
+
+	"github.com/google/uuid"
 
 	"tunnel-api/internal/database"
+	"tunnel-api/internal/logging"
 	"tunnel-api/internal/models"
 	"tunnel-api/internal/tunnel"
 )
 
 // TunnelService is the API-layer service that manages tunnel lifecycle.
-// It delegates actual networking to tunnel.Server.
+// It delegates actual networking to the tunnel server of the tunnel's region,
+// local or on a remote edge node. Live inspection (stats, connections, logs)
+// reads the local server or asks the region's edge node over RPC.
 type TunnelService struct {
-	server *tunnel.Server
-	domain string
+	edges   *EdgeService
+	quota   *QuotaService
+	log     *slog.Logger
+	syncing sync.Map // region → struct{}, while SyncEdge runs
 }
 
-func NewTunnelService(srv *tunnel.Server, domain string) *TunnelService {
-	return &TunnelService{server: srv, domain: domain}
+func NewTunnelService(edges *EdgeService, quota *QuotaService, logger *slog.Logger) *TunnelService {
+	return &TunnelService{
+		edges: edges,
+		quota: quota,
+		log:   logger.With(logging.Subsystem, "tunnels"),
+	}
 }
 
-// StartTunnel registers a tunnel with the server so clients can connect and be routed.
-func (t *TunnelService) StartTunnel(tun models.Tunnel) error {
+// StartTunnel registers a tunnel with the server of its region so clients can
+// connect and be routed.
+func (t *TunnelService) StartTunnel(ctx context.Context, tun models.Tunnel) error {
+	node, err := t.edges.Node(tun.Region)
+	if err != nil {
+		return err
+	}
 	reg := tunnel.TunnelRegistration{
 		TunnelID:      tun.ID.String(),
+		UserID:        tun.UserID.String(),
 		Subdomain:     tun.Subdomain,
 		MCLocalPort:   tun.MCLocalPort,
 		HTTPLocalPort: tun.HTTPLocalPort,
+		HTTPCache:     tun.HTTPCacheEnabled,
 		UDPLocalPort:  tun.UDPLocalPort,
 		UDPPublicPort: tun.UDPPublicPort,
+		TCPLocalPort:  tun.TCPLocalPort,
+		TCPPublicPort: tun.TCPPublicPort,
+	}
+	for _, m := range tun.UDPMappings {
+		if m.Enabled {
+			reg.UDPMappings = append(reg.UDPMappings, tunnel.UDPMapping{PublicPort: m.PublicPort, LocalPort: m.LocalPort})
+		}
+	}
+	limits, err := t.quota.Limits(ctx, tun.UserID)
+	if err != nil {
+		return err
 	}
-	t.server.RegisterTunnel(reg)
+	reg.Limits = tunnelLimits(limits)
+	if reg.Hostnames, err = VerifiedHostnames(ctx, tun.ID); err != nil {
+		return err
+	}
+	if err := node.Register(ctx, reg); err != nil {
+		return err
+	}
+	t.quota.applied.Store(reg.TunnelID, reg.Limits)
 	return nil
 }
 
 // StopTunnel removes the tunnel from active routing and disconnects the client.
+// If the edge node is unreachable, the next heartbeat sync removes it.
 func (t *TunnelService) StopTunnel(tun models.Tunnel) {
-	t.server.UnregisterTunnel(tun.ID.String(), tun.Subdomain, tun.UDPPublicPort)
+	t.quota.applied.Delete(tun.ID.String())
+	node, err := t.edges.Node(tun.Region)
+	if err != nil {
+		return
+	}
+	if err := node.Unregister(context.Background(), tun.ID.String()); err != nil {
+		t.log.Error("Failed to stop tunnel", "tunnel_id", tun.ID, "region", tun.Region, "error", err)
+	}
+}
+
+// RenameTunnel switches the tunnel's routing to its new subdomain if it is active.
+func (t *TunnelService) RenameTunnel(tun models.Tunnel) {
+	node, err := t.edges.Node(tun.Region)
+	if err != nil {
+		return
+	}
+	if err := node.Rename(context.Background(), tun.ID.String(), tun.Subdomain); err != nil {
+		t.log.Error("Failed to rename tunnel", "tunnel_id", tun.ID, "region", tun.Region, "error", err)
+	}
+}
+
+// MoveTunnel hands an active tunnel over to the server of its new region
+// (tun.Region): it is started there first, then the old region's server drops
+// it, tells the client to reconnect and keeps redirecting players from the
+// old address. If the old region is unreachable, its next heartbeat sync
+// removes the tunnel without a redirect.
+func (t *TunnelService) MoveTunnel(ctx context.Context, tun models.Tunnel, from string) error {
+	target, err := t.edges.Target(tun.Region)
+	if err != nil {
+		return err
+	}
+	if !tun.IsActive {
+		return nil
+	}
+	if err := t.StartTunnel(ctx, tun); err != nil {
+		return err
+	}
+	node, err := t.edges.Node(from)
+	if err != nil {
+		return nil
+	}
+	if err := node.Move(ctx, tun.ID.String(), target); err != nil {
+		t.log.Error("Failed to move tunnel", "tunnel_id", tun.ID, "region", from, "to", tun.Region, "error", err)
+	}
+	return nil
+}
+
+// Draining reports whether the local tunnel server is draining before a shutdown.
+func (t *TunnelService) Draining() bool {
+	local := t.edges.Local()
+	return local != nil && local.Draining()
 }
 
 // IsClientConnected returns true if the VoidLink desktop app is connected for this tunnel.
-func (t *TunnelService) IsClientConnected(tunnelID string) bool {
-	return t.server.IsClientConnected(tunnelID)
+func (t *TunnelService) IsClientConnected(tun models.Tunnel) bool {
+	_, ok := t.ClientInfo(tun)
+	return ok
+}
+
+// ClientInfo returns the desktop app attached to a tunnel (ok=false if none is connected).
+func (t *TunnelService) ClientInfo(tun models.Tunnel) (tunnel.ClientInfo, bool) {
+	return t.edges.ClientInfo(tun.Region, tun.ID.String())
+}
+
+// The live inspection methods below read from the tunnel server of the
+// tunnel's region, over edge RPC for remote regions. They return
+// ErrRegionUnavailable if no node of the region is online.
+
+// ClientLatency returns the recent control channel RTTs of a tunnel's client.
+func (t *TunnelService) ClientLatency(ctx context.Context, tun models.Tunnel) (tunnel.ClientLatency, bool, error) {
+	node, err := t.edges.Inspector(tun.Region, tun.ID.String())
+	if err != nil {
+		return tunnel.ClientLatency{}, false, err
+	}
+	return node.ClientLatency(ctx, tun.ID.String())
+}
+
+// HTTPCacheStats returns the edge cache statistics of a tunnel (ok=false if caching is off).
+func (t *TunnelService) HTTPCacheStats(ctx context.Context, tun models.Tunnel) (tunnel.HTTPCacheStats, bool, error) {
+	node, err := t.edges.Inspector(tun.Region, tun.ID.String())
+	if err != nil {
+		return tunnel.HTTPCacheStats{}, false, err
+	}
+	return node.HTTPCacheStats(ctx, tun.ID.String())
+}
+
+// PurgeHTTPCache invalidates cached web map responses whose path starts with prefix.
+func (t *TunnelService) PurgeHTTPCache(ctx context.Context, tun models.Tunnel, prefix string) (int, error) {
+	node, err := t.edges.Inspector(tun.Region, tun.ID.String())
+	if err != nil {
+		return 0, err
+	}
+	return node.PurgeHTTPCache(ctx, tun.ID.String(), prefix)
+}
+
+// TunnelStats returns the live statistics (compression savings etc.) of a tunnel.
+func (t *TunnelService) TunnelStats(ctx context.Context, tun models.Tunnel) (tunnel.TunnelStats, error) {
+	node, err := t.edges.Inspector(tun.Region, tun.ID.String())
+	if err != nil {
+		return tunnel.TunnelStats{}, err
+	}
+	return node.TunnelStats(ctx, tun.ID.String())
+}
+
+// Limits returns the plan limits and monthly transfer of the tunnel's owner,
+// with the bandwidth currently applied to the tunnel.
+func (t *TunnelService) Limits(ctx context.Context, tun models.Tunnel) (models.TunnelLimitsResponse, error) {
+	limits, err := t.quota.Limits(ctx, tun.UserID)
+	if err != nil {
+		return limits, err
+	}
+	if tun.IsActive {
+		applied := t.quota.AppliedLimits(tun.ID.String())
+		limits.UploadBytesPerSec = applied.UploadBytesPerSec
+		limits.DownloadBytesPerSec = applied.DownloadBytesPerSec
+	}
+	return limits, nil
+}
+
+// Connections lists the open player connections and UDP sessions of a tunnel.
+func (t *TunnelService) Connections(ctx context.Context, tun models.Tunnel) ([]tunnel.Connection, error) {
+	node, err := t.edges.Inspector(tun.Region, tun.ID.String())
+	if err != nil {
+		return nil, err
+	}
+	return node.Connections(ctx, tun.ID.String())
+}
+
+// CloseConnection kills a player connection of a tunnel. Returns false if it does not exist.
+func (t *TunnelService) CloseConnection(ctx context.Context, tun models.Tunnel, connID string) (bool, error) {
+	node, err := t.edges.Inspector(tun.Region, tun.ID.String())
+	if err != nil {
+		return false, err
+	}
+	return node.CloseConnection(ctx, tun.ID.String(), connID)
+}
+
+// HTTPAccessLogs returns recent HTTP proxy requests of a tunnel, newest first.
+func (t *TunnelService) HTTPAccessLogs(ctx context.Context, tun models.Tunnel, filter tunnel.AccessLogFilter) ([]tunnel.HTTPAccessLog, error) {
+	node, err := t.edges.Inspector(tun.Region, tun.ID.String())
+	if err != nil {
+		return nil, err
+	}
+	return node.HTTPAccessLogs(ctx, tun.ID.String(), filter)
+}
+
+// LoadUDPMappings fills in the extra UDP mappings of the given tunnels.
+func (t *TunnelService) LoadUDPMappings(ctx context.Context, tunnels ...*models.Tunnel) error {
+	if len(tunnels) == 0 {
+		return nil
+	}
+	ids := make([]string, len(tunnels))
+	byID := make(map[uuid.UUID]*models.Tunnel, len(tunnels))
+	for i, tun := range tunnels {
+		ids[i] = tun.ID.String()
+		byID[tun.ID] = tun
+		tun.UDPMappings = []models.UDPMapping{}
+	}
+
+	rows, err := database.Pool.Query(ctx,
+		`SELECT `+models.UDPMappingColumns+` FROM tunnel_udp_mappings
+		 WHERE tunnel_id = ANY($1::uuid[]) ORDER BY created_at`, ids)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var m models.UDPMapping
+		if err := rows.Scan(m.ScanFields()...); err != nil {
+			return err
+		}
+		if tun, ok := byID[m.TunnelID]; ok {
+			tun.UDPMappings = append(tun.UDPMappings, m)
+		}
+	}
+	return rows.Err()
 }
 
-// IsUDPPortInUse checks whether the given UDP public port is in use at the server level.
+// IsUDPPortInUse checks whether the given UDP public port is in use at the local server level.
 func (t *TunnelService) IsUDPPortInUse(port int) bool {
-	return t.server.IsUDPPortInUse(port)
+	srv := t.edges.Local()
+	return srv != nil && srv.IsUDPPortInUse(port)
 }
 
-// RestoreActiveTunnels re-registers all is_active tunnels from the database
-// into the server's in-memory routing tables. Call this once on startup.
+// RestoreActiveTunnels re-registers all is_active tunnels of the local region
+// from the database into the server's in-memory routing tables. Call this once
+// on startup. Remote edge nodes are restored by SyncEdge.
 func (t *TunnelService) RestoreActiveTunnels() {
+	if t.edges.Local() == nil {
+		return
+	}
 	ctx := context.Background()
-	rows, err := database.Pool.Query(ctx, `
-		SELECT id, subdomain, mc_local_port, http_local_port, udp_local_port, udp_public_port
-		FROM tunnels WHERE is_active = TRUE
-	`)
+	tunnels, err := t.activeTunnels(ctx, t.edges.localRegion)
 	if err != nil {
-		log.Printf("[TunnelService] Failed to restore active tunnels: %v", err)
+		t.log.Error("Failed to restore active tunnels", "error", err)
 		return
 	}
-	defer rows.Close()
 
 	count := 0
+	for _, tun := range tunnels {
+		if err := t.StartTunnel(ctx, *tun); err != nil {
+			t.log.Error("Failed to restore tunnel", "tunnel_id", tun.ID, "user_id", tun.UserID, "error", err)
+			continue
+		}
+		count++
+	}
+	t.log.Info("Restored active tunnels", "count", count)
+}
+
+// SyncEdge reconciles a remote edge node with the database after a heartbeat:
+// active tunnels of its region it does not run (after a restart, or a start
+// while it was unreachable) are registered, and tunnels it runs that are no
+// longer active are removed. A tunnel started between the node's report and
+// the query may be removed too; the next heartbeat registers it again.
+func (t *TunnelService) SyncEdge(ctx context.Context, region string, running []string) {
+	if _, busy := t.syncing.LoadOrStore(region, struct{}{}); busy {
+		return
+	}
+	defer t.syncing.Delete(region)
+
+	node, err := t.edges.Node(region)
+	if err != nil {
+		return
+	}
+	tunnels, err := t.activeTunnels(ctx, region)
+	if err != nil {
+		t.log.Error("Failed to sync edge node", "region", region, "error", err)
+		return
+	}
+
+	active := make(map[string]bool, len(tunnels))
+	for _, tun := range tunnels {
+		id := tun.ID.String()
+		active[id] = true
+		if slices.Contains(running, id) {
+			continue
+		}
+		if err := t.StartTunnel(ctx, *tun); err != nil {
+			t.log.Error("Failed to restore tunnel", "tunnel_id", tun.ID, "region", region, "error", err)
+			continue
+		}
+		t.log.Info("Restored tunnel on edge node", "tunnel_id", tun.ID, "region", region)
+	}
+	for _, id := range running {
+		if active[id] {
+			continue
+		}
+		if err := node.Unregister(ctx, id); err != nil {
+			t.log.Error("Failed to remove stale tunnel", "tunnel_id", id, "region", region, "error", err)
+			continue
+		}
+		t.log.Info("Removed stale tunnel from edge node", "tunnel_id", id, "region", region)
+	}
+}
+
+// activeTunnels loads the is_active tunnels of a region with their UDP mappings.
+func (t *TunnelService) activeTunnels(ctx context.Context, region string) ([]*models.Tunnel, error) {
+	rows, err := database.Pool.Query(ctx,
+		`SELECT `+models.TunnelColumns+` FROM tunnels WHERE is_active = TRUE AND region = $1`, region)
+	if err != nil {
+		return nil, err
+	}
+
+	var tunnels []*models.Tunnel
 	for rows.Next() {
 		var tun models.Tunnel
-		if err := rows.Scan(
-			&tun.ID, &tun.Subdomain,
-			&tun.MCLocalPort, &tun.HTTPLocalPort,
-			&tun.UDPLocalPort, &tun.UDPPublicPort,
-		); err != nil {
-			log.Printf("[TunnelService] Failed to scan tunnel row: %v", err)
+		if err := rows.Scan(tun.ScanFields()...); err != nil {
+			t.log.Error("Failed to scan tunnel row", "error", err)
 			continue
 		}
-		if err := t.StartTunnel(tun); err == nil {
-			count++
-		}
+		tunnels = append(tunnels, &tun)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := t.LoadUDPMappings(ctx, tunnels...); err != nil {
+		t.log.Error("Failed to load UDP mappings", "error", err)
 	}
-	log.Printf("[TunnelService] Restored %d active tunnel(s)", count)
+	return tunnels, nil
 }
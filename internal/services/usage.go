@@ -0,0 +1,158 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"tunnel-api/internal/database"
+	"tunnel-api/internal/logging"
+	"tunnel-api/internal/tunnel"
+)
+
+// UsageService periodically drains the tunnel server's traffic counters and
+// adds them to hourly buckets in the tunnel_usage table. Traffic of remote edge
+// nodes arrives with their heartbeats through Add.
+type UsageService struct {
+	server   *tunnel.Server // nil in control mode
+	interval time.Duration
+	log      *slog.Logger
+
+	mu      sync.Mutex
+	pending map[usageKey]tunnel.UsageRecord // drained but not yet persisted
+
+	// regionTunnels is RegionTunnelOwners, replaced in tests.
+	regionTunnels func(ctx context.Context, region string, ids []uuid.UUID) (map[string]string, error)
+}
+
+type usageKey struct {
+	tunnelID string
+	channel  string
+	bucket   time.Time
+}
+
+func NewUsageService(srv *tunnel.Server, interval time.Duration, logger *slog.Logger) *UsageService {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	return &UsageService{
+		server:   srv,
+		interval: interval,
+		log:      logger.With(logging.Subsystem, "usage"),
+		pending:  make(map[usageKey]tunnel.UsageRecord),
+
+		regionTunnels: RegionTunnelOwners,
+	}
+}
+
+// Run flushes usage every interval until ctx is cancelled.
+func (u *UsageService) Run(ctx context.Context) {
+	ticker := time.NewTicker(u.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := u.Flush(context.Background()); err != nil {
+				u.log.Warn("Flush failed, will retry", "error", err)
+			}
+		}
+	}
+}
+
+// Flush drains the in-memory counters into the current hourly bucket.
+// Records that could not be written are kept and retried on the next flush.
+func (u *UsageService) Flush(ctx context.Context) error {
+	bucket := time.Now().UTC().Truncate(time.Hour)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.server != nil {
+		u.add(bucket, u.server.DrainUsage())
+	}
+	if len(u.pending) == 0 {
+		return nil
+	}
+
+	// Rows of tunnels deleted in the meantime are skipped by the EXISTS check.
+	batch := &pgx.Batch{}
+	for k, r := range u.pending {
+		batch.Queue(
+			`INSERT INTO tunnel_usage (tunnel_id, bucket, channel, bytes_in, bytes_out, connections, bytes_saved)
+			 SELECT $1, $2, $3, $4, $5, $6, $7 WHERE EXISTS (SELECT 1 FROM tunnels WHERE id = $1)
+			 ON CONFLICT (tunnel_id, bucket, channel) DO UPDATE SET
+			     bytes_in = tunnel_usage.bytes_in + EXCLUDED.bytes_in,
+			     bytes_out = tunnel_usage.bytes_out + EXCLUDED.bytes_out,
+			     connections = tunnel_usage.connections + EXCLUDED.connections,
+			     bytes_saved = tunnel_usage.bytes_saved + EXCLUDED.bytes_saved`,
+			r.TunnelID, k.bucket, r.Channel, r.BytesIn, r.BytesOut, r.Connections, r.BytesSaved,
+		)
+	}
+	if err := database.Pool.SendBatch(ctx, batch).Close(); err != nil {
+		return err
+	}
+
+	clear(u.pending)
+	return nil
+}
+
+// AddFromRegion queues traffic reported by an edge node of region, dropping
+// the records of tunnels outside it: a node's token must not let it charge
+// other regions' tunnels. Tunnels that moved away from the region within
+// tunnel.MoveRedirectTTL are accepted, since the node may still report their
+// last traffic. It returns the number of records dropped.
+func (u *UsageService) AddFromRegion(ctx context.Context, region string, records []tunnel.UsageRecord) (int, error) {
+	if len(records) == 0 {
+		return 0, nil
+	}
+	var ids []uuid.UUID
+	for _, r := range records {
+		if id, err := uuid.Parse(r.TunnelID); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	owners, err := u.regionTunnels(ctx, region, ids)
+	if err != nil {
+		return 0, err
+	}
+
+	kept := records[:0:0]
+	for _, r := range records {
+		if _, ok := owners[r.TunnelID]; ok {
+			kept = append(kept, r)
+		}
+	}
+	if dropped := len(records) - len(kept); dropped > 0 {
+		u.log.Warn("Dropped usage of tunnels outside the edge node's region", "region", region, "records", dropped)
+	}
+	u.Add(kept)
+	return len(records) - len(kept), nil
+}
+
+// Add queues traffic for the next flush.
+func (u *UsageService) Add(records []tunnel.UsageRecord) {
+	bucket := time.Now().UTC().Truncate(time.Hour)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.add(bucket, records)
+}
+
+func (u *UsageService) add(bucket time.Time, records []tunnel.UsageRecord) {
+	for _, r := range records {
+		k := usageKey{tunnelID: r.TunnelID, channel: r.Channel, bucket: bucket}
+		p := u.pending[k]
+		p.TunnelID, p.Channel = r.TunnelID, r.Channel
+		p.BytesIn += r.BytesIn
+		p.BytesOut += r.BytesOut
+		p.Connections += r.Connections
+		p.BytesSaved += r.BytesSaved
+		u.pending[k] = p
+	}
+}
@@ -0,0 +1,55 @@
+package services
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"tunnel-api/internal/tunnel"
+)
+
+// An edge node's traffic is only counted for tunnels its region may report.
+func TestAddFromRegionDropsOtherRegions(t *testing.T) {
+	own, movedAway, foreign := uuid.New(), uuid.New(), uuid.New()
+	u := NewUsageService(nil, time.Minute, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	var asked []uuid.UUID
+	u.regionTunnels = func(_ context.Context, region string, ids []uuid.UUID) (map[string]string, error) {
+		if region != "eu" {
+			t.Errorf("region = %q, want eu", region)
+		}
+		asked = ids
+		return map[string]string{own.String(): "u1", movedAway.String(): "u2"}, nil
+	}
+
+	dropped, err := u.AddFromRegion(context.Background(), "eu", []tunnel.UsageRecord{
+		{TunnelID: own.String(), Channel: tunnel.ChannelMC, BytesIn: 10},
+		{TunnelID: movedAway.String(), Channel: tunnel.ChannelUDP, BytesIn: 20},
+		{TunnelID: foreign.String(), Channel: tunnel.ChannelMC, BytesIn: 30},
+		{TunnelID: "not-a-uuid", Channel: tunnel.ChannelMC, BytesIn: 40},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dropped != 2 {
+		t.Errorf("dropped %d records, want 2", dropped)
+	}
+	if want := []uuid.UUID{own, movedAway, foreign}; !slices.Equal(asked, want) {
+		t.Errorf("looked up %v, want %v", asked, want)
+	}
+
+	var counted []string
+	for k, r := range u.pending {
+		counted = append(counted, k.tunnelID+" "+r.Channel)
+	}
+	slices.Sort(counted)
+	want := []string{own.String() + " mc", movedAway.String() + " udp"}
+	slices.Sort(want)
+	if !slices.Equal(counted, want) {
+		t.Errorf("pending usage %v, want %v", counted, want)
+	}
+}
@@ -0,0 +1,43 @@
+package tracing
+
+import (
+	"encoding/hex"
+	"strings"
+)
+
+// W3C Trace Context: traceparent = version "-" trace-id "-" parent-id "-" flags
+
+// ParseTraceparent parses a traceparent header.
+func ParseTraceparent(h string) (traceID TraceID, spanID SpanID, sampled bool, ok bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return traceID, spanID, false, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil {
+		return traceID, spanID, false, false
+	}
+	if _, err := hex.Decode(spanID[:], []byte(parts[2])); err != nil {
+		return traceID, spanID, false, false
+	}
+	var flags [1]byte
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return traceID, spanID, false, false
+	}
+	if !traceID.IsValid() || !spanID.IsValid() {
+		return traceID, spanID, false, false
+	}
+	return traceID, spanID, flags[0]&1 == 1, true
+}
+
+// Traceparent formats the span's context as a traceparent header ("" for a nil span).
+func (s *Span) Traceparent() string {
+	if s == nil {
+		return ""
+	}
+	flags := "00"
+	if s.recording {
+		flags = "01"
+	}
+	return "00-" + s.data.TraceID.String() + "-" + s.data.SpanID.String() + "-" + flags
+}
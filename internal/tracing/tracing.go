@@ -0,0 +1,392 @@
+// Package tracing is a small OpenTelemetry-compatible tracer: spans with
+// attributes, events and error status, propagated through context.Context,
+// batched and handed to an Exporter (OTLP/HTTP JSON or in-memory).
+//
+// Without a default tracer (SetDefault), Start returns a nil *Span and every
+// Span method is a no-op, so instrumented code costs almost nothing when
+// tracing is disabled.
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"log/slog"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type TraceID [16]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (t TraceID) IsValid() bool  { return t != TraceID{} }
+
+type SpanID [8]byte
+
+func (s SpanID) String() string { return hex.EncodeToString(s[:]) }
+func (s SpanID) IsValid() bool  { return s != SpanID{} }
+
+// SpanKind values match the OTLP enum.
+type SpanKind int
+
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+	KindClient   SpanKind = 3
+)
+
+// StatusCode values match the OTLP enum.
+type StatusCode int
+
+const (
+	StatusUnset StatusCode = 0
+	StatusOK    StatusCode = 1
+	StatusError StatusCode = 2
+)
+
+// Attr is a span or event attribute. Values are string, bool, int, int64 or float64.
+type Attr struct {
+	Key   string
+	Value any
+}
+
+func String(k, v string) Attr        { return Attr{k, v} }
+func Int(k string, v int) Attr       { return Attr{k, int64(v)} }
+func Int64(k string, v int64) Attr   { return Attr{k, v} }
+func Bool(k string, v bool) Attr     { return Attr{k, v} }
+func Float(k string, v float64) Attr { return Attr{k, v} }
+
+type Event struct {
+	Name  string
+	Time  time.Time
+	Attrs []Attr
+}
+
+// SpanData is a finished span as passed to exporters.
+type SpanData struct {
+	TraceID       TraceID
+	SpanID        SpanID
+	ParentID      SpanID
+	Name          string
+	Kind          SpanKind
+	Start         time.Time
+	End           time.Time
+	Attrs         []Attr
+	Events        []Event
+	Status        StatusCode
+	StatusMessage string
+}
+
+// Attr returns the value of the attribute key, or nil.
+func (d *SpanData) Attr(key string) any {
+	for _, a := range d.Attrs {
+		if a.Key == key {
+			return a.Value
+		}
+	}
+	return nil
+}
+
+// Span is an operation in progress. A nil *Span is valid and records nothing.
+type Span struct {
+	tracer    *Tracer
+	recording bool
+
+	mu    sync.Mutex
+	data  SpanData
+	ended bool
+}
+
+// SetAttrs adds or replaces attributes.
+func (s *Span) SetAttrs(attrs ...Attr) {
+	if s == nil || !s.recording {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, a := range attrs {
+		replaced := false
+		for i := range s.data.Attrs {
+			if s.data.Attrs[i].Key == a.Key {
+				s.data.Attrs[i].Value = a.Value
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			s.data.Attrs = append(s.data.Attrs, a)
+		}
+	}
+}
+
+// AddEvent records a lifecycle step.
+func (s *Span) AddEvent(name string, attrs ...Attr) {
+	if s == nil || !s.recording {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Events = append(s.data.Events, Event{Name: name, Time: time.Now(), Attrs: attrs})
+}
+
+// RecordError adds an exception event and marks the span as failed.
+func (s *Span) RecordError(err error, attrs ...Attr) {
+	if s == nil || !s.recording || err == nil {
+		return
+	}
+	s.AddEvent("exception", append([]Attr{String("exception.message", err.Error())}, attrs...)...)
+	s.SetStatus(StatusError, err.Error())
+}
+
+func (s *Span) SetStatus(code StatusCode, msg string) {
+	if s == nil || !s.recording {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Status, s.data.StatusMessage = code, msg
+}
+
+// End finishes the span and queues it for export. Later calls are ignored.
+func (s *Span) End() {
+	if s == nil || !s.recording {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	s.mu.Unlock()
+	s.tracer.enqueue(data)
+}
+
+// TraceID returns the span's trace ID (zero for a nil span).
+func (s *Span) TraceID() TraceID {
+	if s == nil {
+		return TraceID{}
+	}
+	return s.data.TraceID
+}
+
+type spanKey struct{}
+
+// SpanFromContext returns the current span, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// ContextWithRemoteParent makes spans started from ctx children of a span in
+// another process (e.g. from a traceparent header).
+func ContextWithRemoteParent(ctx context.Context, traceID TraceID, spanID SpanID, sampled bool) context.Context {
+	return context.WithValue(ctx, spanKey{}, &Span{
+		recording: sampled,
+		data:      SpanData{TraceID: traceID, SpanID: spanID},
+		ended:     true,
+	})
+}
+
+// ---- Tracer ----
+
+// Config configures a Tracer.
+type Config struct {
+	Exporter      Exporter
+	SampleRatio   float64       // fraction of new traces recorded (children follow their parent)
+	BatchSize     int           // spans per export (default 512)
+	QueueSize     int           // spans buffered before new ones are dropped (default 2048)
+	FlushInterval time.Duration // default 5s
+	Logger        *slog.Logger  // export failures are logged here (default slog.Default())
+}
+
+// Tracer creates spans and exports them in batches from a background goroutine.
+type Tracer struct {
+	exporter  Exporter
+	log       *slog.Logger
+	ratio     float64
+	batchSize int
+	interval  time.Duration
+
+	queue   chan SpanData
+	flushCh chan chan struct{}
+	done    chan struct{}
+	dropped atomic.Int64
+
+	mu     sync.RWMutex // guards closing queue against enqueue
+	closed bool
+}
+
+func NewTracer(cfg Config) *Tracer {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 512
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 2048
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = 5 * time.Second
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	t := &Tracer{
+		exporter:  cfg.Exporter,
+		log:       cfg.Logger,
+		ratio:     cfg.SampleRatio,
+		batchSize: cfg.BatchSize,
+		interval:  cfg.FlushInterval,
+		queue:     make(chan SpanData, cfg.QueueSize),
+		flushCh:   make(chan chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+var defaultTracer atomic.Pointer[Tracer]
+
+// SetDefault installs the tracer used by Start.
+func SetDefault(t *Tracer) {
+	defaultTracer.Store(t)
+}
+
+// Start starts a span with the default tracer. It returns a nil span if
+// tracing is not configured.
+func Start(ctx context.Context, name string, kind SpanKind, attrs ...Attr) (context.Context, *Span) {
+	t := defaultTracer.Load()
+	if t == nil {
+		return ctx, nil
+	}
+	return t.Start(ctx, name, kind, attrs...)
+}
+
+// Start starts a span as a child of the span in ctx, if any.
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind, attrs ...Attr) (context.Context, *Span) {
+	s := &Span{tracer: t, data: SpanData{Name: name, Kind: kind, Start: time.Now(), Attrs: attrs}}
+	if parent := SpanFromContext(ctx); parent != nil {
+		s.recording = parent.recording
+		s.data.TraceID = parent.data.TraceID
+		s.data.ParentID = parent.data.SpanID
+	} else {
+		s.recording = t.ratio >= 1 || rand.Float64() < t.ratio
+		s.data.TraceID = newTraceID()
+	}
+	s.data.SpanID = newSpanID()
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func newTraceID() (id TraceID) {
+	for id == (TraceID{}) {
+		hi, lo := rand.Uint64(), rand.Uint64()
+		for i := 0; i < 8; i++ {
+			id[i], id[8+i] = byte(hi>>(56-8*i)), byte(lo>>(56-8*i))
+		}
+	}
+	return id
+}
+
+func newSpanID() (id SpanID) {
+	for id == (SpanID{}) {
+		v := rand.Uint64()
+		for i := 0; i < 8; i++ {
+			id[i] = byte(v >> (56 - 8*i))
+		}
+	}
+	return id
+}
+
+func (t *Tracer) enqueue(d SpanData) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.queue <- d:
+	default:
+		t.dropped.Add(1)
+	}
+}
+
+// Dropped returns the number of spans dropped because the queue was full.
+func (t *Tracer) Dropped() int64 {
+	return t.dropped.Load()
+}
+
+func (t *Tracer) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	var batch []SpanData
+	export := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := t.exporter.Export(ctx, batch); err != nil {
+			t.log.Warn("Span export failed", "spans", len(batch), "error", err)
+		}
+		cancel()
+		batch = nil
+	}
+	for {
+		select {
+		case d, ok := <-t.queue:
+			if !ok {
+				export()
+				return
+			}
+			batch = append(batch, d)
+			if len(batch) >= t.batchSize {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		case ack := <-t.flushCh:
+			for n := len(t.queue); n > 0; n-- {
+				batch = append(batch, <-t.queue)
+			}
+			export()
+			close(ack)
+		}
+	}
+}
+
+// ForceFlush exports every span ended so far.
+func (t *Tracer) ForceFlush(ctx context.Context) {
+	ack := make(chan struct{})
+	select {
+	case t.flushCh <- ack:
+	case <-t.done:
+		return
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case <-ack:
+	case <-ctx.Done():
+	}
+}
+
+// Shutdown exports the remaining spans and stops the tracer.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.closed = true
+	close(t.queue)
+	t.mu.Unlock()
+	select {
+	case <-t.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return t.exporter.Shutdown(ctx)
+}
@@ -0,0 +1,235 @@
+package tunnel
+
+// Access logs for the HTTP proxy. Every proxied request produces one record,
+// kept in a bounded per-tunnel ring buffer that owners can query through the
+// API, and optionally appended as a JSON line to an operator-configured file.
+// The ring outlives a stop of the tunnel, when its owner is most likely to
+// read it, and is dropped accessLogRetention later unless the tunnel starts
+// again.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultAccessLogSize = 1000
+	accessLogSinkBuffer  = 4096
+
+	// accessLogRetention is how long the access log of a stopped tunnel is kept.
+	accessLogRetention = 24 * time.Hour
+)
+
+// HTTPAccessLog is one proxied HTTP request.
+type HTTPAccessLog struct {
+	Time      time.Time `json:"time"`
+	TunnelID  string    `json:"tunnel_id"`
+	ClientIP  string    `json:"client_ip"`
+	Host      string    `json:"host"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+	BytesSent int64     `json:"bytes_sent"`
+	LatencyMs float64   `json:"latency_ms"`
+	Cache     string    `json:"cache,omitempty"` // HIT, MISS, REVALIDATED or BYPASS
+	UserAgent string    `json:"user_agent,omitempty"`
+}
+
+// AccessLogFilter selects records from a tunnel's access log.
+// Zero values match everything.
+type AccessLogFilter struct {
+	Since      time.Time `json:"since"`
+	Until      time.Time `json:"until"`
+	Method     string    `json:"method,omitempty"`
+	PathPrefix string    `json:"path_prefix,omitempty"`
+	ClientIP   string    `json:"client_ip,omitempty"`
+	StatusMin  int       `json:"status_min,omitempty"`
+	StatusMax  int       `json:"status_max,omitempty"`
+	Limit      int       `json:"limit,omitempty"`
+}
+
+func (f *AccessLogFilter) match(r *HTTPAccessLog) bool {
+	if !f.Since.IsZero() && r.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && r.Time.After(f.Until) {
+		return false
+	}
+	if f.Method != "" && !strings.EqualFold(f.Method, r.Method) {
+		return false
+	}
+	if f.PathPrefix != "" && !strings.HasPrefix(r.Path, f.PathPrefix) {
+		return false
+	}
+	if f.ClientIP != "" && f.ClientIP != r.ClientIP {
+		return false
+	}
+	if f.StatusMin > 0 && r.Status < f.StatusMin {
+		return false
+	}
+	if f.StatusMax > 0 && r.Status > f.StatusMax {
+		return false
+	}
+	return true
+}
+
+// accessLogRing is a fixed-size ring buffer of access log records.
+type accessLogRing struct {
+	mu   sync.Mutex
+	buf  []HTTPAccessLog
+	next int
+	full bool
+
+	stopped atomic.Int64 // unix nanos when the tunnel was unregistered, 0 while registered
+}
+
+func newAccessLogRing(size int) *accessLogRing {
+	return &accessLogRing{buf: make([]HTTPAccessLog, size)}
+}
+
+func (r *accessLogRing) add(rec HTTPAccessLog) {
+	r.mu.Lock()
+	r.buf[r.next] = rec
+	r.next = (r.next + 1) % len(r.buf)
+	if r.next == 0 {
+		r.full = true
+	}
+	r.mu.Unlock()
+}
+
+// query returns matching records, newest first.
+func (r *accessLogRing) query(f AccessLogFilter) []HTTPAccessLog {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := r.next
+	if r.full {
+		n = len(r.buf)
+	}
+	out := []HTTPAccessLog{}
+	for i := 0; i < n; i++ {
+		idx := (r.next - 1 - i + len(r.buf)) % len(r.buf)
+		if rec := &r.buf[idx]; f.match(rec) {
+			out = append(out, *rec)
+			if f.Limit > 0 && len(out) >= f.Limit {
+				break
+			}
+		}
+	}
+	return out
+}
+
+// accessLogSink appends records as JSON lines to a file without blocking the proxy.
+type accessLogSink struct {
+	ch chan HTTPAccessLog
+}
+
+func openAccessLogSink(path string, logger *slog.Logger) (*accessLogSink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open access log %s: %w", path, err)
+	}
+	sink := &accessLogSink{ch: make(chan HTTPAccessLog, accessLogSinkBuffer)}
+	go func() {
+		enc := json.NewEncoder(f)
+		for rec := range sink.ch {
+			if err := enc.Encode(rec); err != nil {
+				logger.Error("Access log write failed", "error", err)
+			}
+		}
+	}()
+	return sink, nil
+}
+
+func (k *accessLogSink) write(rec HTTPAccessLog) {
+	select {
+	case k.ch <- rec:
+	default:
+		// Sink is behind; drop rather than stall the proxy.
+	}
+}
+
+// recordHTTPAccess stores an access log record for the tunnel.
+func (s *Server) recordHTTPAccess(rec HTTPAccessLog) {
+	ringRaw, ok := s.accessLogs.Load(rec.TunnelID)
+	if !ok {
+		ringRaw, ok = s.accessLogs.LoadOrStore(rec.TunnelID, newAccessLogRing(s.accessLogSize))
+		if !ok {
+			s.markLateAccessLog(rec.TunnelID, ringRaw.(*accessLogRing))
+		}
+	}
+	ringRaw.(*accessLogRing).add(rec)
+	if s.accessLogSink != nil {
+		s.accessLogSink.write(rec)
+	}
+}
+
+// markLateAccessLog marks a ring created for a request that finished after
+// its tunnel was unregistered as stopped, so the janitor frees it. The
+// registration is checked again afterwards in case the tunnel started in
+// between; RegisterTunnel clears the mark itself if it runs later.
+func (s *Server) markLateAccessLog(tunnelID string, ring *accessLogRing) {
+	if _, registered := s.registrations.Load(tunnelID); registered {
+		return
+	}
+	at := time.Now().UnixNano()
+	ring.stopped.Store(at)
+	if _, registered := s.registrations.Load(tunnelID); registered {
+		ring.stopped.CompareAndSwap(at, 0)
+	}
+}
+
+// keepAccessLog marks a tunnel's access log as belonging to a stopped tunnel
+// (stopped=true) or to a registered one again.
+func (s *Server) keepAccessLog(tunnelID string, stopped bool) {
+	ringRaw, ok := s.accessLogs.Load(tunnelID)
+	if !ok {
+		return
+	}
+	var at int64
+	if stopped {
+		at = time.Now().UnixNano()
+	}
+	ringRaw.(*accessLogRing).stopped.Store(at)
+}
+
+// accessLogJanitor drops the access logs of tunnels stopped longer than
+// accessLogRetention ago.
+func (s *Server) accessLogJanitor(ctx context.Context) {
+	ticker := time.NewTicker(accessLogRetention / 24)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.expireAccessLogs(now)
+		}
+	}
+}
+
+func (s *Server) expireAccessLogs(now time.Time) {
+	cutoff := now.Add(-accessLogRetention).UnixNano()
+	s.accessLogs.Range(func(k, v any) bool {
+		if stopped := v.(*accessLogRing).stopped.Load(); stopped != 0 && stopped < cutoff {
+			s.accessLogs.CompareAndDelete(k, v)
+		}
+		return true
+	})
+}
+
+// HTTPAccessLogs returns the tunnel's recent HTTP access log records, newest first.
+func (s *Server) HTTPAccessLogs(tunnelID string, f AccessLogFilter) []HTTPAccessLog {
+	ringRaw, ok := s.accessLogs.Load(tunnelID)
+	if !ok {
+		return []HTTPAccessLog{}
+	}
+	return ringRaw.(*accessLogRing).query(f)
+}
@@ -0,0 +1,84 @@
+package tunnel
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAccessLogKeptAfterStop(t *testing.T) {
+	s := NewServer(Config{})
+	s.recordHTTPAccess(HTTPAccessLog{TunnelID: "t1", Path: "/", Status: 200})
+	s.keepAccessLog("t1", true)
+
+	if got := s.HTTPAccessLogs("t1", AccessLogFilter{}); len(got) != 1 {
+		t.Fatalf("stopped tunnel has %d records, want 1", len(got))
+	}
+
+	s.expireAccessLogs(time.Now().Add(accessLogRetention - time.Minute))
+	if got := s.HTTPAccessLogs("t1", AccessLogFilter{}); len(got) != 1 {
+		t.Fatal("access log dropped before the retention passed")
+	}
+
+	// Started again: kept however long it runs
+	s.keepAccessLog("t1", false)
+	s.expireAccessLogs(time.Now().Add(2 * accessLogRetention))
+	if got := s.HTTPAccessLogs("t1", AccessLogFilter{}); len(got) != 1 {
+		t.Fatal("access log of a registered tunnel dropped")
+	}
+
+	s.keepAccessLog("t1", true)
+	s.expireAccessLogs(time.Now().Add(accessLogRetention + time.Minute))
+	if got := s.HTTPAccessLogs("t1", AccessLogFilter{}); len(got) != 0 {
+		t.Fatalf("expired access log still has %d records", len(got))
+	}
+}
+
+// A request finishing after its tunnel was unregistered creates a ring that
+// must still expire.
+func TestAccessLogCreatedAfterStopExpires(t *testing.T) {
+	s := NewServer(Config{})
+	s.registrations.Store("live", TunnelRegistration{TunnelID: "live"})
+	s.recordHTTPAccess(HTTPAccessLog{TunnelID: "live", Path: "/", Status: 200})
+	s.recordHTTPAccess(HTTPAccessLog{TunnelID: "gone", Path: "/", Status: 200})
+
+	s.expireAccessLogs(time.Now().Add(accessLogRetention + time.Minute))
+	if got := s.HTTPAccessLogs("gone", AccessLogFilter{}); len(got) != 0 {
+		t.Fatalf("late access log still has %d records", len(got))
+	}
+	if got := s.HTTPAccessLogs("live", AccessLogFilter{}); len(got) != 1 {
+		t.Fatal("access log of a registered tunnel dropped")
+	}
+}
+
+// Bytes the relay of an upgraded connection sends to the browser count
+// towards the request's access log entry.
+func TestUpgradeRelayCountsBytesSent(t *testing.T) {
+	browser, browserPeer := net.Pipe()
+	origin, originPeer := net.Pipe()
+	const header = "HTTP/1.1 101 Switching Protocols\r\n\r\n"
+	const payload = 5000
+
+	received := make(chan int64, 1)
+	go func() {
+		n, _ := io.CopyN(io.Discard, browserPeer, int64(len(header)+payload))
+		browserPeer.Close() // the browser hangs up once it has everything
+		received <- n
+	}()
+	out := &countingWriter{w: browser}
+	out.Write([]byte(header))
+	go func() {
+		originPeer.Write(make([]byte, payload))
+		originPeer.Close()
+	}()
+
+	relay(&bufferedConn{Conn: &countingWriteConn{Conn: browser, out: out}, r: bufio.NewReader(browser)},
+		&bufferedConn{Conn: origin, r: bufio.NewReader(origin)})
+	<-received
+
+	if want := int64(len(header) + payload); out.n != want {
+		t.Fatalf("bytes sent = %d, want %d", out.n, want)
+	}
+}
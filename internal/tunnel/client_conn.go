@@ -0,0 +1,234 @@
+package tunnel
+
+// Outbound side of a client's control connection. Messages are queued by
+// priority and written by a single writer goroutine, so a slow home uplink
+// never blocks the proxies that produce them:
+//
+//	control — OPEN, PING; never dropped, a full queue means the client is stuck
+//	udp     — UDP_PKT batches; dropped (and counted) when the queue is full
+//	bulk    — informational notices such as UDP_CLOSE; dropped when full
+//
+// Every write has a deadline. A client that cannot take a write within
+// clientWriteTimeout, or whose control queue overflows, is disconnected.
+
+import (
+	"bufio"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	clientWriteTimeout = 10 * time.Second
+
+	controlQueueSize = 64
+	udpSendQueueSize = 256
+	bulkQueueSize    = 256
+)
+
+var (
+	errClientClosed = errors.New("client connection closed")
+	errClientSlow   = errors.New("client is not reading its control channel")
+	errQueueFull    = errors.New("client send queue full")
+)
+
+type ClientConn struct {
+	tunnelID    string
+	conn        net.Conn
+	reader      *bufio.Reader
+	writer      *bufio.Writer
+	pendingTCP  sync.Map // connID → chan net.Conn
+	hopCompress bool     // client accepts deflate-compressed data channels
+	version     string   // announced with the AUTH option version=
+	since       time.Time
+
+	rtt      rttWindow
+	lastPing atomic.Int64 // unix nanoseconds of the last PING, for bare PONGs
+
+	controlQ chan []byte
+	udpQ     chan []byte
+	bulkQ    chan []byte
+	done     chan struct{}
+	once     sync.Once
+
+	closing     chan struct{} // closed by sendClose: close once controlQ is written
+	closingOnce sync.Once
+
+	st  *tunnelStats
+	log *slog.Logger
+}
+
+func newClientConn(tunnelID string, conn net.Conn, reader *bufio.Reader, st *tunnelStats, logger *slog.Logger) *ClientConn {
+	return &ClientConn{
+		tunnelID: tunnelID,
+		conn:     conn,
+		since:    time.Now().UTC(),
+		reader:   reader,
+		writer:   bufio.NewWriter(conn),
+		controlQ: make(chan []byte, controlQueueSize),
+		udpQ:     make(chan []byte, udpSendQueueSize),
+		bulkQ:    make(chan []byte, bulkQueueSize),
+		done:     make(chan struct{}),
+		closing:  make(chan struct{}),
+		st:       st,
+		log:      logger.With("tunnel_id", tunnelID),
+	}
+}
+
+// send queues a control message. Control messages are never dropped: if the
+// queue is full the client is considered stuck and is disconnected.
+func (c *ClientConn) send(msg string) error {
+	select {
+	case <-c.done:
+		return errClientClosed
+	case c.controlQ <- []byte(msg + "\n"):
+		return nil
+	default:
+		c.disconnectSlow("control queue full")
+		return errClientSlow
+	}
+}
+
+// sendClose queues a final control message and closes the connection once it
+// is written, or after clientWriteTimeout.
+func (c *ClientConn) sendClose(msg string) {
+	if c.send(msg) != nil {
+		return
+	}
+	c.closingOnce.Do(func() { close(c.closing) })
+	time.AfterFunc(clientWriteTimeout, c.close)
+}
+
+// sendUDP queues already newline-terminated UDP_PKT lines. b is copied.
+func (c *ClientConn) sendUDP(b []byte) error {
+	return c.enqueue(c.udpQ, append([]byte(nil), b...), &c.st.clientDroppedUDP)
+}
+
+// sendBulk queues a low-priority message.
+func (c *ClientConn) sendBulk(msg string) error {
+	return c.enqueue(c.bulkQ, []byte(msg+"\n"), &c.st.clientDroppedBulk)
+}
+
+func (c *ClientConn) enqueue(q chan []byte, b []byte, dropped *atomic.Int64) error {
+	select {
+	case <-c.done:
+		return errClientClosed
+	case q <- b:
+		return nil
+	default:
+		dropped.Add(1)
+		return errQueueFull
+	}
+}
+
+// next returns the highest-priority queued message, blocking until one is
+// available. ok is false once the connection is closed, or once the control
+// queue is drained after sendClose.
+func (c *ClientConn) next() (b []byte, ok bool) {
+	select {
+	case b := <-c.controlQ:
+		return b, true
+	default:
+	}
+	select {
+	case <-c.closing:
+		return c.lastControl()
+	default:
+	}
+	select {
+	case b := <-c.controlQ:
+		return b, true
+	case b := <-c.udpQ:
+		return b, true
+	default:
+	}
+	select {
+	case b := <-c.controlQ:
+		return b, true
+	case b := <-c.udpQ:
+		return b, true
+	case b := <-c.bulkQ:
+		return b, true
+	case <-c.done:
+		return nil, false
+	case <-c.closing:
+		return c.lastControl()
+	}
+}
+
+// lastControl returns what is left in the control queue after sendClose: the
+// final message may have been queued after next last looked.
+func (c *ClientConn) lastControl() ([]byte, bool) {
+	select {
+	case b := <-c.controlQ:
+		return b, true
+	default:
+		return nil, false
+	}
+}
+
+func (c *ClientConn) queued() int {
+	return len(c.controlQ) + len(c.udpQ) + len(c.bulkQ)
+}
+
+// writeLoop is the only writer of the control connection after the handshake.
+// It flushes once the queues are drained, so bursts share a single syscall.
+func (c *ClientConn) writeLoop() {
+	for {
+		b, ok := c.next()
+		if !ok {
+			select {
+			case <-c.closing:
+				c.writer.Flush()
+				c.close()
+			default:
+			}
+			return
+		}
+		c.conn.SetWriteDeadline(time.Now().Add(clientWriteTimeout))
+		_, err := c.writer.Write(b)
+		if err == nil && c.queued() == 0 {
+			err = c.writer.Flush()
+		}
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				c.disconnectSlow("write timed out")
+			} else {
+				c.close()
+			}
+			return
+		}
+	}
+}
+
+func (c *ClientConn) disconnectSlow(reason string) {
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	c.st.clientSlowDisconnects.Add(1)
+	c.log.Warn("Disconnecting slow client", "reason", reason)
+	c.close()
+}
+
+func (c *ClientConn) close() {
+	c.once.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// ClientQueueStats reports the client's outbound queues.
+type ClientQueueStats struct {
+	ControlDepth    int   `json:"control_depth"`
+	UDPDepth        int   `json:"udp_depth"`
+	BulkDepth       int   `json:"bulk_depth"`
+	DroppedUDP      int64 `json:"dropped_udp"`
+	DroppedBulk     int64 `json:"dropped_bulk"`
+	SlowDisconnects int64 `json:"slow_disconnects"`
+}
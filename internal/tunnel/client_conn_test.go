@@ -0,0 +1,60 @@
+package tunnel
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestClientConn(conn net.Conn) *ClientConn {
+	return newClientConn("t1", conn, nil, &tunnelStats{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+// An empty datagram is an ordinary message, not a signal to stop writing.
+func TestClientConnEmptyUDPKeepsWriter(t *testing.T) {
+	conn, peer := net.Pipe()
+	c := newTestClientConn(conn)
+	defer c.close()
+	go c.writeLoop()
+
+	if err := c.sendUDP(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.send("PING"); err != nil {
+		t.Fatal(err)
+	}
+
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 16)
+	n, err := peer.Read(buf)
+	if err != nil || string(buf[:n]) != "PING\n" {
+		t.Fatalf("read %q, %v; want PING", buf[:n], err)
+	}
+	select {
+	case <-c.done:
+		t.Fatal("writer closed the connection")
+	default:
+	}
+}
+
+func TestClientConnSendCloseWritesFinalMessage(t *testing.T) {
+	conn, peer := net.Pipe()
+	c := newTestClientConn(conn)
+	go c.writeLoop()
+
+	c.sendClose("ERROR shutting down")
+	got, err := io.ReadAll(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "ERROR shutting down\n" {
+		t.Fatalf("read %q", got)
+	}
+	select {
+	case <-c.done:
+	case <-time.After(time.Second):
+		t.Fatal("connection not closed after the final message")
+	}
+}
@@ -0,0 +1,183 @@
+package tunnel
+
+// Details of the desktop client attached to a tunnel, and its control
+// channel round-trip time measured from PING/PONG.
+//
+// Clients that announce a version (AUTH option version=...) receive
+// "PING <unix_micros>" and echo the timestamp in "PONG <unix_micros>", so
+// the RTT does not depend on which PING a PONG answers. For older clients a
+// bare PONG is matched with the most recent PING.
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// rttWindowSize is the number of RTT samples kept per client: one hour at pingInterval.
+	rttWindowSize = 120
+
+	maxClientVersionLen = 32
+)
+
+// RTTSample is one round-trip measurement of a client's control channel.
+type RTTSample struct {
+	Time  time.Time `json:"time"`
+	RTTMs float64   `json:"rtt_ms"`
+}
+
+// rttWindow is a ring of the latest RTT samples.
+type rttWindow struct {
+	mu      sync.Mutex
+	samples [rttWindowSize]RTTSample
+	n, next int
+}
+
+func (w *rttWindow) add(s RTTSample) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.samples[w.next] = s
+	w.next = (w.next + 1) % rttWindowSize
+	if w.n < rttWindowSize {
+		w.n++
+	}
+}
+
+// list returns the samples, oldest first.
+func (w *rttWindow) list() []RTTSample {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	out := make([]RTTSample, 0, w.n)
+	for i := w.n; i > 0; i-- {
+		out = append(out, w.samples[(w.next-i+rttWindowSize)%rttWindowSize])
+	}
+	return out
+}
+
+func (w *rttWindow) last() (RTTSample, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.n == 0 {
+		return RTTSample{}, false
+	}
+	return w.samples[(w.next-1+rttWindowSize)%rttWindowSize], true
+}
+
+// sanitizeVersion keeps a client-supplied version string short and printable.
+func sanitizeVersion(v string) string {
+	if len(v) > maxClientVersionLen {
+		v = v[:maxClientVersionLen]
+	}
+	for i := 0; i < len(v); i++ {
+		if v[i] < 0x21 || v[i] > 0x7e {
+			return ""
+		}
+	}
+	return v
+}
+
+// ping sends a keepalive and remembers when it was sent.
+func (c *ClientConn) ping() error {
+	now := time.Now()
+	msg := "PING"
+	if c.version != "" {
+		msg += " " + strconv.FormatInt(now.UnixMicro(), 10)
+	}
+	c.lastPing.Store(now.UnixNano())
+	return c.send(msg)
+}
+
+// pong records the RTT of a PONG. args is the echoed timestamp, if any.
+func (c *ClientConn) pong(args []string) {
+	now := time.Now()
+	var sent time.Time
+	if len(args) > 0 {
+		us, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return
+		}
+		sent = time.UnixMicro(us)
+	} else {
+		ns := c.lastPing.Swap(0)
+		if ns == 0 {
+			return
+		}
+		sent = time.Unix(0, ns)
+	}
+	rtt := now.Sub(sent)
+	if rtt < 0 || rtt > 2*pingInterval {
+		return // not a timestamp we sent
+	}
+	c.rtt.add(RTTSample{Time: now.UTC(), RTTMs: float64(rtt.Microseconds()) / 1000})
+}
+
+// ClientInfo describes the desktop client attached to a tunnel.
+type ClientInfo struct {
+	ConnectedSince time.Time `json:"connected_since"`
+	RemoteAddr     string    `json:"remote_addr"`
+	Version        string    `json:"version"` // empty if the client did not announce one
+	RTTMs          *float64  `json:"rtt_ms"`  // latest measurement, nil until the first PONG
+}
+
+// ClientInfo returns the attached client of a tunnel; ok is false if none is connected.
+// A client attached to another node of the region is reported as claimed there.
+func (s *Server) ClientInfo(tunnelID string) (info ClientInfo, ok bool) {
+	clientRaw, ok := s.clients.Load(tunnelID)
+	if !ok {
+		if s.routes != nil {
+			_, info, ok = s.routes.Owner(tunnelID)
+		}
+		return info, ok
+	}
+	return clientRaw.(*ClientConn).info(), true
+}
+
+// Clients returns the attached clients of all tunnels, by tunnel ID.
+func (s *Server) Clients() map[string]ClientInfo {
+	clients := make(map[string]ClientInfo)
+	s.clients.Range(func(k, v any) bool {
+		clients[k.(string)] = v.(*ClientConn).info()
+		return true
+	})
+	return clients
+}
+
+func (c *ClientConn) info() ClientInfo {
+	info := ClientInfo{
+		ConnectedSince: c.since,
+		RemoteAddr:     c.conn.RemoteAddr().String(),
+		Version:        c.version,
+	}
+	if last, ok := c.rtt.last(); ok {
+		info.RTTMs = &last.RTTMs
+	}
+	return info
+}
+
+// ClientLatency is the recent RTT history of a tunnel's client.
+type ClientLatency struct {
+	Samples []RTTSample `json:"samples"` // oldest first
+	MinMs   *float64    `json:"min_ms"`
+	AvgMs   *float64    `json:"avg_ms"`
+	MaxMs   *float64    `json:"max_ms"`
+}
+
+// ClientLatency returns the RTT window of a tunnel's client; ok is false if none is connected.
+func (s *Server) ClientLatency(tunnelID string) (l ClientLatency, ok bool) {
+	clientRaw, ok := s.clients.Load(tunnelID)
+	if !ok {
+		return ClientLatency{Samples: []RTTSample{}}, false
+	}
+	l.Samples = clientRaw.(*ClientConn).rtt.list()
+	if len(l.Samples) == 0 {
+		return l, true
+	}
+	lo, hi, sum := l.Samples[0].RTTMs, l.Samples[0].RTTMs, 0.0
+	for _, s := range l.Samples {
+		lo, hi, sum = min(lo, s.RTTMs), max(hi, s.RTTMs), sum+s.RTTMs
+	}
+	avg := sum / float64(len(l.Samples))
+	l.MinMs, l.AvgMs, l.MaxMs = &lo, &avg, &hi
+	return l, true
+}
@@ -0,0 +1,281 @@
+package tunnel
+
+// Bandwidth savings for web map traffic.
+//
+// Edge compression: map JSON and JS are often served uncompressed by plugins.
+// When the browser accepts brotli or gzip, the HTTP proxy compresses eligible responses
+// before sending them to the browser. Compressed bodies are what gets cached,
+// so cache hits don't pay the compression cost again.
+//
+// Hop compression: when the desktop client advertises "compress=deflate" in
+// AUTH, HTTP data channels are opened with "OPEN <conn_id> <port> deflate" and
+// both directions of that data channel carry a flushed deflate stream. This
+// shrinks what crosses the owner's home upload regardless of what the origin
+// does.
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/andybalholm/brotli"
+)
+
+const (
+	// Responses smaller than this are not worth compressing.
+	minCompressBytes = 1024
+	// Responses larger than this are streamed through uncompressed.
+	maxCompressBytes = 8 << 20
+
+	hopCompression = "deflate"
+)
+
+// compressibleTypes lists the media types (or prefixes) compressed at the edge.
+var compressibleTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/x-javascript",
+	"application/xml",
+	"application/wasm",
+	"image/svg+xml",
+}
+
+// acceptsGzip reports whether the browser accepts a gzip response.
+func acceptsGzip(req *http.Request) bool {
+	return acceptsEncoding(req, "gzip")
+}
+
+// acceptsEncoding reports whether the browser accepts coding, listed by name
+// or through "*", with a non-zero q-value.
+func acceptsEncoding(req *http.Request, coding string) bool {
+	return encodingQuality(req, coding) > 0
+}
+
+// encodingQuality returns the q-value of coding in Accept-Encoding (0 if it is
+// not accepted). A coding listed by name takes precedence over "*".
+func encodingQuality(req *http.Request, coding string) float64 {
+	wildcard := 0.0
+	for _, part := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.TrimSpace(name)
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.ReplaceAll(strings.TrimSpace(params), " ", ""), "q="); ok {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = f
+		}
+		switch {
+		case strings.EqualFold(name, coding):
+			return q
+		case name == "*":
+			wildcard = q
+		}
+	}
+	return wildcard
+}
+
+// edgeEncoding is a content coding the proxy can produce.
+type edgeEncoding struct {
+	name      string
+	newWriter func(w io.Writer) io.WriteCloser
+}
+
+// edgeEncodings lists the codings used for edge compression, preferred first.
+var edgeEncodings = []edgeEncoding{
+	{"br", func(w io.Writer) io.WriteCloser {
+		return brotli.NewWriterLevel(w, brotli.DefaultCompression)
+	}},
+	{"gzip", func(w io.Writer) io.WriteCloser {
+		zw, _ := gzip.NewWriterLevel(w, gzip.DefaultCompression)
+		return zw
+	}},
+}
+
+// negotiateEncoding picks the coding of edgeEncodings the browser gives the
+// highest q-value, the earlier one on a tie. It returns nil if none is accepted.
+func negotiateEncoding(req *http.Request) *edgeEncoding {
+	var best *edgeEncoding
+	bestQ := 0.0
+	for i := range edgeEncodings {
+		if q := encodingQuality(req, edgeEncodings[i].name); q > bestQ {
+			best, bestQ = &edgeEncodings[i], q
+		}
+	}
+	return best
+}
+
+func compressibleResponse(req *http.Request, resp *http.Response) bool {
+	if req.Method == http.MethodHead || resp.StatusCode != http.StatusOK {
+		return false
+	}
+	if resp.Header.Get("Content-Encoding") != "" || resp.Header.Get("Content-Range") != "" {
+		return false
+	}
+	if strings.Contains(strings.ToLower(resp.Header.Get("Cache-Control")), "no-transform") {
+		return false
+	}
+	if resp.ContentLength >= 0 && (resp.ContentLength < minCompressBytes || resp.ContentLength > maxCompressBytes) {
+		return false
+	}
+	ct := strings.ToLower(resp.Header.Get("Content-Type"))
+	for _, t := range compressibleTypes {
+		if strings.HasPrefix(ct, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressResponse compresses the response body in place with the coding
+// negotiated with the browser when the content type is eligible. The body is
+// buffered, so the resulting response has an exact Content-Length. The bytes
+// saved are added to u for the usage statistics.
+func compressResponse(req *http.Request, resp *http.Response, st *tunnelStats, u *channelUsage) error {
+	enc := negotiateEncoding(req)
+	if enc == nil || !compressibleResponse(req, resp) {
+		return nil
+	}
+
+	orig, err := io.ReadAll(io.LimitReader(resp.Body, maxCompressBytes+1))
+	if err != nil {
+		return err
+	}
+	if len(orig) > maxCompressBytes || len(orig) < minCompressBytes {
+		// Replay what was read and keep the rest streaming.
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(orig), resp.Body), resp.Body}
+		return nil
+	}
+	resp.Body.Close()
+
+	var buf bytes.Buffer
+	zw := enc.newWriter(&buf)
+	zw.Write(orig)
+	zw.Close()
+
+	if buf.Len() >= len(orig) {
+		resp.Body = io.NopCloser(bytes.NewReader(orig))
+		resp.ContentLength = int64(len(orig))
+		resp.TransferEncoding = nil
+		return nil
+	}
+
+	resp.Body = io.NopCloser(&buf)
+	resp.ContentLength = int64(buf.Len())
+	resp.TransferEncoding = nil
+	resp.Header.Set("Content-Encoding", enc.name)
+	resp.Header.Set("Content-Length", strconv.Itoa(buf.Len()))
+	resp.Header.Add("Vary", "Accept-Encoding")
+	// The representation changed, so a strong validator becomes weak.
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+
+	st.edgeCompressed.Add(1)
+	st.edgeBytesOrig.Add(int64(len(orig)))
+	st.edgeBytesSent.Add(int64(buf.Len()))
+	u.addSaved(int64(len(orig) - buf.Len()))
+	return nil
+}
+
+// ---- Hop compression ----
+
+// countingConn counts the bytes that actually cross the tunnel, for the
+// tunnel and for this connection.
+type countingConn struct {
+	net.Conn
+	n, own *atomic.Int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.n.Add(int64(n))
+	c.own.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.n.Add(int64(n))
+	c.own.Add(int64(n))
+	return n, err
+}
+
+// deflateConn wraps a data channel carrying a deflate stream in each direction.
+// Every Write is flushed so request/response exchanges are not delayed. The
+// bytes saved on the channel are added to the usage statistics when it closes.
+type deflateConn struct {
+	net.Conn
+	r       io.ReadCloser
+	wmu     sync.Mutex
+	w       *flate.Writer
+	payload *atomic.Int64
+
+	u                   *channelUsage
+	ownPayload, ownWire atomic.Int64
+	closeOnce           sync.Once
+}
+
+func newDeflateConn(conn net.Conn, st *tunnelStats, u *channelUsage) *deflateConn {
+	d := &deflateConn{
+		Conn:    conn,
+		payload: &st.hopBytesPayload,
+		u:       u,
+	}
+	counted := &countingConn{Conn: conn, n: &st.hopBytesWire, own: &d.ownWire}
+	d.w, _ = flate.NewWriter(counted, flate.BestSpeed)
+	d.r = flate.NewReader(counted)
+	return d
+}
+
+func (d *deflateConn) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.payload.Add(int64(n))
+	d.ownPayload.Add(int64(n))
+	return n, err
+}
+
+func (d *deflateConn) Write(p []byte) (int, error) {
+	d.wmu.Lock()
+	defer d.wmu.Unlock()
+	n, err := d.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	d.payload.Add(int64(n))
+	d.ownPayload.Add(int64(n))
+	return n, d.w.Flush()
+}
+
+// CloseWrite terminates the outgoing deflate stream and half-closes the socket.
+func (d *deflateConn) CloseWrite() error {
+	d.wmu.Lock()
+	d.w.Close()
+	d.wmu.Unlock()
+	if hc, ok := d.Conn.(interface{ CloseWrite() error }); ok {
+		return hc.CloseWrite()
+	}
+	return nil
+}
+
+func (d *deflateConn) Close() error {
+	d.closeOnce.Do(func() {
+		d.r.Close()
+		if saved := d.ownPayload.Load() - d.ownWire.Load(); saved > 0 {
+			d.u.addSaved(saved)
+		}
+	})
+	return d.Conn.Close()
+}
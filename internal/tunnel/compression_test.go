@@ -0,0 +1,100 @@
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"gzip;q=0", ""},
+		{"br", "br"},
+		{"gzip, deflate, br", "br"},
+		{"br;q=1, gzip;q=0.5", "br"},
+		{"br;q=0.5, gzip", "gzip"},
+		{"br;q=0, gzip", "gzip"},
+		{"*", "br"},
+		{"*;q=0.5, gzip", "gzip"},
+		{"*;q=0.5, gzip;q=0", "br"},
+		{"identity, *;q=0", ""},
+		{"GZIP; q=0.8", "gzip"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Encoding", tt.accept)
+		got := ""
+		if enc := negotiateEncoding(req); enc != nil {
+			got = enc.name
+		}
+		if got != tt.want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestCompressResponseCountsSavedBytes(t *testing.T) {
+	body := strings.Repeat(`{"type":"marker","x":1,"z":2}`, 200)
+	req := httptest.NewRequest(http.MethodGet, "/up/world/markers.json", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		ContentLength: int64(len(body)),
+		Body:          io.NopCloser(strings.NewReader(body)),
+	}
+
+	var st tunnelStats
+	u := &channelUsage{}
+	if err := compressResponse(req, resp, &st, u); err != nil {
+		t.Fatal(err)
+	}
+	if ce := resp.Header.Get("Content-Encoding"); ce != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", ce)
+	}
+	sent, _ := io.ReadAll(resp.Body)
+	if want := int64(len(body) - len(sent)); u.bytesSaved.Load() != want || want <= 0 {
+		t.Fatalf("bytes saved = %d, want %d", u.bytesSaved.Load(), want)
+	}
+	if cl := resp.Header.Get("Content-Length"); cl != strconv.Itoa(len(sent)) {
+		t.Fatalf("Content-Length = %s, body is %d bytes", cl, len(sent))
+	}
+}
+
+func TestCompressResponseBrotli(t *testing.T) {
+	body := strings.Repeat("var tile = {x: 1, z: 2};\n", 200)
+	req := httptest.NewRequest(http.MethodGet, "/js/dynmap.js", nil)
+	req.Header.Set("Accept-Encoding", "gzip, deflate, br")
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Type": {"application/javascript"}},
+		ContentLength: int64(len(body)),
+		Body:          io.NopCloser(strings.NewReader(body)),
+	}
+
+	if err := compressResponse(req, resp, &tunnelStats{}, &channelUsage{}); err != nil {
+		t.Fatal(err)
+	}
+	if ce := resp.Header.Get("Content-Encoding"); ce != "br" {
+		t.Fatalf("Content-Encoding = %q, want br", ce)
+	}
+	sent, _ := io.ReadAll(resp.Body)
+	got, err := io.ReadAll(brotli.NewReader(bytes.NewReader(sent)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != body {
+		t.Fatal("brotli body does not decode to the original")
+	}
+}
@@ -0,0 +1,161 @@
+package tunnel
+
+// Live connection inspector: every relayed player connection (Minecraft, web
+// map, raw TCP) is tracked while it is open, so owners can list and kill them.
+// UDP sessions come from the session table.
+
+import (
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// udpConnPrefix marks UDP session IDs in the inspector, keeping them apart
+// from relay IDs.
+const udpConnPrefix = "udp-"
+
+// Connection is a live player connection of a tunnel.
+type Connection struct {
+	ID         string    `json:"id"`
+	Channel    string    `json:"channel"`
+	SourceIP   string    `json:"source_ip"`
+	SourcePort int       `json:"source_port"`
+	Since      time.Time `json:"since"`
+	BytesIn    int64     `json:"bytes_in"`  // player → owner's server
+	BytesOut   int64     `json:"bytes_out"` // owner's server → player
+	Username   string    `json:"username,omitempty"`
+
+	// UDP sessions only
+	PublicPort int        `json:"public_port,omitempty"`
+	LastSeen   *time.Time `json:"last_seen,omitempty"`
+}
+
+// liveConn is a tracked relay.
+type liveConn struct {
+	id       string
+	tunnelID string
+	channel  string
+	username string
+	player   *usageConn
+	idle     atomic.Bool // web map connection waiting for its next request
+
+	mu       sync.Mutex
+	upstream net.Conn // data channel; HTTP opens it lazily and may replace it
+}
+
+// setUpstream records the data channel currently serving the connection.
+func (lc *liveConn) setUpstream(c net.Conn) {
+	lc.mu.Lock()
+	lc.upstream = c
+	lc.mu.Unlock()
+}
+
+func (lc *liveConn) kill() {
+	lc.player.Close()
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if lc.upstream != nil {
+		lc.upstream.Close()
+	}
+}
+
+// trackConn registers an open relay with the inspector until untrackConn.
+func (s *Server) trackConn(tunnelID, channel string, player *usageConn, upstream net.Conn, username string) *liveConn {
+	lc := &liveConn{
+		id:       generateID(),
+		tunnelID: tunnelID,
+		channel:  channel,
+		username: username,
+		player:   player,
+		upstream: upstream,
+	}
+	s.liveConns.Store(lc.id, lc)
+	return lc
+}
+
+func (s *Server) untrackConn(lc *liveConn) {
+	s.liveConns.Delete(lc.id)
+}
+
+// Connections lists the open connections of a tunnel, oldest first.
+func (s *Server) Connections(tunnelID string) []Connection {
+	conns := []Connection{}
+	s.liveConns.Range(func(_, v any) bool {
+		lc := v.(*liveConn)
+		if lc.tunnelID != tunnelID {
+			return true
+		}
+		ip, port := splitAddr(lc.player.RemoteAddr())
+		conns = append(conns, Connection{
+			ID:         lc.id,
+			Channel:    lc.channel,
+			SourceIP:   ip,
+			SourcePort: port,
+			Since:      lc.player.since,
+			BytesIn:    lc.player.in.Load(),
+			BytesOut:   lc.player.out.Load(),
+			Username:   lc.username,
+		})
+		return true
+	})
+	for _, u := range s.udpSessions.list(tunnelID) {
+		lastSeen := time.Unix(0, u.lastSeen.Load())
+		conns = append(conns, Connection{
+			ID:         udpConnPrefix + u.connID(),
+			Channel:    ChannelUDP,
+			SourceIP:   u.addr.Addr().Unmap().String(),
+			SourcePort: int(u.addr.Port()),
+			Since:      u.created,
+			BytesIn:    u.bytesIn.Load(),
+			BytesOut:   u.bytesOut.Load(),
+			PublicPort: u.publicPort,
+			LastSeen:   &lastSeen,
+		})
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].Since.Before(conns[j].Since) })
+	return conns
+}
+
+// CloseConnection kills a connection of a tunnel at the edge. A relay is
+// closed on both sides; a UDP session is dropped and the client told to
+// release it (a player who keeps sending gets a new session).
+// Returns false if the tunnel has no such connection.
+func (s *Server) CloseConnection(tunnelID, connID string) bool {
+	if rest, ok := strings.CutPrefix(connID, udpConnPrefix); ok {
+		id, err := strconv.ParseUint(rest, 10, 64)
+		if err != nil {
+			return false
+		}
+		u := s.udpSessions.remove(tunnelID, id)
+		if u == nil {
+			return false
+		}
+		if clientRaw, ok := s.clients.Load(tunnelID); ok {
+			clientRaw.(*ClientConn).sendBulk("UDP_CLOSE " + u.connID())
+		}
+		s.udpLog.Info("Session closed by owner", "tunnel_id", tunnelID, "conn_id", u.connID())
+		return true
+	}
+
+	v, ok := s.liveConns.Load(connID)
+	if !ok || v.(*liveConn).tunnelID != tunnelID {
+		return false
+	}
+	lc := v.(*liveConn)
+	lc.kill()
+	s.log.Info("Connection closed by owner", "tunnel_id", tunnelID, "conn_id", connID, "channel", lc.channel)
+	return true
+}
+
+func splitAddr(addr net.Addr) (ip string, port int) {
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return addr.String(), 0
+	}
+	return ap.Addr().Unmap().String(), int(ap.Port())
+}
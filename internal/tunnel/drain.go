@@ -0,0 +1,142 @@
+package tunnel
+
+// Draining before a shutdown or deploy: the public listeners (Minecraft, web
+// map, raw TCP ports) and the control listener close, and every attached
+// client is told when the server goes away with
+//
+//	DRAIN <unix_deadline>
+//
+// so it can connect again elsewhere (another node of the region, this server
+// once it is back, or the process that took over its listeners after a
+// binary upgrade). Relays already open keep running until they end or Close
+// is called. UDP sessions keep working until Close.
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+)
+
+// drainPollInterval is how often Drain checks for open relays.
+const drainPollInterval = 250 * time.Millisecond
+
+// Drain stops accepting public connections, announces ctx's deadline (now,
+// if it has none) to the clients and waits until the open relays have
+// finished or ctx is done. It returns the number of relays still open.
+// Calling it again only waits.
+func (s *Server) Drain(ctx context.Context) int {
+	s.drainOnce.Do(func() {
+		close(s.draining)
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			deadline = time.Now()
+		}
+		s.log.Info("Draining", "deadline", deadline, "open_connections", s.OpenConnections())
+
+		s.tcpListeners.Range(func(port, l any) bool {
+			if s.tcpListeners.CompareAndDelete(port, l) {
+				l.(net.Listener).Close()
+			}
+			return true
+		})
+		if s.handedOff.Load() {
+			// The new process reads the UDP ports now; sharing them would
+			// split each player's packets between the two
+			s.closeUDPListeners()
+		}
+		// Wake web map connections waiting for their next request
+		s.liveConns.Range(func(_, v any) bool {
+			if lc := v.(*liveConn); lc.idle.Load() {
+				lc.player.SetReadDeadline(time.Now())
+			}
+			return true
+		})
+		msg := "DRAIN " + strconv.FormatInt(deadline.Unix(), 10)
+		s.clients.Range(func(_, c any) bool {
+			c.(*ClientConn).send(msg)
+			return true
+		})
+	})
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		open := s.OpenConnections()
+		if open == 0 {
+			return 0
+		}
+		select {
+		case <-ctx.Done():
+			return open
+		case <-ticker.C:
+		}
+	}
+}
+
+// Handoff marks the server as replaced by a new process that inherited its
+// listeners. Call it before Drain: clients leaving this process keep their
+// routes, which the new process claims under the same node address.
+func (s *Server) Handoff() {
+	s.handedOff.Store(true)
+}
+
+// Draining reports whether Drain was called.
+func (s *Server) Draining() bool {
+	select {
+	case <-s.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// OpenConnections returns the number of open relays (Minecraft, web map, raw TCP).
+func (s *Server) OpenConnections() int {
+	n := 0
+	s.liveConns.Range(func(_, _ any) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// Close ends the relays still open and disconnects all clients. The
+// listeners close with the context passed to Run.
+func (s *Server) Close() {
+	s.liveConns.Range(func(_, lc any) bool {
+		lc.(*liveConn).kill()
+		return true
+	})
+	s.clients.Range(func(_, c any) bool {
+		c.(*ClientConn).close()
+		return true
+	})
+	s.closeUDPListeners()
+	s.tcpListeners.Range(func(port, l any) bool {
+		if s.tcpListeners.CompareAndDelete(port, l) {
+			l.(net.Listener).Close()
+		}
+		return true
+	})
+}
+
+func (s *Server) closeUDPListeners() {
+	s.udpListeners.Range(func(port, pc any) bool {
+		if s.udpListeners.CompareAndDelete(port, pc) {
+			pc.(net.PacketConn).Close()
+		}
+		return true
+	})
+}
+
+// closeOnDrain closes a public listener when the server drains or ctx is done.
+func (s *Server) closeOnDrain(ctx context.Context, l net.Listener) {
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-s.draining:
+		}
+		l.Close()
+	}()
+}
@@ -0,0 +1,85 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Drain closes the public listeners, tells attached clients the deadline and
+// waits for the open relays.
+func TestDrain(t *testing.T) {
+	s := NewServer(Config{})
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	s.closeOnDrain(ctx, l)
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			conn.Close()
+		}
+		accepted <- err
+	}()
+
+	conn, peer := net.Pipe()
+	client := newTestClientConn(conn)
+	s.clients.Store("t1", client)
+	go client.writeLoop()
+	t.Cleanup(client.close)
+
+	player, _ := net.Pipe()
+	lc := s.trackConn("t1", ChannelMC, &usageConn{Conn: player}, nil, "")
+
+	drainCtx, drainCancel := context.WithTimeout(ctx, time.Minute)
+	defer drainCancel()
+	deadline, _ := drainCtx.Deadline()
+	drained := make(chan int, 1)
+	go func() { drained <- s.Drain(drainCtx) }()
+
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(peer).ReadString('\n')
+	if want := "DRAIN " + strconv.FormatInt(deadline.Unix(), 10) + "\n"; err != nil || line != want {
+		t.Fatalf("client got %q, %v; want %q", line, err, want)
+	}
+	select {
+	case err := <-accepted:
+		if err == nil {
+			t.Fatal("public listener accepted a connection")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("public listener still open")
+	}
+
+	select {
+	case n := <-drained:
+		t.Fatalf("Drain returned %d with a relay open", n)
+	case <-time.After(2 * drainPollInterval):
+	}
+	s.untrackConn(lc)
+	select {
+	case n := <-drained:
+		if n != 0 {
+			t.Fatalf("Drain = %d after the relay ended, want 0", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Drain did not return after the relay ended")
+	}
+
+	// A relay outliving the deadline is reported
+	s.trackConn("t1", ChannelMC, &usageConn{Conn: player}, nil, "")
+	expired, expiredCancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer expiredCancel()
+	if n := s.Drain(expired); n != 1 {
+		t.Fatalf("Drain = %d at the deadline, want 1", n)
+	}
+}
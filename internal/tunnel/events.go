@@ -0,0 +1,77 @@
+package tunnel
+
+import (
+	"time"
+
+	"tunnel-api/internal/events"
+)
+
+// publish sends a status event of a registered tunnel to the event bus,
+// scoped to the tunnel's owner.
+func (s *Server) publish(typ, tunnelID string, data map[string]any) {
+	if s.events == nil {
+		return
+	}
+	regRaw, ok := s.registrations.Load(tunnelID)
+	if !ok {
+		return
+	}
+	s.publishFor(regRaw.(TunnelRegistration), typ, data)
+}
+
+func (s *Server) publishFor(reg TunnelRegistration, typ string, data map[string]any) {
+	s.events.Publish(events.Event{Type: typ, TunnelID: reg.TunnelID, UserID: reg.UserID, Data: data})
+}
+
+// connectionOpened announces a relayed player connection.
+func (s *Server) connectionOpened(lc *liveConn) {
+	data := map[string]any{
+		"conn_id": lc.id,
+		"channel": lc.channel,
+		"remote":  lc.player.RemoteAddr().String(),
+	}
+	if lc.username != "" {
+		data["username"] = lc.username
+	}
+	s.publish(events.ConnectionOpened, lc.tunnelID, data)
+}
+
+// connectionClosed announces the end of a relayed player connection with its transfer.
+func (s *Server) connectionClosed(lc *liveConn) {
+	data := map[string]any{
+		"conn_id":     lc.id,
+		"channel":     lc.channel,
+		"remote":      lc.player.RemoteAddr().String(),
+		"bytes_in":    lc.player.in.Load(),
+		"bytes_out":   lc.player.out.Load(),
+		"duration_ms": time.Since(lc.player.since).Milliseconds(),
+	}
+	if lc.username != "" {
+		data["username"] = lc.username
+	}
+	s.publish(events.ConnectionClosed, lc.tunnelID, data)
+}
+
+// publishUsage sends one usage tick per tunnel with the traffic just drained.
+func (s *Server) publishUsage(records []UsageRecord) {
+	if s.events == nil {
+		return
+	}
+	byTunnel := make(map[string]map[string]any)
+	for _, r := range records {
+		channels, ok := byTunnel[r.TunnelID]
+		if !ok {
+			channels = make(map[string]any)
+			byTunnel[r.TunnelID] = channels
+		}
+		channels[r.Channel] = map[string]int64{
+			"bytes_in":    r.BytesIn,
+			"bytes_out":   r.BytesOut,
+			"connections": r.Connections,
+			"bytes_saved": r.BytesSaved,
+		}
+	}
+	for tunnelID, channels := range byTunnel {
+		s.publish(events.Usage, tunnelID, map[string]any{"channels": channels})
+	}
+}
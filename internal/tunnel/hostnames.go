@@ -0,0 +1,85 @@
+package tunnel
+
+import (
+	"net"
+	"slices"
+	"strings"
+)
+
+// Custom domains: verified hostnames of active tunnels are routed by exact
+// match before falling back to the subdomain under the service domain.
+
+// normalizeHost lower-cases a Minecraft server address or HTTP Host and strips
+// the port, a trailing dot and the "\x00FML\x00" marker Forge clients append.
+func normalizeHost(addr string) string {
+	addr, _, _ = strings.Cut(addr, "\x00")
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return strings.TrimSuffix(strings.ToLower(addr), ".")
+}
+
+// resolveRoute maps a requested host to its tunnel. The returned route is the
+// custom hostname if addr is one, otherwise the subdomain label ("" if none).
+func (s *Server) resolveRoute(addr string) (route, tunnelID string, ok bool) {
+	host := normalizeHost(addr)
+	if id, found := s.hostMap.Load(host); found {
+		return host, id.(string), true
+	}
+	route = extractSubdomainFromAddr(host, s.domain)
+	if route == "" {
+		return "", "", false
+	}
+	id, found := s.subdomainMap.Load(route)
+	if !found {
+		return route, "", false
+	}
+	return route, id.(string), true
+}
+
+// TunnelIDs returns the IDs of all registered tunnels.
+func (s *Server) TunnelIDs() []string {
+	var ids []string
+	s.registrations.Range(func(k, _ any) bool {
+		ids = append(ids, k.(string))
+		return true
+	})
+	return ids
+}
+
+// LookupSubdomain returns the ID of the active tunnel with the given
+// subdomain, or of a tunnel moved away that is still redirected from here.
+func (s *Server) LookupSubdomain(subdomain string) (string, bool) {
+	subdomain = strings.ToLower(subdomain)
+	if id, ok := s.subdomainMap.Load(subdomain); ok {
+		return id.(string), true
+	}
+	if m, ok := s.lookupMoved(subdomain + "." + s.domain); ok && m.subdomain == subdomain {
+		return m.tunnelID, true
+	}
+	return "", false
+}
+
+// SetTunnelHostnames replaces the custom hostnames routed to an active tunnel.
+// It does nothing if the tunnel is not registered; RegisterTunnel picks the
+// hostnames up from TunnelRegistration instead.
+func (s *Server) SetTunnelHostnames(tunnelID string, hostnames []string) {
+	s.routesMu.Lock()
+	defer s.routesMu.Unlock()
+
+	regRaw, ok := s.registrations.Load(tunnelID)
+	if !ok {
+		return
+	}
+	reg := regRaw.(TunnelRegistration)
+	for _, h := range reg.Hostnames {
+		if !slices.Contains(hostnames, h) {
+			s.hostMap.CompareAndDelete(h, tunnelID)
+		}
+	}
+	reg.Hostnames = slices.Clone(hostnames)
+	for _, h := range reg.Hostnames {
+		s.hostMap.Store(h, tunnelID)
+	}
+	s.registrations.Store(tunnelID, reg)
+}
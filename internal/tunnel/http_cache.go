@@ -0,0 +1,328 @@
+package tunnel
+
+// Edge cache for web map responses (Dynmap / BlueMap tiles).
+// Tiles are large, immutable-ish images that every viewer downloads through
+// the owner's home upload. Cacheable responses are kept in a per-tunnel LRU
+// bounded by HTTPCacheMaxBytes, and fresh hits are answered by the proxy
+// without opening a data channel to the client.
+//
+// Caching follows the shared-cache rules of RFC 9111 in a simplified form:
+//   - only GET responses with status 200 are stored (HEAD is served from them)
+//   - requests with Authorization are never cached
+//   - responses with no-store, private, Set-Cookie or Vary other than
+//     Accept-Encoding are never stored
+//   - freshness comes from s-maxage, max-age or Expires; no-cache entries and
+//     stale entries with an ETag/Last-Modified are revalidated with a
+//     conditional request
+
+import (
+	"container/list"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxCacheEntryDivisor limits a single entry to 1/8 of the tunnel's cache budget.
+const maxCacheEntryDivisor = 8
+
+// HTTPCacheStats is a snapshot of a tunnel's web map cache.
+type HTTPCacheStats struct {
+	Hits        int64 `json:"hits"`
+	Misses      int64 `json:"misses"`
+	Revalidated int64 `json:"revalidated"`
+	Stores      int64 `json:"stores"`
+	Evictions   int64 `json:"evictions"`
+	Entries     int   `json:"entries"`
+	Bytes       int64 `json:"bytes"`
+	MaxBytes    int64 `json:"max_bytes"`
+}
+
+type httpCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	entries  map[string]*list.Element
+	lru      *list.List // front = most recently used
+
+	hits, misses, revalidated, stores, evictions int64
+}
+
+// cacheEntry is immutable once stored; refresh replaces it with a copy, so
+// sessions holding an entry can read it without the lock.
+type cacheEntry struct {
+	key     string
+	path    string
+	status  int
+	header  http.Header
+	body    []byte
+	stored  time.Time
+	expires time.Time
+}
+
+func newHTTPCache(maxBytes int64) *httpCache {
+	return &httpCache{
+		maxBytes: maxBytes,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+func (e *cacheEntry) fresh(now time.Time) bool {
+	return now.Before(e.expires)
+}
+
+func (e *cacheEntry) size() int64 {
+	n := int64(len(e.body) + len(e.key))
+	for k, vs := range e.header {
+		n += int64(len(k))
+		for _, v := range vs {
+			n += int64(len(v))
+		}
+	}
+	return n
+}
+
+// maxEntryBytes is the largest body that will be considered for storing.
+func (c *httpCache) maxEntryBytes() int64 {
+	return c.maxBytes / maxCacheEntryDivisor
+}
+
+func (c *httpCache) get(key string) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*cacheEntry)
+}
+
+func (c *httpCache) put(e *cacheEntry) {
+	sz := e.size()
+	if sz > c.maxEntryBytes() {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[e.key]; ok {
+		c.removeLocked(el)
+	}
+	for c.size+sz > c.maxBytes && c.lru.Len() > 0 {
+		c.removeLocked(c.lru.Back())
+		c.evictions++
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	c.size += sz
+	c.stores++
+}
+
+// revalidationHeaders are taken over from a 304 into the refreshed entry, so
+// later freshness checks and conditional requests use the origin's current
+// validators.
+var revalidationHeaders = []string{"Cache-Control", "Date", "ETag", "Expires", "Last-Modified"}
+
+// refresh extends the lifetime of an entry after a 304 from the origin and
+// returns the refreshed copy, with the 304's validator and freshness headers
+// merged in. The copy replaces e in the cache unless e was evicted or replaced
+// meanwhile; if the merged headers no longer allow storing, e is dropped.
+func (c *httpCache) refresh(e *cacheEntry, notModified http.Header, now time.Time) *cacheEntry {
+	fresh := *e
+	fresh.header = e.header.Clone()
+	for _, h := range revalidationHeaders {
+		if vs := notModified.Values(h); len(vs) > 0 {
+			fresh.header[http.CanonicalHeaderKey(h)] = append([]string(nil), vs...)
+		}
+	}
+	expires, storable := responseExpiry(&http.Response{StatusCode: e.status, Header: fresh.header}, now)
+	fresh.stored = now
+	fresh.expires = expires
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[e.key]; ok && el.Value == e {
+		if storable {
+			el.Value = &fresh
+			c.size += fresh.size() - e.size()
+		} else {
+			c.removeLocked(el)
+		}
+	}
+	c.revalidated++
+	return &fresh
+}
+
+func (c *httpCache) removeLocked(el *list.Element) {
+	e := el.Value.(*cacheEntry)
+	c.lru.Remove(el)
+	delete(c.entries, e.key)
+	c.size -= e.size()
+}
+
+func (c *httpCache) purge(prefix string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	removed := 0
+	for _, el := range c.entries {
+		if strings.HasPrefix(el.Value.(*cacheEntry).path, prefix) {
+			c.removeLocked(el)
+			removed++
+		}
+	}
+	return removed
+}
+
+func (c *httpCache) recordHit() {
+	c.mu.Lock()
+	c.hits++
+	c.mu.Unlock()
+}
+
+func (c *httpCache) recordMiss() {
+	c.mu.Lock()
+	c.misses++
+	c.mu.Unlock()
+}
+
+func (c *httpCache) stats() HTTPCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return HTTPCacheStats{
+		Hits:        c.hits,
+		Misses:      c.misses,
+		Revalidated: c.revalidated,
+		Stores:      c.stores,
+		Evictions:   c.evictions,
+		Entries:     len(c.entries),
+		Bytes:       c.size,
+		MaxBytes:    c.maxBytes,
+	}
+}
+
+// ---- Cache policy helpers ----
+
+// cacheKey returns the cache key for a request, or "" if the request must
+// bypass the cache entirely.
+func cacheKey(req *http.Request) string {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return ""
+	}
+	if req.Header.Get("Authorization") != "" {
+		return ""
+	}
+	cc := parseCacheControl(req.Header.Get("Cache-Control"))
+	if _, ok := cc["no-store"]; ok {
+		return ""
+	}
+	// Responses may vary by Accept-Encoding, so keep encodings apart.
+	enc := ""
+	if acceptsEncoding(req, "br") {
+		enc += "br"
+	}
+	if acceptsGzip(req) {
+		enc += "gz"
+	}
+	return strings.ToLower(req.Host) + req.URL.RequestURI() + "|" + enc
+}
+
+// wantsRevalidation reports whether the browser asked to skip cached copies
+// (hard reload sends "Cache-Control: no-cache" / "Pragma: no-cache").
+func wantsRevalidation(req *http.Request) bool {
+	cc := parseCacheControl(req.Header.Get("Cache-Control"))
+	if _, ok := cc["no-cache"]; ok {
+		return true
+	}
+	if v, ok := cc["max-age"]; ok && v == "0" {
+		return true
+	}
+	return strings.Contains(strings.ToLower(req.Header.Get("Pragma")), "no-cache")
+}
+
+// responseExpiry decides whether a response may be stored and until when it is
+// fresh. A zero expiry with storable=true means "store, but always revalidate".
+func responseExpiry(resp *http.Response, now time.Time) (expires time.Time, storable bool) {
+	if resp.StatusCode != http.StatusOK {
+		return time.Time{}, false
+	}
+	if resp.Header.Get("Set-Cookie") != "" {
+		return time.Time{}, false
+	}
+	for _, v := range resp.Header.Values("Vary") {
+		for _, f := range strings.Split(v, ",") {
+			f = strings.TrimSpace(f)
+			if f != "" && !strings.EqualFold(f, "Accept-Encoding") {
+				return time.Time{}, false
+			}
+		}
+	}
+
+	cc := parseCacheControl(resp.Header.Get("Cache-Control"))
+	if _, ok := cc["no-store"]; ok {
+		return time.Time{}, false
+	}
+	if _, ok := cc["private"]; ok {
+		return time.Time{}, false
+	}
+
+	hasValidator := resp.Header.Get("ETag") != "" || resp.Header.Get("Last-Modified") != ""
+	if _, ok := cc["no-cache"]; ok {
+		return time.Time{}, hasValidator
+	}
+
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if v, ok := cc[directive]; ok {
+			secs, err := strconv.Atoi(v)
+			if err != nil || secs <= 0 {
+				return time.Time{}, hasValidator
+			}
+			return now.Add(time.Duration(secs) * time.Second), true
+		}
+	}
+
+	if exp := resp.Header.Get("Expires"); exp != "" {
+		if t, err := http.ParseTime(exp); err == nil && t.After(now) {
+			return t, true
+		}
+	}
+
+	return time.Time{}, hasValidator
+}
+
+// notModified reports whether the browser's conditional headers match the entry.
+func notModified(req *http.Request, e *cacheEntry) bool {
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		etag := e.header.Get("ETag")
+		if etag == "" {
+			return false
+		}
+		for _, t := range strings.Split(inm, ",") {
+			t = strings.TrimSpace(t)
+			if t == "*" || strings.TrimPrefix(t, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := req.Header.Get("If-Modified-Since"); ims != "" {
+		lm, err1 := http.ParseTime(e.header.Get("Last-Modified"))
+		since, err2 := http.ParseTime(ims)
+		return err1 == nil && err2 == nil && !lm.After(since)
+	}
+	return false
+}
+
+func parseCacheControl(v string) map[string]string {
+	cc := make(map[string]string)
+	for _, part := range strings.Split(v, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, val, _ := strings.Cut(part, "=")
+		cc[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(val), `"`)
+	}
+	return cc
+}
@@ -0,0 +1,145 @@
+package tunnel
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Concurrent sessions read entries while others revalidate them; run with -race.
+func TestHTTPCacheRefreshConcurrentReads(t *testing.T) {
+	c := newHTTPCache(1 << 20)
+	c.put(&cacheEntry{key: "k", path: "/tiles/0.png", status: http.StatusOK, header: http.Header{}, body: []byte("tile"), stored: time.Now()})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				if e := c.get("k"); e != nil {
+					_ = e.fresh(time.Now())
+					_ = time.Since(e.stored)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				if e := c.get("k"); e != nil {
+					c.refresh(e, http.Header{"Cache-Control": {"max-age=60"}}, time.Now())
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := c.stats().Entries; got != 1 {
+		t.Fatalf("entries = %d, want 1", got)
+	}
+}
+
+func TestHTTPCacheRefreshReplacesEntry(t *testing.T) {
+	c := newHTTPCache(1 << 20)
+	old := &cacheEntry{key: "k", status: http.StatusOK, header: http.Header{}, body: []byte("tile")}
+	c.put(old)
+
+	now := time.Now()
+	expires := now.Add(time.Hour)
+	notModified := http.Header{"Cache-Control": {"max-age=3600"}}
+	fresh := c.refresh(old, notModified, now)
+	if fresh == old {
+		t.Fatal("refresh modified the entry in place")
+	}
+	if !old.expires.IsZero() {
+		t.Fatal("old entry changed")
+	}
+	if got := c.get("k"); got != fresh || !got.expires.Equal(expires) {
+		t.Fatalf("cache holds %+v, want the refreshed copy", got)
+	}
+
+	// An entry replaced meanwhile is kept
+	newer := &cacheEntry{key: "k", status: http.StatusOK, header: http.Header{}, body: []byte("newer")}
+	c.put(newer)
+	c.refresh(fresh, notModified, now)
+	if got := c.get("k"); got != newer {
+		t.Fatal("refresh of a stale entry replaced the newer one")
+	}
+}
+
+func TestHTTPCacheRefreshMergesValidators(t *testing.T) {
+	c := newHTTPCache(1 << 20)
+	old := &cacheEntry{key: "k", status: http.StatusOK, body: []byte("tile"), header: http.Header{
+		"Content-Type":  {"image/png"},
+		"Cache-Control": {"max-age=60"},
+		"Etag":          {`"v1"`},
+		"Last-Modified": {"Mon, 05 Oct 2026 10:00:00 GMT"},
+	}}
+	c.put(old)
+	sizeBefore := c.stats().Bytes
+
+	now := time.Now()
+	fresh := c.refresh(old, http.Header{
+		"Cache-Control": {"max-age=600"},
+		"Etag":          {`"v2"`},
+		"Last-Modified": {"Tue, 06 Oct 2026 10:00:00 GMT"},
+		"Set-Cookie":    {"ignored=1"},
+	}, now)
+
+	if got := fresh.header.Get("ETag"); got != `"v2"` {
+		t.Errorf("ETag = %s, want \"v2\"", got)
+	}
+	if got := fresh.header.Get("Last-Modified"); got != "Tue, 06 Oct 2026 10:00:00 GMT" {
+		t.Errorf("Last-Modified = %s", got)
+	}
+	if got := fresh.header.Get("Content-Type"); got != "image/png" {
+		t.Errorf("Content-Type = %s, want the stored one", got)
+	}
+	if fresh.header.Get("Set-Cookie") != "" {
+		t.Error("Set-Cookie of the 304 was stored")
+	}
+	if want := now.Add(10 * time.Minute); !fresh.expires.Equal(want) {
+		t.Errorf("expires = %v, want %v from the new max-age", fresh.expires, want)
+	}
+	if old.header.Get("ETag") != `"v1"` {
+		t.Error("old entry's header changed")
+	}
+	if got, want := c.stats().Bytes, sizeBefore+fresh.size()-old.size(); got != want {
+		t.Errorf("cache size = %d, want %d", got, want)
+	}
+
+	// A 304 forbidding storage drops the entry.
+	c.refresh(fresh, http.Header{"Cache-Control": {"no-store"}}, now)
+	if c.get("k") != nil {
+		t.Error("entry kept after a no-store 304")
+	}
+}
+
+func TestCacheKeyAcceptEncoding(t *testing.T) {
+	key := func(ae string) string {
+		req := httptest.NewRequest(http.MethodGet, "http://map.example.com/tiles/0.png", nil)
+		if ae != "" {
+			req.Header.Set("Accept-Encoding", ae)
+		}
+		return cacheKey(req)
+	}
+
+	tests := []struct {
+		a, b string
+		same bool
+	}{
+		{"gzip", "gzip, deflate", true},
+		{"gzip;q=0", "", true},
+		{"gzip;q=0", "gzip", false},
+		{"br;q=0, gzip", "gzip", true},
+		{"br, gzip", "gzip", false},
+		{"GZIP; q=0.5", "gzip", true},
+	}
+	for _, tt := range tests {
+		if same := key(tt.a) == key(tt.b); same != tt.same {
+			t.Errorf("key(%q) == key(%q) is %v, want %v", tt.a, tt.b, same, tt.same)
+		}
+	}
+}
@@ -6,31 +6,41 @@ package tunnel
 //
 // Expected Host header format: map.happy-cat.eu.domain.com
 // The subdomain "happy-cat" is the tunnel identifier.
+//
+// Requests are parsed one at a time so that cacheable responses can be served
+// from the tunnel's edge cache (see http_cache.go). Keep-alive connections reuse
+// a single data channel to the client; protocol upgrades (WebSocket live maps)
+// switch to a raw relay after the 101 response.
 
 import (
 	"bufio"
 	"bytes"
 	"context"
 	"fmt"
-	"log"
+	"io"
 	"net"
-	"strings"
+	"net/http"
+	"strconv"
 	"time"
+
+	"tunnel-api/internal/tracing"
+)
+
+const (
+	httpHeaderTimeout = 10 * time.Second
+	httpIdleTimeout   = 60 * time.Second
 )
 
 func (s *Server) startHTTPProxy(ctx context.Context) {
 	addr := fmt.Sprintf("0.0.0.0:%d", s.httpProxyPort)
-	l, err := net.Listen("tcp", addr)
+	l, err := s.listen("tcp", addr)
 	if err != nil {
-		log.Printf("[HTTPProxy] Failed to listen on %s: %v", addr, err)
+		s.httpLog.Error("Failed to listen", "addr", addr, "error", err)
 		return
 	}
-	log.Printf("[HTTPProxy] HTTP proxy listening on :%d (shared, routed by Host header)", s.httpProxyPort)
+	s.httpLog.Info("HTTP proxy listening (shared, routed by Host header)", "port", s.httpProxyPort)
 
-	go func() {
-		<-ctx.Done()
-		l.Close()
-	}()
+	s.closeOnDrain(ctx, l)
 
 	go func() {
 		for {
@@ -39,6 +49,8 @@ func (s *Server) startHTTPProxy(ctx context.Context) {
 				select {
 				case <-ctx.Done():
 					return
+				case <-s.draining:
+					return
 				default:
 					time.Sleep(50 * time.Millisecond)
 					continue
@@ -49,101 +61,442 @@ func (s *Server) startHTTPProxy(ctx context.Context) {
 	}()
 }
 
-func (s *Server) handleHTTPConnection(clientConn net.Conn) {
-	defer clientConn.Close()
+// httpSession is one browser connection routed to one tunnel.
+type httpSession struct {
+	s          *Server
+	tunnelID   string
+	httpPort   int
+	cache      *httpCache // nil when caching is disabled
+	clientConn net.Conn
+	reader     *bufio.Reader
+	clientIP   string
+	live       *liveConn // inspector entry, closed on both sides when killed
 
-	clientConn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	// per-request state for the access log and trace
+	ctx         context.Context
+	out         *countingWriter
+	status      int
+	cacheResult string
 
-	// Buffer the entire request to relay it later
-	raw := &bytes.Buffer{}
-	reader := bufio.NewReader(clientConn)
+	// upstream data channel, opened lazily and reused across keep-alive requests
+	upstream       net.Conn
+	upstreamReader *bufio.Reader
+}
 
-	var hostHeader string
+func (s *Server) handleHTTPConnection(rawConn net.Conn) {
+	clientConn := &usageConn{Conn: rawConn}
+	defer clientConn.Close()
+	ctx, span := startConnSpan("http.connection", rawConn)
+	defer endConnSpan(span, clientConn)
 
-	// Read HTTP headers line by line
-	for {
-		line, err := reader.ReadString('\n')
-		raw.WriteString(line)
-		if err != nil {
-			break
-		}
-		trimmed := strings.TrimSpace(line)
-		if trimmed == "" {
-			// End of headers
-			break
-		}
-		lower := strings.ToLower(trimmed)
-		if strings.HasPrefix(lower, "host:") {
-			hostHeader = strings.TrimSpace(trimmed[5:])
+	reader := bufio.NewReader(clientConn)
+	clientConn.SetReadDeadline(time.Now().Add(httpHeaderTimeout))
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		if err != io.EOF {
+			writeHTTPError(clientConn, http.StatusBadRequest, "Bad Request")
+			span.RecordError(err, tracing.String("stage", "request"))
 		}
+		return
 	}
-
 	clientConn.SetReadDeadline(time.Time{})
 
-	if hostHeader == "" {
-		log.Printf("[HTTPProxy] No Host header in request")
+	if req.Host == "" {
+		s.httpLog.Debug("No Host header in request")
+		writeHTTPError(clientConn, http.StatusBadRequest, "Missing Host header")
+		span.RecordError(errNoTunnel, tracing.String("stage", "lookup"))
 		return
 	}
 
-	// Strip port from host header if present
-	host := hostHeader
-	if h, _, err := net.SplitHostPort(hostHeader); err == nil {
-		host = h
-	}
-
-	// Extract subdomain from host
+	// Custom hostname, or subdomain extracted from host:
 	// "map.happy-cat.eu.domain.com" → "happy-cat"
-	subdomain := extractSubdomainFromAddr(host, s.domain)
+	subdomain, tunnelID, ok := s.resolveRoute(req.Host)
 	if subdomain == "" {
-		log.Printf("[HTTPProxy] Could not extract subdomain from Host: %s", hostHeader)
+		s.httpLog.Debug("Could not extract subdomain from Host", "host", req.Host)
+		writeHTTPError(clientConn, http.StatusNotFound, "Unknown host")
+		span.RecordError(errNoTunnel, tracing.String("stage", "lookup"), tracing.String("host", req.Host))
 		return
 	}
-
-	tunnelIDRaw, ok := s.subdomainMap.Load(subdomain)
 	if !ok {
-		log.Printf("[HTTPProxy] No tunnel for subdomain %q", subdomain)
+		if m, moved := s.lookupMoved(req.Host); moved {
+			span.AddEvent("tunnel.moved", tracing.String("region", m.target.Region))
+			redirectHTTP(clientConn, req, m)
+			return
+		}
+		s.httpLog.Debug("No tunnel for subdomain", "subdomain", subdomain)
+		writeHTTPError(clientConn, http.StatusNotFound, "Unknown host")
+		span.RecordError(errNoTunnel, tracing.String("stage", "lookup"), tracing.String("subdomain", subdomain))
 		return
 	}
-	tunnelID := tunnelIDRaw.(string)
+	span.SetAttrs(tracing.String("tunnel_id", tunnelID), tracing.String("subdomain", subdomain))
+	span.AddEvent("tunnel.resolved")
 
 	// Check HTTP is enabled for this tunnel
 	httpPortRaw, ok := s.tunnelHTTPPort.Load(tunnelID)
 	if !ok {
-		log.Printf("[HTTPProxy] HTTP not enabled for tunnel %s", tunnelID)
+		s.httpLog.Debug("HTTP not enabled for tunnel", "tunnel_id", tunnelID)
+		writeHTTPError(clientConn, http.StatusNotFound, "Web map not enabled for this tunnel")
+		span.RecordError(errHTTPDisabled, tracing.String("stage", "lookup"))
 		return
 	}
-	httpPort := httpPortRaw.(int)
 
-	clientRaw, ok := s.clients.Load(tunnelID)
-	if !ok {
-		log.Printf("[HTTPProxy] No client connected for tunnel %s", tunnelID)
+	if suspended, reason := s.suspended(tunnelID); suspended {
+		writeHTTPError(clientConn, http.StatusServiceUnavailable, reason)
+		span.RecordError(errTunnelSuspended, tracing.String("stage", "limits"))
 		return
 	}
-	client := clientRaw.(*ClientConn)
+	if _, attached := s.clients.Load(tunnelID); !attached {
+		// Attached to another node of the region: resend the request, then relay
+		if s.forward(ctx, ChannelHTTP, tunnelID, &bufferedConn{Conn: clientConn, r: reader}, req.Write) {
+			return
+		}
+	}
+	s.bindUsage(clientConn, tunnelID, ChannelHTTP)
+	live := s.trackConn(tunnelID, ChannelHTTP, clientConn, nil, "")
+	defer s.untrackConn(live)
 
-	connID := generateID()
-	dataCh := make(chan net.Conn, 1)
-	client.pendingTCP.Store(connID, dataCh)
-	defer client.pendingTCP.Delete(connID)
+	clientIP := clientConn.RemoteAddr().String()
+	if h, _, err := net.SplitHostPort(clientIP); err == nil {
+		clientIP = h
+	}
 
-	if err := client.send(fmt.Sprintf("OPEN %s %d", connID, httpPort)); err != nil {
-		log.Printf("[HTTPProxy] Failed to send OPEN: %v", err)
-		return
+	sess := &httpSession{
+		s:          s,
+		tunnelID:   tunnelID,
+		httpPort:   httpPortRaw.(int),
+		clientConn: clientConn,
+		reader:     reader,
+		clientIP:   clientIP,
+		live:       live,
 	}
+	if cRaw, ok := s.httpCaches.Load(tunnelID); ok {
+		sess.cache = cRaw.(*httpCache)
+	}
+	defer sess.closeUpstream()
 
-	select {
-	case dataConn := <-dataCh:
-		defer dataConn.Close()
-		// Send buffered headers first, then relay remaining request body and response
-		dataConn.Write(raw.Bytes())
-		// Also relay any remaining buffered bytes from the reader
-		if reader.Buffered() > 0 {
-			buf := make([]byte, reader.Buffered())
-			reader.Read(buf)
-			dataConn.Write(buf)
+	for {
+		start := time.Now()
+		sess.out = &countingWriter{w: clientConn}
+		sess.status, sess.cacheResult = 0, ""
+		var reqSpan *tracing.Span
+		sess.ctx, reqSpan = tracing.Start(ctx, "http.request", tracing.KindServer,
+			tracing.String("http.request.method", req.Method),
+			tracing.String("url.path", req.URL.Path),
+		)
+		keepAlive, err := sess.serve(req)
+		sess.logAccess(req, start)
+		reqSpan.SetAttrs(tracing.Int("http.response.status_code", sess.status))
+		if sess.cacheResult != "" {
+			reqSpan.SetAttrs(tracing.String("cache", sess.cacheResult))
+		}
+		reqSpan.RecordError(err)
+		reqSpan.End()
+		if err != nil {
+			s.httpLog.Warn("Request failed", "tunnel_id", tunnelID, "error", err)
+			span.RecordError(err, tracing.String("stage", "relay"))
+			return
+		}
+		if !keepAlive {
+			return
+		}
+
+		// Waiting for the next request; Drain wakes idle connections
+		clientConn.SetReadDeadline(time.Now().Add(httpIdleTimeout))
+		live.idle.Store(true)
+		if s.Draining() {
+			return
+		}
+		req, err = http.ReadRequest(reader)
+		live.idle.Store(false)
+		if err != nil {
+			return
+		}
+		clientConn.SetReadDeadline(time.Time{})
+	}
+}
+
+// serve answers a single request, from the cache when possible.
+// keepAlive is false when the browser connection must be closed afterwards.
+func (p *httpSession) serve(req *http.Request) (keepAlive bool, err error) {
+	key := ""
+	if p.cache != nil {
+		key = cacheKey(req)
+	}
+
+	var entry *cacheEntry
+	if key != "" {
+		entry = p.cache.get(key)
+		if entry != nil && entry.fresh(time.Now()) && !wantsRevalidation(req) {
+			p.cache.recordHit()
+			p.cacheResult = "HIT"
+			return !req.Close, p.writeCached(req, entry)
+		}
+		p.cache.recordMiss()
+	}
+
+	// Forward to the origin, revalidating a stale entry when we have validators.
+	outReq := req
+	if entry != nil && req.Method == http.MethodGet {
+		outReq = req.Clone(req.Context())
+		outReq.Header.Del("If-None-Match")
+		outReq.Header.Del("If-Modified-Since")
+		if etag := entry.header.Get("ETag"); etag != "" {
+			outReq.Header.Set("If-None-Match", etag)
+		}
+		if lm := entry.header.Get("Last-Modified"); lm != "" {
+			outReq.Header.Set("If-Modified-Since", lm)
+		}
+	}
+
+	resp, err := p.roundTrip(outReq)
+	if err != nil {
+		p.status = http.StatusBadGateway
+		writeHTTPError(p.out, http.StatusBadGateway, "Tunnel client unavailable")
+		return false, err
+	}
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		p.status = resp.StatusCode
+		return false, p.upgrade(resp)
+	}
+
+	now := time.Now()
+	if entry != nil && outReq != req && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		entry = p.cache.refresh(entry, resp.Header, now)
+		p.cacheResult = "REVALIDATED"
+		if resp.Close {
+			p.closeUpstream()
+		}
+		return !req.Close, p.writeCached(req, entry)
+	}
+
+	if err := compressResponse(req, resp, p.s.stats(p.tunnelID), p.s.usage(p.tunnelID, ChannelHTTP)); err != nil {
+		resp.Body.Close()
+		p.closeUpstream()
+		return false, fmt.Errorf("failed to read response body (tunnel %s): %w", p.tunnelID, err)
+	}
+
+	if key != "" && req.Method == http.MethodGet {
+		if expires, storable := responseExpiry(resp, now); storable {
+			if err := p.storeResponse(key, req, resp, expires); err != nil {
+				resp.Body.Close()
+				p.closeUpstream()
+				return false, err
+			}
 		}
-		relay(clientConn, dataConn)
-	case <-time.After(dataConnTimeout):
-		log.Printf("[HTTPProxy] Timeout waiting for data conn (tunnel %s)", tunnelID)
 	}
+
+	p.cacheResult = cacheStatus(p.cache, key)
+	p.status = resp.StatusCode
+	resp.Header.Set("X-Cache", p.cacheResult)
+	werr := resp.Write(p.out)
+	resp.Body.Close()
+	if resp.Close {
+		p.closeUpstream()
+	}
+	if werr != nil {
+		return false, nil
+	}
+	return !req.Close && !resp.Close, nil
+}
+
+// roundTrip writes the request to the client's data channel and reads the response.
+func (p *httpSession) roundTrip(req *http.Request) (*http.Response, error) {
+	reused := p.upstream != nil
+	resp, err := p.tryRoundTrip(req)
+	if err != nil && reused && req.Body == http.NoBody {
+		// The origin may have closed an idle keep-alive connection; retry once on a fresh one.
+		return p.tryRoundTrip(req)
+	}
+	return resp, err
+}
+
+func (p *httpSession) tryRoundTrip(req *http.Request) (*http.Response, error) {
+	if p.upstream == nil {
+		clientRaw, ok := p.s.clients.Load(p.tunnelID)
+		if !ok {
+			return nil, fmt.Errorf("no client connected for tunnel %s", p.tunnelID)
+		}
+		dataConn, err := p.s.openDataConn(p.ctx, clientRaw.(*ClientConn), p.httpPort, true)
+		if err != nil {
+			return nil, err
+		}
+		p.upstream = dataConn
+		p.live.setUpstream(dataConn)
+		p.upstreamReader = bufio.NewReader(dataConn)
+	}
+
+	// Keep the browser's User-Agent as-is instead of letting net/http add its own
+	if _, ok := req.Header["User-Agent"]; !ok {
+		req.Header["User-Agent"] = []string{""}
+	}
+
+	if err := req.Write(p.upstream); err != nil {
+		p.closeUpstream()
+		return nil, fmt.Errorf("failed to forward request (tunnel %s): %w", p.tunnelID, err)
+	}
+	resp, err := http.ReadResponse(p.upstreamReader, req)
+	if err != nil {
+		p.closeUpstream()
+		return nil, fmt.Errorf("failed to read response (tunnel %s): %w", p.tunnelID, err)
+	}
+	return resp, nil
+}
+
+// storeResponse buffers a cacheable response body and stores it. Bodies larger
+// than the entry limit are streamed through untouched.
+func (p *httpSession) storeResponse(key string, req *http.Request, resp *http.Response, expires time.Time) error {
+	limit := p.cache.maxEntryBytes()
+	if resp.ContentLength > limit {
+		return nil
+	}
+	buf, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return fmt.Errorf("failed to read response body (tunnel %s): %w", p.tunnelID, err)
+	}
+	if int64(len(buf)) > limit {
+		// Too large to cache: replay what was read and stream the rest.
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), resp.Body), resp.Body}
+		return nil
+	}
+
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(buf))
+	resp.ContentLength = int64(len(buf))
+	resp.TransferEncoding = nil
+
+	header := resp.Header.Clone()
+	for _, h := range hopHeaders {
+		header.Del(h)
+	}
+	p.cache.put(&cacheEntry{
+		key:     key,
+		path:    req.URL.Path,
+		status:  resp.StatusCode,
+		header:  header,
+		body:    buf,
+		stored:  time.Now(),
+		expires: expires,
+	})
+	return nil
+}
+
+// writeCached answers a request from a cache entry without contacting the client.
+func (p *httpSession) writeCached(req *http.Request, e *cacheEntry) error {
+	header := e.header.Clone()
+	header.Set("Age", strconv.Itoa(int(time.Since(e.stored).Seconds())))
+	header.Set("X-Cache", "HIT")
+
+	resp := &http.Response{
+		StatusCode:    e.status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		ContentLength: int64(len(e.body)),
+		Body:          io.NopCloser(bytes.NewReader(e.body)),
+		Request:       req,
+		Close:         req.Close,
+	}
+	if notModified(req, e) {
+		resp.StatusCode = http.StatusNotModified
+		resp.ContentLength = 0
+		resp.Body = http.NoBody
+		header.Del("Content-Length")
+	}
+	p.status = resp.StatusCode
+	return resp.Write(p.out)
+}
+
+// upgrade completes a protocol switch (e.g. WebSocket) and relays raw bytes.
+func (p *httpSession) upgrade(resp *http.Response) error {
+	if err := resp.Write(p.out); err != nil {
+		return nil
+	}
+	upstream := &bufferedConn{Conn: p.upstream, r: p.upstreamReader}
+	p.upstream = nil
+	// What the relay sends to the browser counts towards the request's
+	// access log entry, which is written once the relay closes.
+	browser := &countingWriteConn{Conn: p.clientConn, out: p.out}
+	relay(&bufferedConn{Conn: browser, r: p.reader}, upstream)
+	return nil
+}
+
+// countingWriteConn sends writes to the browser through the request's countingWriter.
+type countingWriteConn struct {
+	net.Conn
+	out *countingWriter
+}
+
+func (c *countingWriteConn) Write(p []byte) (int, error) {
+	return c.out.Write(p)
+}
+
+func (c *countingWriteConn) CloseWrite() error {
+	if hc, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return hc.CloseWrite()
+	}
+	return nil
+}
+
+// logAccess records the request that was just served in the tunnel's access log.
+func (p *httpSession) logAccess(req *http.Request, start time.Time) {
+	if p.status == 0 {
+		return
+	}
+	p.s.recordHTTPAccess(HTTPAccessLog{
+		Time:      start.UTC(),
+		TunnelID:  p.tunnelID,
+		ClientIP:  p.clientIP,
+		Host:      req.Host,
+		Method:    req.Method,
+		Path:      req.URL.RequestURI(),
+		Status:    p.status,
+		BytesSent: p.out.n,
+		LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+		Cache:     p.cacheResult,
+		UserAgent: req.UserAgent(),
+	})
+}
+
+func (p *httpSession) closeUpstream() {
+	if p.upstream != nil {
+		p.live.setUpstream(nil)
+		p.upstream.Close()
+		p.upstream = nil
+		p.upstreamReader = nil
+	}
+}
+
+func cacheStatus(c *httpCache, key string) string {
+	if c == nil || key == "" {
+		return "BYPASS"
+	}
+	return "MISS"
+}
+
+// hopHeaders are connection-specific and never stored in the cache.
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade", "Trailer",
+}
+
+// countingWriter counts the bytes written to the browser for the access log.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func writeHTTPError(w io.Writer, status int, msg string) {
+	body := msg + "\n"
+	fmt.Fprintf(w, "HTTP/1.1 %d %s\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+		status, http.StatusText(status), len(body), body)
 }
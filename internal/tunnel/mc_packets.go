@@ -0,0 +1,212 @@
+package tunnel
+
+// Minimal Minecraft packet encoding for the few replies the proxy sends on its
+// own, without reaching the tunnel client: the login disconnect screen, the
+// server list status and the transfer of moved tunnels. All packets here are uncompressed and unencrypted, which
+// holds for the status and login states before Set Compression.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	mcStateStatus = 1
+	mcStateLogin  = 2
+
+	mcMaxUsernameLen = 16
+
+	mcReplyTimeout = 5 * time.Second
+)
+
+func appendVarInt(b []byte, v int) []byte {
+	u := uint32(v)
+	for u >= 0x80 {
+		b = append(b, byte(u)|0x80)
+		u >>= 7
+	}
+	return append(b, byte(u))
+}
+
+func appendMCString(b []byte, s string) []byte {
+	b = appendVarInt(b, len(s))
+	return append(b, s...)
+}
+
+func readVarInt(r io.ByteReader) (int, error) {
+	var result uint32
+	for shift := 0; shift < 35; shift += 7 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		result |= uint32(b&0x7F) << shift
+		if b&0x80 == 0 {
+			return int(int32(result)), nil
+		}
+	}
+	return 0, fmt.Errorf("VarInt too large")
+}
+
+// writeMCPacket writes a length-prefixed packet.
+func writeMCPacket(w io.Writer, id int, payload []byte) error {
+	body := appendVarInt(nil, id)
+	body = append(body, payload...)
+	_, err := w.Write(append(appendVarInt(nil, len(body)), body...))
+	return err
+}
+
+// readMCPacket reads a length-prefixed packet.
+func readMCPacket(r *bufio.Reader) (id int, payload []byte, err error) {
+	n, err := readVarInt(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if n <= 0 || n > 32768 {
+		return 0, nil, fmt.Errorf("bad packet length %d", n)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	br := bytes.NewReader(body)
+	if id, err = readVarInt(br); err != nil {
+		return 0, nil, err
+	}
+	payload, _ = io.ReadAll(br)
+	return id, payload, nil
+}
+
+// mcText is a plain JSON text component.
+func mcText(msg string) string {
+	b, _ := json.Marshal(map[string]string{"text": msg})
+	return string(b)
+}
+
+// rejectMinecraft answers a player without reaching the tunnel. Login attempts
+// get a disconnect screen showing reason; server list pings show it as the MOTD.
+func rejectMinecraft(conn net.Conn, hs mcHandshake, reason string) {
+	conn.SetDeadline(time.Now().Add(mcReplyTimeout))
+
+	if hs.NextState != mcStateStatus {
+		// Login Disconnect (0x00)
+		writeMCPacket(conn, 0x00, appendMCString(nil, mcText(reason)))
+		return
+	}
+
+	var status struct {
+		Version struct {
+			Name     string `json:"name"`
+			Protocol int    `json:"protocol"`
+		} `json:"version"`
+		Players struct {
+			Max    int `json:"max"`
+			Online int `json:"online"`
+		} `json:"players"`
+		Description struct {
+			Text string `json:"text"`
+		} `json:"description"`
+	}
+	status.Version.Name = "VoidLink"
+	status.Version.Protocol = hs.Protocol
+	status.Description.Text = reason
+	statusJSON, _ := json.Marshal(status)
+
+	r := bufio.NewReader(conn)
+	for {
+		id, payload, err := readMCPacket(r)
+		if err != nil {
+			return
+		}
+		switch id {
+		case 0x00: // Status Request → Status Response
+			if writeMCPacket(conn, 0x00, appendMCString(nil, string(statusJSON))) != nil {
+				return
+			}
+		case 0x01: // Ping Request → Pong Response
+			writeMCPacket(conn, 0x01, payload)
+			return
+		default:
+			return
+		}
+	}
+}
+
+// readLoginStart reads the Login Start packet that follows a login handshake
+// and returns the player name. raw holds every byte consumed from conn, which
+// must still be forwarded to the server, also when err is set.
+func readLoginStart(conn net.Conn) (name string, raw []byte, err error) {
+	conn.SetReadDeadline(time.Now().Add(mcReplyTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var buf bytes.Buffer
+	id, payload, err := readMCPacket(bufio.NewReaderSize(io.TeeReader(conn, &buf), 16))
+	if err != nil {
+		return "", buf.Bytes(), err
+	}
+	if id != 0x00 {
+		return "", buf.Bytes(), fmt.Errorf("expected Login Start (0x00), got 0x%02X", id)
+	}
+	r := bytes.NewReader(payload)
+	n, err := readVarInt(r)
+	if err != nil {
+		return "", buf.Bytes(), err
+	}
+	if n <= 0 || n > mcMaxUsernameLen || n > r.Len() {
+		return "", buf.Bytes(), fmt.Errorf("bad username length %d", n)
+	}
+	return string(payload[len(payload)-r.Len():][:n]), buf.Bytes(), nil
+}
+
+// transferMinecraft completes an offline-mode login and sends the player to
+// host:port with a Transfer packet. The client must speak protocol 766+.
+func transferMinecraft(conn net.Conn, protocol int, host string, port int) {
+	conn.SetDeadline(time.Now().Add(mcReplyTimeout))
+	r := bufio.NewReader(conn)
+
+	// Login Start: name, UUID
+	id, payload, err := readMCPacket(r)
+	if err != nil || id != 0x00 {
+		return
+	}
+	pr := bytes.NewReader(payload)
+	n, err := readVarInt(pr)
+	if err != nil || n <= 0 || n > mcMaxUsernameLen || n+16 > pr.Len() {
+		return
+	}
+	rest := payload[len(payload)-pr.Len():]
+	name, uuid := rest[:n], rest[n:n+16]
+
+	// Login Success (0x02): UUID, name, no properties
+	success := append([]byte(nil), uuid...)
+	success = appendMCString(success, string(name))
+	success = appendVarInt(success, 0)
+	if protocol < mcProtocolNoStrictErrors {
+		success = append(success, 0) // strict error handling: false
+	}
+	if writeMCPacket(conn, 0x02, success) != nil {
+		return
+	}
+
+	// Login Acknowledged (0x03) switches to the configuration state
+	for id != 0x03 {
+		if id, _, err = readMCPacket(r); err != nil {
+			return
+		}
+	}
+	if port <= 0 {
+		port = 25565
+	}
+	// Transfer (configuration state, 0x0B): host, port
+	transfer := appendVarInt(appendMCString(nil, host), port)
+	if writeMCPacket(conn, 0x0B, transfer) != nil {
+		return
+	}
+	// The client disconnects once it has read the packet
+	io.Copy(io.Discard, r)
+}
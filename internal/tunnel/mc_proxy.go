@@ -18,26 +18,24 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"strings"
 	"time"
+
+	"tunnel-api/internal/tracing"
 )
 
 // startMCProxy starts the shared Minecraft TCP proxy.
 func (s *Server) startMCProxy(ctx context.Context) {
 	addr := fmt.Sprintf("0.0.0.0:%d", s.mcProxyPort)
-	l, err := net.Listen("tcp", addr)
+	l, err := s.listen("tcp", addr)
 	if err != nil {
-		log.Printf("[MCProxy] Failed to listen on %s: %v", addr, err)
+		s.mcLog.Error("Failed to listen", "addr", addr, "error", err)
 		return
 	}
-	log.Printf("[MCProxy] Minecraft proxy listening on :%d (shared, routed by subdomain)", s.mcProxyPort)
+	s.mcLog.Info("Minecraft proxy listening (shared, routed by subdomain)", "port", s.mcProxyPort)
 
-	go func() {
-		<-ctx.Done()
-		l.Close()
-	}()
+	s.closeOnDrain(ctx, l)
 
 	go func() {
 		for {
@@ -46,6 +44,8 @@ func (s *Server) startMCProxy(ctx context.Context) {
 				select {
 				case <-ctx.Done():
 					return
+				case <-s.draining:
+					return
 				default:
 					time.Sleep(50 * time.Millisecond)
 					continue
@@ -57,61 +57,113 @@ func (s *Server) startMCProxy(ctx context.Context) {
 }
 
 func (s *Server) handleMCConnection(playerConn net.Conn) {
-	defer playerConn.Close()
+	player := &usageConn{Conn: playerConn}
+	defer player.Close()
+	ctx, span := startConnSpan("mc.connection", playerConn)
+	defer endConnSpan(span, player)
 
-	serverAddr, buffered, err := parseMinecraftHandshake(playerConn)
+	hs, buffered, err := parseMinecraftHandshake(player)
+	hsLen := len(buffered)
 	if err != nil {
-		log.Printf("[MCProxy] Handshake parse error: %v", err)
+		s.handshakeFailures.Add(1)
+		s.mcLog.Debug("Handshake parse error", "remote", playerConn.RemoteAddr().String(), "error", err)
+		span.RecordError(err, tracing.String("stage", "handshake"))
 		return
 	}
+	span.AddEvent("handshake.parsed",
+		tracing.Int("mc.protocol", hs.Protocol),
+		tracing.String("mc.server_addr", hs.ServerAddr),
+		tracing.Int("mc.next_state", hs.NextState),
+	)
 
-	subdomain := extractSubdomainFromAddr(serverAddr, s.domain)
+	// subdomain is the custom hostname when the player used one
+	subdomain, tunnelID, ok := s.resolveRoute(hs.ServerAddr)
 	if subdomain == "" {
-		log.Printf("[MCProxy] Could not extract subdomain from %q", serverAddr)
+		s.mcLog.Debug("Could not extract subdomain", "server_addr", hs.ServerAddr)
+		span.RecordError(errNoTunnel, tracing.String("stage", "lookup"))
 		return
 	}
-
-	tunnelIDRaw, ok := s.subdomainMap.Load(subdomain)
 	if !ok {
-		log.Printf("[MCProxy] No tunnel for subdomain %q", subdomain)
+		if m, moved := s.lookupMoved(hs.ServerAddr); moved {
+			span.AddEvent("tunnel.moved", tracing.String("region", m.target.Region))
+			redirectMinecraft(player, hs, m)
+			return
+		}
+		s.mcLog.Debug("No tunnel for subdomain", "subdomain", subdomain)
+		span.RecordError(errNoTunnel, tracing.String("stage", "lookup"), tracing.String("subdomain", subdomain))
+		return
+	}
+	span.SetAttrs(tracing.String("tunnel_id", tunnelID), tracing.String("subdomain", subdomain))
+	span.AddEvent("tunnel.resolved")
+
+	if suspended, reason := s.suspended(tunnelID); suspended {
+		rejectMinecraft(playerConn, hs, reason)
+		span.RecordError(errTunnelSuspended, tracing.String("stage", "limits"))
 		return
 	}
-	tunnelID := tunnelIDRaw.(string)
 
 	clientRaw, ok := s.clients.Load(tunnelID)
 	if !ok {
-		log.Printf("[MCProxy] No client connected for tunnel %s (subdomain %s)", tunnelID, subdomain)
+		// Attached to another node of the region: hand over the handshake as read
+		if s.forward(ctx, ChannelMC, tunnelID, player, func(w io.Writer) error {
+			_, err := w.Write(buffered)
+			return err
+		}) {
+			return
+		}
+		s.mcLog.Debug("No client connected", "tunnel_id", tunnelID, "subdomain", subdomain)
+		span.RecordError(errNoClient, tracing.String("stage", "lookup"))
 		return
 	}
 	client := clientRaw.(*ClientConn)
 
+	// Login Start carries the player name; it is forwarded with the handshake
+	var username string
+	if hs.NextState != mcStateStatus {
+		name, raw, err := readLoginStart(player)
+		buffered = append(buffered, raw...)
+		if err != nil {
+			s.mcLog.Debug("Could not read Login Start", "tunnel_id", tunnelID, "error", err)
+		} else {
+			username = name
+			span.AddEvent("login.start", tracing.String("mc.username", username))
+		}
+	}
+
 	mcPortRaw, _ := s.tunnelMCPort.LoadOrStore(tunnelID, 25565)
 	mcPort := mcPortRaw.(int)
 
-	connID := generateID()
-	dataCh := make(chan net.Conn, 1)
-	client.pendingTCP.Store(connID, dataCh)
-	defer client.pendingTCP.Delete(connID)
-
-	if err := client.send(fmt.Sprintf("OPEN %s %d", connID, mcPort)); err != nil {
-		log.Printf("[MCProxy] Failed to send OPEN: %v", err)
+	dataConn, err := s.openDataConn(ctx, client, mcPort, false)
+	if err != nil {
 		return
 	}
-
-	select {
-	case dataConn := <-dataCh:
-		defer dataConn.Close()
-		// Prepend the buffered handshake bytes so the MC server sees the full packet
-		dataConn.Write(buffered)
-		relay(playerConn, dataConn)
-	case <-time.After(dataConnTimeout):
-		log.Printf("[MCProxy] Timeout waiting for data conn (tunnel %s)", tunnelID)
+	defer dataConn.Close()
+	// Players sent here by a moved tunnel's redirect arrive with the transfer
+	// intent, which servers refuse unless accepts-transfers is set; present
+	// them as a normal login. The intent is the handshake's last byte.
+	if hs.NextState == mcStateTransfer {
+		buffered[hsLen-1] = mcStateLogin
 	}
+	// Prepend the buffered handshake bytes so the MC server sees the full packet
+	dataConn.Write(buffered)
+	s.bindUsage(player, tunnelID, ChannelMC)
+	lc := s.trackConn(tunnelID, ChannelMC, player, dataConn, username)
+	defer s.untrackConn(lc)
+	s.connectionOpened(lc)
+	relayTraced(span, player, dataConn)
+	s.connectionClosed(lc)
+}
+
+// mcHandshake is the parsed Minecraft handshake packet.
+type mcHandshake struct {
+	Protocol   int
+	ServerAddr string
+	NextState  int // 1 = status, 2 = login, 3 = transfer
 }
 
 // parseMinecraftHandshake reads and buffers the MC handshake packet.
-// Returns the server address from the packet and all bytes read.
-func parseMinecraftHandshake(conn net.Conn) (serverAddr string, readBytes []byte, err error) {
+// Returns the parsed packet and all bytes read.
+func parseMinecraftHandshake(conn net.Conn) (hs mcHandshake, readBytes []byte, err error) {
 	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
 	defer conn.SetReadDeadline(time.Time{})
 
@@ -139,13 +191,13 @@ func parseMinecraftHandshake(conn net.Conn) (serverAddr string, readBytes []byte
 	// Packet length
 	pktLen, err := readVarInt()
 	if err != nil || pktLen <= 0 || pktLen > 32768 {
-		return "", raw.Bytes(), fmt.Errorf("bad packet length %d: %v", pktLen, err)
+		return hs, raw.Bytes(), fmt.Errorf("bad packet length %d: %v", pktLen, err)
 	}
 
 	// Read entire packet body
 	pktBody := make([]byte, pktLen)
 	if _, err = io.ReadFull(r, pktBody); err != nil {
-		return "", raw.Bytes(), err
+		return hs, raw.Bytes(), err
 	}
 
 	// Parse packet body
@@ -170,26 +222,26 @@ func parseMinecraftHandshake(conn net.Conn) (serverAddr string, readBytes []byte
 
 	pktID, err := readVarIntFrom(pr)
 	if err != nil || pktID != 0x00 {
-		return "", raw.Bytes(), fmt.Errorf("expected handshake (0x00), got 0x%02X", pktID)
+		return hs, raw.Bytes(), fmt.Errorf("expected handshake (0x00), got 0x%02X", pktID)
 	}
 
-	// Protocol version (discard)
-	if _, err = readVarIntFrom(pr); err != nil {
-		return "", raw.Bytes(), err
+	// Protocol version
+	if hs.Protocol, err = readVarIntFrom(pr); err != nil {
+		return hs, raw.Bytes(), err
 	}
 
 	// Server address string
 	strLen, err := readVarIntFrom(pr)
 	if err != nil || strLen <= 0 || strLen > 255 {
-		return "", raw.Bytes(), fmt.Errorf("bad server address length %d", strLen)
+		return hs, raw.Bytes(), fmt.Errorf("bad server address length %d", strLen)
 	}
 
 	addrBytes := make([]byte, strLen)
 	if _, err = io.ReadFull(pr, addrBytes); err != nil {
-		return "", raw.Bytes(), err
+		return hs, raw.Bytes(), err
 	}
 
-	serverAddr = string(addrBytes)
+	serverAddr := string(addrBytes)
 
 	// Strip BungeeCord / Forge null-byte suffixes
 	if idx := strings.IndexByte(serverAddr, '\x00'); idx >= 0 {
@@ -197,9 +249,17 @@ func parseMinecraftHandshake(conn net.Conn) (serverAddr string, readBytes []byte
 	}
 
 	// Strip trailing dot (some clients send "happy-cat.domain.com.")
-	serverAddr = strings.TrimSuffix(serverAddr, ".")
+	hs.ServerAddr = strings.TrimSuffix(serverAddr, ".")
+
+	// Server port (discard), next state
+	if _, err = io.ReadFull(pr, make([]byte, 2)); err != nil {
+		return hs, raw.Bytes(), err
+	}
+	if hs.NextState, err = readVarIntFrom(pr); err != nil {
+		return hs, raw.Bytes(), err
+	}
 
-	return serverAddr, raw.Bytes(), nil
+	return hs, raw.Bytes(), nil
 }
 
 // extractSubdomainFromAddr extracts the leftmost subdomain label from a full hostname.
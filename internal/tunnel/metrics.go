@@ -0,0 +1,68 @@
+package tunnel
+
+// Prometheus metrics of the tunnel server. Server implements metrics.Collector;
+// values are read from the live counters at scrape time.
+
+import (
+	"tunnel-api/internal/metrics"
+)
+
+// pairingBuckets cover OPEN→DATA round trips over home connections, up to dataConnTimeout.
+var pairingBuckets = []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 15}
+
+// Collect implements metrics.Collector.
+func (s *Server) Collect(e *metrics.Emitter) {
+	clients, tunnels := 0, 0
+	s.clients.Range(func(_, _ any) bool { clients++; return true })
+	s.registrations.Range(func(_, _ any) bool { tunnels++; return true })
+	e.Gauge("voidlink_clients_connected", "Desktop clients connected to the control port.", float64(clients))
+	e.Gauge("voidlink_tunnels_registered", "Tunnels registered (started) on this server.", float64(tunnels))
+
+	for i, ch := range usageChannels {
+		t := &s.usageTotals[i]
+		if ch != ChannelUDP {
+			e.Gauge("voidlink_relays_active", "Open player connections relayed through tunnels.",
+				float64(t.active.Load()), "channel", ch)
+		}
+		e.Counter("voidlink_relayed_bytes_total", "Player traffic relayed through tunnels (in = player to server).",
+			float64(t.relayedIn.Load()), "channel", ch, "direction", "in")
+		e.Counter("voidlink_relayed_bytes_total", "Player traffic relayed through tunnels (in = player to server).",
+			float64(t.relayedOut.Load()), "channel", ch, "direction", "out")
+	}
+
+	sessions := s.udpSessions.active()
+	total := 0
+	for _, n := range sessions {
+		total += n
+	}
+	e.Gauge("voidlink_udp_sessions_active", "Active UDP sessions (player address and port).", float64(total))
+
+	e.Counter("voidlink_mc_handshake_failures_total", "Minecraft connections with an unparseable handshake.",
+		float64(s.handshakeFailures.Load()))
+	e.Histogram("voidlink_data_channel_pairing_seconds", "Time from OPEN until the client dialled back with DATA.",
+		s.pairingLatency)
+	e.Counter("voidlink_data_channel_timeouts_total", "OPEN requests the client did not answer in time.",
+		float64(s.pairingTimeouts.Load()))
+
+	if !s.metricsPerTunnel {
+		return
+	}
+	s.tunnelUsage.Range(func(k, v any) bool {
+		tunnelID, u := k.(string), v.(*tunnelUsage)
+		for i, ch := range usageChannels {
+			t := &u.channels[i].totals
+			if ch != ChannelUDP {
+				e.Gauge("voidlink_tunnel_relays_active", "Open player connections per tunnel.",
+					float64(t.active.Load()), "tunnel", tunnelID, "channel", ch)
+			}
+			e.Counter("voidlink_tunnel_relayed_bytes_total", "Player traffic per tunnel (in = player to server).",
+				float64(t.relayedIn.Load()), "tunnel", tunnelID, "channel", ch, "direction", "in")
+			e.Counter("voidlink_tunnel_relayed_bytes_total", "Player traffic per tunnel (in = player to server).",
+				float64(t.relayedOut.Load()), "tunnel", tunnelID, "channel", ch, "direction", "out")
+		}
+		return true
+	})
+	for tunnelID, n := range sessions {
+		e.Gauge("voidlink_tunnel_udp_sessions_active", "Active UDP sessions per tunnel.", float64(n), "tunnel", tunnelID)
+	}
+}
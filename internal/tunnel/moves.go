@@ -0,0 +1,156 @@
+package tunnel
+
+// Moving a tunnel to another region: the node it leaves keeps redirecting
+// players who still use the old address. Minecraft 1.20.5+ clients are sent a
+// Transfer packet, older ones a disconnect screen naming the new address, and
+// web map requests a 307. The desktop client is told to reconnect with
+//
+//	MOVE <region> <domain>
+//
+// and the control connection is closed once the message is written.
+// Raw TCP and UDP ports cannot be redirected; players reconnect to the new
+// address on the same port.
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"tunnel-api/internal/events"
+)
+
+// MoveRedirectTTL is how long a node keeps redirecting a moved tunnel.
+const MoveRedirectTTL = 7 * 24 * time.Hour
+
+const (
+	// First protocol version with the Transfer packet (1.20.5)
+	mcProtocolTransfer = 766
+	// First protocol version without the strict error handling flag in
+	// Login Success (1.21.2)
+	mcProtocolNoStrictErrors = 768
+
+	// Handshake intent of a client sent by a Transfer packet
+	mcStateTransfer = 3
+)
+
+// MoveTarget is the region a tunnel moves to.
+type MoveTarget struct {
+	Region string `json:"region"`
+	Domain string `json:"domain"`
+	MCPort int    `json:"mc_port"` // public Minecraft port of the region
+}
+
+// movedTunnel is a redirect left behind by a move.
+type movedTunnel struct {
+	tunnelID  string
+	subdomain string
+	target    MoveTarget
+	expires   time.Time
+}
+
+// mcHost returns the Minecraft address of the tunnel in its new region.
+func (m *movedTunnel) mcHost() string {
+	return m.subdomain + "." + m.target.Domain
+}
+
+// MCProxyPort returns the port of the shared Minecraft listener.
+func (s *Server) MCProxyPort() int {
+	return s.mcProxyPort
+}
+
+// MoveTunnel removes a tunnel that now runs in another region and redirects
+// its subdomain and custom hostnames there. An attached client is told to
+// reconnect to the target region.
+func (s *Server) MoveTunnel(tunnelID string, target MoveTarget) {
+	regRaw, ok := s.registrations.Load(tunnelID)
+	if !ok {
+		return
+	}
+	reg := regRaw.(TunnelRegistration)
+	s.RedirectTunnel(reg, target)
+
+	if c, ok := s.clients.LoadAndDelete(tunnelID); ok {
+		c.(*ClientConn).sendClose("MOVE " + target.Region + " " + target.Domain)
+		s.releaseRoute(tunnelID)
+		s.publishFor(reg, events.ClientDisconnected, nil)
+	}
+	if s.removeTunnel(tunnelID) {
+		s.log.Info("Tunnel moved", "tunnel_id", tunnelID, "region", target.Region, "domain", target.Domain)
+		s.publishFor(reg, events.TunnelMoved, map[string]any{"region": target.Region, "domain": target.Domain})
+	}
+}
+
+// RedirectTunnel sends players of reg's subdomain and hostnames to the target
+// region for MoveRedirectTTL, or until the names are registered again. Route
+// stores use it for moves made on another node.
+func (s *Server) RedirectTunnel(reg TunnelRegistration, target MoveTarget) {
+	m := &movedTunnel{
+		tunnelID:  reg.TunnelID,
+		subdomain: reg.Subdomain,
+		target:    target,
+		expires:   time.Now().Add(MoveRedirectTTL),
+	}
+	s.moved.Store(reg.Subdomain, m)
+	for _, h := range reg.Hostnames {
+		s.moved.Store(h, m)
+	}
+}
+
+// clearMoved drops redirects of names that are registered again.
+func (s *Server) clearMoved(reg TunnelRegistration) {
+	s.moved.Delete(reg.Subdomain)
+	for _, h := range reg.Hostnames {
+		s.moved.Delete(h)
+	}
+}
+
+// lookupMoved returns the redirect for a requested host: a custom hostname,
+// or a subdomain under the service domain.
+func (s *Server) lookupMoved(addr string) (*movedTunnel, bool) {
+	host := normalizeHost(addr)
+	for _, key := range []string{host, extractSubdomainFromAddr(host, s.domain)} {
+		raw, ok := s.moved.Load(key)
+		if !ok {
+			continue
+		}
+		m := raw.(*movedTunnel)
+		if time.Now().After(m.expires) {
+			s.moved.CompareAndDelete(key, m)
+			return nil, false
+		}
+		return m, true
+	}
+	return nil, false
+}
+
+// redirectMinecraft sends a player to the tunnel's new region: a Transfer
+// packet for clients that support it, otherwise a message with the address.
+func redirectMinecraft(conn net.Conn, hs mcHandshake, m *movedTunnel) {
+	if hs.NextState == mcStateStatus || hs.Protocol < mcProtocolTransfer {
+		rejectMinecraft(conn, hs, "This server has moved to "+m.mcHost())
+		return
+	}
+	transferMinecraft(conn, hs.Protocol, m.mcHost(), m.target.MCPort)
+}
+
+// redirectHTTP answers a web map request with a redirect to the new region.
+func redirectHTTP(conn net.Conn, req *http.Request, m *movedTunnel) {
+	scheme := "http"
+	if req.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	location := scheme + "://map." + m.mcHost() + req.URL.RequestURI()
+
+	conn.SetWriteDeadline(time.Now().Add(mcReplyTimeout))
+	resp := &http.Response{
+		StatusCode: http.StatusTemporaryRedirect,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Location":       {location},
+			"Content-Length": {"0"},
+			"Connection":     {"close"},
+		},
+	}
+	resp.Write(conn)
+}
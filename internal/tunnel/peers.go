@@ -0,0 +1,185 @@
+package tunnel
+
+// Horizontal scaling: several tunnel servers of one region behind a load
+// balancer share their routing state through a RouteStore. Every node knows
+// every registered tunnel, but a tunnel's client is attached to one node
+// only. A player connection that lands on another node is forwarded to the
+// owner over the peer link, where it is handled as if it had arrived there.
+//
+// Peer link (node → owner, first line only, then the player's bytes):
+//
+//	FORWARD <peer_token> <channel> <tunnel_id> <player_addr>
+//
+// UDP datagrams are relayed too, framed over one link per public port (see
+// udp_peers.go), so a region's UDP ports work on every node.
+//
+// The load balancer must keep a client's control and data connections on one
+// node (source IP affinity on TUNNEL_PORT): data channels are not forwarded.
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"tunnel-api/internal/tracing"
+)
+
+const peerDialTimeout = 5 * time.Second
+
+// RouteStore shares which node each tunnel's client is attached to.
+// Implementations also replicate tunnel registrations between the nodes
+// (see package routes).
+type RouteStore interface {
+	// Claim records that the tunnel's client is attached to this node.
+	Claim(tunnelID string, info ClientInfo)
+	// Release clears the claim if it is still this node's.
+	Release(tunnelID string)
+	// Owner returns the peer address of the node holding the tunnel's client.
+	Owner(tunnelID string) (node string, info ClientInfo, ok bool)
+}
+
+// forwardedConn is a player connection received over the peer link. It
+// reports the player's address rather than the forwarding node's.
+type forwardedConn struct {
+	bufferedConn
+	remote peerAddr
+}
+
+func (c *forwardedConn) RemoteAddr() net.Addr { return c.remote }
+
+type peerAddr string
+
+func (a peerAddr) Network() string { return "tcp" }
+func (a peerAddr) String() string  { return string(a) }
+
+// Registration returns the registration of an active tunnel, with the
+// limits currently applied to it.
+func (s *Server) Registration(tunnelID string) (TunnelRegistration, bool) {
+	regRaw, ok := s.registrations.Load(tunnelID)
+	if !ok {
+		return TunnelRegistration{}, false
+	}
+	reg := regRaw.(TunnelRegistration)
+	reg.Limits = s.TunnelLimits(tunnelID)
+	return reg, true
+}
+
+// claimRoute and releaseRoute publish client attachment to the route store.
+func (s *Server) claimRoute(client *ClientConn) {
+	if s.routes != nil {
+		s.routes.Claim(client.tunnelID, client.info())
+	}
+}
+
+func (s *Server) releaseRoute(tunnelID string) {
+	// After a handoff the new process claims the routes under the same node address
+	if s.routes != nil && !s.handedOff.Load() {
+		s.routes.Release(tunnelID)
+	}
+}
+
+// forward relays a player connection to the node its tunnel's client is
+// attached to. head writes the bytes already read from conn. It returns
+// false if the connection must be handled here: no route store, no other
+// owner, or conn already came over the peer link.
+func (s *Server) forward(ctx context.Context, channel, tunnelID string, conn net.Conn, head func(io.Writer) error) bool {
+	if s.routes == nil {
+		return false
+	}
+	if _, forwarded := conn.RemoteAddr().(peerAddr); forwarded {
+		return false
+	}
+	node, _, ok := s.routes.Owner(tunnelID)
+	if !ok || node == s.nodeAddr {
+		return false
+	}
+
+	span := tracing.SpanFromContext(ctx)
+	peer, err := net.DialTimeout("tcp", node, peerDialTimeout)
+	if err != nil {
+		s.log.Warn("Failed to reach owner node", "tunnel_id", tunnelID, "node", node, "error", err)
+		span.RecordError(err, tracing.String("stage", "forward"), tracing.String("node", node))
+		return true
+	}
+	defer peer.Close()
+
+	fmt.Fprintf(peer, "FORWARD %s %s %s %s\n", s.peerToken, channel, tunnelID, conn.RemoteAddr().String())
+	if head != nil {
+		if err := head(peer); err != nil {
+			return true
+		}
+	}
+	span.AddEvent("forwarded", tracing.String("node", node))
+	relay(conn, peer)
+	return true
+}
+
+// startPeerListener accepts player connections forwarded by other nodes.
+func (s *Server) startPeerListener(ctx context.Context) error {
+	l, err := s.listen("tcp", s.peerAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on peer address %s: %w", s.peerAddr, err)
+	}
+	s.log.Info("Peer link listening", "addr", s.peerAddr, "node", s.nodeAddr)
+
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				select {
+				case <-ctx.Done():
+					return
+				default:
+					time.Sleep(50 * time.Millisecond)
+					continue
+				}
+			}
+			go s.handlePeerConn(conn)
+		}
+	}()
+	return nil
+}
+
+func (s *Server) handlePeerConn(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(controlTimeout))
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	parts := strings.Fields(line)
+	if err != nil || len(parts) != 5 || parts[0] != "FORWARD" ||
+		subtle.ConstantTimeCompare([]byte(parts[1]), []byte(s.peerToken)) != 1 {
+		s.log.Warn("Rejected peer connection", "remote", conn.RemoteAddr().String())
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	channel, tunnelID := parts[2], parts[3]
+	fc := &forwardedConn{bufferedConn: bufferedConn{Conn: conn, r: reader}, remote: peerAddr(parts[4])}
+	switch channel {
+	case ChannelMC:
+		s.handleMCConnection(fc)
+	case ChannelHTTP:
+		s.handleHTTPConnection(fc)
+	case ChannelTCP:
+		reg, ok := s.Registration(tunnelID)
+		if !ok || reg.TCPLocalPort == nil {
+			conn.Close()
+			return
+		}
+		s.handleTCPConnection(fc, tunnelID, *reg.TCPLocalPort)
+	case ChannelUDP:
+		s.serveUDPPeer(conn, reader, tunnelID, parts[4])
+	default:
+		conn.Close()
+	}
+}
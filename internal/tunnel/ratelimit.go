@@ -0,0 +1,164 @@
+package tunnel
+
+// Per-tunnel bandwidth limits. Each registered tunnel has a limiter with two
+// token buckets: upload (owner's server → players, i.e. the owner's home
+// uplink and our egress) and download (players → owner's server). TCP relays
+// wait for tokens; UDP drops packets that exceed the rate. Limits can be
+// changed at any time with SetTunnelLimits and apply to open connections.
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// minBurstBytes keeps slow limits from fragmenting every read into tiny waits.
+const minBurstBytes = 16 << 10
+
+var errTunnelSuspended = errors.New("tunnel suspended")
+
+// TunnelLimits are the bandwidth limits of a tunnel. Zero rates are unlimited.
+type TunnelLimits struct {
+	UploadBytesPerSec   int64 `json:"upload_bytes_per_sec"`
+	DownloadBytesPerSec int64 `json:"download_bytes_per_sec"`
+	// Suspended refuses new connections (with Reason shown to Minecraft
+	// players) and closes open relays.
+	Suspended bool   `json:"suspended"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// tokenBucket is a byte rate limiter that may go into debt, so a single large
+// read is delayed proportionally instead of being rejected.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second, 0 = unlimited
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) setRate(bytesPerSec int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rate = float64(bytesPerSec)
+	b.burst = max(b.rate, minBurstBytes)
+	b.tokens = min(b.tokens, b.burst)
+	b.last = time.Now()
+}
+
+// refill must be called with mu held.
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// wait takes n tokens, sleeping for as long as the bucket is in debt.
+func (b *tokenBucket) wait(n int) {
+	b.mu.Lock()
+	if b.rate == 0 {
+		b.mu.Unlock()
+		return
+	}
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	var d time.Duration
+	if b.tokens < 0 {
+		d = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// allow takes n tokens if they are available.
+func (b *tokenBucket) allow(n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate == 0 {
+		return true
+	}
+	b.refill(time.Now())
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+type tunnelLimiter struct {
+	up, down  tokenBucket
+	suspended atomic.Bool
+	reason    atomic.Pointer[string]
+}
+
+// set applies limits and reports whether they newly suspend the tunnel.
+func (l *tunnelLimiter) set(limits TunnelLimits) bool {
+	l.up.setRate(limits.UploadBytesPerSec)
+	l.down.setRate(limits.DownloadBytesPerSec)
+	reason := limits.Reason
+	l.reason.Store(&reason)
+	return !l.suspended.Swap(limits.Suspended) && limits.Suspended
+}
+
+func (l *tunnelLimiter) limits() TunnelLimits {
+	l.up.mu.Lock()
+	up := int64(l.up.rate)
+	l.up.mu.Unlock()
+	l.down.mu.Lock()
+	down := int64(l.down.rate)
+	l.down.mu.Unlock()
+	var reason string
+	if r := l.reason.Load(); r != nil {
+		reason = *r
+	}
+	return TunnelLimits{
+		UploadBytesPerSec:   up,
+		DownloadBytesPerSec: down,
+		Suspended:           l.suspended.Load(),
+		Reason:              reason,
+	}
+}
+
+// limiter returns the limiter of a tunnel, creating an unlimited one on first use.
+func (s *Server) limiter(tunnelID string) *tunnelLimiter {
+	l, ok := s.limiters.Load(tunnelID)
+	if !ok {
+		l, _ = s.limiters.LoadOrStore(tunnelID, &tunnelLimiter{})
+	}
+	return l.(*tunnelLimiter)
+}
+
+// SetTunnelLimits changes the bandwidth limits of a tunnel at runtime.
+// Suspending it closes its open relays, including idle ones that would
+// otherwise only notice on their next read.
+func (s *Server) SetTunnelLimits(tunnelID string, limits TunnelLimits) {
+	if !s.limiter(tunnelID).set(limits) {
+		return
+	}
+	s.liveConns.Range(func(_, v any) bool {
+		if lc := v.(*liveConn); lc.tunnelID == tunnelID {
+			lc.kill()
+		}
+		return true
+	})
+}
+
+// TunnelLimits returns the limits currently applied to a tunnel.
+func (s *Server) TunnelLimits(tunnelID string) TunnelLimits {
+	l, ok := s.limiters.Load(tunnelID)
+	if !ok {
+		return TunnelLimits{}
+	}
+	return l.(*tunnelLimiter).limits()
+}
+
+// suspended reports whether the tunnel is suspended, and why.
+func (s *Server) suspended(tunnelID string) (bool, string) {
+	l, ok := s.limiters.Load(tunnelID)
+	if !ok || !l.(*tunnelLimiter).suspended.Load() {
+		return false, ""
+	}
+	return true, l.(*tunnelLimiter).limits().Reason
+}
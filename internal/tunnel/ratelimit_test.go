@@ -0,0 +1,108 @@
+package tunnel
+
+import (
+	"io"
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	tests := []struct {
+		name       string
+		rate       int64
+		tokens     float64
+		wait       int // taken with wait when set, else with allow
+		allow      int
+		wantAllow  bool
+		wantTokens float64
+		wantSleep  time.Duration
+	}{
+		{name: "unlimited", rate: 0, allow: 1 << 20, wantAllow: true},
+		{name: "allow within tokens", rate: 10000, tokens: 16384, allow: 1000, wantAllow: true, wantTokens: 15384},
+		{name: "allow over tokens", rate: 10000, tokens: 500, allow: 1000, wantTokens: 500},
+		{name: "allow in debt", rate: 10000, tokens: -2000, allow: 1, wantTokens: -2000},
+		{name: "wait within tokens", rate: 10000, tokens: 16384, wait: 1000, wantTokens: 15384},
+		{name: "wait into debt", rate: 100000, wait: 5000, wantTokens: -5000, wantSleep: 50 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b tokenBucket
+			b.setRate(tt.rate)
+			b.tokens = tt.tokens
+			b.last = time.Now()
+
+			start := time.Now()
+			if tt.wait > 0 {
+				b.wait(tt.wait)
+			} else if got := b.allow(tt.allow); got != tt.wantAllow {
+				t.Errorf("allow(%d) = %v, want %v", tt.allow, got, tt.wantAllow)
+			}
+			elapsed := time.Since(start)
+
+			// Whatever refilled while the test ran
+			if slack := float64(tt.rate) * 0.01; math.Abs(b.tokens-tt.wantTokens) > slack {
+				t.Errorf("tokens = %.0f, want %.0f", b.tokens, tt.wantTokens)
+			}
+			if elapsed < tt.wantSleep*9/10 {
+				t.Errorf("returned after %v, want a %v wait", elapsed, tt.wantSleep)
+			}
+			if tt.wantSleep == 0 && elapsed > 10*time.Millisecond {
+				t.Errorf("slept %v with tokens available", elapsed)
+			}
+		})
+	}
+}
+
+func TestTokenBucketSetRate(t *testing.T) {
+	tests := []struct {
+		name       string
+		from, to   int64
+		tokens     float64
+		wantBurst  float64
+		wantTokens float64
+	}{
+		{name: "lowered rate clamps tokens", from: 1 << 20, to: 1000, tokens: 1 << 20, wantBurst: minBurstBytes, wantTokens: minBurstBytes},
+		{name: "raised rate keeps tokens", from: 10000, to: 1 << 20, tokens: 5000, wantBurst: 1 << 20, wantTokens: 5000},
+		{name: "debt kept", from: 10000, to: 20000, tokens: -3000, wantBurst: 20000, wantTokens: -3000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b tokenBucket
+			b.setRate(tt.from)
+			b.tokens = tt.tokens
+			b.setRate(tt.to)
+			if b.burst != tt.wantBurst || b.tokens != tt.wantTokens {
+				t.Errorf("burst %.0f tokens %.0f, want %.0f %.0f", b.burst, b.tokens, tt.wantBurst, tt.wantTokens)
+			}
+		})
+	}
+}
+
+// Suspending a tunnel closes its idle relays; other tunnels' stay open.
+func TestSuspendClosesRelays(t *testing.T) {
+	s := NewServer(Config{})
+	relay := func(tunnelID string) (player, upstream net.Conn) {
+		p1, p2 := net.Pipe()
+		u1, u2 := net.Pipe()
+		t.Cleanup(func() { p1.Close(); u1.Close() })
+		s.trackConn(tunnelID, ChannelMC, s.countUsage(p2, tunnelID, ChannelMC), u2, "")
+		return p1, u1
+	}
+	player, upstream := relay("t1")
+	other, _ := relay("t2")
+
+	s.SetTunnelLimits("t1", TunnelLimits{Suspended: true, Reason: "abuse"})
+
+	for _, c := range []net.Conn{player, upstream} {
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("relay of the suspended tunnel: %v, want closed", err)
+		}
+	}
+	other.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := other.Read(make([]byte, 1)); err == io.EOF {
+		t.Error("relay of another tunnel closed")
+	}
+}
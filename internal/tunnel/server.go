@@ -5,29 +5,37 @@ import (
 	"context"
 	"encoding/hex"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+
+	"tunnel-api/internal/events"
+	"tunnel-api/internal/logging"
+	"tunnel-api/internal/metrics"
+	"tunnel-api/internal/tracing"
 )
 
 // Protocol messages (newline-terminated plain text)
 // Control channel (client → server):
 //
-//	AUTH <jwt_token> <tunnel_id>
-//	PONG
+//	AUTH <jwt_token> <tunnel_id> [key=value ...]   (options: compress=deflate, version=<client version>)
+//	PONG [<unix_micros>]             (echoes the PING timestamp)
 //	UDP_REPLY <conn_id> <hex_payload>
 //
 // Control channel (server → client):
 //
-//	OK
+//	OK [key=value ...]               (accepted options are echoed back)
 //	ERROR <message>
-//	OPEN <conn_id> <local_port>      (new TCP connection arrived, open data channel)
-//	UDP_PKT <conn_id> <local_port> <hex_payload>  (UDP packet arrived)
-//	PING
+//	OPEN <conn_id> <local_port> [deflate]  (new TCP connection arrived — MC, HTTP or raw TCP — open data channel;
+//	                                        "deflate" = data channel carries deflate streams)
+//	UDP_PKT <conn_id> <local_port> <hex_payload>  (UDP packet arrived; conn_id is a numeric session ID)
+//	UDP_CLOSE <conn_id>              (UDP session expired after being idle)
+//	PING [<unix_micros>]             (timestamp only for clients that announced a version)
 //
 // Data channel (client → server, first message only):
 //
@@ -40,20 +48,93 @@ const (
 	dataConnTimeout = 15 * time.Second
 )
 
+// Config holds the listener ports and limits of a tunnel server.
+type Config struct {
+	JWTSecret     []byte
+	TunnelPort    int
+	MCProxyPort   int
+	HTTPProxyPort int
+	Domain        string
+	MinPort       int
+	MaxPort       int
+
+	// HTTPCacheMaxBytes bounds the in-memory web map cache of each tunnel
+	// that has caching enabled.
+	HTTPCacheMaxBytes int64
+
+	// AccessLogSize is the number of HTTP access log records kept per tunnel.
+	AccessLogSize int
+	// AccessLogFile, if set, receives every HTTP access log record as a JSON line.
+	AccessLogFile string
+
+	// UDPSessionIdle expires UDP sessions (one per player address and port) without traffic.
+	UDPSessionIdle time.Duration
+	// MaxUDPSessions caps concurrent UDP sessions per tunnel.
+	MaxUDPSessions int
+
+	// MetricsPerTunnel adds per-tunnel series (labelled with the tunnel ID) to
+	// the exported metrics. Off by default to keep cardinality bounded.
+	MetricsPerTunnel bool
+
+	// Events, if set, receives client, tunnel, connection and usage events.
+	Events *events.Bus
+
+	// Routes, if set, shares client attachment with the other nodes of the
+	// region (see peers.go). NodeAddr is the host:port under which they reach
+	// this node's PeerAddr listener, and PeerToken authenticates the link.
+	Routes    RouteStore
+	PeerAddr  string
+	NodeAddr  string
+	PeerToken string
+
+	// Listen and ListenPacket open the control, proxy and public port sockets
+	// (default net.Listen and net.ListenPacket). Binary upgrades pass the
+	// sockets of the previous process in through them.
+	Listen       func(network, addr string) (net.Listener, error)
+	ListenPacket func(network, addr string) (net.PacketConn, error)
+
+	// Logger is the parent of the server's subsystem loggers (tunnel, mcproxy,
+	// httpproxy, tcp, udp). Defaults to slog.Default().
+	Logger *slog.Logger
+}
+
 // TunnelRegistration holds the parameters to register a tunnel with the server.
 type TunnelRegistration struct {
-	TunnelID      string
-	Subdomain     string
-	MCLocalPort   int
-	HTTPLocalPort *int // nil = disabled
-	UDPLocalPort  int
-	UDPPublicPort *int // nil = no dedicated UDP port
+	TunnelID      string       `json:"tunnel_id"`
+	UserID        string       `json:"user_id"` // owner, for scoping events
+	Subdomain     string       `json:"subdomain"`
+	Hostnames     []string     `json:"hostnames"` // verified custom domains, routed by exact match
+	MCLocalPort   int          `json:"mc_local_port"`
+	HTTPLocalPort *int         `json:"http_local_port"` // nil = disabled
+	HTTPCache     bool         `json:"http_cache"`      // cache cacheable web map responses at the edge
+	UDPLocalPort  int          `json:"udp_local_port"`
+	UDPPublicPort *int         `json:"udp_public_port"` // nil = no dedicated UDP port
+	TCPLocalPort  *int         `json:"tcp_local_port"`  // raw TCP channel, nil = disabled
+	TCPPublicPort *int         `json:"tcp_public_port"` // dedicated public TCP port for the raw TCP channel
+	UDPMappings   []UDPMapping `json:"udp_mappings"`    // additional UDP services (Geyser, Valheim, ...)
+	Limits        TunnelLimits `json:"limits"`          // bandwidth limits (adjustable later with SetTunnelLimits)
+}
+
+// UDPMapping is an additional public UDP port forwarded to a local port.
+type UDPMapping struct {
+	PublicPort int `json:"public_port"`
+	LocalPort  int `json:"local_port"`
+}
+
+// udpPorts returns every enabled UDP mapping of the tunnel, voice chat first.
+func (reg *TunnelRegistration) udpPorts() []UDPMapping {
+	var ports []UDPMapping
+	if reg.UDPPublicPort != nil {
+		ports = append(ports, UDPMapping{PublicPort: *reg.UDPPublicPort, LocalPort: reg.UDPLocalPort})
+	}
+	return append(ports, reg.UDPMappings...)
 }
 
 // Server is the core tunnel server.
 // Minecraft TCP is proxied via startMCProxy (shared port, routed by MC handshake).
 // HTTP is proxied via startHTTPProxy (shared port, routed by Host header).
-// Voice chat UDP gets one dedicated public port per tunnel from the pool.
+// UDP (voice chat and extra mappings) gets dedicated public ports from the pool.
+// Raw TCP (RCON, SFTP, other games) gets one dedicated public TCP port per tunnel.
 type Server struct {
 	jwtSecret     []byte
 	tunnelPort    int
@@ -63,52 +144,165 @@ type Server struct {
 	minPort       int
 	maxPort       int
 
+	httpCacheMaxBytes int64
+	accessLogSize     int
+	accessLogFile     string
+	accessLogSink     *accessLogSink
+
 	// tunnelID → *ClientConn (currently connected clients)
 	clients sync.Map
 
+	// tunnelID → TunnelRegistration (registered/active tunnels)
+	registrations sync.Map
+
+	// Serializes changes to registrations and subdomainMap so a rename cannot
+	// race a start/stop and leave a stale route behind.
+	routesMu sync.Mutex
+
 	// subdomain → tunnelID (registered/active tunnels)
 	subdomainMap sync.Map
 
+	// custom hostname → tunnelID (verified custom domains of active tunnels)
+	hostMap sync.Map
+
+	// subdomain or custom hostname → *movedTunnel (tunnels moved to another region)
+	moved sync.Map
+
 	// tunnelID → mc_local_port
 	tunnelMCPort sync.Map
 
 	// tunnelID → http_local_port (only set when HTTP is enabled)
 	tunnelHTTPPort sync.Map
 
-	// UDP voice chat: public_port → tunnelID
+	// tunnelID → *httpCache (only set when HTTP caching is enabled)
+	httpCaches sync.Map
+
+	// tunnelID → *tunnelStats (live counters)
+	tunnelStats sync.Map
+
+	// tunnelID → *accessLogRing (recent HTTP requests)
+	accessLogs sync.Map
+
+	// tunnelID → *tunnelUsage (traffic not yet drained for persistence)
+	tunnelUsage sync.Map
+
+	// tunnelID → *tunnelLimiter (bandwidth limits and suspension)
+	limiters sync.Map
+
+	// connID → *liveConn (open relays, for the connection inspector)
+	liveConns sync.Map
+
+	// Server-wide counters exported as metrics (see metrics.go)
+	usageTotals       [len(usageChannels)]channelTotals
+	handshakeFailures atomic.Int64
+	pairingLatency    *metrics.Histogram
+	pairingTimeouts   atomic.Int64
+	metricsPerTunnel  bool
+
+	events *events.Bus
+
+	// Closed by Drain (see drain.go)
+	draining  chan struct{}
+	drainOnce sync.Once
+	handedOff atomic.Bool
+
+	// Shared routing state and peer link (nil routes = single node)
+	routes    RouteStore
+	peerAddr  string
+	nodeAddr  string
+	peerToken string
+
+	listen       func(network, addr string) (net.Listener, error)
+	listenPacket func(network, addr string) (net.PacketConn, error)
+
+	// UDP: public_port → tunnelID
 	portOwners sync.Map
 
-	// UDP voice chat: public_port → local_port
+	// UDP: public_port → local_port
 	portLocalMap sync.Map
 
-	// UDP voice chat: public_port → net.PacketConn (active listeners)
+	// UDP: public_port → net.PacketConn (active listeners)
 	udpListeners sync.Map
 
-	// UDP voice chat: playerAddr → *udpPlayerEntry (persistent, for routing UDP_REPLY back to player)
-	udpPlayerMap sync.Map
-}
+	// UDP: public_port → *udpPeerLink (datagrams relayed to the owner node)
+	udpPeers sync.Map
+
+	// Raw TCP: public_port → net.Listener (active listeners)
+	tcpListeners sync.Map
 
-type udpPlayerEntry struct {
-	pc   net.PacketConn
-	addr net.Addr
+	// UDP sessions (player address ↔ session ID, for routing UDP_REPLY back to the player)
+	udpSessions *udpSessionTable
+
+	log     *slog.Logger // control channel
+	mcLog   *slog.Logger
+	httpLog *slog.Logger
+	tcpLog  *slog.Logger
+	udpLog  *slog.Logger
 }
 
-func NewServer(jwtSecret []byte, tunnelPort, mcProxyPort, httpProxyPort int, domain string, minPort, maxPort int) *Server {
+func NewServer(cfg Config) *Server {
+	if cfg.AccessLogSize <= 0 {
+		cfg.AccessLogSize = defaultAccessLogSize
+	}
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	if cfg.Listen == nil {
+		cfg.Listen = net.Listen
+	}
+	if cfg.ListenPacket == nil {
+		cfg.ListenPacket = net.ListenPacket
+	}
 	return &Server{
-		jwtSecret:     jwtSecret,
-		tunnelPort:    tunnelPort,
-		mcProxyPort:   mcProxyPort,
-		httpProxyPort: httpProxyPort,
-		domain:        domain,
-		minPort:       minPort,
-		maxPort:       maxPort,
+		jwtSecret:         cfg.JWTSecret,
+		tunnelPort:        cfg.TunnelPort,
+		mcProxyPort:       cfg.MCProxyPort,
+		httpProxyPort:     cfg.HTTPProxyPort,
+		domain:            cfg.Domain,
+		minPort:           cfg.MinPort,
+		maxPort:           cfg.MaxPort,
+		httpCacheMaxBytes: cfg.HTTPCacheMaxBytes,
+		accessLogSize:     cfg.AccessLogSize,
+		accessLogFile:     cfg.AccessLogFile,
+		udpSessions:       newUDPSessionTable(cfg.UDPSessionIdle, cfg.MaxUDPSessions),
+		pairingLatency:    metrics.NewHistogram(pairingBuckets),
+		metricsPerTunnel:  cfg.MetricsPerTunnel,
+		events:            cfg.Events,
+		draining:          make(chan struct{}),
+		routes:            cfg.Routes,
+		peerAddr:          cfg.PeerAddr,
+		nodeAddr:          cfg.NodeAddr,
+		peerToken:         cfg.PeerToken,
+		listen:            cfg.Listen,
+		listenPacket:      cfg.ListenPacket,
+		log:               logger.With(logging.Subsystem, "tunnel"),
+		mcLog:             logger.With(logging.Subsystem, "mcproxy"),
+		httpLog:           logger.With(logging.Subsystem, "httpproxy"),
+		tcpLog:            logger.With(logging.Subsystem, "tcp"),
+		udpLog:            logger.With(logging.Subsystem, "udp"),
 	}
 }
 
 // RegisterTunnel activates a tunnel: registers subdomain routing and starts UDP listener if needed.
 // Called when a tunnel is started via the API (or restored on server startup).
 func (s *Server) RegisterTunnel(reg TunnelRegistration) {
+	s.SetTunnelLimits(reg.TunnelID, reg.Limits)
+	s.routesMu.Lock()
+	if prevRaw, ok := s.registrations.Swap(reg.TunnelID, reg); ok {
+		prev := prevRaw.(TunnelRegistration)
+		s.subdomainMap.CompareAndDelete(prev.Subdomain, reg.TunnelID)
+		for _, h := range prev.Hostnames {
+			s.hostMap.CompareAndDelete(h, reg.TunnelID)
+		}
+	}
 	s.subdomainMap.Store(reg.Subdomain, reg.TunnelID)
+	for _, h := range reg.Hostnames {
+		s.hostMap.Store(h, reg.TunnelID)
+	}
+	s.routesMu.Unlock()
+	s.clearMoved(reg)
+	s.keepAccessLog(reg.TunnelID, false)
 	s.tunnelMCPort.Store(reg.TunnelID, reg.MCLocalPort)
 
 	if reg.HTTPLocalPort != nil {
@@ -117,35 +311,117 @@ func (s *Server) RegisterTunnel(reg TunnelRegistration) {
 		s.tunnelHTTPPort.Delete(reg.TunnelID)
 	}
 
-	if reg.UDPPublicPort != nil {
+	if reg.HTTPLocalPort != nil && reg.HTTPCache && s.httpCacheMaxBytes > 0 {
+		if _, exists := s.httpCaches.Load(reg.TunnelID); !exists {
+			s.httpCaches.Store(reg.TunnelID, newHTTPCache(s.httpCacheMaxBytes))
+		}
+	} else {
+		s.httpCaches.Delete(reg.TunnelID)
+	}
+
+	for _, m := range reg.udpPorts() {
 		// Only start listener if not already running
-		if _, running := s.udpListeners.Load(*reg.UDPPublicPort); !running {
-			s.portOwners.Store(*reg.UDPPublicPort, reg.TunnelID)
-			s.portLocalMap.Store(*reg.UDPPublicPort, reg.UDPLocalPort)
-			go s.startUDPPortListener(*reg.UDPPublicPort, reg.TunnelID, reg.UDPLocalPort)
+		if _, running := s.udpListeners.Load(m.PublicPort); !running {
+			s.portOwners.Store(m.PublicPort, reg.TunnelID)
+			s.portLocalMap.Store(m.PublicPort, m.LocalPort)
+			go s.startUDPPortListener(m.PublicPort, reg.TunnelID, m.LocalPort)
+		}
+	}
+
+	if reg.TCPLocalPort != nil && reg.TCPPublicPort != nil && !s.Draining() {
+		if _, running := s.tcpListeners.Load(*reg.TCPPublicPort); !running {
+			go s.startTCPPortListener(*reg.TCPPublicPort, reg.TunnelID, *reg.TCPLocalPort)
 		}
 	}
+
+	s.publishFor(reg, events.TunnelStarted, nil)
 }
 
-// UnregisterTunnel deactivates a tunnel: removes subdomain routing and stops UDP listener.
+// UnregisterTunnel deactivates a tunnel: removes subdomain routing and stops UDP/TCP listeners.
 // Called when a tunnel is stopped via the API.
-func (s *Server) UnregisterTunnel(tunnelID, subdomain string, udpPublicPort *int) {
-	s.subdomainMap.Delete(subdomain)
+func (s *Server) UnregisterTunnel(tunnelID string) {
+	regRaw, ok := s.registrations.Load(tunnelID)
+	if !ok {
+		return
+	}
+	reg := regRaw.(TunnelRegistration)
+
+	// Disconnect client if still connected
+	if c, ok := s.clients.LoadAndDelete(tunnelID); ok {
+		c.(*ClientConn).close()
+		s.publishFor(reg, events.ClientDisconnected, nil)
+	}
+	if s.removeTunnel(tunnelID) {
+		s.publishFor(reg, events.TunnelStopped, nil)
+	}
+}
+
+// removeTunnel drops a tunnel's routing, listeners and live state. It
+// reports false if the tunnel was not registered.
+func (s *Server) removeTunnel(tunnelID string) bool {
+	s.routesMu.Lock()
+	regRaw, ok := s.registrations.LoadAndDelete(tunnelID)
+	if !ok {
+		s.routesMu.Unlock()
+		return false
+	}
+	reg := regRaw.(TunnelRegistration)
+	s.subdomainMap.CompareAndDelete(reg.Subdomain, tunnelID)
+	for _, h := range reg.Hostnames {
+		s.hostMap.CompareAndDelete(h, tunnelID)
+	}
+	s.routesMu.Unlock()
+
 	s.tunnelMCPort.Delete(tunnelID)
 	s.tunnelHTTPPort.Delete(tunnelID)
-
-	if udpPublicPort != nil {
-		s.portOwners.Delete(*udpPublicPort)
-		s.portLocalMap.Delete(*udpPublicPort)
-		if pc, ok := s.udpListeners.LoadAndDelete(*udpPublicPort); ok {
+	s.httpCaches.Delete(tunnelID)
+	s.tunnelStats.Delete(tunnelID)
+	s.keepAccessLog(tunnelID, true)
+	s.limiters.Delete(tunnelID)
+
+	s.udpSessions.removeTunnel(tunnelID)
+	for _, m := range reg.udpPorts() {
+		s.portOwners.Delete(m.PublicPort)
+		s.portLocalMap.Delete(m.PublicPort)
+		s.closeUDPPeerLink(m.PublicPort)
+		if pc, ok := s.udpListeners.LoadAndDelete(m.PublicPort); ok {
 			pc.(net.PacketConn).Close()
 		}
 	}
 
-	// Disconnect client if still connected
-	if c, ok := s.clients.LoadAndDelete(tunnelID); ok {
-		c.(*ClientConn).close()
+	if reg.TCPPublicPort != nil {
+		if l, ok := s.tcpListeners.LoadAndDelete(*reg.TCPPublicPort); ok {
+			l.(net.Listener).Close()
+		}
 	}
+	return true
+}
+
+// RenameTunnel moves an active tunnel's routing to a new subdomain. The new
+// name starts routing before the old one stops, so there is no moment where
+// neither resolves; connections already proxied are not affected. It does
+// nothing if the tunnel is not registered.
+func (s *Server) RenameTunnel(tunnelID, subdomain string) {
+	s.routesMu.Lock()
+	regRaw, ok := s.registrations.Load(tunnelID)
+	if !ok {
+		s.routesMu.Unlock()
+		return
+	}
+	reg := regRaw.(TunnelRegistration)
+	previous := reg.Subdomain
+	if previous == subdomain {
+		s.routesMu.Unlock()
+		return
+	}
+	reg.Subdomain = subdomain
+	s.registrations.Store(tunnelID, reg)
+	s.subdomainMap.Store(subdomain, tunnelID)
+	s.subdomainMap.CompareAndDelete(previous, tunnelID)
+	s.routesMu.Unlock()
+
+	s.log.Info("Tunnel renamed", "tunnel_id", tunnelID, "subdomain", subdomain, "previous", previous)
+	s.publishFor(reg, events.TunnelRenamed, map[string]any{"subdomain": subdomain, "previous": previous})
 }
 
 // IsClientConnected returns true if a VoidLink desktop client is connected for this tunnel.
@@ -154,6 +430,26 @@ func (s *Server) IsClientConnected(tunnelID string) bool {
 	return ok
 }
 
+// HTTPCacheStats returns the web map cache statistics of a tunnel.
+// ok is false when caching is not enabled for the tunnel.
+func (s *Server) HTTPCacheStats(tunnelID string) (stats HTTPCacheStats, ok bool) {
+	cRaw, ok := s.httpCaches.Load(tunnelID)
+	if !ok {
+		return HTTPCacheStats{}, false
+	}
+	return cRaw.(*httpCache).stats(), true
+}
+
+// PurgeHTTPCache drops cached responses of a tunnel whose path starts with prefix
+// (an empty prefix drops everything). Returns the number of entries removed.
+func (s *Server) PurgeHTTPCache(tunnelID, prefix string) int {
+	cRaw, ok := s.httpCaches.Load(tunnelID)
+	if !ok {
+		return 0
+	}
+	return cRaw.(*httpCache).purge(prefix)
+}
+
 // IsUDPPortInUse returns true if the given public port is already allocated.
 func (s *Server) IsUDPPortInUse(port int) bool {
 	_, ok := s.portOwners.Load(port)
@@ -162,17 +458,22 @@ func (s *Server) IsUDPPortInUse(port int) bool {
 
 // Run starts the control server and the shared MC/HTTP proxies.
 func (s *Server) Run(ctx context.Context) error {
-	listener, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", s.tunnelPort))
+	if s.accessLogFile != "" {
+		sink, err := openAccessLogSink(s.accessLogFile, s.httpLog)
+		if err != nil {
+			return err
+		}
+		s.accessLogSink = sink
+	}
+
+	listener, err := s.listen("tcp", fmt.Sprintf("0.0.0.0:%d", s.tunnelPort))
 	if err != nil {
 		return fmt.Errorf("failed to listen on tunnel port %d: %w", s.tunnelPort, err)
 	}
 
-	log.Printf("[Tunnel] Control server running on :%d", s.tunnelPort)
+	s.log.Info("Control server running", "port", s.tunnelPort)
 
-	go func() {
-		<-ctx.Done()
-		listener.Close()
-	}()
+	s.closeOnDrain(ctx, listener)
 
 	go func() {
 		for {
@@ -181,8 +482,10 @@ func (s *Server) Run(ctx context.Context) error {
 				select {
 				case <-ctx.Done():
 					return
+				case <-s.draining:
+					return
 				default:
-					log.Printf("[Tunnel] Accept error: %v", err)
+					s.log.Warn("Accept error", "error", err)
 					time.Sleep(100 * time.Millisecond)
 					continue
 				}
@@ -191,10 +494,16 @@ func (s *Server) Run(ctx context.Context) error {
 		}
 	}()
 
+	go s.udpSessionJanitor(ctx)
+	go s.accessLogJanitor(ctx)
+
 	// Start shared TCP proxies
 	s.startMCProxy(ctx)
 	s.startHTTPProxy(ctx)
 
+	if s.routes != nil {
+		return s.startPeerListener(ctx)
+	}
 	return nil
 }
 
@@ -225,7 +534,7 @@ func (s *Server) handleNewConn(conn net.Conn) {
 			conn.Close()
 			return
 		}
-		s.handleControlConnFromReader(conn, bufio.NewReaderSize(reader, 4096), parts[1], parts[2])
+		s.handleControlConnFromReader(conn, bufio.NewReaderSize(reader, 4096), parts[1], parts[2], parseOptions(parts[3:]))
 	case "DATA":
 		if len(parts) < 2 {
 			conn.Close()
@@ -240,50 +549,60 @@ func (s *Server) handleNewConn(conn net.Conn) {
 	}
 }
 
-func (s *Server) handleControlConnFromReader(conn net.Conn, reader *bufio.Reader, tokenStr, tunnelID string) {
+func (s *Server) handleControlConnFromReader(conn net.Conn, reader *bufio.Reader, tokenStr, tunnelID string, opts map[string]string) {
+	if s.Draining() {
+		conn.Write([]byte("ERROR draining\n"))
+		conn.Close()
+		return
+	}
 	if err := s.validateJWT(tokenStr); err != nil {
 		conn.Write([]byte("ERROR unauthorized\n"))
 		conn.Close()
-		log.Printf("[Tunnel] Auth failed for tunnel %s: %v", tunnelID, err)
+		s.log.Warn("Auth failed", "tunnel_id", tunnelID, "remote", conn.RemoteAddr().String(), "error", err)
 		return
 	}
 
-	// Check that this tunnel is registered (subdomain must be in the map)
-	isRegistered := false
-	s.subdomainMap.Range(func(_, v any) bool {
-		if v.(string) == tunnelID {
-			isRegistered = true
-			return false
-		}
-		return true
-	})
-	if !isRegistered {
+	// Check that this tunnel is registered
+	if _, isRegistered := s.registrations.Load(tunnelID); !isRegistered {
 		conn.Write([]byte("ERROR tunnel not active\n"))
 		conn.Close()
-		log.Printf("[Tunnel] Client attempted connection for unregistered tunnel %s", tunnelID)
+		s.log.Info("Client attempted connection for unregistered tunnel", "tunnel_id", tunnelID)
 		return
 	}
 
-	client := &ClientConn{
-		tunnelID: tunnelID,
-		conn:     conn,
-		reader:   reader,
-		writer:   bufio.NewWriter(conn),
-	}
+	client := newClientConn(tunnelID, conn, reader, s.stats(tunnelID), s.log)
+	client.hopCompress = opts["compress"] == hopCompression
+	client.version = sanitizeVersion(opts["version"])
 
 	if old, ok := s.clients.LoadAndDelete(tunnelID); ok {
 		old.(*ClientConn).close()
 	}
 	s.clients.Store(tunnelID, client)
+	s.claimRoute(client)
 
-	conn.Write([]byte("OK\n"))
-	log.Printf("[Tunnel] Client connected for tunnel %s", tunnelID)
+	if client.hopCompress {
+		conn.Write([]byte("OK compress=" + hopCompression + "\n"))
+	} else {
+		conn.Write([]byte("OK\n"))
+	}
+	client.log.Info("Client connected", "remote", conn.RemoteAddr().String(), "version", client.version)
+	s.publish(events.ClientConnected, tunnelID, map[string]any{
+		"remote":  conn.RemoteAddr().String(),
+		"version": client.version,
+	})
 
+	go client.writeLoop()
 	go s.pingLoop(client)
 	s.readControlLoop(client)
 
-	s.clients.CompareAndDelete(tunnelID, client)
-	log.Printf("[Tunnel] Client disconnected for tunnel %s", tunnelID)
+	client.close()
+	// A client replaced by a reconnect, or removed by UnregisterTunnel, is
+	// no longer current and must not announce a disconnect
+	if s.clients.CompareAndDelete(tunnelID, client) {
+		s.releaseRoute(tunnelID)
+		s.publish(events.ClientDisconnected, tunnelID, nil)
+	}
+	client.log.Info("Client disconnected")
 }
 
 func (s *Server) readControlLoop(client *ClientConn) {
@@ -301,29 +620,12 @@ func (s *Server) readControlLoop(client *ClientConn) {
 		parts := strings.Fields(line)
 		switch parts[0] {
 		case "PONG":
-			// keepalive received
+			client.pong(parts[1:])
 		case "UDP_REPLY":
 			if len(parts) < 3 {
 				continue
 			}
-			connID := parts[1]
-			data, err := hex.DecodeString(parts[2])
-			if err != nil {
-				log.Printf("[UDP] DROP: invalid hex in UDP_REPLY for conn %s: %v", connID, err)
-				continue
-			}
-			// Route reply back to player using persistent session map
-			if entryRaw, ok := s.udpPlayerMap.Load(connID); ok {
-				entry := entryRaw.(*udpPlayerEntry)
-				n, werr := entry.pc.WriteTo(data, entry.addr)
-				if werr != nil {
-					log.Printf("[UDP] DROP: failed to write reply to player %s: %v", connID, werr)
-				} else {
-					log.Printf("[UDP] → player %s: %d bytes (voice reply)", connID, n)
-				}
-			} else {
-				log.Printf("[UDP] DROP: no player entry for connID=%s (expired?)", connID)
-			}
+			s.handleUDPReply(client, parts[1], parts[2])
 		}
 	}
 }
@@ -331,62 +633,68 @@ func (s *Server) readControlLoop(client *ClientConn) {
 func (s *Server) pingLoop(client *ClientConn) {
 	ticker := time.NewTicker(pingInterval)
 	defer ticker.Stop()
-	for range ticker.C {
-		if err := client.send("PING"); err != nil {
+	// The first PING goes out right away so the RTT is known shortly after connecting
+	for {
+		if err := client.ping(); err != nil {
 			return
 		}
-	}
-}
-
-// ---- UDP Port Listener (voice chat) ----
-
-func (s *Server) startUDPPortListener(publicPort int, tunnelID string, localPort int) {
-	addr := fmt.Sprintf("0.0.0.0:%d", publicPort)
-	pc, err := net.ListenPacket("udp", addr)
-	if err != nil {
-		log.Printf("[UDP] Failed to listen on :%d: %v", publicPort, err)
-		return
-	}
-	s.udpListeners.Store(publicPort, pc)
-	log.Printf("[UDP] Listening on :%d → tunnel %s → local port %d", publicPort, tunnelID, localPort)
-
-	buf := make([]byte, 65535)
-	for {
-		n, remoteAddr, err := pc.ReadFrom(buf)
-		if err != nil {
-			log.Printf("[UDP] Listener on :%d closed: %v", publicPort, err)
+		select {
+		case <-ticker.C:
+		case <-client.done:
 			return
 		}
-		log.Printf("[UDP] ← player %s sent %d bytes (pub:%d)", remoteAddr, n, publicPort)
-		data := make([]byte, n)
-		copy(data, buf[:n])
-		go s.handleUDPPacket(pc, remoteAddr, data, tunnelID, localPort)
 	}
 }
 
-func (s *Server) handleUDPPacket(pc net.PacketConn, addr net.Addr, data []byte, tunnelID string, localPort int) {
-	clientRaw, ok := s.clients.Load(tunnelID)
-	if !ok {
-		log.Printf("[UDP] DROP: no VoidLink client connected for tunnel %s", tunnelID)
-		return
-	}
-	client := clientRaw.(*ClientConn)
-
-	connID := addr.String()
-
-	// Register/refresh persistent player entry so UDP_REPLY can find the right PacketConn+addr
-	s.udpPlayerMap.Store(connID, &udpPlayerEntry{pc: pc, addr: addr})
+// ---- Data Connection Handler ----
 
-	hexData := hex.EncodeToString(data)
-	if err := client.send(fmt.Sprintf("UDP_PKT %s %d %s", connID, localPort, hexData)); err != nil {
-		log.Printf("[UDP] DROP: failed to send UDP_PKT to client (tunnel %s): %v", tunnelID, err)
-	} else {
-		log.Printf("[UDP] → client: UDP_PKT connID=%s localPort=%d len=%d", connID, localPort, len(data))
+// openDataConn asks the client to open a new data channel to localPort and waits
+// until the client dials back with the matching DATA message. compressible marks
+// channels worth deflating when the client negotiated hop compression. The
+// steps are recorded as events on the span in ctx.
+func (s *Server) openDataConn(ctx context.Context, client *ClientConn, localPort int, compressible bool) (net.Conn, error) {
+	span := tracing.SpanFromContext(ctx)
+	connID := generateID()
+	dataCh := make(chan net.Conn, 1)
+	client.pendingTCP.Store(connID, dataCh)
+	defer client.pendingTCP.Delete(connID)
+
+	deflate := compressible && client.hopCompress
+	msg := fmt.Sprintf("OPEN %s %d", connID, localPort)
+	if deflate {
+		msg += " " + hopCompression
+	}
+	start := time.Now()
+	if err := client.send(msg); err != nil {
+		client.log.Warn("Failed to send OPEN", "conn_id", connID, "error", err)
+		err = fmt.Errorf("failed to send OPEN: %w", err)
+		span.RecordError(err, tracing.String("conn_id", connID))
+		return nil, err
+	}
+	span.AddEvent("open.sent", tracing.String("conn_id", connID), tracing.Int("local_port", localPort))
+
+	select {
+	case dataConn := <-dataCh:
+		waited := time.Since(start)
+		s.pairingLatency.Observe(waited.Seconds())
+		span.AddEvent("data.paired",
+			tracing.String("conn_id", connID),
+			tracing.Float("wait_ms", float64(waited.Microseconds())/1000),
+			tracing.Bool("deflate", deflate),
+		)
+		if deflate {
+			return newDeflateConn(dataConn, s.stats(client.tunnelID), s.usage(client.tunnelID, ChannelHTTP)), nil
+		}
+		return dataConn, nil
+	case <-time.After(dataConnTimeout):
+		s.pairingTimeouts.Add(1)
+		client.log.Warn("Timed out waiting for data channel", "conn_id", connID, "local_port", localPort)
+		err := fmt.Errorf("timeout waiting for data conn %s (tunnel %s)", connID, client.tunnelID)
+		span.RecordError(err, tracing.String("conn_id", connID))
+		return nil, err
 	}
 }
 
-// ---- Data Connection Handler ----
-
 func (s *Server) handleDataConn(conn net.Conn, connID string) {
 	var found *ClientConn
 	s.clients.Range(func(_, v any) bool {
@@ -399,7 +707,7 @@ func (s *Server) handleDataConn(conn net.Conn, connID string) {
 	})
 
 	if found == nil {
-		log.Printf("[Tunnel] No pending connection for DATA %s", connID)
+		s.log.Debug("No pending connection for DATA", "conn_id", connID)
 		conn.Close()
 		return
 	}
@@ -431,31 +739,6 @@ func (s *Server) validateJWT(tokenStr string) error {
 	return nil
 }
 
-// ---- ClientConn ----
-
-type ClientConn struct {
-	tunnelID   string
-	conn       net.Conn
-	reader     *bufio.Reader
-	writer     *bufio.Writer
-	mu         sync.Mutex
-	pendingTCP sync.Map // connID → chan net.Conn
-}
-
-func (c *ClientConn) send(msg string) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	_, err := c.writer.WriteString(msg + "\n")
-	if err != nil {
-		return err
-	}
-	return c.writer.Flush()
-}
-
-func (c *ClientConn) close() {
-	c.conn.Close()
-}
-
 // ---- Helpers ----
 
 func relay(a, b net.Conn) {
@@ -472,8 +755,8 @@ func relay(a, b net.Conn) {
 			}
 		}
 		// Half-close: signal the other direction that src is done
-		if tc, ok := dst.(*net.TCPConn); ok {
-			tc.CloseWrite()
+		if hc, ok := dst.(interface{ CloseWrite() error }); ok {
+			hc.CloseWrite()
 		}
 		done <- struct{}{}
 	}
@@ -486,6 +769,35 @@ func relay(a, b net.Conn) {
 	b.Close()
 }
 
+// parseOptions parses the optional key=value fields of a control message.
+func parseOptions(fields []string) map[string]string {
+	opts := make(map[string]string, len(fields))
+	for _, f := range fields {
+		if k, v, ok := strings.Cut(f, "="); ok {
+			opts[k] = v
+		}
+	}
+	return opts
+}
+
+// bufferedConn is a net.Conn whose reads are served from a bufio.Reader first,
+// so bytes already buffered while parsing a protocol are not lost when relaying.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
+
+func (b *bufferedConn) CloseWrite() error {
+	if hc, ok := b.Conn.(interface{ CloseWrite() error }); ok {
+		return hc.CloseWrite()
+	}
+	return nil
+}
+
 func generateID() string {
 	b := make([]byte, 8)
 	ts := time.Now().UnixNano()
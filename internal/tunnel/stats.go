@@ -0,0 +1,112 @@
+package tunnel
+
+import "sync/atomic"
+
+// tunnelStats holds live per-tunnel counters. Counters are reset when the
+// tunnel is unregistered.
+type tunnelStats struct {
+	// Edge compression (proxy → browser)
+	edgeCompressed  atomic.Int64 // responses compressed by the proxy
+	edgeBytesOrig   atomic.Int64 // body bytes before compression
+	edgeBytesSent   atomic.Int64 // body bytes after compression
+	hopBytesPayload atomic.Int64 // data channel bytes before hop compression
+	hopBytesWire    atomic.Int64 // data channel bytes actually sent over the tunnel
+
+	// UDP sessions
+	udpSessionsCreated  atomic.Int64
+	udpSessionsExpired  atomic.Int64
+	udpSessionsRejected atomic.Int64 // packets dropped because the session cap was reached
+	udpPacketsIn        atomic.Int64 // player → client
+	udpPacketsOut       atomic.Int64 // client → player
+	udpPacketsDropped   atomic.Int64 // queue full, no client, expired session or write error
+
+	// Client control channel
+	clientDroppedUDP      atomic.Int64 // UDP_PKT batches dropped on a full send queue
+	clientDroppedBulk     atomic.Int64
+	clientSlowDisconnects atomic.Int64
+}
+
+// TunnelStats is a snapshot of a tunnel's live statistics.
+type TunnelStats struct {
+	Compression CompressionStats `json:"compression"`
+	UDP         UDPSessionStats  `json:"udp"`
+	ClientQueue ClientQueueStats `json:"client_queue"`
+}
+
+// UDPSessionStats reports UDP (voice chat and extra mappings) sessions.
+type UDPSessionStats struct {
+	ActiveSessions int         `json:"active_sessions"`
+	ActiveByPort   map[int]int `json:"active_by_port"` // public port → active sessions
+	Created        int64       `json:"sessions_created"`
+	Expired        int64       `json:"sessions_expired"`
+	Rejected       int64       `json:"packets_rejected"`
+	PacketsIn      int64       `json:"packets_in"`
+	PacketsOut     int64       `json:"packets_out"`
+	PacketsDropped int64       `json:"packets_dropped"`
+}
+
+// CompressionStats reports bandwidth saved by compression.
+// Edge savings reduce the server's egress to browsers; hop savings reduce the
+// owner's home upload through the tunnel.
+type CompressionStats struct {
+	EdgeResponses     int64 `json:"edge_responses"`
+	EdgeBytesOriginal int64 `json:"edge_bytes_original"`
+	EdgeBytesSent     int64 `json:"edge_bytes_sent"`
+	EdgeBytesSaved    int64 `json:"edge_bytes_saved"`
+	HopBytesPayload   int64 `json:"hop_bytes_payload"`
+	HopBytesWire      int64 `json:"hop_bytes_wire"`
+	HopBytesSaved     int64 `json:"hop_bytes_saved"`
+}
+
+func (st *tunnelStats) snapshot() TunnelStats {
+	c := CompressionStats{
+		EdgeResponses:     st.edgeCompressed.Load(),
+		EdgeBytesOriginal: st.edgeBytesOrig.Load(),
+		EdgeBytesSent:     st.edgeBytesSent.Load(),
+		HopBytesPayload:   st.hopBytesPayload.Load(),
+		HopBytesWire:      st.hopBytesWire.Load(),
+	}
+	c.EdgeBytesSaved = c.EdgeBytesOriginal - c.EdgeBytesSent
+	c.HopBytesSaved = c.HopBytesPayload - c.HopBytesWire
+	return TunnelStats{
+		Compression: c,
+		UDP: UDPSessionStats{
+			Created:        st.udpSessionsCreated.Load(),
+			Expired:        st.udpSessionsExpired.Load(),
+			Rejected:       st.udpSessionsRejected.Load(),
+			PacketsIn:      st.udpPacketsIn.Load(),
+			PacketsOut:     st.udpPacketsOut.Load(),
+			PacketsDropped: st.udpPacketsDropped.Load(),
+		},
+		ClientQueue: ClientQueueStats{
+			DroppedUDP:      st.clientDroppedUDP.Load(),
+			DroppedBulk:     st.clientDroppedBulk.Load(),
+			SlowDisconnects: st.clientSlowDisconnects.Load(),
+		},
+	}
+}
+
+// stats returns the live counters of a tunnel, creating them on first use.
+func (s *Server) stats(tunnelID string) *tunnelStats {
+	if st, ok := s.tunnelStats.Load(tunnelID); ok {
+		return st.(*tunnelStats)
+	}
+	st, _ := s.tunnelStats.LoadOrStore(tunnelID, &tunnelStats{})
+	return st.(*tunnelStats)
+}
+
+// TunnelStats returns a snapshot of the live statistics of a tunnel.
+func (s *Server) TunnelStats(tunnelID string) TunnelStats {
+	var snap TunnelStats
+	if st, ok := s.tunnelStats.Load(tunnelID); ok {
+		snap = st.(*tunnelStats).snapshot()
+	}
+	snap.UDP.ActiveSessions, snap.UDP.ActiveByPort = s.udpSessions.counts(tunnelID)
+	if clientRaw, ok := s.clients.Load(tunnelID); ok {
+		client := clientRaw.(*ClientConn)
+		snap.ClientQueue.ControlDepth = len(client.controlQ)
+		snap.ClientQueue.UDPDepth = len(client.udpQ)
+		snap.ClientQueue.BulkDepth = len(client.bulkQ)
+	}
+	return snap
+}
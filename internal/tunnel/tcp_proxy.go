@@ -0,0 +1,82 @@
+package tunnel
+
+// Raw TCP proxy for services without a hostname in their protocol
+// (RCON, SFTP, Terraria, ...). Each tunnel with a raw TCP channel gets a
+// dedicated public port from the TCP pool; every accepted connection is
+// relayed to the client's local port through a regular OPEN/DATA pair.
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"tunnel-api/internal/tracing"
+)
+
+func (s *Server) startTCPPortListener(publicPort int, tunnelID string, localPort int) {
+	addr := fmt.Sprintf("0.0.0.0:%d", publicPort)
+	l, err := s.listen("tcp", addr)
+	if err != nil {
+		s.tcpLog.Error("Failed to listen", "port", publicPort, "tunnel_id", tunnelID, "error", err)
+		return
+	}
+	if _, loaded := s.tcpListeners.LoadOrStore(publicPort, l); loaded {
+		l.Close()
+		return
+	}
+	s.tcpLog.Info("Listening", "port", publicPort, "tunnel_id", tunnelID, "local_port", localPort)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if cur, active := s.tcpListeners.Load(publicPort); !active || cur != l {
+				s.tcpLog.Info("Listener closed", "port", publicPort, "tunnel_id", tunnelID)
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+			continue
+		}
+		go s.handleTCPConnection(conn, tunnelID, localPort)
+	}
+}
+
+func (s *Server) handleTCPConnection(playerConn net.Conn, tunnelID string, localPort int) {
+	defer playerConn.Close()
+	ctx, span := startConnSpan("tcp.connection", playerConn,
+		tracing.String("tunnel_id", tunnelID),
+		tracing.Int("local_port", localPort),
+	)
+
+	if suspended, _ := s.suspended(tunnelID); suspended {
+		span.RecordError(errTunnelSuspended, tracing.String("stage", "limits"))
+		span.End()
+		return
+	}
+
+	clientRaw, ok := s.clients.Load(tunnelID)
+	if !ok {
+		if s.forward(ctx, ChannelTCP, tunnelID, playerConn, nil) {
+			span.End()
+			return
+		}
+		s.tcpLog.Debug("No client connected", "tunnel_id", tunnelID)
+		span.RecordError(errNoClient, tracing.String("stage", "lookup"))
+		span.End()
+		return
+	}
+
+	dataConn, err := s.openDataConn(ctx, clientRaw.(*ClientConn), localPort, false)
+	if err != nil {
+		span.End()
+		return
+	}
+	defer dataConn.Close()
+	player := s.countUsage(playerConn, tunnelID, ChannelTCP)
+	defer player.Close()
+	defer endConnSpan(span, player)
+	lc := s.trackConn(tunnelID, ChannelTCP, player, dataConn, "")
+	defer s.untrackConn(lc)
+	s.connectionOpened(lc)
+	relayTraced(span, player, dataConn)
+	s.connectionClosed(lc)
+}
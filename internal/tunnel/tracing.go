@@ -0,0 +1,40 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"tunnel-api/internal/tracing"
+)
+
+// Reasons a player connection is dropped before it is relayed, recorded on
+// its trace span.
+var (
+	errNoTunnel     = errors.New("no tunnel for subdomain")
+	errNoClient     = errors.New("tunnel client not connected")
+	errHTTPDisabled = errors.New("HTTP not enabled for tunnel")
+)
+
+// startConnSpan starts the span covering one proxied player connection.
+// Its lifecycle steps are added as events, and endConnSpan closes it.
+func startConnSpan(name string, conn net.Conn, attrs ...tracing.Attr) (context.Context, *tracing.Span) {
+	attrs = append(attrs, tracing.String("client.address", conn.RemoteAddr().String()))
+	return tracing.Start(context.Background(), name, tracing.KindServer, attrs...)
+}
+
+// endConnSpan records the bytes transferred by c and ends the span.
+func endConnSpan(span *tracing.Span, c *usageConn) {
+	span.SetAttrs(
+		tracing.Int64("bytes_in", c.in.Load()),
+		tracing.Int64("bytes_out", c.out.Load()),
+	)
+	span.End()
+}
+
+// relayTraced relays like relay, bracketed by relay.start and relay.end events.
+func relayTraced(span *tracing.Span, a, b net.Conn) {
+	span.AddEvent("relay.start")
+	relay(a, b)
+	span.AddEvent("relay.end")
+}
@@ -0,0 +1,116 @@
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"tunnel-api/internal/tracing"
+)
+
+// A status ping through the MC proxy is recorded as one mc.connection span
+// carrying the handshake, the pairing with the client and the relay.
+func TestMCConnectionSpan(t *testing.T) {
+	exp := tracing.NewInMemoryExporter()
+	tracer := tracing.NewTracer(tracing.Config{Exporter: exp, SampleRatio: 1})
+	tracing.SetDefault(tracer)
+	t.Cleanup(func() {
+		tracing.SetDefault(nil)
+		tracer.Shutdown(context.Background())
+	})
+
+	s := NewServer(Config{Domain: "example.com"})
+	s.subdomainMap.Store("play", "t1")
+	control, agent := net.Pipe()
+	client := newTestClientConn(control)
+	s.clients.Store("t1", client)
+	go client.writeLoop()
+	t.Cleanup(client.close)
+
+	// The client answers OPEN by dialing back; its local server echoes "pong"
+	go func() {
+		line, err := bufio.NewReader(agent).ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != "OPEN" {
+			t.Errorf("control message %q, want OPEN", line)
+			return
+		}
+		data, local := net.Pipe()
+		go s.handleDataConn(data, fields[1])
+		defer local.Close()
+		if _, _, err := parseMinecraftHandshake(local); err != nil {
+			t.Errorf("local server: %v", err)
+			return
+		}
+		local.Write([]byte("pong"))
+	}()
+
+	player, conn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.handleMCConnection(conn)
+	}()
+
+	payload := appendVarInt(nil, 767)
+	payload = appendMCString(payload, "play.example.com")
+	payload = binary.BigEndian.AppendUint16(payload, 25565)
+	payload = appendVarInt(payload, mcStateStatus)
+	var handshake bytes.Buffer
+	writeMCPacket(&handshake, 0x00, payload)
+	if _, err := player.Write(handshake.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	player.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply := make([]byte, len("pong"))
+	if _, err := io.ReadFull(player, reply); err != nil {
+		t.Fatalf("player read %q, %v; want pong", reply, err)
+	}
+	if string(reply) != "pong" {
+		t.Fatalf("player read %q, want pong", reply)
+	}
+	player.Close()
+	<-done
+
+	tracer.ForceFlush(context.Background())
+	spans := exp.Spans()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(spans))
+	}
+	span := spans[0]
+	if span.Name != "mc.connection" || span.Kind != tracing.KindServer || span.ParentID.IsValid() {
+		t.Fatalf("span %q kind %d parent %s, want root mc.connection server span", span.Name, span.Kind, span.ParentID)
+	}
+	for key, want := range map[string]any{
+		"client.address": "pipe",
+		"tunnel_id":      "t1",
+		"subdomain":      "play",
+		"bytes_in":       int64(handshake.Len()),
+		"bytes_out":      int64(len("pong")),
+	} {
+		if got := span.Attr(key); got != want {
+			t.Errorf("%s = %v, want %v", key, got, want)
+		}
+	}
+
+	var events []string
+	for _, e := range span.Events {
+		events = append(events, e.Name)
+	}
+	want := []string{"handshake.parsed", "tunnel.resolved", "open.sent", "data.paired", "relay.start", "relay.end"}
+	if strings.Join(events, ",") != strings.Join(want, ",") {
+		t.Errorf("events = %v, want %v", events, want)
+	}
+	if span.Status != tracing.StatusUnset {
+		t.Errorf("status = %d (%s), want unset", span.Status, span.StatusMessage)
+	}
+}
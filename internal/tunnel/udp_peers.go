@@ -0,0 +1,248 @@
+package tunnel
+
+// UDP over the peer link. Datagrams reaching a node that does not hold the
+// tunnel's client are relayed to the owner over one TCP link per public port:
+//
+//	FORWARD <peer_token> udp <tunnel_id> <public_port>
+//
+// followed by frames in both directions. The owner treats the datagrams as if
+// they had arrived on its own listener and frames the client's replies back,
+// which the receiving node sends from the public port the player used, so the
+// player never sees another source address.
+//
+// Frame: <length uint16> <player IP, 16 bytes> <player port uint16> <payload>,
+// length counting everything after itself. IPv4 players are sent IPv4-mapped.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	udpFrameHeader = 16 + 2
+	// udpPeerRetry is how long a node drops a port's datagrams after failing
+	// to reach the owner, instead of dialing for every packet.
+	udpPeerRetry = 2 * time.Second
+	// udpPeerWriteTimeout bounds a frame write to a stalled peer; the link is
+	// closed rather than stalling the port's forwarder or the client's
+	// control reader.
+	udpPeerWriteTimeout = time.Second
+)
+
+// udpWriter sends a datagram to a player: the public UDP socket, or the peer
+// link of the node the player's datagrams arrived on.
+type udpWriter interface {
+	WriteToUDPAddrPort(b []byte, addr netip.AddrPort) (int, error)
+}
+
+func appendUDPFrame(b []byte, addr netip.AddrPort, payload []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(udpFrameHeader+len(payload)))
+	ip := addr.Addr().As16()
+	b = append(b, ip[:]...)
+	b = binary.BigEndian.AppendUint16(b, addr.Port())
+	return append(b, payload...)
+}
+
+// readUDPFrame reads one frame into buf, which must hold maxUDPPacket bytes.
+// The payload aliases buf.
+func readUDPFrame(r io.Reader, buf []byte) (netip.AddrPort, []byte, error) {
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		return netip.AddrPort{}, nil, err
+	}
+	n := int(binary.BigEndian.Uint16(buf[:2]))
+	if n < udpFrameHeader {
+		return netip.AddrPort{}, nil, errors.New("short UDP frame")
+	}
+	frame := buf[:n]
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return netip.AddrPort{}, nil, err
+	}
+	ip := netip.AddrFrom16([16]byte(frame[:16])).Unmap()
+	addr := netip.AddrPortFrom(ip, binary.BigEndian.Uint16(frame[16:udpFrameHeader]))
+	return addr, frame[udpFrameHeader:], nil
+}
+
+// udpPeerLink relays one public port's datagrams to the tunnel's owner. It
+// is written by the port's forwarder only. A link with no conn records a
+// failed dial.
+type udpPeerLink struct {
+	node      string
+	conn      net.Conn
+	retryAt   time.Time
+	buf       []byte
+	closeOnce sync.Once
+}
+
+func (l *udpPeerLink) close() {
+	if l.conn != nil {
+		l.closeOnce.Do(func() { l.conn.Close() })
+	}
+}
+
+// udpPeerConn is the owner's end of a UDP peer link. Replies to the sessions
+// created from it are framed back to the forwarding node.
+type udpPeerConn struct {
+	conn net.Conn
+	mu   sync.Mutex
+	buf  []byte
+}
+
+func (c *udpPeerConn) WriteToUDPAddrPort(b []byte, addr netip.AddrPort) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.buf = appendUDPFrame(c.buf[:0], addr, b)
+	c.conn.SetWriteDeadline(time.Now().Add(udpPeerWriteTimeout))
+	if _, err := c.conn.Write(c.buf); err != nil {
+		// A partial frame desynchronizes the stream
+		c.conn.Close()
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// forwardUDP relays a datagram received on a public port to the node the
+// tunnel's client is attached to, reporting whether it was sent. Datagrams
+// that already came over the peer link are never relayed again.
+func (s *Server) forwardUDP(w udpWriter, tunnelID string, publicPort int, pkt *udpPacket) bool {
+	if s.routes == nil {
+		return false
+	}
+	if _, peered := w.(*udpPeerConn); peered {
+		return false
+	}
+	node, _, ok := s.routes.Owner(tunnelID)
+	if !ok || node == s.nodeAddr {
+		return false
+	}
+
+	l := s.udpPeerLink(node, tunnelID, publicPort, w)
+	if l == nil {
+		return false
+	}
+	l.buf = appendUDPFrame(l.buf[:0], pkt.addr, pkt.data)
+	l.conn.SetWriteDeadline(time.Now().Add(udpPeerWriteTimeout))
+	if _, err := l.conn.Write(l.buf); err != nil {
+		// Stalled or gone owner; a partial frame desynchronizes the stream.
+		// The next datagram dials again.
+		l.close()
+		s.udpPeers.CompareAndDelete(publicPort, l)
+		return false
+	}
+	return true
+}
+
+// udpPeerLink returns the port's link to node, dialing it if the owner
+// changed or the previous link broke. It returns nil while a failed dial is
+// being backed off.
+func (s *Server) udpPeerLink(node, tunnelID string, publicPort int, w udpWriter) *udpPeerLink {
+	if v, ok := s.udpPeers.Load(publicPort); ok {
+		l := v.(*udpPeerLink)
+		if l.node == node {
+			if l.conn == nil && time.Now().Before(l.retryAt) {
+				return nil
+			}
+			if l.conn != nil {
+				return l
+			}
+		}
+		l.close()
+		s.udpPeers.CompareAndDelete(publicPort, l)
+	}
+
+	conn, err := net.DialTimeout("tcp", node, peerDialTimeout)
+	if err != nil {
+		s.udpLog.Warn("Failed to reach owner node", "tunnel_id", tunnelID, "port", publicPort, "node", node, "error", err)
+		s.udpPeers.Store(publicPort, &udpPeerLink{node: node, retryAt: time.Now().Add(udpPeerRetry)})
+		return nil
+	}
+	if _, err := fmt.Fprintf(conn, "FORWARD %s %s %s %d\n", s.peerToken, ChannelUDP, tunnelID, publicPort); err != nil {
+		conn.Close()
+		return nil
+	}
+	l := &udpPeerLink{node: node, conn: conn}
+	s.udpPeers.Store(publicPort, l)
+	go s.readUDPReplies(l, w, publicPort)
+	return l
+}
+
+// readUDPReplies sends the owner's replies to the players from the public port.
+func (s *Server) readUDPReplies(l *udpPeerLink, w udpWriter, publicPort int) {
+	defer func() {
+		l.close()
+		// The forwarder redials on the next datagram
+		s.udpPeers.CompareAndDelete(publicPort, l)
+	}()
+	buf := make([]byte, maxUDPPacket)
+	for {
+		addr, payload, err := readUDPFrame(l.conn, buf)
+		if err != nil {
+			return
+		}
+		w.WriteToUDPAddrPort(payload, addr)
+	}
+}
+
+// closeUDPPeerLink drops a public port's link to the owner, if any.
+func (s *Server) closeUDPPeerLink(publicPort int) {
+	if v, ok := s.udpPeers.LoadAndDelete(publicPort); ok {
+		v.(*udpPeerLink).close()
+	}
+}
+
+// serveUDPPeer handles the datagrams another node relays for one public port
+// of a tunnel whose client is attached here, like startUDPPortListener does
+// for the local socket. Sessions created from the link end with it.
+func (s *Server) serveUDPPeer(conn net.Conn, r io.Reader, tunnelID, port string) {
+	defer conn.Close()
+	publicPort, err := strconv.Atoi(port)
+	if err != nil {
+		return
+	}
+	if owner, ok := s.portOwners.Load(publicPort); !ok || owner.(string) != tunnelID {
+		return
+	}
+	localRaw, ok := s.portLocalMap.Load(publicPort)
+	if !ok {
+		return
+	}
+
+	w := &udpPeerConn{conn: conn}
+	queue := make(chan udpPacket, udpQueueSize)
+	forwarded := make(chan struct{})
+	go func() {
+		defer close(forwarded)
+		s.forwardUDPPackets(w, queue, tunnelID, publicPort, localRaw.(int))
+	}()
+	defer func() {
+		close(queue)
+		<-forwarded
+		for _, u := range s.udpSessions.removeWriter(w) {
+			if clientRaw, ok := s.clients.Load(u.tunnelID); ok {
+				clientRaw.(*ClientConn).sendBulk("UDP_CLOSE " + u.connID())
+			}
+		}
+	}()
+
+	st := s.stats(tunnelID)
+	buf := make([]byte, maxUDPPacket)
+	for {
+		addr, payload, err := readUDPFrame(r, buf)
+		if err != nil {
+			return
+		}
+		pkt := newUDPPacket(payload, addr)
+		select {
+		case queue <- pkt:
+		default:
+			pkt.release()
+			st.udpPacketsDropped.Add(1)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUDPFrameRoundTrip(t *testing.T) {
+	var stream bytes.Buffer
+	addrs := []netip.AddrPort{
+		netip.MustParseAddrPort("203.0.113.9:40000"),
+		netip.MustParseAddrPort("[2001:db8::9]:40001"),
+	}
+	for i, addr := range addrs {
+		stream.Write(appendUDPFrame(nil, addr, []byte{byte(i), 0xff}))
+	}
+	stream.Write(appendUDPFrame(nil, addrs[0], nil))
+
+	buf := make([]byte, maxUDPPacket)
+	for i, want := range addrs {
+		addr, payload, err := readUDPFrame(&stream, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr != want || !bytes.Equal(payload, []byte{byte(i), 0xff}) {
+			t.Errorf("frame %d: %s %x, want %s %02xff", i, addr, payload, want, i)
+		}
+	}
+	if addr, payload, err := readUDPFrame(&stream, buf); err != nil || addr != addrs[0] || len(payload) != 0 {
+		t.Errorf("empty datagram: %s %x %v", addr, payload, err)
+	}
+}
+
+// staticRoutes reports every tunnel as attached to one node.
+type staticRoutes string
+
+func (r staticRoutes) Claim(string, ClientInfo) {}
+func (r staticRoutes) Release(string)           {}
+func (r staticRoutes) Owner(string) (string, ClientInfo, bool) {
+	return string(r), ClientInfo{}, true
+}
+
+// udpRecorder stands in for a public UDP socket.
+type udpRecorder chan string
+
+func (r udpRecorder) WriteToUDPAddrPort(b []byte, addr netip.AddrPort) (int, error) {
+	r <- addr.String() + " " + string(b)
+	return len(b), nil
+}
+
+// A datagram reaching a node without the client is handled by the owner, and
+// the client's reply leaves from the node the player sent to.
+func TestUDPForwardedToOwner(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ownerAddr := l.Addr().String()
+	owner := NewServer(Config{
+		Routes:    staticRoutes(ownerAddr),
+		PeerAddr:  ownerAddr,
+		NodeAddr:  ownerAddr,
+		PeerToken: "secret",
+		Listen:    func(string, string) (net.Listener, error) { return l, nil },
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if err := owner.startPeerListener(ctx); err != nil {
+		t.Fatal(err)
+	}
+	owner.portOwners.Store(24454, "t1")
+	owner.portLocalMap.Store(24454, 24455)
+	client := testClient(owner, "t1")
+	t.Cleanup(client.close)
+
+	node := NewServer(Config{Routes: staticRoutes(ownerAddr), NodeAddr: "127.0.0.1:1", PeerToken: "secret"})
+	public := make(udpRecorder, 1)
+	queue := make(chan udpPacket, 1)
+	t.Cleanup(func() { close(queue) })
+	go node.forwardUDPPackets(public, queue, "t1", 24454, 24455)
+
+	player := netip.MustParseAddrPort("203.0.113.9:40000")
+	queue <- newUDPPacket([]byte("ping"), player)
+
+	var line string
+	select {
+	case msg := <-client.udpQ:
+		line = string(msg)
+	case <-time.After(5 * time.Second):
+		t.Fatal("datagram not forwarded to the owner's client")
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 4 || fields[0] != "UDP_PKT" || fields[2] != "24455" || fields[3] != hex.EncodeToString([]byte("ping")) {
+		t.Fatalf("client got %q, want UDP_PKT <id> 24455 ping", line)
+	}
+	if sess := owner.udpSessions.list("t1"); len(sess) != 1 || sess[0].addr != player {
+		t.Fatalf("owner sessions %v, want one for %s", sess, player)
+	}
+
+	owner.handleUDPReply(client, fields[1], hex.EncodeToString([]byte("pong")))
+	select {
+	case got := <-public:
+		if want := player.String() + " pong"; got != want {
+			t.Fatalf("player got %q, want %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reply not sent from the receiving node")
+	}
+
+	// Dropping the link ends the sessions created from it
+	node.closeUDPPeerLink(24454)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(owner.udpSessions.list("t1")) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("session outlived its peer link")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// A stalled owner times the link out instead of blocking the port's forwarder.
+func TestUDPForwardStalledOwner(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		// Accept and never read
+		if conn, err := l.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	defer func() {
+		select {
+		case conn := <-accepted:
+			conn.Close()
+		default:
+		}
+	}()
+
+	node := NewServer(Config{Routes: staticRoutes(l.Addr().String()), NodeAddr: "127.0.0.1:1"})
+	pkt := newUDPPacket(make([]byte, 60000), netip.MustParseAddrPort("203.0.113.9:40000"))
+	public := make(udpRecorder, 1)
+
+	start := time.Now()
+	for node.forwardUDP(public, "t1", 24454, &pkt) {
+		if time.Since(start) > 30*time.Second {
+			t.Fatal("writes to a stalled owner never failed")
+		}
+	}
+	if _, ok := node.udpPeers.Load(24454); ok {
+		t.Error("timed out link kept for the next datagram")
+	}
+}
@@ -0,0 +1,214 @@
+package tunnel
+
+// UDP proxy for voice chat and extra UDP mappings. Each public port has one
+// reader and one forwarder goroutine connected by a bounded queue, so packets
+// of a listener reach the client in arrival order. Packet buffers are pooled,
+// a full queue drops packets (counted, never blocks the socket), and the
+// forwarder coalesces queued packets into a single control channel write.
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	udpQueueSize     = 1024 // packets buffered per listener before dropping
+	udpBatchPackets  = 64   // UDP_PKT lines coalesced into one control write
+	udpPooledBufSize = 2048 // voice packets fit; larger datagrams get their own buffer
+	maxUDPPacket     = 65535
+	udpSocketBuffer  = 1 << 20 // absorbs bursts while the forwarder catches up
+)
+
+var udpBufPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, udpPooledBufSize)
+		return &b
+	},
+}
+
+// udpPacket is a received datagram waiting to be forwarded to the client.
+type udpPacket struct {
+	data   []byte
+	pooled *[]byte // backing buffer to return to udpBufPool, nil if not pooled
+	addr   netip.AddrPort
+}
+
+func newUDPPacket(payload []byte, addr netip.AddrPort) udpPacket {
+	if len(payload) > udpPooledBufSize {
+		return udpPacket{data: append([]byte(nil), payload...), addr: addr}
+	}
+	buf := udpBufPool.Get().(*[]byte)
+	n := copy(*buf, payload)
+	return udpPacket{data: (*buf)[:n], pooled: buf, addr: addr}
+}
+
+func (p *udpPacket) release() {
+	if p.pooled != nil {
+		udpBufPool.Put(p.pooled)
+		p.pooled = nil
+	}
+}
+
+// listenUDP opens a public UDP port on all addresses.
+func (s *Server) listenUDP(port int) (*net.UDPConn, error) {
+	pc, err := s.listenPacket("udp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+	conn, ok := pc.(*net.UDPConn)
+	if !ok {
+		pc.Close()
+		return nil, fmt.Errorf("not a UDP socket: %T", pc)
+	}
+	return conn, nil
+}
+
+func (s *Server) startUDPPortListener(publicPort int, tunnelID string, localPort int) {
+	pc, err := s.listenUDP(publicPort)
+	if err != nil {
+		s.udpLog.Error("Failed to listen", "port", publicPort, "tunnel_id", tunnelID, "error", err)
+		return
+	}
+	pc.SetReadBuffer(udpSocketBuffer)
+	s.udpListeners.Store(publicPort, pc)
+	s.udpLog.Info("Listening", "port", publicPort, "tunnel_id", tunnelID, "local_port", localPort)
+
+	queue := make(chan udpPacket, udpQueueSize)
+	defer close(queue)
+	go s.forwardUDPPackets(pc, queue, tunnelID, publicPort, localPort)
+
+	st := s.stats(tunnelID)
+	buf := make([]byte, maxUDPPacket)
+	for {
+		n, remoteAddr, err := pc.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			s.udpLog.Info("Listener closed", "port", publicPort, "tunnel_id", tunnelID, "error", err)
+			return
+		}
+		pkt := newUDPPacket(buf[:n], remoteAddr)
+		select {
+		case queue <- pkt:
+		default:
+			// Forwarder is behind (slow client uplink); drop rather than stall the socket.
+			pkt.release()
+			st.udpPacketsDropped.Add(1)
+		}
+	}
+}
+
+// forwardUDPPackets drains the listener queue in order and sends the packets to
+// the client as UDP_PKT lines, batching whatever is already queued. Without
+// the client on this node, packets go to its owner over the peer link.
+func (s *Server) forwardUDPPackets(w udpWriter, queue <-chan udpPacket, tunnelID string, publicPort, localPort int) {
+	st := s.stats(tunnelID)
+	u := s.usage(tunnelID, ChannelUDP)
+	lim := s.limiter(tunnelID)
+	var batch []byte
+	for pkt := range queue {
+		clientRaw, connected := s.clients.Load(tunnelID)
+		now := time.Now()
+
+		batch = batch[:0]
+		lines, dropped := 0, 0
+		var payload, sessions int64
+		for n, more := 1, true; more; n++ {
+			if !connected {
+				if !s.forwardUDP(w, tunnelID, publicPort, &pkt) {
+					dropped++
+				}
+			} else if lim.suspended.Load() || !lim.down.allow(len(pkt.data)) {
+				dropped++
+			} else if sess, created := s.udpSessions.session(tunnelID, publicPort, localPort, w, pkt.addr); sess == nil {
+				st.udpSessionsRejected.Add(1)
+			} else {
+				if created {
+					st.udpSessionsCreated.Add(1)
+					sessions++
+				}
+				sess.touch(now)
+				sess.bytesIn.Add(int64(len(pkt.data)))
+				batch = appendUDPPkt(batch, sess, pkt.data)
+				payload += int64(len(pkt.data))
+				lines++
+			}
+			pkt.release()
+
+			if n == udpBatchPackets {
+				break
+			}
+			select {
+			case pkt, more = <-queue:
+			default:
+				more = false
+			}
+		}
+
+		if lines > 0 {
+			if err := clientRaw.(*ClientConn).sendUDP(batch); err != nil {
+				dropped += lines
+			} else {
+				st.udpPacketsIn.Add(int64(lines))
+				u.addIn(payload)
+			}
+		}
+		if sessions > 0 {
+			u.connections.Add(sessions)
+		}
+		if dropped > 0 {
+			st.udpPacketsDropped.Add(int64(dropped))
+		}
+	}
+}
+
+// appendUDPPkt appends "UDP_PKT <conn_id> <local_port> <hex_payload>\n".
+func appendUDPPkt(b []byte, sess *udpSession, payload []byte) []byte {
+	b = append(b, "UDP_PKT "...)
+	b = strconv.AppendUint(b, sess.id, 10)
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, int64(sess.localPort), 10)
+	b = append(b, ' ')
+	b = hex.AppendEncode(b, payload)
+	return append(b, '\n')
+}
+
+// handleUDPReply routes a UDP_REPLY from the client back to the session's player.
+// Only the tunnel owning the session may use it.
+func (s *Server) handleUDPReply(client *ClientConn, connID, hexPayload string) {
+	st := s.stats(client.tunnelID)
+	id, err := strconv.ParseUint(connID, 10, 64)
+	if err != nil {
+		st.udpPacketsDropped.Add(1)
+		return
+	}
+	sess := s.udpSessions.get(id)
+	if sess == nil || sess.tunnelID != client.tunnelID {
+		st.udpPacketsDropped.Add(1) // expired or foreign session
+		return
+	}
+
+	data, err := hex.DecodeString(hexPayload)
+	if err != nil {
+		st.udpPacketsDropped.Add(1)
+		return
+	}
+
+	lim := s.limiter(client.tunnelID)
+	if lim.suspended.Load() || !lim.up.allow(len(data)) {
+		st.udpPacketsDropped.Add(1)
+		return
+	}
+
+	sess.touch(time.Now())
+	if _, err := sess.pc.WriteToUDPAddrPort(data, sess.addr); err != nil {
+		st.udpPacketsDropped.Add(1)
+		return
+	}
+	st.udpPacketsOut.Add(1)
+	sess.bytesOut.Add(int64(len(data)))
+	s.usage(client.tunnelID, ChannelUDP).addOut(int64(len(data)))
+}
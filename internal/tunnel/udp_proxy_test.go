@@ -0,0 +1,158 @@
+package tunnel
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+)
+
+// Voice packets of Simple Voice Chat are a few hundred bytes.
+const benchVoicePacket = 300
+
+func benchPlayers(n int) []netip.AddrPort {
+	addrs := make([]netip.AddrPort, n)
+	for i := range addrs {
+		addrs[i] = netip.AddrPortFrom(netip.AddrFrom4([4]byte{203, 0, 113, byte(i + 1)}), uint16(40000+i))
+	}
+	return addrs
+}
+
+// testClient registers a client for tunnelID whose control connection goes nowhere.
+func testClient(s *Server, tunnelID string) *ClientConn {
+	conn, _ := net.Pipe()
+	client := newClientConn(tunnelID, conn, nil, s.stats(tunnelID), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	s.clients.Store(tunnelID, client)
+	return client
+}
+
+// benchClient registers a client for tunnelID whose UDP queue is written to
+// io.Discard, as the writer goroutine would write it to the control channel.
+func benchClient(b *testing.B, s *Server, tunnelID string) {
+	client := testClient(s, tunnelID)
+	w := bufio.NewWriter(io.Discard)
+	go func() {
+		for {
+			select {
+			case msg := <-client.udpQ:
+				w.Write(msg)
+				w.Flush()
+			case <-client.done:
+				return
+			}
+		}
+	}()
+	b.Cleanup(client.close)
+}
+
+// BenchmarkUDPForwardPipeline measures the listener → forwarder path: pooled
+// packet buffers, one ordered queue and batched UDP_PKT writes.
+func BenchmarkUDPForwardPipeline(b *testing.B) {
+	s := NewServer(Config{})
+	benchClient(b, s, "t1")
+	players := benchPlayers(8)
+	payload := make([]byte, benchVoicePacket)
+
+	queue := make(chan udpPacket, udpQueueSize)
+	done := make(chan struct{})
+	go func() {
+		s.forwardUDPPackets(nil, queue, "t1", 24454, 24454)
+		close(done)
+	}()
+
+	b.SetBytes(benchVoicePacket)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		queue <- newUDPPacket(payload, players[i%len(players)])
+	}
+	close(queue)
+	<-done
+}
+
+// BenchmarkUDPForwardPerPacket measures the path the pipeline replaced: a
+// fresh buffer and a goroutine per datagram, each formatting its own UDP_PKT
+// line and writing it under the connection's mutex.
+func BenchmarkUDPForwardPerPacket(b *testing.B) {
+	var mu sync.Mutex
+	w := bufio.NewWriter(io.Discard)
+	send := func(msg string) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.WriteString(msg + "\n")
+		w.Flush()
+	}
+	players := benchPlayers(8)
+	payload := make([]byte, benchVoicePacket)
+
+	var wg sync.WaitGroup
+	b.SetBytes(benchVoicePacket)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		data := make([]byte, len(payload))
+		copy(data, payload)
+		addr := players[i%len(players)]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			send(fmt.Sprintf("UDP_PKT %s %d %s", addr.String(), 24454, hex.EncodeToString(data)))
+		}()
+	}
+	wg.Wait()
+}
+
+func BenchmarkUDPPacketPooled(b *testing.B) {
+	payload := make([]byte, benchVoicePacket)
+	addr := benchPlayers(1)[0]
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		pkt := newUDPPacket(payload, addr)
+		pkt.release()
+	}
+}
+
+func BenchmarkUDPPacketUnpooled(b *testing.B) {
+	payload := make([]byte, benchVoicePacket)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		data := make([]byte, len(payload))
+		copy(data, payload)
+		benchSink = data
+	}
+}
+
+var benchSink []byte
+
+// The pipeline keeps the packets of a listener in arrival order.
+func TestUDPForwardKeepsOrder(t *testing.T) {
+	s := NewServer(Config{})
+	client := testClient(s, "t1")
+	defer client.close()
+	addr := benchPlayers(1)[0]
+
+	queue := make(chan udpPacket, udpQueueSize)
+	const packets = 200
+	for i := 0; i < packets; i++ {
+		queue <- newUDPPacket([]byte{byte(i)}, addr)
+	}
+	close(queue)
+	s.forwardUDPPackets(nil, queue, "t1", 24454, 24454)
+
+	var got []byte
+	for len(client.udpQ) > 0 {
+		got = append(got, <-client.udpQ...)
+	}
+	var want []byte
+	for i := 0; i < packets; i++ {
+		want = fmt.Appendf(want, "UDP_PKT 1 24454 %02x\n", byte(i))
+	}
+	if string(got) != string(want) {
+		t.Fatalf("forwarded lines out of order:\n%s", got)
+	}
+}
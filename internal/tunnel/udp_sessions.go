@@ -0,0 +1,244 @@
+package tunnel
+
+// UDP sessions. Every (public port, player address) pair that sends a datagram
+// gets a session with an opaque numeric ID, which is what the client sees as
+// <conn_id> in UDP_PKT/UDP_REPLY. Sessions expire after an idle timeout, are
+// capped per tunnel and are dropped together with their tunnel.
+
+import (
+	"context"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultUDPSessionIdle   = 2 * time.Minute
+	defaultUDPSessionsLimit = 256
+)
+
+type udpSession struct {
+	id         uint64
+	tunnelID   string
+	publicPort int
+	localPort  int
+	pc         udpWriter
+	addr       netip.AddrPort
+	created    time.Time
+	lastSeen   atomic.Int64 // unix nanoseconds
+
+	// payload bytes, for the connection inspector
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+}
+
+func (u *udpSession) touch(now time.Time) {
+	u.lastSeen.Store(now.UnixNano())
+}
+
+// connID is the session ID as sent over the control channel.
+func (u *udpSession) connID() string {
+	return strconv.FormatUint(u.id, 10)
+}
+
+type udpSessionKey struct {
+	publicPort int
+	addr       netip.AddrPort
+}
+
+// udpSessionTable indexes live UDP sessions by ID and by player address.
+type udpSessionTable struct {
+	mu        sync.Mutex
+	nextID    uint64
+	byID      map[uint64]*udpSession
+	byAddr    map[udpSessionKey]*udpSession
+	perTunnel map[string]int
+
+	idleTimeout  time.Duration
+	maxPerTunnel int
+}
+
+func newUDPSessionTable(idleTimeout time.Duration, maxPerTunnel int) *udpSessionTable {
+	if idleTimeout <= 0 {
+		idleTimeout = defaultUDPSessionIdle
+	}
+	if maxPerTunnel <= 0 {
+		maxPerTunnel = defaultUDPSessionsLimit
+	}
+	return &udpSessionTable{
+		byID:         make(map[uint64]*udpSession),
+		byAddr:       make(map[udpSessionKey]*udpSession),
+		perTunnel:    make(map[string]int),
+		idleTimeout:  idleTimeout,
+		maxPerTunnel: maxPerTunnel,
+	}
+}
+
+// session returns the player's session on the given public port, creating it on
+// first contact. created reports a new session; nil means the tunnel is at its cap.
+func (t *udpSessionTable) session(tunnelID string, publicPort, localPort int, pc udpWriter, addr netip.AddrPort) (u *udpSession, created bool) {
+	key := udpSessionKey{publicPort: publicPort, addr: addr}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if u := t.byAddr[key]; u != nil {
+		return u, false
+	}
+	if t.perTunnel[tunnelID] >= t.maxPerTunnel {
+		return nil, false
+	}
+	t.nextID++
+	now := time.Now()
+	u = &udpSession{
+		id:         t.nextID,
+		tunnelID:   tunnelID,
+		publicPort: publicPort,
+		localPort:  localPort,
+		pc:         pc,
+		addr:       addr,
+		created:    now,
+	}
+	// Set before the session becomes visible, or expire could drop it first.
+	u.touch(now)
+	t.byID[u.id] = u
+	t.byAddr[key] = u
+	t.perTunnel[tunnelID]++
+	return u, true
+}
+
+func (t *udpSessionTable) get(id uint64) *udpSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.byID[id]
+}
+
+func (t *udpSessionTable) removeLocked(u *udpSession) {
+	delete(t.byID, u.id)
+	delete(t.byAddr, udpSessionKey{publicPort: u.publicPort, addr: u.addr})
+	if t.perTunnel[u.tunnelID]--; t.perTunnel[u.tunnelID] <= 0 {
+		delete(t.perTunnel, u.tunnelID)
+	}
+}
+
+// remove drops a session of the tunnel and returns it, or nil if the tunnel
+// has no session with that ID.
+func (t *udpSessionTable) remove(tunnelID string, id uint64) *udpSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u := t.byID[id]
+	if u == nil || u.tunnelID != tunnelID {
+		return nil
+	}
+	t.removeLocked(u)
+	return u
+}
+
+// removeWriter drops the sessions replying through w and returns them.
+func (t *udpSessionTable) removeWriter(w udpWriter) []*udpSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var removed []*udpSession
+	for _, u := range t.byID {
+		if u.pc == w {
+			t.removeLocked(u)
+			removed = append(removed, u)
+		}
+	}
+	return removed
+}
+
+// list returns the sessions of a tunnel.
+func (t *udpSessionTable) list(tunnelID string) []*udpSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var sessions []*udpSession
+	for _, u := range t.byID {
+		if u.tunnelID == tunnelID {
+			sessions = append(sessions, u)
+		}
+	}
+	return sessions
+}
+
+// removeTunnel drops every session of the tunnel.
+func (t *udpSessionTable) removeTunnel(tunnelID string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, u := range t.byID {
+		if u.tunnelID == tunnelID {
+			t.removeLocked(u)
+			n++
+		}
+	}
+	return n
+}
+
+// expire removes sessions idle for longer than the idle timeout and returns them.
+func (t *udpSessionTable) expire(now time.Time) []*udpSession {
+	cutoff := now.Add(-t.idleTimeout).UnixNano()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var expired []*udpSession
+	for _, u := range t.byID {
+		if u.lastSeen.Load() < cutoff {
+			t.removeLocked(u)
+			expired = append(expired, u)
+		}
+	}
+	return expired
+}
+
+// counts returns the active sessions of a tunnel, total and by public port.
+func (t *udpSessionTable) counts(tunnelID string) (int, map[int]int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	byPort := map[int]int{}
+	for _, u := range t.byID {
+		if u.tunnelID == tunnelID {
+			byPort[u.publicPort]++
+		}
+	}
+	return t.perTunnel[tunnelID], byPort
+}
+
+// active returns the number of active sessions of each tunnel.
+func (t *udpSessionTable) active() map[string]int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	m := make(map[string]int, len(t.perTunnel))
+	for id, n := range t.perTunnel {
+		m[id] = n
+	}
+	return m
+}
+
+// udpSessionJanitor periodically expires idle UDP sessions and tells the
+// client so it can release its local sockets.
+func (s *Server) udpSessionJanitor(ctx context.Context) {
+	interval := s.udpSessions.idleTimeout / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			expired := s.udpSessions.expire(now)
+			for _, u := range expired {
+				s.stats(u.tunnelID).udpSessionsExpired.Add(1)
+				if clientRaw, ok := s.clients.Load(u.tunnelID); ok {
+					clientRaw.(*ClientConn).sendBulk("UDP_CLOSE " + u.connID())
+				}
+			}
+			if len(expired) > 0 {
+				s.udpLog.Debug("Expired idle sessions", "count", len(expired))
+			}
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package tunnel
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// A new session counts as seen from the moment it is created, so an expiry
+// pass running before the caller touches it keeps it.
+func TestUDPSessionNotExpiredOnCreation(t *testing.T) {
+	table := newUDPSessionTable(time.Minute, 4)
+	addr := netip.MustParseAddrPort("203.0.113.7:50000")
+
+	u, created := table.session("t1", 24454, 24454, nil, addr)
+	if u == nil || !created {
+		t.Fatal("session not created")
+	}
+	if expired := table.expire(time.Now()); len(expired) != 0 {
+		t.Fatalf("expired %d new sessions", len(expired))
+	}
+	if table.get(u.id) != u {
+		t.Fatal("new session dropped")
+	}
+
+	if expired := table.expire(time.Now().Add(2 * time.Minute)); len(expired) != 1 {
+		t.Fatalf("expired %d idle sessions, want 1", len(expired))
+	}
+}
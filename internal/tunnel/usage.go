@@ -0,0 +1,215 @@
+package tunnel
+
+// Bandwidth accounting. Bytes and connections are counted per tunnel and per
+// channel on the player side of every proxy: ingress is player → owner's
+// server, egress is owner's server → player. Counters accumulate in memory
+// until DrainUsage hands them to the API layer for persistence.
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Usage channels.
+const (
+	ChannelMC   = "mc"
+	ChannelHTTP = "http"
+	ChannelUDP  = "udp"
+	ChannelTCP  = "tcp"
+)
+
+var usageChannels = [...]string{ChannelMC, ChannelHTTP, ChannelUDP, ChannelTCP}
+
+type channelUsage struct {
+	bytesIn     atomic.Int64 // since the previous drain
+	bytesOut    atomic.Int64
+	connections atomic.Int64
+	bytesSaved  atomic.Int64 // by edge and hop compression
+
+	totals channelTotals  // cumulative, exported as metrics
+	server *channelTotals // the same for all tunnels
+}
+
+// channelTotals are cumulative counters of a channel that are never drained.
+type channelTotals struct {
+	relayedIn  atomic.Int64
+	relayedOut atomic.Int64
+	active     atomic.Int64 // open player connections
+}
+
+func (c *channelUsage) addIn(n int64) {
+	c.bytesIn.Add(n)
+	c.totals.relayedIn.Add(n)
+	c.server.relayedIn.Add(n)
+}
+
+func (c *channelUsage) addOut(n int64) {
+	c.bytesOut.Add(n)
+	c.totals.relayedOut.Add(n)
+	c.server.relayedOut.Add(n)
+}
+
+func (c *channelUsage) addSaved(n int64) {
+	c.bytesSaved.Add(n)
+}
+
+func (c *channelUsage) open() {
+	c.connections.Add(1)
+	c.totals.active.Add(1)
+	c.server.active.Add(1)
+}
+
+func (c *channelUsage) closed() {
+	c.totals.active.Add(-1)
+	c.server.active.Add(-1)
+}
+
+type tunnelUsage struct {
+	channels [len(usageChannels)]channelUsage
+}
+
+func (u *tunnelUsage) channel(name string) *channelUsage {
+	for i, c := range usageChannels {
+		if c == name {
+			return &u.channels[i]
+		}
+	}
+	panic("tunnel: unknown usage channel " + name)
+}
+
+// UsageRecord is the traffic of one tunnel channel since the previous drain.
+type UsageRecord struct {
+	TunnelID    string `json:"tunnel_id"`
+	Channel     string `json:"channel"`
+	BytesIn     int64  `json:"bytes_in"`
+	BytesOut    int64  `json:"bytes_out"`
+	Connections int64  `json:"connections"`
+	BytesSaved  int64  `json:"bytes_saved"` // by compression, web map channel only
+}
+
+// usage returns the counters of a tunnel channel, creating them on first use.
+func (s *Server) usage(tunnelID, channel string) *channelUsage {
+	u, ok := s.tunnelUsage.Load(tunnelID)
+	if !ok {
+		tu := &tunnelUsage{}
+		for i := range tu.channels {
+			tu.channels[i].server = &s.usageTotals[i]
+		}
+		u, _ = s.tunnelUsage.LoadOrStore(tunnelID, tu)
+	}
+	return u.(*tunnelUsage).channel(channel)
+}
+
+// DrainUsage returns the traffic counted since the previous call and resets
+// the counters. Tunnels that are no longer registered are forgotten once drained.
+// Each call also publishes a usage event per active tunnel with traffic.
+func (s *Server) DrainUsage() []UsageRecord {
+	var records []UsageRecord
+	s.tunnelUsage.Range(func(k, v any) bool {
+		tunnelID, u := k.(string), v.(*tunnelUsage)
+		if _, active := s.registrations.Load(tunnelID); !active {
+			s.tunnelUsage.Delete(tunnelID)
+		}
+		for i := range u.channels {
+			c := &u.channels[i]
+			r := UsageRecord{
+				TunnelID:    tunnelID,
+				Channel:     usageChannels[i],
+				BytesIn:     c.bytesIn.Swap(0),
+				BytesOut:    c.bytesOut.Swap(0),
+				Connections: c.connections.Swap(0),
+				BytesSaved:  c.bytesSaved.Swap(0),
+			}
+			if r.BytesIn != 0 || r.BytesOut != 0 || r.Connections != 0 || r.BytesSaved != 0 {
+				records = append(records, r)
+			}
+		}
+		return true
+	})
+	s.publishUsage(records)
+	return records
+}
+
+// usageConn counts the bytes of a player-side connection and applies the
+// tunnel's bandwidth limits. Until bind is called (the tunnel is not known
+// yet), reads are held in pending and nothing is limited.
+type usageConn struct {
+	net.Conn
+	u       *channelUsage
+	lim     *tunnelLimiter
+	pending int64
+	closed  atomic.Bool
+
+	// totals of this connection alone, for its trace span
+	in, out atomic.Int64
+	since   time.Time // when the connection was bound to its tunnel
+}
+
+func (c *usageConn) bind(u *channelUsage, lim *tunnelLimiter) {
+	c.u, c.lim = u, lim
+	c.since = time.Now()
+	u.open()
+	u.addIn(c.pending)
+	c.pending = 0
+}
+
+func (c *usageConn) Read(p []byte) (int, error) {
+	if c.lim != nil && c.lim.suspended.Load() {
+		return 0, errTunnelSuspended
+	}
+	n, err := c.Conn.Read(p)
+	c.in.Add(int64(n))
+	if c.u == nil {
+		c.pending += int64(n)
+		return n, err
+	}
+	c.u.addIn(int64(n))
+	if n > 0 {
+		c.lim.down.wait(n)
+	}
+	return n, err
+}
+
+func (c *usageConn) Write(p []byte) (int, error) {
+	if c.u == nil {
+		n, err := c.Conn.Write(p)
+		c.out.Add(int64(n))
+		return n, err
+	}
+	if c.lim.suspended.Load() {
+		return 0, errTunnelSuspended
+	}
+	c.lim.up.wait(len(p))
+	n, err := c.Conn.Write(p)
+	c.out.Add(int64(n))
+	c.u.addOut(int64(n))
+	return n, err
+}
+
+func (c *usageConn) Close() error {
+	if c.closed.CompareAndSwap(false, true) && c.u != nil {
+		c.u.closed()
+	}
+	return c.Conn.Close()
+}
+
+// CloseWrite keeps half-close working for relay.
+func (c *usageConn) CloseWrite() error {
+	if hc, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return hc.CloseWrite()
+	}
+	return nil
+}
+
+// bindUsage attaches a player connection to a tunnel channel's counters and limits.
+func (s *Server) bindUsage(c *usageConn, tunnelID, channel string) {
+	c.bind(s.usage(tunnelID, channel), s.limiter(tunnelID))
+}
+
+// countUsage wraps a player connection of a known tunnel channel.
+func (s *Server) countUsage(conn net.Conn, tunnelID, channel string) *usageConn {
+	uc := &usageConn{Conn: conn}
+	s.bindUsage(uc, tunnelID, channel)
+	return uc
+}
@@ -0,0 +1,206 @@
+// Package upgrade replaces the running binary without closing its sockets.
+//
+// Every listener is opened through an Upgrader. On Upgrade (SIGUSR2 on unix
+// systems) the process starts its executable again and passes all open
+// listeners to it as inherited file descriptors. The new process opens the
+// same addresses, gets the inherited sockets instead of binding again and
+// calls Ready once it serves them; the old process then stops accepting,
+// lets its open connections finish and exits. The ports never close.
+//
+// The sockets are described to the new process in the VOIDLINK_UPGRADE
+// environment variable.
+package upgrade
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// envState names the environment variable describing the inherited sockets.
+const envState = "VOIDLINK_UPGRADE"
+
+// inheritGrace is how long inherited sockets nobody asked for stay open
+// after Ready. Raw TCP and UDP ports of tunnels are opened when the tunnels
+// are registered again, which can take a while after start-up.
+const inheritGrace = time.Minute
+
+// ErrUnsupported is returned by Upgrade on systems without descriptor inheritance.
+var ErrUnsupported = errors.New("binary upgrades are not supported on this system")
+
+// state is passed from the old process to the new one. Socket i is file
+// descriptor 4+i; descriptor 3 is the ready pipe.
+type state struct {
+	Sockets []socket `json:"sockets"`
+}
+
+type socket struct {
+	Network string `json:"network"`
+	Addr    string `json:"addr"`
+}
+
+func (s socket) String() string {
+	return s.Network + " " + s.Addr
+}
+
+// filer is implemented by *net.TCPListener, *net.UnixListener and *net.UDPConn.
+type filer interface {
+	File() (*os.File, error)
+}
+
+// Upgrader opens listeners, inheriting them from the previous process when
+// there was one, and passes them on to the next.
+type Upgrader struct {
+	pidFile string
+	log     *slog.Logger
+
+	mu        sync.Mutex
+	inherited map[socket]*os.File // not yet claimed by Listen/ListenPacket
+	open      map[socket]filer    // everything opened, closed ones included
+	ready     *os.File            // pipe to the previous process (nil = first start)
+	upgrading bool                // an Upgrade started or succeeded
+}
+
+// New returns an Upgrader, taking over the sockets of the previous process
+// if this one was started by an upgrade. pidFile, if set, receives the PID
+// once the process is ready, for supervisors that follow a PID file.
+func New(pidFile string, logger *slog.Logger) (*Upgrader, error) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	u := &Upgrader{
+		pidFile:   pidFile,
+		log:       logger,
+		inherited: make(map[socket]*os.File),
+		open:      make(map[socket]filer),
+	}
+
+	raw, ok := os.LookupEnv(envState)
+	if !ok {
+		return u, nil
+	}
+	os.Unsetenv(envState)
+	var st state
+	if err := json.Unmarshal([]byte(raw), &st); err != nil {
+		return nil, fmt.Errorf("upgrade: invalid %s: %w", envState, err)
+	}
+	u.ready = os.NewFile(3, "ready")
+	for i, sock := range st.Sockets {
+		u.inherited[sock] = os.NewFile(uintptr(4+i), sock.String())
+	}
+	u.log.Info("Inherited sockets from the previous process", "sockets", len(st.Sockets))
+	return u, nil
+}
+
+// Listen is net.Listen, returning the previous process's listener for the
+// same network and address if there is one.
+func (u *Upgrader) Listen(network, addr string) (net.Listener, error) {
+	sock := socket{network, addr}
+	if f := u.take(sock); f != nil {
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("upgrade: inherited %s: %w", sock, err)
+		}
+		u.track(sock, l)
+		return l, nil
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	u.track(sock, l)
+	return l, nil
+}
+
+// ListenPacket is net.ListenPacket, returning the previous process's socket
+// for the same network and address if there is one.
+func (u *Upgrader) ListenPacket(network, addr string) (net.PacketConn, error) {
+	sock := socket{network, addr}
+	if f := u.take(sock); f != nil {
+		pc, err := net.FilePacketConn(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("upgrade: inherited %s: %w", sock, err)
+		}
+		u.track(sock, pc)
+		return pc, nil
+	}
+	pc, err := net.ListenPacket(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	u.track(sock, pc)
+	return pc, nil
+}
+
+func (u *Upgrader) take(sock socket) *os.File {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	f, ok := u.inherited[sock]
+	if ok {
+		delete(u.inherited, sock)
+	}
+	return f
+}
+
+func (u *Upgrader) track(sock socket, v any) {
+	if f, ok := v.(filer); ok {
+		u.mu.Lock()
+		u.open[sock] = f
+		u.mu.Unlock()
+	}
+}
+
+// Ready tells the previous process that this one serves the inherited
+// sockets, so it can stop accepting. Inherited sockets not opened within
+// inheritGrace are closed.
+func (u *Upgrader) Ready() {
+	if u.pidFile != "" {
+		if err := os.WriteFile(u.pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644); err != nil {
+			u.log.Error("Failed to write PID file", "path", u.pidFile, "error", err)
+		}
+	}
+	if u.ready == nil {
+		return
+	}
+	u.ready.Write([]byte{1})
+	u.ready.Close()
+	u.ready = nil
+
+	time.AfterFunc(inheritGrace, func() {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		for sock, f := range u.inherited {
+			u.log.Info("Closing inherited socket nobody opened", "socket", sock.String())
+			f.Close()
+			delete(u.inherited, sock)
+		}
+	})
+}
+
+// files duplicates the descriptors of the sockets still open, dropping the
+// closed ones. Inherited sockets not claimed yet are not passed on.
+func (u *Upgrader) files() ([]socket, []*os.File) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var socks []socket
+	var files []*os.File
+	for sock, l := range u.open {
+		f, err := l.File()
+		if err != nil {
+			// Closed since it was opened
+			delete(u.open, sock)
+			continue
+		}
+		socks = append(socks, sock)
+		files = append(files, f)
+	}
+	return socks, files
+}
@@ -0,0 +1,259 @@
+//go:build linux
+
+package upgrade
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// envRole starts the test binary as the process being upgraded. The process
+// it re-executes inherits the variable and also has envState set.
+const envRole = "UPGRADE_TEST_ROLE"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(envRole) != "" {
+		_, upgraded := os.LookupEnv(envState)
+		if upgraded {
+			runNew()
+		} else {
+			runOld()
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func childLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(os.Stderr, nil))
+}
+
+func exitOn(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// runOld serves one TCP connection, then upgrades on SIGUSR2 and exits once
+// that connection is done. Connections arriving after the first wait in the
+// listen backlog for the new process.
+func runOld() {
+	u, err := New("", childLogger())
+	exitOn(err)
+	l, err := u.Listen("tcp", "127.0.0.1:0")
+	exitOn(err)
+	pc, err := u.ListenPacket("udp", "127.0.0.1:0")
+	exitOn(err)
+	sig := make(chan os.Signal, 1)
+	Notify(sig)
+	u.Ready()
+	fmt.Printf("listening %s %s\n", l.Addr(), pc.LocalAddr())
+
+	var active sync.WaitGroup
+	conn, err := l.Accept()
+	exitOn(err)
+	active.Add(1)
+	go func() {
+		defer active.Done()
+		serve(conn, "old")
+	}()
+
+	<-sig
+	if err := u.Upgrade(); err != nil {
+		fmt.Printf("upgrade failed: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println("upgraded")
+	l.Close()
+	pc.Close()
+	active.Wait()
+}
+
+// runNew serves the inherited sockets until a client says quit.
+func runNew() {
+	u, err := New("", childLogger())
+	exitOn(err)
+	l, err := u.Listen("tcp", "127.0.0.1:0")
+	exitOn(err)
+	pc, err := u.ListenPacket("udp", "127.0.0.1:0")
+	exitOn(err)
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(fmt.Appendf(nil, "new %d %s", os.Getpid(), buf[:n]), addr)
+		}
+	}()
+	quit := make(chan struct{})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				if serve(conn, "new") == "quit" {
+					close(quit)
+				}
+			}()
+		}
+	}()
+	u.Ready()
+
+	select {
+	case <-quit:
+	case <-time.After(time.Minute):
+	}
+}
+
+// serve answers each line with "<name> <pid> <line>" and returns the last line.
+func serve(conn net.Conn, name string) string {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	var last string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return last
+		}
+		last = strings.TrimSpace(line)
+		fmt.Fprintf(conn, "%s %d %s\n", name, os.Getpid(), last)
+	}
+}
+
+func exchange(t *testing.T, conn net.Conn, r *bufio.Reader, msg string) []string {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := fmt.Fprintf(conn, "%s\n", msg); err != nil {
+		t.Fatal(err)
+	}
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("reply to %q: %v", msg, err)
+	}
+	return strings.Fields(line)
+}
+
+// The old process passes its sockets to a re-executed binary (ready pipe on
+// descriptor 3, sockets from 4): a connection made during the handoff is
+// served by the new process, and the old one exits once its own connection
+// is done.
+func TestUpgradeHandsOffListeners(t *testing.T) {
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(), envRole+"=1")
+	// A file rather than a buffer: the new process inherits it and outlives Wait
+	logs, err := os.Create(t.TempDir() + "/stderr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if b, _ := os.ReadFile(logs.Name()); t.Failed() {
+			t.Logf("process logs:\n%s", b)
+		}
+	})
+	cmd.Stderr = logs
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	t.Cleanup(func() { cmd.Process.Kill() })
+	out := bufio.NewReader(stdout)
+
+	var tcpAddr, udpAddr string
+	if _, err := fmt.Fscanf(out, "listening %s %s\n", &tcpAddr, &udpAddr); err != nil {
+		t.Fatal(err)
+	}
+	oldPID := strconv.Itoa(cmd.Process.Pid)
+
+	// A connection the old process keeps serving through the upgrade
+	held, err := net.Dial("tcp", tcpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+	heldR := bufio.NewReader(held)
+	if got := exchange(t, held, heldR, "hello"); got[0] != "old" || got[1] != oldPID {
+		t.Fatalf("before the upgrade: %v, want the old process", got)
+	}
+
+	if err := cmd.Process.Signal(syscall.SIGUSR2); err != nil {
+		t.Fatal(err)
+	}
+	// Made while the new process starts; the old one no longer accepts
+	during, err := net.Dial("tcp", tcpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer during.Close()
+
+	line, err := out.ReadString('\n')
+	if err != nil || line != "upgraded\n" {
+		t.Fatalf("old process: %q, %v", line, err)
+	}
+
+	got := exchange(t, during, bufio.NewReader(during), "during")
+	if got[0] != "new" || got[1] == oldPID {
+		t.Fatalf("connection made during the handoff: %v, want the new process", got)
+	}
+	newPID, _ := strconv.Atoi(got[1])
+	t.Cleanup(func() { syscall.Kill(newPID, syscall.SIGKILL) })
+
+	udp, err := net.Dial("udp", udpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	udp.SetDeadline(time.Now().Add(10 * time.Second))
+	udp.Write([]byte("ping"))
+	buf := make([]byte, 512)
+	n, err := udp.Read(buf)
+	if err != nil || string(buf[:n]) != fmt.Sprintf("new %d ping", newPID) {
+		t.Fatalf("UDP reply %q, %v; want the new process", buf[:n], err)
+	}
+
+	// The old process waits for its connection before exiting
+	select {
+	case err := <-exited:
+		t.Fatalf("old process exited with a connection open: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if got := exchange(t, held, heldR, "still"); got[0] != "old" {
+		t.Fatalf("held connection: %v, want the old process", got)
+	}
+	held.Close()
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Fatalf("old process: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("old process did not exit after draining")
+	}
+
+	quit, err := net.Dial("tcp", tcpAddr)
+	if err != nil {
+		t.Fatalf("new process stopped accepting after the old one exited: %v", err)
+	}
+	defer quit.Close()
+	exchange(t, quit, bufio.NewReader(quit), "quit")
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package upgrade
+
+import "os"
+
+// Notify does nothing: there is no upgrade signal on this system.
+func Notify(c chan<- os.Signal) {}
+
+// Upgrade always fails with ErrUnsupported.
+func (u *Upgrader) Upgrade() error {
+	return ErrUnsupported
+}
@@ -0,0 +1,111 @@
+//go:build unix
+
+package upgrade
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// readyTimeout bounds the start-up of the new process.
+const readyTimeout = time.Minute
+
+// Notify relays the upgrade signal, SIGUSR2, to c.
+func Notify(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR2)
+}
+
+// Upgrade starts the executable again with the open sockets and waits until
+// the new process is ready. After it returns nil the caller stops accepting
+// and exits once its connections are done; after an error it keeps running
+// as before.
+func (u *Upgrader) Upgrade() error {
+	u.mu.Lock()
+	if u.upgrading {
+		u.mu.Unlock()
+		return errors.New("upgrade: already upgrading or upgraded")
+	}
+	u.upgrading = true
+	u.mu.Unlock()
+
+	err := u.start()
+	if err != nil {
+		u.mu.Lock()
+		u.upgrading = false
+		u.mu.Unlock()
+	}
+	return err
+}
+
+func (u *Upgrader) start() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("upgrade: %w", err)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("upgrade: %w", err)
+	}
+	defer r.Close()
+
+	socks, files := u.files()
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	raw, err := json.Marshal(state{Sockets: socks})
+	if err != nil {
+		w.Close()
+		return fmt.Errorf("upgrade: %w", err)
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, envState+"=") {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	cmd.Env = append(cmd.Env, envState+"="+string(raw))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append([]*os.File{w}, files...)
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return fmt.Errorf("upgrade: failed to start %s: %w", exe, err)
+	}
+	u.log.Info("Started new process", "pid", cmd.Process.Pid, "executable", exe, "sockets", len(socks))
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	ready := make(chan bool, 1)
+	go func() {
+		b := make([]byte, 1)
+		n, _ := r.Read(b)
+		ready <- n == 1
+	}()
+
+	select {
+	case ok := <-ready:
+		if ok {
+			u.log.Info("New process is ready", "pid", cmd.Process.Pid)
+			return nil
+		}
+		// The pipe closed without the ready byte: the process died
+		cmd.Process.Kill()
+		return fmt.Errorf("upgrade: new process exited before it was ready: %v", <-exited)
+	case err := <-exited:
+		return fmt.Errorf("upgrade: new process exited before it was ready: %v", err)
+	case <-time.After(readyTimeout):
+		cmd.Process.Kill()
+		return fmt.Errorf("upgrade: new process not ready after %s", readyTimeout)
+	}
+}